@@ -16,7 +16,6 @@ import (
 	"strconv"
 	"strings"
 	"sync/atomic"
-	"time"
 )
 
 const logFileName = `skip.txt`
@@ -36,6 +35,11 @@ func (this *DownloadEnv) StartDownload(req StartDownload_Req) (ok bool) {
 	this.ctx, this.cancelFn = context.WithCancel(context.Background())
 	this.status.IsRunning = true
 	this.status.TaskId = req.TaskId
+	this.pauseCh = nil
+	this.resumeSeq = 0
+	this.urlRefresher = nil
+	finishCh := make(chan struct{})
+	this.finishCh = finishCh
 	go func() {
 		this.runDownload(req)
 		this.logToFile_TsNotWriteReason()
@@ -45,9 +49,27 @@ func (this *DownloadEnv) StartDownload(req StartDownload_Req) (ok bool) {
 		this.status.Locker.Lock()
 		//this.cancelFn()
 		this.status.IsRunning = false
+		if this.pauseCh != nil {
+			close(this.pauseCh)
+			this.pauseCh = nil
+		}
+		onFinished := this.onFinished
 		this.status.Locker.Unlock()
 
 		this.logFileClose()
+		status := this.GetStatus()
+		this.emitEvent(DownloadEvent{
+			Type:       EventType_Finish,
+			ErrMsg:     status.ErrMsg,
+			ErrCode:    status.ErrCode,
+			IsCancel:   status.IsCancel,
+			SaveFileTo: status.SaveFileTo,
+			IsSkipped:  status.IsSkipped,
+		})
+		close(finishCh)
+		if onFinished != nil {
+			onFinished()
+		}
 	}()
 	return true
 }
@@ -67,9 +89,19 @@ func (this *DownloadEnv) GetStatus() (resp GetStatus_Resp) {
 
 		resp.IsDownloading = this.status.IsRunning
 		resp.ErrMsg = this.status.errMsg
+		if this.status.lastErr != nil {
+			resp.ErrCode = this.status.lastErr.Code
+			resp.ErrTsName = this.status.lastErr.TsName
+			resp.ErrUrl = this.status.lastErr.Url
+		}
 		resp.IsSkipped = this.status.isSkipped
 		resp.SaveFileTo = this.status.saveFileTo
+		resp.SaveFileList = this.status.saveFileList
 		resp.TaskId  = this.status.TaskId
+		resp.IsPaused = this.pauseCh != nil
+		resp.TotalBytes = int(this.status.getTsExpectedBytesNoLock())
+		resp.FetchedBytes = int(this.status.tsFetchedBytes)
+		resp.CachedBytes = int(this.status.tsCachedBytes)
 	}()
 
 	var speed SpeedInfo
@@ -83,6 +115,12 @@ func (this *DownloadEnv) GetStatus() (resp GetStatus_Resp) {
 		}
 		resp.StatusBar += "有 " + strconv.Itoa(int(sleepTh)) + "个线程正在休眠."
 	}
+	if resp.IsPaused {
+		if resp.StatusBar != "" {
+			resp.StatusBar = ", " + resp.StatusBar
+		}
+		resp.StatusBar = "已暂停" + resp.StatusBar
+	}
 
 	if resp.ErrMsg != "" {
 		resp.IsCancel = this.GetIsCancel()
@@ -91,29 +129,26 @@ func (this *DownloadEnv) GetStatus() (resp GetStatus_Resp) {
 }
 
 func (this *DownloadEnv) WaitDownloadFinish() GetStatus_Resp {
-	for {
-		status := this.GetStatus()
-		if status.IsDownloading {
-			time.Sleep(time.Millisecond * 100)
-			continue
-		}
-		return status
-	}
-}
-
-func (this *DownloadEnv) setErrMsg(errMsg string) {
 	this.status.Locker.Lock()
-	this.status.errMsg = errMsg
+	finishCh := this.finishCh
 	this.status.Locker.Unlock()
 
-	if errMsg != "" {
-		this.logToFile("errMsg " + errMsg)
+	// 等待发送 EventType_Finish, 然后等待回调收到所有事件
+	if finishCh != nil {
+		<-finishCh
 	}
+	this.status.waitEventDispatched()
+	return this.GetStatus()
 }
 
 func (this *DownloadEnv) setSaveFileTo(to string, isSkipped bool) {
+	this.setSaveFileList([]string{to}, isSkipped)
+}
+
+func (this *DownloadEnv) setSaveFileList(list []string, isSkipped bool) {
 	this.status.Locker.Lock()
-	this.status.saveFileTo = to
+	this.status.saveFileTo = list[0]
+	this.status.saveFileList = list
 	this.status.isSkipped = isSkipped
 	this.status.Locker.Unlock()
 }
@@ -121,27 +156,28 @@ func (this *DownloadEnv) setSaveFileTo(to string, isSkipped bool) {
 var debugLogNo uint32
 
 func (this *DownloadEnv) runDownload(req StartDownload_Req) {
-	skipInfo, errMsg := ParseSkipTsExpr(req.SkipTsExpr)
-	if errMsg != "" {
-		this.setErrMsg("解析跳过ts的表达式错误: " + errMsg)
-		return
-	}
-
-	var proxyUrlObj *url.URL
-	req.SetProxy, proxyUrlObj, errMsg = ParseProxyFormat(req.SetProxy)
-	if errMsg != "" {
-		this.setErrMsg("parseProxy " + errMsg)
-	}
-	this.setupClient(req, proxyUrlObj)
-	errMsg = this.prepareReqAndHeader(&req)
-	if errMsg != "" {
-		this.setErrMsg("prepareReqAndHeader " + errMsg)
+	skipInfo, downloadErr := this.initRequest(&req)
+	if downloadErr != nil {
+		this.setError(downloadErr)
 		return
 	}
-
-	if !strings.HasPrefix(req.M3u8Url, "http") || req.M3u8Url == "" {
-		this.setErrMsg("M3u8Url not valid " + strconv.Quote(req.M3u8Url))
-		return
+	if req.CookieSaveTo != "" {
+		// 无论下载是否成功, 都导出服务器更新后的cookie
+		defer func() {
+			err := os.WriteFile(req.CookieSaveTo, this.cookieJar.ExportNetscape(), 0600)
+			if err != nil && this.GetStatus().ErrMsg == "" {
+				this.setError(newDownloadError(ErrCode_IOFailed, "导出cookie文件失败: "+err.Error(), err))
+			}
+		}()
+	}
+
+	originM3u8Url := req.M3u8Url
+	historyKey := newDownloadHistoryKey(req)
+	if req.SkipCacheCheck == false {
+		if history, ok := lookupDownloadHistory(req.SaveDir, historyKey); ok {
+			this.setSaveFileList(history.getSaveFileList(), true)
+			return
+		}
 	}
 	var err error
 	downloadingDir := filepath.Join(req.TsTempDir, "downloading")
@@ -151,7 +187,7 @@ func (this *DownloadEnv) runDownload(req StartDownload_Req) {
 		}
 		err = os.MkdirAll(dir, 0755)
 		if err != nil {
-			this.setErrMsg("os.MkdirAll " + strconv.Quote(dir) + " error: " + err.Error())
+			this.setError(newDownloadError(ErrCode_IOFailed, "os.MkdirAll "+strconv.Quote(dir)+" error: "+err.Error(), err))
 			return
 		}
 	}
@@ -160,21 +196,26 @@ func (this *DownloadEnv) runDownload(req StartDownload_Req) {
 		tmpDebugFilePath = filepath.Join(downloadingDir, fmt.Sprintf("temp_debuglog_%08d-%05d.txt", os.Getpid(), atomic.AddUint32(&debugLogNo, 1)))
 		this.logFile, err = os.OpenFile(tmpDebugFilePath, os.O_APPEND|os.O_CREATE, 0666)
 		if err != nil {
-			this.setErrMsg("os.WriteUrl error: " + err.Error())
+			this.setError(newDownloadError(ErrCode_IOFailed, "os.WriteUrl error: "+err.Error(), err))
 			return
 		}
 		this.logToFile("version: " + GetVersion())
 		this.logToFile("origin m3u8 url: " + req.M3u8Url)
 
-		data, _ := json.Marshal(req)
+		// 日志里不记录cookie、认证header、证书密码、代理密码
+		data, _ := json.Marshal(getRedactedReq(req, "REDACTED"))
 		this.logToFile("run args: " + string(data))
 	}
 
-	this.status.SetProgressBarTitle("[1/5]嗅探m3u8")
+	this.setPhase(Phase_Sniff)
 	var info mformat.M3U8File
-	req.M3u8Url, info, errMsg = this.sniffM3u8(req.M3u8Url)
+	var baseUrl string
+	var errMsg string
+	req.M3u8Url, baseUrl, info, errMsg = this.sniffM3u8(req.M3u8Url)
 	if errMsg != "" {
-		this.setErrMsg("sniffM3u8: " + errMsg)
+		downloadErr := newDownloadError(ErrCode_SniffFailed, "sniffM3u8: "+errMsg, nil)
+		downloadErr.Url = originM3u8Url
+		this.setError(downloadErr)
 		return
 	}
 	videoId := req.getVideoId()
@@ -182,7 +223,7 @@ func (this *DownloadEnv) runDownload(req StartDownload_Req) {
 	if !isDirExists(tsSaveDir) {
 		err = os.MkdirAll(tsSaveDir, os.ModePerm)
 		if err != nil {
-			this.setErrMsg("os.MkdirAll error: " + err.Error())
+			this.setError(newDownloadError(ErrCode_IOFailed, "os.MkdirAll error: "+err.Error(), err))
 			return
 		}
 	}
@@ -193,37 +234,51 @@ func (this *DownloadEnv) runDownload(req StartDownload_Req) {
 		persistDebugFilePath := filepath.Join(tsSaveDir, "debuglog.txt")
 		err = os.Rename(tmpDebugFilePath, persistDebugFilePath)
 		if err != nil {
-			this.setErrMsg("os.Rename set persistDebugFilePath " + strconv.Quote(persistDebugFilePath) + " error : " + err.Error())
+			this.setError(newDownloadError(ErrCode_IOFailed, "os.Rename set persistDebugFilePath "+strconv.Quote(persistDebugFilePath)+" error : "+err.Error(), err))
 			return
 		}
 		this.logFile, err = os.OpenFile(persistDebugFilePath, os.O_APPEND|os.O_CREATE, 0666)
 		if err != nil {
-			this.setErrMsg("os.Open persistDebugFilePath " + strconv.Quote(persistDebugFilePath) + " error: " + err.Error())
+			this.setError(newDownloadError(ErrCode_IOFailed, "os.Open persistDebugFilePath "+strconv.Quote(persistDebugFilePath)+" error: "+err.Error(), err))
 			return
 		}
 		this.logToFile("refresh m3u8 url: " + req.M3u8Url)
+		this.logToFile("m3u8 base url: " + baseUrl)
 	}
 
-	this.status.SetProgressBarTitle("[2/5]获取ts列表")
+	this.setPhase(Phase_List)
 	tsList := info.GetTsList()
 
 	//先更新ts的url信息, 方便后续记录url
-	errMsg = updateTsUrl(req.M3u8Url, tsList)
+	errMsg = updateTsUrl(baseUrl, tsList)
+	this.urlRefresher = newTsUrlRefresher(req.M3u8Url, len(tsList))
+	this.status.initSegmentList(tsList)
 	if errMsg != "" {
-		this.setErrMsg("updateTsUrl: " + errMsg)
+		downloadErr := newDownloadError(ErrCode_PlaylistInvalid, "updateTsUrl: "+errMsg, nil)
+		downloadErr.Url = req.M3u8Url
+		this.setError(downloadErr)
 		return
 	}
 
 	tsList, skipTsRecordList := skipApplyFilter(tsList, skipInfo)
 	for _, record := range skipTsRecordList {
 		this.status.setTsNotWriteReason(&record.ts, "触发跳过表达式,"+record.reason)
+		event := newTsEvent(EventType_TsSkip, &record.ts)
+		event.Reason = "触发跳过表达式," + record.reason
+		this.emitEvent(event)
 	}
 	if len(tsList) <= 0 {
-		this.setErrMsg("需要下载的文件为空")
+		this.setError(newDownloadError(ErrCode_PlaylistEmpty, "需要下载的文件为空", nil))
 		return
 	}
 	// 获取m3u8地址的内容体
-	errMsg = UpdateMediaKeyContent(req.M3u8Url, tsList, func(urlStr string) (content []byte, err error) {
+	var keyUrl string
+	var keyErr error
+	errMsg = UpdateMediaKeyContent(baseUrl, tsList, func(urlStr string) (content []byte, err error) {
+		keyUrl = urlStr
+		defer func() {
+			keyErr = err
+		}()
 		var httpResp *http.Response
 		content, httpResp, err = this.doGetRequest(urlStr, true)
 		if err != nil {
@@ -235,35 +290,92 @@ func (this *DownloadEnv) runDownload(req StartDownload_Req) {
 		return content, nil
 	})
 	if errMsg != "" {
-		this.setErrMsg("updateMediaKeyContent: " + errMsg)
+		downloadErr := newDownloadError(ErrCode_KeyFetchFailed, "updateMediaKeyContent: "+errMsg, keyErr)
+		downloadErr.Url = keyUrl
+		this.setError(downloadErr)
 		return
 	}
 
+	if req.ProbeTotalSize {
+		this.setPhase(Phase_Probe)
+		this.status.setTsProbeBytes(this.probeTotalBytes(tsList, req.ThreadCount))
+	}
+
+	var name string
+	var ok bool
+	// 分割时每个文件的名字为 FileName_part001.mp4 ..., 和不分割时一样先写入 .temp 文件
+	splitOutputName := func(idx int) string {
+		partName, ok := getSaveFileName(req.SaveDir, getSplitFileName(req.FileName, idx), GetOutputFileExt(req.OutputFormat, req.TrackMode))
+		if ok == false {
+			return ""
+		}
+		return partName + ".temp"
+	}
+	this.streamMerger = nil
+	if req.StreamMerge && req.SkipMergeTs == false {
+		if req.SplitMode == "" {
+			name, ok = getSaveFileName(req.SaveDir, req.FileName, GetOutputFileExt(req.OutputFormat, req.TrackMode))
+			if ok == false {
+				this.setError(newDownloadError(ErrCode_IOFailed, "自动寻找文件名失败", nil))
+				return
+			}
+		}
+		this.streamMerger = newStreamMerger(this, tsList, tsSaveDir, skipInfo, req)
+		err = this.streamMerger.loadState(name + ".temp")
+		if err != nil {
+			this.streamMerger = nil
+			this.setError(newDownloadError(ErrCode_MergeFailed, "合并错误: "+err.Error(), err))
+			return
+		}
+		this.streamMerger.start(splitOutputName, req)
+	}
+
 	// 下载ts
-	this.status.SetProgressBarTitle("[3/5]下载ts")
+	this.setPhase(Phase_Download)
 	this.status.SpeedResetBytes()
 	err = this.downloader(tsList, skipInfo, tsSaveDir, req)
 	this.status.SpeedResetBytes()
+	if err != nil && this.streamMerger != nil {
+		// 有ts下载失败, 取消合并
+		this.streamMerger.finish()
+	}
 	if err != nil {
-		this.setErrMsg("下载ts文件错误: " + err.Error())
+		downloadErr, ok := err.(*DownloadError)
+		if ok == false {
+			downloadErr = newDownloadError(ErrCode_InvalidArgs, err.Error(), err)
+		}
+		downloadErr.Message = "下载ts文件错误: " + downloadErr.Message
+		this.setError(downloadErr)
 		return
 	}
 	this.status.DrawProgressBar(1, 1)
 
-	this.status.SetProgressBarTitle("[4/5]分析ts列表")
-	resp, err := this.removeSkipList(tsSaveDir, tsList)
+	this.setPhase(Phase_Analyze)
+	var resp removeSkipListResp
+	var tmpOutputList []string
+	if this.streamMerger != nil {
+		// 合并时已经按顺序检查过每个ts, 等待剩下的ts合并完成
+		tmpOutputList, err = this.streamMerger.finish()
+		if err != nil {
+			this.setError(newDownloadError(ErrCode_MergeFailed, "合并错误: "+err.Error(), err))
+			return
+		}
+		resp, err = this.finishSkipCheck(this.streamMerger.checker)
+	} else {
+		resp, err = this.removeSkipList(tsSaveDir, tsList)
+	}
 	if err != nil {
-		this.setErrMsg("写入" + logFileName + "失败, " + err.Error())
+		this.setError(newDownloadError(ErrCode_IOFailed, "写入"+logFileName+"失败, "+err.Error(), err))
 		return
 	}
 
 	if resp.skipByHttpCodeCount > 0 && skipInfo.IfHttpCodeMergeTs == false {
-		this.setErrMsg("使用http.code跳过了" + strconv.Itoa(resp.skipByHttpCodeCount) + "条ts记录，请自行合并")
+		this.setError(newDownloadError(ErrCode_SegmentSkipped, "使用http.code跳过了"+strconv.Itoa(resp.skipByHttpCodeCount)+"条ts记录，请自行合并", nil))
 		return
 	}
 
 	if len(resp.mergeTsList) == 0 {
-		this.setErrMsg("ts文件列表为空")
+		this.setError(newDownloadError(ErrCode_PlaylistEmpty, "ts文件列表为空", nil))
 		return
 	}
 
@@ -272,57 +384,64 @@ func (this *DownloadEnv) runDownload(req StartDownload_Req) {
 	}
 
 	var tsFileList []string
+	discontinuityMap := map[string]int{}
 	for _, one := range resp.mergeTsList {
-		tsFileList = append(tsFileList, filepath.Join(tsSaveDir, one.Name))
-	}
-	var name string
-	var tmpOutputName string
-
-	for idx := 0; ; idx++ {
-		idxS := strconv.Itoa(idx)
-		if len(idxS) < 4 {
-			idxS = strings.Repeat("0", 4-len(idxS)) + idxS
-		}
-		idxS = "_" + idxS
-		if idx == 0 {
-			name = filepath.Join(req.SaveDir, req.FileName+".mp4")
-		} else {
-			name = filepath.Join(req.SaveDir, req.FileName+idxS+".mp4")
-		}
-		if !isFileExists(name) {
-			tmpOutputName = name + ".temp"
-			break
-		}
-		if idx > 10000 { // 超过1万就不找了
-			this.setErrMsg("自动寻找文件名失败")
+		tsFile := filepath.Join(tsSaveDir, one.Name)
+		tsFileList = append(tsFileList, tsFile)
+		discontinuityMap[tsFile] = one.Idx_EXT_X_DISCONTINUITY
+	}
+	if this.streamMerger == nil && req.SplitMode == "" {
+		name, ok = getSaveFileName(req.SaveDir, req.FileName, GetOutputFileExt(req.OutputFormat, req.TrackMode))
+		if ok == false {
+			this.setError(newDownloadError(ErrCode_IOFailed, "自动寻找文件名失败", nil))
 			return
 		}
 	}
-	this.status.SetProgressBarTitle("[5/5]合并ts为mp4")
-	err = MergeTsFileListToSingleMp4(MergeTsFileListToSingleMp4_Req{
-		TsFileList: tsFileList,
-		OutputMp4:  tmpOutputName,
-		Ctx:        this.ctx,
-		Status:     &this.status,
-	})
-	this.status.SpeedResetBytes()
-	if err != nil {
-		this.setErrMsg("合并错误: " + err.Error())
-		return
+	this.setPhase(Phase_Merge)
+	if this.streamMerger == nil {
+		tmpOutputList, err = MergeTsFileListToMultiFile(MergeTsFileListToSingleMp4_Req{
+			TsFileList:       tsFileList,
+			OutputMp4:        name + ".temp",
+			OutputFormat:     req.OutputFormat,
+			Resume:           true, // fmp4 上次合并中断时继续合并
+			TsFixContinuity:  req.TsFixContinuity,
+			DiscontinuityMap: discontinuityMap,
+			SplitMode:        req.SplitMode,
+			SplitValue:       req.SplitValue,
+			SplitOutputName:  splitOutputName,
+			TrackMode:        req.TrackMode,
+			FastStart:        req.FastStart,
+			Ctx:              this.ctx,
+			Status:           &this.status,
+		})
+		this.status.SpeedResetBytes()
+		if err != nil {
+			this.setError(newDownloadError(ErrCode_MergeFailed, "合并错误: "+err.Error(), err))
+			return
+		}
 	}
 
-	err = os.Rename(tmpOutputName, name)
-	if err != nil {
-		this.setErrMsg("重命名失败: " + err.Error())
-		return
-	}
-	if req.UseServerSideTime && len(tsFileList) > 0 {
-		this.logToFile("更新mp4时间")
-		err = UpdateMp4Time(tsFileList[0], name)
+	var outputList []string
+	for _, tmpOutputName := range tmpOutputList {
+		outputName := strings.TrimSuffix(tmpOutputName, ".temp")
+		err = os.Rename(tmpOutputName, outputName)
 		if err != nil {
-			this.setErrMsg("更新mp4文件时间失败: " + err.Error())
+			this.setError(newDownloadError(ErrCode_IOFailed, "重命名失败: "+err.Error(), err))
 			return
 		}
+		if req.UseServerSideTime && len(tsFileList) > 0 {
+			this.logToFile("更新mp4时间")
+			err = UpdateOutputFileTime(tsFileList[0], outputName, req.OutputFormat)
+			if err != nil {
+				this.setError(newDownloadError(ErrCode_MergeFailed, "更新mp4文件时间失败: "+err.Error(), err))
+				return
+			}
+		}
+		outputList = append(outputList, outputName)
+	}
+	name = outputList[0]
+	if this.streamMerger != nil {
+		this.streamMerger.removeMergedTs(resp.mergeTsList)
 	}
 
 	if len(resp.skipLogContent) > 0 && req.WithSkipLog {
@@ -330,7 +449,7 @@ func (this *DownloadEnv) runDownload(req StartDownload_Req) {
 		this.logToFile("写入文件" + saveFileName)
 		err = os.WriteFile(saveFileName, resp.skipLogContent, 0666)
 		if err != nil {
-			this.setErrMsg("写入" + saveFileName + "失败, " + err.Error())
+			this.setError(newDownloadError(ErrCode_IOFailed, "写入"+saveFileName+"失败, "+err.Error(), err))
 			return
 		}
 	}
@@ -338,35 +457,123 @@ func (this *DownloadEnv) runDownload(req StartDownload_Req) {
 		this.logFileClose()
 		err = os.RemoveAll(tsSaveDir)
 		if err != nil {
-			this.setErrMsg("删除下载目录失败: " + err.Error())
+			this.setError(newDownloadError(ErrCode_IOFailed, "删除下载目录失败: "+err.Error(), err))
 			return
 		}
 		// 如果downloading目录为空,就删除掉,否则忽略
 		_ = os.Remove(downloadingDir)
 	}
-	this.setSaveFileTo(name, false)
+	err = addDownloadHistory(req.SaveDir, historyKey, outputList)
+	if err != nil {
+		// 下载历史只影响下次是否跳过, 所以只记录日志
+		this.logToFile("写入" + downloadHistoryFileName + "失败, " + err.Error())
+	}
+	this.setSaveFileList(outputList, false)
 	return
 }
 
-func (this *DownloadEnv) setupClient(req StartDownload_Req, proxyUrlObj *url.URL) {
+// initRequest 解析参数、创建http客户端, 下载和 PlanDownload 共用
+func (this *DownloadEnv) initRequest(req *StartDownload_Req) (skipInfo SkipTsInfo, downloadErr *DownloadError) {
+	skipInfo, errMsg := ParseSkipTsExpr(req.SkipTsExpr)
+	if errMsg != "" {
+		return skipInfo, newDownloadError(ErrCode_InvalidArgs, "解析跳过ts的表达式错误: "+errMsg, nil)
+	}
+	req.OutputFormat, errMsg = ParseOutputFormat(req.OutputFormat)
+	if errMsg != "" {
+		return skipInfo, newDownloadError(ErrCode_InvalidArgs, errMsg, nil)
+	}
+	req.SplitMode, errMsg = ParseSplitMode(req.SplitMode, req.SplitValue)
+	if errMsg != "" {
+		return skipInfo, newDownloadError(ErrCode_InvalidArgs, errMsg, nil)
+	}
+	req.TrackMode, errMsg = ParseTrackMode(req.TrackMode, req.OutputFormat)
+	if errMsg != "" {
+		return skipInfo, newDownloadError(ErrCode_InvalidArgs, errMsg, nil)
+	}
+	this.isAudioOnly = req.TrackMode == TrackMode_Audio
+	// 合并时删除ts需要在中断后从输出文件里继续合并
+	if req.StreamRemoveTs && (req.StreamMerge == false || req.OutputFormat != OutputFormat_Fmp4 || req.SplitMode != "") {
+		return skipInfo, newDownloadError(ErrCode_InvalidArgs, "StreamRemoveTs 只支持边下载边合并为不分割的fmp4", nil)
+	}
+
+	var proxyUrlObj *url.URL
+	req.SetProxy, proxyUrlObj, errMsg = ParseProxyFormat(req.SetProxy)
+	if errMsg != "" {
+		return skipInfo, newDownloadError(ErrCode_InvalidArgs, "parseProxy "+errMsg, nil)
+	}
+	dialer, errMsg := newHostDialer(*req)
+	if errMsg != "" {
+		return skipInfo, newDownloadError(ErrCode_InvalidArgs, "newHostDialer "+errMsg, nil)
+	}
+	tlsConfig, errMsg := newTlsConfig(*req)
+	if errMsg != "" {
+		return skipInfo, newDownloadError(ErrCode_InvalidArgs, "newTlsConfig "+errMsg, nil)
+	}
+	this.setupClient(*req, proxyUrlObj, dialer, tlsConfig)
+	errMsg = this.prepareReqAndHeader(req)
+	if errMsg != "" {
+		return skipInfo, newDownloadError(ErrCode_InvalidArgs, "prepareReqAndHeader "+errMsg, nil)
+	}
+	if req.CookieFile != "" {
+		content, err := os.ReadFile(req.CookieFile)
+		if err != nil {
+			return skipInfo, newDownloadError(ErrCode_InvalidArgs, "读取cookie文件失败: "+err.Error(), err)
+		}
+		errMsg = this.cookieJar.ImportNetscape(content)
+		if errMsg != "" {
+			return skipInfo, newDownloadError(ErrCode_InvalidArgs, "导入cookie文件失败: "+errMsg, nil)
+		}
+	}
+	if urlObj, err := url.Parse(req.M3u8Url); err != nil || this.getFetcher(urlObj.Scheme) == nil {
+		downloadErr = newDownloadError(ErrCode_InvalidArgs, "M3u8Url not valid "+strconv.Quote(req.M3u8Url), err)
+		downloadErr.Url = req.M3u8Url
+		return skipInfo, downloadErr
+	}
+	return skipInfo, nil
+}
+
+func (this *DownloadEnv) setupClient(req StartDownload_Req, proxyUrlObj *url.URL, dialer *hostDialer, tlsConfig *tls.Config) {
 	if this.nowClient == nil {
 		this.nowClient = &http.Client{}
 	}
 	//关闭以前的空闲链接
 	this.nowClient.CloseIdleConnections()
+	// 每个任务使用新的cookie jar, 保存playlist、key、ts服务器返回的Set-Cookie
+	this.cookieJar = newCookieJar()
+	this.nowClient.Jar = this.cookieJar
+	this.nowClient.CheckRedirect = this.checkRedirect(req)
+
+	transport, ok := this.nowClient.Transport.(*http.Transport)
+	if ok == false {
+		transport = &http.Transport{}
+	}
+	transport.TLSClientConfig = tlsConfig
+	transport.Proxy = http.ProxyURL(proxyUrlObj)
+	transport.DialContext = dialer.DialContext
+	this.nowClient.Transport = transport
+	if req.TlsServerName != "" {
+		this.nowClient.Transport = newTlsServerNameTransport(transport, req.M3u8Url, req.TlsServerName)
+	}
+}
 
-	if this.nowClient.Transport == nil {
-		this.nowClient.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: req.Insecure,
-			},
-			Proxy: http.ProxyURL(proxyUrlObj),
+// getSaveFileName 文件已存在时在文件名后面加上编号: a.mp4, a_0001.mp4, a_0002.mp4 ... 扩展名为 ext
+func getSaveFileName(saveDir string, fileName string, ext string) (name string, ok bool) {
+	for idx := 0; idx <= 10000; idx++ { // 超过1万就不找了
+		idxS := strconv.Itoa(idx)
+		if len(idxS) < 4 {
+			idxS = strings.Repeat("0", 4-len(idxS)) + idxS
+		}
+		idxS = "_" + idxS
+		if idx == 0 {
+			name = filepath.Join(saveDir, fileName+"."+ext)
+		} else {
+			name = filepath.Join(saveDir, fileName+idxS+"."+ext)
+		}
+		if !isFileExists(name) {
+			return name, true
 		}
-	} else {
-		transport := this.nowClient.Transport.(*http.Transport)
-		transport.TLSClientConfig.InsecureSkipVerify = req.Insecure
-		transport.Proxy = http.ProxyURL(proxyUrlObj)
 	}
+	return "", false
 }
 
 func prepareDir(dir string) (dirAbs string, errMsg string) {
@@ -402,6 +609,8 @@ func (this *DownloadEnv) prepareReqAndHeader(req *StartDownload_Req) (errMsg str
 			return errMsg
 		}
 	}
+	req.M3u8Url = localPathToFileUrl(req.M3u8Url)
+	this.allowSchemeMap = getAllowSchemeMap(req.M3u8Url)
 	if req.FileName == "" {
 		req.FileName = GetFileNameFromUrl(req.M3u8Url)
 	}
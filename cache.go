@@ -0,0 +1,253 @@
+package m3u8d
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/orestonce/m3u8d/mformat"
+)
+
+// 每个任务的 downloading/<videoId>/ 目录下记录已下载ts的信息, 续传时据此判断已有的ts文件是否可以复用
+const tsManifestFileName = "ts_manifest.json"
+
+// 每个ts下载完成后马上追加一行记录, 程序被杀死、断电时也不会丢失. 加载和下载结束时合并到 ts_manifest.json
+const tsManifestLogFileName = "ts_manifest.log"
+
+type tsManifestUnit struct {
+	Name     string
+	Url      string
+	Size     int64
+	Sha256   string
+	KeyURI   string
+	RespSize int64 // 下载时响应body的长度(解密、去掉0x47之前的内容之前), 和探测的大小一致, 用于计算进度. 旧记录里为0
+}
+
+type tsManifestFile struct {
+	List      []tsManifestUnit
+	HasLegacy bool // 目录里有记录文件出现之前下载的ts
+}
+
+type tsManifest struct {
+	locker    sync.Mutex
+	path      string
+	logPath   string
+	logFd     *os.File
+	unitMap   map[string]tsManifestUnit
+	hasLegacy bool
+}
+
+// loadTsManifest 读取ts下载记录以及上次没有合并的追加记录, 文件不存在或者损坏时返回空记录
+func loadTsManifest(tsSaveDir string) *tsManifest {
+	manifest := &tsManifest{
+		path:    filepath.Join(tsSaveDir, tsManifestFileName),
+		logPath: filepath.Join(tsSaveDir, tsManifestLogFileName),
+		unitMap: map[string]tsManifestUnit{},
+	}
+	data, errFile := os.ReadFile(manifest.path)
+	if errFile == nil {
+		var file tsManifestFile
+		if json.Unmarshal(data, &file) == nil {
+			for _, unit := range file.List {
+				manifest.unitMap[unit.Name] = unit
+			}
+			manifest.hasLegacy = file.HasLegacy
+		}
+	}
+	logData, errLog := os.ReadFile(manifest.logPath)
+	if errLog == nil {
+		scanner := bufio.NewScanner(bytes.NewReader(logData))
+		scanner.Buffer(nil, len(logData)+1)
+		for scanner.Scan() {
+			var unit tsManifestUnit
+			// 最后一行可能只写了一半
+			if json.Unmarshal(scanner.Bytes(), &unit) == nil && unit.Name != "" {
+				manifest.unitMap[unit.Name] = unit
+			}
+		}
+	}
+	if os.IsNotExist(errFile) && os.IsNotExist(errLog) {
+		// 旧版本下载的ts没有记录, 按照原来的方式继续使用
+		entryList, _ := os.ReadDir(tsSaveDir)
+		for _, one := range entryList {
+			if one.Type().IsRegular() && filepath.Ext(one.Name()) == ".ts" {
+				manifest.hasLegacy = true
+				break
+			}
+		}
+	}
+	return manifest
+}
+
+func (this *tsManifest) get(name string) (unit tsManifestUnit, ok bool) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	unit, ok = this.unitMap[name]
+	return unit, ok
+}
+
+// set 记录下载完成的ts, 同时追加到 ts_manifest.log
+func (this *tsManifest) set(unit tsManifestUnit) error {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	this.unitMap[unit.Name] = unit
+	data, err := json.Marshal(unit)
+	if err != nil {
+		return err
+	}
+	if this.logFd == nil {
+		this.logFd, err = os.OpenFile(this.logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = this.logFd.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+	return this.logFd.Sync()
+}
+
+// save 把所有记录写入 ts_manifest.json, 然后删除 ts_manifest.log
+func (this *tsManifest) save() error {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	file := tsManifestFile{
+		HasLegacy: this.hasLegacy,
+	}
+	for _, unit := range this.unitMap {
+		file.List = append(file.List, unit)
+	}
+	sort.Slice(file.List, func(i, j int) bool {
+		return file.List[i].Name < file.List[j].Name
+	})
+	data, err := json.MarshalIndent(file, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmpPath := this.path + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0666)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpPath, this.path)
+	if err != nil {
+		return err
+	}
+	if this.logFd != nil {
+		this.logFd.Close()
+		this.logFd = nil
+	}
+	err = os.Remove(this.logPath)
+	if err != nil && os.IsNotExist(err) == false {
+		return err
+	}
+	return nil
+}
+
+// isLegacyTs 是否为记录文件出现之前下载的ts
+func (this *tsManifest) isLegacyTs(name string) bool {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	_, ok := this.unitMap[name]
+	return this.hasLegacy && ok == false
+}
+
+// adoptLegacyTs 校验记录文件出现之前下载的ts, 通过时加入记录
+func (this *tsManifest) adoptLegacyTs(ts *mformat.TsInfo, tsPath string, isValidate bool) error {
+	data, err := os.ReadFile(tsPath)
+	if err != nil {
+		return err
+	}
+	if isValidate {
+		err = mformat.SegmentValidate(data, mformat.SniffSegmentFormat(ts, data))
+		if err != nil {
+			return err
+		}
+	}
+	return this.set(tsManifestUnit{
+		Name:   ts.Name,
+		Url:    ts.Url,
+		Size:   int64(len(data)),
+		Sha256: getBytesSha256(data),
+		KeyURI: ts.Key.KeyURI,
+	})
+}
+
+// getRespSize 获取ts下载时响应body的长度, 没有记录时使用文件大小
+func (this *tsManifest) getRespSize(name string, fileSize int64) int64 {
+	unit, ok := this.get(name)
+	if ok == false || unit.RespSize <= 0 {
+		return fileSize
+	}
+	return unit.RespSize
+}
+
+// isTsCacheMatch 已存在的ts文件是否和当前的m3u8对应
+//
+//	url只比较path部分, 很多cdn的ts地址带有每次请求都会变化的签名参数
+func (this *tsManifest) isTsCacheMatch(ts *mformat.TsInfo, tsPath string, stat os.FileInfo, verifyHash bool) (ok bool, reason string) {
+	unit, ok := this.get(ts.Name)
+	if ok == false {
+		return false, "not in " + tsManifestFileName
+	}
+	if getTsCacheUrlKey(unit.Url) != getTsCacheUrlKey(ts.Url) {
+		return false, "url changed " + unit.Url
+	}
+	if unit.KeyURI != ts.Key.KeyURI {
+		return false, "key uri changed " + unit.KeyURI
+	}
+	if unit.Size != stat.Size() {
+		return false, "size changed"
+	}
+	if verifyHash {
+		hash, err := getFileSha256(tsPath)
+		if err != nil {
+			return false, "hash error " + err.Error()
+		}
+		if hash != unit.Sha256 {
+			return false, "hash changed"
+		}
+	}
+	return true, ""
+}
+
+func getTsCacheUrlKey(urlS string) string {
+	urlObj, err := url.Parse(urlS)
+	if err != nil {
+		return urlS
+	}
+	return urlObj.Path
+}
+
+func getBytesSha256(data []byte) string {
+	tmp := sha256.Sum256(data)
+	return hex.EncodeToString(tmp[:])
+}
+
+func getFileSha256(path string) (hash string, err error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, fd)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
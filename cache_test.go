@@ -0,0 +1,152 @@
+package m3u8d
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/orestonce/m3u8d/mformat"
+)
+
+func TestTsManifest(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte("ts content")
+	tsPath := filepath.Join(dir, "00001.ts")
+	err := os.WriteFile(tsPath, data, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := &mformat.TsInfo{
+		Name: "00001.ts",
+		Url:  "https://example.com/hls/0.ts?sign=1",
+	}
+	stat, err := os.Stat(tsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := loadTsManifest(dir)
+	if ok, _ := manifest.isTsCacheMatch(ts, tsPath, stat, false); ok {
+		t.Fatal("not in manifest")
+	}
+	manifest.set(tsManifestUnit{
+		Name:   ts.Name,
+		Url:    ts.Url,
+		Size:   int64(len(data)),
+		Sha256: getBytesSha256(data),
+	})
+	err = manifest.save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest = loadTsManifest(dir)
+	// 签名参数变化不影响复用
+	ts.Url = "https://example.com/hls/0.ts?sign=2"
+	if ok, reason := manifest.isTsCacheMatch(ts, tsPath, stat, true); !ok {
+		t.Fatal(reason)
+	}
+	ts.Url = "https://example.com/hls2/0.ts"
+	if ok, _ := manifest.isTsCacheMatch(ts, tsPath, stat, false); ok {
+		t.Fatal("url changed")
+	}
+	ts.Url = "https://example.com/hls/0.ts"
+
+	// 内容被修改, 长度不变
+	err = os.WriteFile(tsPath, []byte("TS CONTENT"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := manifest.isTsCacheMatch(ts, tsPath, stat, false); !ok {
+		t.Fatal("without verify hash")
+	}
+	if ok, _ := manifest.isTsCacheMatch(ts, tsPath, stat, true); ok {
+		t.Fatal("hash changed")
+	}
+}
+
+func TestTsManifestLog(t *testing.T) {
+	dir := t.TempDir()
+	manifest := loadTsManifest(dir)
+	for _, name := range []string{"00000.ts", "00001.ts"} {
+		err := manifest.set(tsManifestUnit{Name: name, Url: "https://example.com/" + name, Size: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 没有调用save, 模拟程序被杀死, 最后一行只写了一半
+	fd, err := os.OpenFile(filepath.Join(dir, tsManifestLogFileName), os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fd.WriteString(`{"Name":"00002.ts","Ur`)
+	fd.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest = loadTsManifest(dir)
+	if len(manifest.unitMap) != 2 || manifest.isLegacyTs("00002.ts") {
+		t.Fatal(manifest.unitMap)
+	}
+	err = manifest.save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, tsManifestLogFileName)); os.IsNotExist(err) == false {
+		t.Fatal("log not removed", err)
+	}
+	manifest = loadTsManifest(dir)
+	if _, ok := manifest.get("00001.ts"); ok == false || len(manifest.unitMap) != 2 {
+		t.Fatal(manifest.unitMap)
+	}
+}
+
+func TestTsManifestLegacy(t *testing.T) {
+	dir := t.TempDir()
+	tsData, err := os.ReadFile(filepath.Join("testdata", "TestFull", "jhxy.016.ts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "00000.ts"), tsData, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "00001.ts"), []byte("<html>"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := loadTsManifest(dir)
+	if manifest.isLegacyTs("00000.ts") == false {
+		t.Fatal("expect legacy")
+	}
+	ts0 := &mformat.TsInfo{Name: "00000.ts", Url: "https://example.com/0.ts"}
+	ts1 := &mformat.TsInfo{Name: "00001.ts", Url: "https://example.com/1.ts"}
+	if manifest.adoptLegacyTs(ts0, filepath.Join(dir, ts0.Name), true) != nil {
+		t.Fatal("adopt failed")
+	}
+	if manifest.adoptLegacyTs(ts1, filepath.Join(dir, ts1.Name), true) == nil {
+		t.Fatal("expect invalid ts")
+	}
+	if manifest.isLegacyTs(ts0.Name) || manifest.isLegacyTs(ts1.Name) == false {
+		t.Fatal("legacy state")
+	}
+	err = manifest.save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 保存后仍然记得目录里有旧的ts
+	manifest = loadTsManifest(dir)
+	stat, err := os.Stat(filepath.Join(dir, ts0.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, reason := manifest.isTsCacheMatch(ts0, filepath.Join(dir, ts0.Name), stat, true); ok == false {
+		t.Fatal(reason)
+	}
+	if manifest.isLegacyTs(ts1.Name) == false {
+		t.Fatal("expect legacy")
+	}
+	if loadTsManifest(t.TempDir()).isLegacyTs(ts0.Name) {
+		t.Fatal("empty dir is not legacy")
+	}
+}
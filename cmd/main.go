@@ -3,6 +3,8 @@ package main
 import (
 	"bufio"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -12,6 +14,7 @@ import (
 	"regexp"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/orestonce/m3u8d"
 	"github.com/orestonce/m3u8d/m3u8dcpp"
@@ -34,13 +37,18 @@ var downloadCmd = &cobra.Command{
 }
 
 func downloadFromCmd(req m3u8d.StartDownload_Req) {
+	if gDryRun.Enable || gDryRun.Json {
+		planFromCmd([]m3u8d.StartDownload_Req{req})
+		return
+	}
 	req.ProgressBarShow = true
 	m3u8dcpp.StartDownload(req)
+	go readKeyboardControl()
 	resp := m3u8dcpp.WaitDownloadFinish()
 	fmt.Println() // 有进度条,所以需要换行
 	if resp.ErrMsg != "" {
 		fmt.Println(resp.ErrMsg)
-		return
+		os.Exit(getExitCode(resp.ErrCode))
 	}
 	if resp.IsSkipped {
 		fmt.Println("已经下载过了: " + resp.SaveFileTo)
@@ -50,16 +58,127 @@ func downloadFromCmd(req m3u8d.StartDownload_Req) {
 		fmt.Println("下载成功.")
 		return
 	}
+	if len(resp.SaveFileList) > 1 {
+		fmt.Println("下载成功, 分割为", len(resp.SaveFileList), "个文件:")
+		for _, one := range resp.SaveFileList {
+			fmt.Println(one)
+		}
+		return
+	}
 	fmt.Println("下载成功, 保存路径", resp.SaveFileTo)
 }
 
+var gDryRun struct {
+	Enable bool
+	Json   bool
+}
+
+// planFromCmd 只显示会下载哪些ts, 不下载. 有任务失败时使用第一个失败任务的退出码
+func planFromCmd(reqList []m3u8d.StartDownload_Req) {
+	var respList []m3u8d.PlanDownload_Resp
+	var firstErrCode string
+	for _, req := range reqList {
+		resp := m3u8d.PlanDownload(req)
+		if resp.ErrCode != "" && firstErrCode == "" {
+			firstErrCode = resp.ErrCode
+		}
+		respList = append(respList, resp)
+	}
+	if gDryRun.Json {
+		var data []byte
+		if len(respList) == 1 {
+			data, _ = json.MarshalIndent(respList[0], "", "\t")
+		} else {
+			data, _ = json.MarshalIndent(respList, "", "\t")
+		}
+		fmt.Println(string(data))
+	} else {
+		for idx, resp := range respList {
+			if idx > 0 {
+				fmt.Println()
+			}
+			fmt.Print(resp.ToText())
+		}
+	}
+	if firstErrCode != "" {
+		os.Exit(getExitCode(firstErrCode))
+	}
+}
+
+// parseDryRunArgs curl模式不解析参数, 需要自己去掉 --DryRun、--DryRunJson
+func parseDryRunArgs(args []string) (after []string) {
+	for _, one := range args {
+		switch one {
+		case "--DryRun", "--dry-run":
+			gDryRun.Enable = true
+		case "--DryRunJson":
+			gDryRun.Json = true
+		default:
+			after = append(after, one)
+		}
+	}
+	return after
+}
+
+// readKeyboardControl 下载时从终端读取命令: p 暂停, r 继续, q 取消
+func readKeyboardControl() {
+	stat, err := os.Stdin.Stat()
+	if err != nil || stat.Mode()&os.ModeCharDevice == 0 { // 标准输入不是终端, 例如在脚本里运行
+		return
+	}
+	fmt.Println("输入 p 回车暂停, r 回车继续, q 回车取消下载")
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		switch strings.ToLower(strings.TrimSpace(scanner.Text())) {
+		case "p":
+			if m3u8dcpp.Pause() {
+				fmt.Println("已暂停, 正在下载的ts会继续下载完成. 输入 r 回车继续")
+			} else {
+				fmt.Println("当前不能暂停")
+			}
+		case "r":
+			if m3u8dcpp.Resume() {
+				fmt.Println("继续下载")
+			}
+		case "q":
+			fmt.Println("正在取消...")
+			m3u8dcpp.CloseOldEnv()
+		}
+	}
+}
+
+// 下载失败时的退出码, 方便脚本判断失败原因
+var gExitCodeMap = map[string]int{
+	m3u8d.ErrCode_Unknown:         1,
+	m3u8d.ErrCode_InvalidArgs:     2,
+	m3u8d.ErrCode_SniffFailed:     3,
+	m3u8d.ErrCode_PlaylistInvalid: 4,
+	m3u8d.ErrCode_PlaylistEmpty:   5,
+	m3u8d.ErrCode_KeyFetchFailed:  6,
+	m3u8d.ErrCode_SegmentFailed:   7,
+	m3u8d.ErrCode_SegmentSkipped:  8,
+	m3u8d.ErrCode_MergeFailed:     9,
+	m3u8d.ErrCode_IOFailed:        10,
+	m3u8d.ErrCode_DiskFull:        11,
+	m3u8d.ErrCode_SegmentInvalid:  12,
+	m3u8d.ErrCode_Cancelled:       130,
+}
+
+func getExitCode(errCode string) int {
+	code, ok := gExitCodeMap[errCode]
+	if ok == false {
+		return 1
+	}
+	return code
+}
+
 var curlCmd = &cobra.Command{
 	Use: "curl",
 	Run: func(cmd *cobra.Command, args []string) {
-		resp1 := m3u8d.ParseCurl(args)
+		resp1 := m3u8d.ParseCurl(parseDryRunArgs(args))
 		if resp1.ErrMsg != "" {
 			fmt.Println(resp1.ErrMsg)
-			return
+			os.Exit(getExitCode(m3u8d.ErrCode_InvalidArgs))
 		}
 		downloadFromCmd(resp1.DownloadReq)
 	},
@@ -69,6 +188,7 @@ var curlCmd = &cobra.Command{
 var gBatchReq struct {
 	InputFile string
 	SaveDir   string
+	TaskCount int
 }
 
 var batchCmd = &cobra.Command{
@@ -134,15 +254,15 @@ func batchDownloadFromFile(inputFile, saveDir string) {
 
 	log.Printf("从文件 %s 中读取到 %d 个URL", inputFile, len(urlList))
 
-	// 批量下载
-	successCount := 0
-	failCount := 0
-
-	for i, urlWithFilename := range urlList {
-		log.Printf("[%d/%d] 开始下载: %s 文件名: %s", i+1, len(urlList), urlWithFilename.Url, urlWithFilename.Filename)
-
+	// 批量下载, 任务列表保存在下载目录里, 进程退出后可以使用 task resume 继续下载
+	saveDir, err = filepath.Abs(saveDir)
+	if err != nil {
+		log.Fatalf("获取保存路径失败: %v", err)
+	}
+	var reqList []m3u8d.StartDownload_Req
+	for _, urlWithFilename := range urlList {
 		// 创建下载请求
-		req := m3u8d.StartDownload_Req{
+		reqList = append(reqList, m3u8d.StartDownload_Req{
 			M3u8Url:           urlWithFilename.Url,
 			Insecure:          gRunReq.Insecure,
 			SaveDir:           saveDir,
@@ -150,37 +270,260 @@ func batchDownloadFromFile(inputFile, saveDir string) {
 			SkipTsExpr:        gRunReq.SkipTsExpr,
 			SetProxy:          gRunReq.SetProxy,
 			SkipRemoveTs:      gRunReq.SkipRemoveTs,
-			ProgressBarShow:   true,
+			ProgressBarShow:   gBatchReq.TaskCount <= 1, // 多个任务同时下载时, 进度条会互相覆盖
 			ThreadCount:       gRunReq.ThreadCount,
 			SkipMergeTs:       gRunReq.SkipMergeTs,
 			DebugLog:          gRunReq.DebugLog,
 			TsTempDir:         gRunReq.TsTempDir,
 			UseServerSideTime: gRunReq.UseServerSideTime,
 			WithSkipLog:       gRunReq.WithSkipLog,
+			SkipCacheCheck:    gRunReq.SkipCacheCheck,
+			SkipTsValidate:    gRunReq.SkipTsValidate,
+			VerifyCache:       gRunReq.VerifyCache,
+			CookieFile:        gRunReq.CookieFile,
+			ResolveList:       gRunReq.ResolveList,
+			ConnectToList:     gRunReq.ConnectToList,
+			DnsServer:         gRunReq.DnsServer,
+			CaCertFile:        gRunReq.CaCertFile,
+			ClientCertFile:    gRunReq.ClientCertFile,
+			ClientKeyFile:     gRunReq.ClientKeyFile,
+			ClientCertPass:    gRunReq.ClientCertPass,
+			TlsMinVersion:     gRunReq.TlsMinVersion,
+			TlsServerName:     gRunReq.TlsServerName,
+			MaxRedirect:       gRunReq.MaxRedirect,
+			RedirectKeepAuth:  gRunReq.RedirectKeepAuth,
+			ProbeTotalSize:    gRunReq.ProbeTotalSize,
+			OutputFormat:      gRunReq.OutputFormat,
+			TsFixContinuity:   gRunReq.TsFixContinuity,
+			StreamMerge:       gRunReq.StreamMerge,
+			StreamRemoveTs:    gRunReq.StreamRemoveTs,
+			SplitMode:         gRunReq.SplitMode,
+			SplitValue:        gRunReq.SplitValue,
+			TrackMode:         gRunReq.TrackMode,
+			FastStart:         gRunReq.FastStart,
+			TaskId:            getBatchTaskId(urlWithFilename.Url, urlWithFilename.Filename),
+		})
+	}
+	if gDryRun.Enable || gDryRun.Json {
+		planFromCmd(reqList)
+		return
+	}
+	manager := openTaskManager(saveDir, gBatchReq.TaskCount)
+	idList := addBatchTasks(manager, reqList)
+	manager.ResumeQueued()
+
+	successCount, failCount, firstErrCode := waitTaskManagerFinish(manager, idList)
+	log.Printf("批量下载完成! 成功: %d, 失败: %d", successCount, failCount)
+	if failCount > 0 {
+		os.Exit(getExitCode(firstErrCode))
+	}
+}
+
+// addBatchTasks 添加批量下载的任务, 返回需要等待的任务: 上次没有完成的任务和这次添加、重试的任务.
+//
+//	AddTask、RetryTaskWithReq 会立即开始下载, 所以要在添加之前记录, 不能之后再从任务列表里查找, 否则已经失败、跳过的任务会被漏掉
+func addBatchTasks(manager *m3u8d.TaskManager, reqList []m3u8d.StartDownload_Req) (idList []string) {
+	idList = getUnfinishedTaskIdList(manager)
+	stateMap := map[string]string{}
+	for _, task := range manager.ListTasks() {
+		stateMap[task.TaskId] = task.State
+	}
+	for _, req := range reqList {
+		switch stateMap[req.TaskId] {
+		case "":
+			resp := manager.AddTask(req, 0)
+			if resp.ErrMsg != "" {
+				log.Println(resp.ErrMsg)
+				continue
+			}
+			stateMap[req.TaskId] = m3u8d.TaskState_Queued
+			idList = append(idList, req.TaskId)
+		case m3u8d.TaskState_Failed, m3u8d.TaskState_Cancelled, m3u8d.TaskState_Queued:
+			// 重复执行同一个批量下载文件时, 使用这次的参数重新下载上次失败、没有完成的任务
+			isQueued := stateMap[req.TaskId] == m3u8d.TaskState_Queued
+			if errMsg := manager.RetryTaskWithReq(req); errMsg != "" {
+				log.Println(errMsg)
+				continue
+			}
+			stateMap[req.TaskId] = m3u8d.TaskState_Queued
+			if isQueued == false {
+				idList = append(idList, req.TaskId)
+			}
 		}
+	}
+	return idList
+}
 
-		// 执行下载
-		m3u8dcpp.StartDownload(req)
-		resp := m3u8dcpp.WaitDownloadFinish()
-		if resp.ErrMsg != "" {
-			log.Printf("下载失败: %s", resp.ErrMsg)
-			failCount++
-			continue
+func getBatchTaskId(url string, filename string) string {
+	tmp := sha256.Sum256([]byte(url + "\n" + filename))
+	return "batch-" + hex.EncodeToString(tmp[:])[:12]
+}
+
+// openTaskManager 打开下载目录里保存的任务列表
+func openTaskManager(saveDir string, taskCount int) *m3u8d.TaskManager {
+	if saveDir == "" {
+		saveDir = m3u8d.GetWd()
+	}
+	err := os.MkdirAll(saveDir, 0755)
+	if err != nil {
+		log.Fatalln("创建目录失败", err)
+	}
+	manager := m3u8d.NewTaskManager(taskCount)
+	errMsg := manager.LoadStateFile(filepath.Join(saveDir, m3u8d.TaskStateFileName))
+	if errMsg != "" {
+		log.Fatalln(errMsg)
+	}
+	return manager
+}
+
+func getUnfinishedTaskIdList(manager *m3u8d.TaskManager) (idList []string) {
+	for _, task := range manager.ListTasks() {
+		if task.State == m3u8d.TaskState_Queued || task.State == m3u8d.TaskState_Running {
+			idList = append(idList, task.TaskId)
 		}
+	}
+	return idList
+}
 
-		if resp.IsSkipped {
-			log.Printf("已经下载过了: %s", resp.SaveFileTo)
-			successCount++
-		} else if resp.SaveFileTo != "" {
-			log.Printf("下载成功, 保存路径: %s", resp.SaveFileTo)
-			successCount++
-		} else {
-			log.Println("下载成功")
-			successCount++
+// waitTaskManagerFinish 等待idList里的任务结束, 任务开始、结束时打印日志, 同时下载多个任务时定时打印任务列表.
+//
+//	firstErrCode 为第一个失败任务的错误码
+func waitTaskManagerFinish(manager *m3u8d.TaskManager, idList []string) (successCount int, failCount int, firstErrCode string) {
+	var stateMap = map[string]string{}
+	var posMap = map[string]int{}
+	for idx, taskId := range idList {
+		posMap[taskId] = idx + 1
+	}
+	var lastPrintList time.Time
+
+	for {
+		var runningList []m3u8d.TaskStatus
+		for _, task := range manager.ListTasks() {
+			pos, ok := posMap[task.TaskId]
+			if ok == false {
+				continue
+			}
+			if task.State == m3u8d.TaskState_Running {
+				runningList = append(runningList, task)
+			}
+			if stateMap[task.TaskId] == task.State {
+				continue
+			}
+			stateMap[task.TaskId] = task.State
+			prefix := fmt.Sprintf("[%d/%d] ", pos, len(idList))
+			resp := task.Status
+			switch task.State {
+			case m3u8d.TaskState_Running:
+				log.Printf(prefix+"开始下载: %s 文件名: %s", task.M3u8Url, task.FileName)
+			case m3u8d.TaskState_Failed, m3u8d.TaskState_Cancelled:
+				log.Printf(prefix+"下载失败: %s", resp.ErrMsg)
+				if failCount == 0 {
+					firstErrCode = resp.ErrCode
+				}
+				failCount++
+			case m3u8d.TaskState_Finished:
+				if resp.IsSkipped {
+					log.Printf(prefix+"已经下载过了: %s", resp.SaveFileTo)
+				} else if resp.SaveFileTo != "" {
+					log.Printf(prefix+"下载成功, 保存路径: %s", resp.SaveFileTo)
+				} else {
+					log.Println(prefix + "下载成功")
+				}
+				successCount++
+			}
+		}
+		if successCount+failCount >= len(idList) {
+			return successCount, failCount, firstErrCode
 		}
+		if len(runningList) > 1 && time.Since(lastPrintList) > 5*time.Second {
+			lastPrintList = time.Now()
+			for _, task := range runningList {
+				log.Printf("[%d/%d] %s %d%% %s", posMap[task.TaskId], len(idList), task.Status.Title, task.Status.Percent, task.Status.StatusBar)
+			}
+		}
+		time.Sleep(time.Millisecond * 100)
 	}
+}
 
-	log.Printf("批量下载完成! 成功: %d, 失败: %d", successCount, failCount)
+var gTaskReq struct {
+	SaveDir   string
+	TaskCount int
+}
+
+var taskCmd = &cobra.Command{
+	Use:   "task",
+	Short: "管理下载目录里保存的任务列表(" + m3u8d.TaskStateFileName + ")",
+}
+
+var taskListCmd = &cobra.Command{
+	Use: "list",
+	Run: func(cmd *cobra.Command, args []string) {
+		manager := openTaskManager(gTaskReq.SaveDir, 1)
+		for _, task := range manager.ListTasks() {
+			info := task.Status.SaveFileTo
+			if task.Status.ErrMsg != "" {
+				info = task.Status.ErrMsg
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\n", task.TaskId, task.State, task.M3u8Url, task.FileName, info)
+		}
+	},
+}
+
+var taskRetryCmd = &cobra.Command{
+	Use:   "retry [taskId...]",
+	Short: "重新下载失败、取消的任务, 不指定taskId则重试全部",
+	Run: func(cmd *cobra.Command, args []string) {
+		manager := openTaskManager(gTaskReq.SaveDir, gTaskReq.TaskCount)
+		// RetryTask 会立即开始下载, 要在重试之前记录需要等待的任务
+		idList := getUnfinishedTaskIdList(manager)
+		if len(args) == 0 {
+			for _, task := range manager.ListTasks() {
+				if task.State == m3u8d.TaskState_Failed || task.State == m3u8d.TaskState_Cancelled {
+					args = append(args, task.TaskId)
+				}
+			}
+		}
+		for _, taskId := range args {
+			if errMsg := manager.RetryTask(taskId); errMsg != "" {
+				log.Println(errMsg)
+				continue
+			}
+			idList = append(idList, taskId)
+		}
+		runTaskManager(manager, idList)
+	},
+}
+
+var taskResumeCmd = &cobra.Command{
+	Use:   "resume",
+	Short: "继续下载排队中、上次中断的任务",
+	Run: func(cmd *cobra.Command, args []string) {
+		manager := openTaskManager(gTaskReq.SaveDir, gTaskReq.TaskCount)
+		runTaskManager(manager, getUnfinishedTaskIdList(manager))
+	},
+}
+
+var taskPurgeCmd = &cobra.Command{
+	Use:   "purge",
+	Short: "删除已结束(成功、失败、取消)的任务记录",
+	Run: func(cmd *cobra.Command, args []string) {
+		manager := openTaskManager(gTaskReq.SaveDir, 1)
+		log.Printf("删除了 %d 条任务记录", manager.PurgeTasks())
+	},
+}
+
+// runTaskManager 开始下载排队中的任务, 等待idList里的任务结束. idList需要在开始下载之前获取
+func runTaskManager(manager *m3u8d.TaskManager, idList []string) {
+	manager.ResumeQueued()
+	if len(idList) == 0 {
+		log.Println("没有需要下载的任务")
+		return
+	}
+	successCount, failCount, firstErrCode := waitTaskManagerFinish(manager, idList)
+	log.Printf("下载完成! 成功: %d, 失败: %d", successCount, failCount)
+	if failCount > 0 {
+		os.Exit(getExitCode(firstErrCode))
+	}
 }
 
 var gRunReq m3u8d.StartDownload_Req
@@ -190,6 +533,13 @@ var gMergeReq struct {
 	OutputMp4Name        string
 	UseFirstTsMTime      bool
 	SkipBadResolutionFps bool
+	OutputFormat         string
+	Resume               bool
+	TsFixContinuity      bool
+	SplitMode            string
+	SplitValue           int
+	TrackMode            string
+	FastStart            bool
 }
 
 var mergeCmd = &cobra.Command{
@@ -229,9 +579,30 @@ var mergeCmd = &cobra.Command{
 			log.Fatalln("目录下不存在ts文件", gMergeReq.InputTsDir)
 			return
 		}
+		if gMergeReq.OutputFormat == "" {
+			gMergeReq.OutputFormat = m3u8d.GetOutputFormatByName(gMergeReq.OutputMp4Name)
+		}
+		var errMsg string
+		gMergeReq.OutputFormat, errMsg = m3u8d.ParseOutputFormat(gMergeReq.OutputFormat)
+		if errMsg != "" {
+			log.Fatalln(errMsg)
+			return
+		}
+		if gMergeReq.TrackMode == "" {
+			switch strings.ToLower(filepath.Ext(gMergeReq.OutputMp4Name)) {
+			case ".m4a", ".mka":
+				gMergeReq.TrackMode = m3u8d.TrackMode_Audio
+			}
+		}
+		gMergeReq.TrackMode, errMsg = m3u8d.ParseTrackMode(gMergeReq.TrackMode, gMergeReq.OutputFormat)
+		if errMsg != "" {
+			log.Fatalln(errMsg)
+			return
+		}
 		if gMergeReq.OutputMp4Name == "" {
-			gMergeReq.OutputMp4Name = filepath.Join(gMergeReq.InputTsDir, "all.mp4")
+			gMergeReq.OutputMp4Name = filepath.Join(gMergeReq.InputTsDir, "all."+m3u8d.GetOutputFileExt(gMergeReq.OutputFormat, gMergeReq.TrackMode))
 		}
+		tsFileList = m3u8d.ExcludeOutputFile(tsFileList, gMergeReq.OutputMp4Name)
 		if gMergeReq.SkipBadResolutionFps {
 			tsFileList, err = m3u8d.AnalyzeTs(status, tsFileList, gMergeReq.OutputMp4Name, context.Background())
 			if err != nil {
@@ -247,24 +618,33 @@ var mergeCmd = &cobra.Command{
 
 		status.SetProgressBarTitle("合并ts")
 		status.SpeedResetTotalBlockCount(len(tsFileList))
-		err = m3u8d.MergeTsFileListToSingleMp4(m3u8d.MergeTsFileListToSingleMp4_Req{
-			TsFileList: tsFileList,
-			OutputMp4:  gMergeReq.OutputMp4Name,
-			Ctx:        context.Background(),
-			Status:     status,
+		outputList, err := m3u8d.MergeTsFileListToMultiFile(m3u8d.MergeTsFileListToSingleMp4_Req{
+			TsFileList:      tsFileList,
+			OutputMp4:       gMergeReq.OutputMp4Name,
+			OutputFormat:    gMergeReq.OutputFormat,
+			Resume:          gMergeReq.Resume,
+			TsFixContinuity: gMergeReq.TsFixContinuity,
+			SplitMode:       gMergeReq.SplitMode,
+			SplitValue:      gMergeReq.SplitValue,
+			TrackMode:       gMergeReq.TrackMode,
+			FastStart:       gMergeReq.FastStart,
+			Ctx:             context.Background(),
+			Status:          status,
 		})
 		if err != nil {
 			log.Fatalln("合并失败", err)
 			return
 		}
-		if gMergeReq.UseFirstTsMTime {
-			err = m3u8d.UpdateMp4Time(tsFileList[0], gMergeReq.OutputMp4Name)
-			if err != nil {
-				log.Fatalln("更新mp4文件时间失败", err)
-				return
+		for _, outputName := range outputList {
+			if gMergeReq.UseFirstTsMTime {
+				err = m3u8d.UpdateOutputFileTime(tsFileList[0], outputName, gMergeReq.OutputFormat)
+				if err != nil {
+					log.Fatalln("更新mp4文件时间失败", err)
+					return
+				}
 			}
+			log.Println("合并成功", outputName)
 		}
-		log.Println("合并成功", gMergeReq.OutputMp4Name)
 	},
 }
 
@@ -292,16 +672,59 @@ func init() {
 	downloadCmd.Flags().StringVarP(&gRunReq.TsTempDir, "TsTempDir", "", "", "临时ts文件目录")
 	downloadCmd.Flags().BoolVarP(&gRunReq.UseServerSideTime, "UseServerSideTime", "", false, "使用服务端提供的文件时间")
 	downloadCmd.Flags().BoolVarP(&gRunReq.WithSkipLog, "WithSkipLog", "", false, "在mp4旁记录跳过ts文件的信息")
+	downloadCmd.Flags().BoolVarP(&gRunReq.SkipTsValidate, "SkipTsValidate", "", false, "不校验下载的ts文件(长度、188字节对齐、PAT/PMT)")
+	downloadCmd.Flags().BoolVarP(&gRunReq.SkipCacheCheck, "SkipCacheCheck", "", false, "不检查下载历史, 即使之前下载过并且文件还在也重新下载")
+	downloadCmd.Flags().BoolVarP(&gRunReq.VerifyCache, "VerifyCache", "", false, "续传时重新计算已下载ts文件的hash, 不一致则重新下载")
+	downloadCmd.Flags().StringVarP(&gRunReq.CookieFile, "CookieFile", "", "", "导入Netscape格式的cookies.txt")
+	downloadCmd.Flags().StringVarP(&gRunReq.CookieSaveTo, "CookieSaveTo", "", "", "任务结束后把cookie导出为Netscape格式的文件")
+	downloadCmd.Flags().StringArrayVarP(&gRunReq.ResolveList, "Resolve", "", nil, "指定域名的ip, 可以多次使用, 例如: example.com:443:127.0.0.1")
+	downloadCmd.Flags().StringArrayVarP(&gRunReq.ConnectToList, "ConnectTo", "", nil, "连接到其他的地址, 可以多次使用, 例如: example.com:443:cdn.example.com:443")
+	downloadCmd.Flags().StringVarP(&gRunReq.DnsServer, "DnsServer", "", "", "自定义dns服务器, 例如: 127.0.0.1:5353, 多个用逗号分隔")
+	downloadCmd.Flags().StringVarP(&gRunReq.CaCertFile, "CaCertFile", "", "", "额外信任的CA证书(PEM)")
+	downloadCmd.Flags().StringVarP(&gRunReq.ClientCertFile, "ClientCertFile", "", "", "客户端证书, PEM或者PKCS#12(.p12/.pfx)")
+	downloadCmd.Flags().StringVarP(&gRunReq.ClientKeyFile, "ClientKeyFile", "", "", "客户端私钥(PEM), 私钥和证书不在同一个文件时使用")
+	downloadCmd.Flags().StringVarP(&gRunReq.ClientCertPass, "ClientCertPass", "", "", "PKCS#12客户端证书的密码")
+	downloadCmd.Flags().StringVarP(&gRunReq.TlsMinVersion, "TlsMinVersion", "", "", "最低tls版本: 1.0 1.1 1.2 1.3")
+	downloadCmd.Flags().StringVarP(&gRunReq.TlsServerName, "TlsServerName", "", "", "覆盖m3u8所在host的tls握手时的SNI")
+	downloadCmd.Flags().IntVarP(&gRunReq.MaxRedirect, "MaxRedirect", "", 0, "最多跳转次数, 0表示默认的10次, 小于0表示不跟随跳转")
+	downloadCmd.Flags().BoolVarP(&gRunReq.RedirectKeepAuth, "RedirectKeepAuth", "", false, "跳转到其他host时保留Authorization、Cookie等header")
+	downloadCmd.Flags().BoolVarP(&gRunReq.ProbeTotalSize, "ProbeTotalSize", "", false, "下载前对部分ts发送HEAD请求估算总大小, 进度和剩余时间更准确")
+	downloadCmd.Flags().StringVarP(&gRunReq.OutputFormat, "OutputFormat", "", "", "合并后的格式: mp4(默认)、fmp4(分片的mp4, 合并中也可以播放, 中断后继续合并)、mkv、ts(直接拼接ts, 保留原始时间戳)")
+	downloadCmd.Flags().BoolVarP(&gRunReq.TsFixContinuity, "TsFixContinuity", "", false, "合并为ts时重写连续计数器, 在不是以PAT开头的ts前面插入PAT/PMT")
+	downloadCmd.Flags().BoolVarP(&gRunReq.StreamMerge, "StreamMerge", "", false, "边下载边合并: 按顺序合并已经下载完成的ts, 不用等所有ts下载完成")
+	downloadCmd.Flags().BoolVarP(&gRunReq.StreamRemoveTs, "StreamRemoveTs", "", false, "边下载边合并为fmp4(不分割)时, 每个ts完整写入输出文件后马上删除, 中断后从合并进度继续, 即使使用了 --SkipRemoveTs")
+	downloadCmd.Flags().StringVarP(&gRunReq.SplitMode, "SplitMode", "", "", "分割输出文件: discontinuity(#EXT-X-DISCONTINUITY处)、duration(每SplitValue分钟)、size(每个文件不超过SplitValue MB), 文件名为 FileName_part001 ...")
+	downloadCmd.Flags().IntVarP(&gRunReq.SplitValue, "SplitValue", "", 0, "SplitMode为duration时的分钟数、size时的MB数")
+	downloadCmd.Flags().StringVarP(&gRunReq.TrackMode, "TrackMode", "", "", "audio: 只保留音频, 输出为m4a, 嵌套的m3u8里有只有音频的播放列表时下载它; video: 只保留视频; 默认都保留")
+	downloadCmd.Flags().BoolVarP(&gRunReq.FastStart, "FastStart", "", false, "输出为mp4时把moov移动到文件开头, 网页上可以边下载边播放")
+	for _, one := range []*cobra.Command{downloadCmd, batchCmd} {
+		one.Flags().BoolVarP(&gDryRun.Enable, "DryRun", "", false, "只获取m3u8, 显示会下载、跳过哪些ts和保存的文件名, 不下载")
+		one.Flags().BoolVarP(&gDryRun.Enable, "dry-run", "", false, "同 --DryRun")
+		one.Flags().BoolVarP(&gDryRun.Json, "DryRunJson", "", false, "同 --DryRun, 输出json")
+		one.Flags().MarkHidden("dry-run")
+	}
 	rootCmd.AddCommand(downloadCmd)
 	curlCmd.DisableFlagParsing = true
 	rootCmd.AddCommand(curlCmd)
 	batchCmd.Flags().StringVarP(&gBatchReq.InputFile, "InputFile", "i", "", "输入包含URL的txt文件路径")
 	batchCmd.Flags().StringVarP(&gBatchReq.SaveDir, "SaveDir", "d", "", "批量下载保存路径(默认为当前工作目录)")
+	batchCmd.Flags().IntVarP(&gBatchReq.TaskCount, "TaskCount", "", 1, "同时下载的任务数")
 	rootCmd.AddCommand(batchCmd)
+	taskCmd.PersistentFlags().StringVarP(&gTaskReq.SaveDir, "SaveDir", "d", "", "任务列表所在的下载目录(默认为当前工作目录)")
+	taskCmd.PersistentFlags().IntVarP(&gTaskReq.TaskCount, "TaskCount", "", 1, "同时下载的任务数")
+	taskCmd.AddCommand(taskListCmd, taskRetryCmd, taskResumeCmd, taskPurgeCmd)
+	rootCmd.AddCommand(taskCmd)
 	mergeCmd.Flags().StringVarP(&gMergeReq.InputTsDir, "InputTsDir", "", "", "存放ts文件的目录(默认为当前工作目录)")
 	mergeCmd.Flags().StringVarP(&gMergeReq.OutputMp4Name, "OutputMp4Name", "", "", "输出mp4文件名(默认为输入ts文件的目录下的all.mp4)")
 	mergeCmd.Flags().BoolVarP(&gMergeReq.UseFirstTsMTime, "UseFirstTsMTime", "", false, "使用第一个ts文件的修改时间作为输出mp4文件的创建时间")
 	mergeCmd.Flags().BoolVarP(&gMergeReq.SkipBadResolutionFps, "SkipBadResolutionFps", "", true, "跳过分辨率、fps异常的ts文件")
+	mergeCmd.Flags().StringVarP(&gMergeReq.OutputFormat, "OutputFormat", "", "", "输出格式: mp4、fmp4、mkv、ts(默认根据输出文件的扩展名判断, 没有指定输出文件时为mp4)")
+	mergeCmd.Flags().BoolVarP(&gMergeReq.Resume, "Resume", "", false, "输出格式为fmp4并且输出文件已存在时, 保留完整的分片, 从中断的位置继续合并")
+	mergeCmd.Flags().BoolVarP(&gMergeReq.TsFixContinuity, "TsFixContinuity", "", false, "输出格式为ts时重写连续计数器, 在不是以PAT开头的ts前面插入PAT/PMT")
+	mergeCmd.Flags().StringVarP(&gMergeReq.SplitMode, "SplitMode", "", "", "分割输出文件: duration(每SplitValue分钟)、size(每个文件不超过SplitValue MB), 文件名为 输出文件名_part001 ...")
+	mergeCmd.Flags().IntVarP(&gMergeReq.SplitValue, "SplitValue", "", 0, "SplitMode为duration时的分钟数、size时的MB数")
+	mergeCmd.Flags().StringVarP(&gMergeReq.TrackMode, "TrackMode", "", "", "audio: 只保留音频(默认输出all.m4a); video: 只保留视频. 输出文件名以 .m4a、.mka 结尾时默认为audio")
+	mergeCmd.Flags().BoolVarP(&gMergeReq.FastStart, "FastStart", "", false, "输出为mp4时把moov移动到文件开头, 网页上可以边下载边播放")
 	rootCmd.AddCommand(mergeCmd)
 	rootCmd.AddCommand(getTsVideoInfoCmd)
 	rootCmd.Version = m3u8d.GetVersion()
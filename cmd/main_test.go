@@ -0,0 +1,36 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/orestonce/m3u8d"
+)
+
+func TestAddBatchTasksFailImmediately(t *testing.T) {
+	saveDir := t.TempDir()
+	var reqList []m3u8d.StartDownload_Req
+	for idx := 0; idx < 3; idx++ {
+		m3u8Url := "ftp://x/" + strconv.Itoa(idx) + ".m3u8"
+		reqList = append(reqList, m3u8d.StartDownload_Req{
+			M3u8Url:     m3u8Url,
+			SaveDir:     saveDir,
+			ThreadCount: 1,
+			TaskId:      getBatchTaskId(m3u8Url, ""),
+		})
+	}
+	// 第二次执行时重试上次失败的任务
+	for round := 0; round < 2; round++ {
+		manager := m3u8d.NewTaskManager(3)
+		if errMsg := manager.LoadStateFile(filepath.Join(saveDir, m3u8d.TaskStateFileName)); errMsg != "" {
+			t.Fatal(errMsg)
+		}
+		idList := addBatchTasks(manager, reqList)
+		manager.ResumeQueued()
+		successCount, failCount, firstErrCode := waitTaskManagerFinish(manager, idList)
+		if len(idList) != 3 || successCount != 0 || failCount != 3 || firstErrCode == "" {
+			t.Fatal(round, idList, successCount, failCount, firstErrCode)
+		}
+	}
+}
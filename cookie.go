@@ -0,0 +1,189 @@
+package m3u8d
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cookieJar 在标准库的 cookiejar 之上记录所有cookie, 用于导出为 Netscape 格式的 cookies.txt
+type cookieJar struct {
+	jar      *cookiejar.Jar
+	locker   sync.Mutex
+	entryMap map[string]cookieJarEntry
+}
+
+type cookieJarEntry struct {
+	Domain   string // 以"."开头表示对子域名也生效
+	Path     string
+	Secure   bool
+	HttpOnly bool
+	Expires  time.Time // 为零值表示会话cookie
+	Name     string
+	Value    string
+}
+
+func newCookieJar() *cookieJar {
+	jar, _ := cookiejar.New(nil)
+	return &cookieJar{
+		jar:      jar,
+		entryMap: map[string]cookieJarEntry{},
+	}
+}
+
+func (this *cookieJar) Cookies(u *url.URL) []*http.Cookie {
+	return this.jar.Cookies(u)
+}
+
+func (this *cookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	this.jar.SetCookies(u, cookies)
+
+	now := time.Now()
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	for _, cookie := range cookies {
+		entry := cookieJarEntry{
+			Domain:   u.Hostname(),
+			Path:     cookie.Path,
+			Secure:   cookie.Secure,
+			HttpOnly: cookie.HttpOnly,
+			Expires:  cookie.Expires,
+			Name:     cookie.Name,
+			Value:    cookie.Value,
+		}
+		if cookie.Domain != "" {
+			entry.Domain = "." + strings.TrimPrefix(cookie.Domain, ".")
+		}
+		if entry.Path == "" || entry.Path[0] != '/' {
+			entry.Path = getDefaultCookiePath(u.Path)
+		}
+		if cookie.MaxAge > 0 {
+			entry.Expires = now.Add(time.Duration(cookie.MaxAge) * time.Second)
+		}
+		key := entry.Domain + ";" + entry.Path + ";" + entry.Name
+		if cookie.MaxAge < 0 || (entry.Expires.IsZero() == false && entry.Expires.Before(now)) {
+			delete(this.entryMap, key)
+			continue
+		}
+		this.entryMap[key] = entry
+	}
+}
+
+// getDefaultCookiePath https://datatracker.ietf.org/doc/html/rfc6265#section-5.1.4
+func getDefaultCookiePath(urlPath string) string {
+	idx := strings.LastIndex(urlPath, "/")
+	if idx <= 0 {
+		return "/"
+	}
+	return urlPath[:idx]
+}
+
+// ImportNetscape 导入 Netscape 格式的 cookies.txt, 每行以tab分隔:
+//
+//	domain includeSubdomains path secure expires name value
+func (this *cookieJar) ImportNetscape(content []byte) (errMsg string) {
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		httpOnly := false
+		if strings.HasPrefix(line, "#HttpOnly_") {
+			line = strings.TrimPrefix(line, "#HttpOnly_")
+			httpOnly = true
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) == 6 { // 值为空的cookie
+			fields = append(fields, "")
+		}
+		if len(fields) != 7 {
+			return "cookies.txt line " + strconv.Itoa(lineNo) + " invalid"
+		}
+		expiresUnix, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return "cookies.txt line " + strconv.Itoa(lineNo) + " invalid expires " + strconv.Quote(fields[4])
+		}
+		secure := strings.EqualFold(fields[3], "TRUE")
+		host := strings.TrimPrefix(fields[0], ".")
+		cookie := &http.Cookie{
+			Name:     fields[5],
+			Value:    fields[6],
+			Path:     fields[2],
+			Secure:   secure,
+			HttpOnly: httpOnly,
+		}
+		if strings.EqualFold(fields[1], "TRUE") {
+			cookie.Domain = host
+		}
+		if expiresUnix > 0 {
+			cookie.Expires = time.Unix(expiresUnix, 0)
+		}
+		scheme := "http"
+		if secure {
+			scheme = "https"
+		}
+		this.SetCookies(&url.URL{Scheme: scheme, Host: host, Path: cookie.Path}, []*http.Cookie{cookie})
+	}
+	return ""
+}
+
+// ExportNetscape 导出为 Netscape 格式的 cookies.txt, 会话cookie的过期时间为0
+func (this *cookieJar) ExportNetscape() []byte {
+	this.locker.Lock()
+	var list []cookieJarEntry
+	for _, entry := range this.entryMap {
+		list = append(list, entry)
+	}
+	this.locker.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Domain != list[j].Domain {
+			return list[i].Domain < list[j].Domain
+		}
+		if list[i].Path != list[j].Path {
+			return list[i].Path < list[j].Path
+		}
+		return list[i].Name < list[j].Name
+	})
+
+	var buf bytes.Buffer
+	buf.WriteString("# Netscape HTTP Cookie File\n")
+	for _, entry := range list {
+		if entry.HttpOnly {
+			buf.WriteString("#HttpOnly_")
+		}
+		var expires int64
+		if entry.Expires.IsZero() == false {
+			expires = entry.Expires.Unix()
+		}
+		buf.WriteString(strings.Join([]string{
+			entry.Domain,
+			netscapeBool(strings.HasPrefix(entry.Domain, ".")),
+			entry.Path,
+			netscapeBool(entry.Secure),
+			strconv.FormatInt(expires, 10),
+			entry.Name,
+			entry.Value,
+		}, "\t"))
+		buf.WriteString("\n")
+	}
+	return buf.Bytes()
+}
+
+func netscapeBool(v bool) string {
+	if v {
+		return "TRUE"
+	}
+	return "FALSE"
+}
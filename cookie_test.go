@@ -0,0 +1,68 @@
+package m3u8d
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCookieJar_Netscape(t *testing.T) {
+	content := strings.Join([]string{
+		"# Netscape HTTP Cookie File",
+		"",
+		".example.com\tTRUE\t/\tFALSE\t4102444800\tsid\tabc",
+		"#HttpOnly_www.example.com\tFALSE\t/video\tTRUE\t0\ttoken\txyz",
+		"www.example.com\tFALSE\t/\tFALSE\t0\tempty",
+	}, "\n")
+	jar := newCookieJar()
+	if errMsg := jar.ImportNetscape([]byte(content)); errMsg != "" {
+		t.Fatal(errMsg)
+	}
+	exported := string(jar.ExportNetscape())
+	expect := strings.Join([]string{
+		"# Netscape HTTP Cookie File",
+		".example.com\tTRUE\t/\tFALSE\t4102444800\tsid\tabc",
+		"www.example.com\tFALSE\t/\tFALSE\t0\tempty\t",
+		"#HttpOnly_www.example.com\tFALSE\t/video\tTRUE\t0\ttoken\txyz",
+		"",
+	}, "\n")
+	if exported != expect {
+		t.Fatal(exported)
+	}
+
+	if errMsg := newCookieJar().ImportNetscape([]byte("example.com\tFALSE\t/")); errMsg == "" {
+		t.Fatal("expect error")
+	}
+}
+
+func TestCookieJar_SetCookie(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		switch request.URL.Path {
+		case "/login":
+			http.SetCookie(writer, &http.Cookie{Name: "sid", Value: "v1", Path: "/"})
+		case "/check":
+			cookie, err := request.Cookie("sid")
+			if err != nil || cookie.Value != "v1" {
+				writer.WriteHeader(http.StatusForbidden)
+			}
+		}
+	}))
+	defer server.Close()
+
+	jar := newCookieJar()
+	client := &http.Client{Jar: jar}
+	for _, path := range []string{"/login", "/check"} {
+		resp, err := client.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal(path, resp.StatusCode)
+		}
+	}
+	if exported := string(jar.ExportNetscape()); strings.Contains(exported, "\tsid\tv1\n") == false {
+		t.Fatal(exported)
+	}
+}
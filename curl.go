@@ -74,6 +74,16 @@ func ParseCurl(cmdList []string) (resp ParseCurl_Resp) {
 	isHeader := false
 	isMethod := false
 	isProxy := false
+	isCookie := false
+	isCookieJar := false
+	isResolve := false
+	isConnectTo := false
+	isDnsServer := false
+	isCaCert := false
+	isCert := false
+	isKey := false
+	isPass := false
+	isMaxRedirect := false
 
 	for idx := 0; idx < len(cmdList); idx++ {
 		value := cmdList[idx]
@@ -100,6 +110,73 @@ func ParseCurl(cmdList []string) (resp ParseCurl_Resp) {
 			isProxy = false
 			continue
 		}
+		if isCookie {
+			// curl -b 的参数包含"="时是cookie内容, 否则是cookie文件
+			if strings.Contains(value, "=") {
+				header.Add("Cookie", value)
+			} else {
+				resp.DownloadReq.CookieFile = value
+			}
+			isCookie = false
+			continue
+		}
+		if isCookieJar {
+			resp.DownloadReq.CookieSaveTo = value
+			isCookieJar = false
+			continue
+		}
+		if isResolve {
+			resp.DownloadReq.ResolveList = append(resp.DownloadReq.ResolveList, value)
+			isResolve = false
+			continue
+		}
+		if isConnectTo {
+			resp.DownloadReq.ConnectToList = append(resp.DownloadReq.ConnectToList, value)
+			isConnectTo = false
+			continue
+		}
+		if isDnsServer {
+			resp.DownloadReq.DnsServer = value
+			isDnsServer = false
+			continue
+		}
+		if isCaCert {
+			resp.DownloadReq.CaCertFile = value
+			isCaCert = false
+			continue
+		}
+		if isCert {
+			var pass string
+			resp.DownloadReq.ClientCertFile, pass = parseCurlCertArg(value)
+			if pass != "" {
+				resp.DownloadReq.ClientCertPass = pass
+			}
+			isCert = false
+			continue
+		}
+		if isKey {
+			resp.DownloadReq.ClientKeyFile = value
+			isKey = false
+			continue
+		}
+		if isPass {
+			resp.DownloadReq.ClientCertPass = value
+			isPass = false
+			continue
+		}
+		if isMaxRedirect {
+			maxRedirect, err := strconv.Atoi(value)
+			if err != nil {
+				resp.ErrMsg = "--max-redirs参数错误: " + strconv.Quote(value)
+				return resp
+			}
+			if maxRedirect == 0 { // curl的0表示不跟随跳转
+				maxRedirect = -1
+			}
+			resp.DownloadReq.MaxRedirect = maxRedirect
+			isMaxRedirect = false
+			continue
+		}
 		valueLow := strings.ToLower(value)
 		switch valueLow {
 		case "-h":
@@ -113,6 +190,32 @@ func ParseCurl(cmdList []string) (resp ParseCurl_Resp) {
 			}
 		case "-k", "--insecure":
 			resp.DownloadReq.Insecure = true
+		case "-b", "--cookie":
+			isCookie = true
+		case "-c", "--cookie-jar":
+			isCookieJar = true
+		case "--resolve":
+			isResolve = true
+		case "--connect-to":
+			isConnectTo = true
+		case "--dns-servers":
+			isDnsServer = true
+		case "--cacert":
+			isCaCert = true
+		case "-e", "--cert":
+			isCert = value != "-e" // curl的 -e 是 --referer
+		case "--key":
+			isKey = true
+		case "--pass":
+			isPass = true
+		case "--max-redirs":
+			isMaxRedirect = true
+		case "--location-trusted":
+			resp.DownloadReq.RedirectKeepAuth = true
+		case "-1", "--tlsv1":
+			resp.DownloadReq.TlsMinVersion = "1.0"
+		case "--tlsv1.0", "--tlsv1.1", "--tlsv1.2", "--tlsv1.3":
+			resp.DownloadReq.TlsMinVersion = strings.TrimPrefix(valueLow, "--tlsv")
 		default:
 			if strings.HasPrefix(valueLow, "-") { // 不认识的flag, 跳过
 				continue
@@ -128,6 +231,25 @@ func ParseCurl(cmdList []string) (resp ParseCurl_Resp) {
 	return resp
 }
 
+// parseCurlCertArg 解析curl的 --cert <file[:password]>, 文件名里的":"使用"\\:"转义, 兼容windows的盘符
+func parseCurlCertArg(value string) (file string, password string) {
+	var buf strings.Builder
+	for idx := 0; idx < len(value); idx++ {
+		ch := value[idx]
+		if ch == '\\' && idx+1 < len(value) && value[idx+1] == ':' {
+			buf.WriteByte(':')
+			idx++
+			continue
+		}
+		isDrive := idx == 1 && len(value) > 2 && (value[2] == '\\' || value[2] == '/')
+		if ch == ':' && isDrive == false {
+			return buf.String(), value[idx+1:]
+		}
+		buf.WriteByte(ch)
+	}
+	return buf.String(), ""
+}
+
 func RunDownload_Req_ToCurlStr(req StartDownload_Req) string {
 	if req.M3u8Url == "" {
 		return ""
@@ -140,6 +262,46 @@ func RunDownload_Req_ToCurlStr(req StartDownload_Req) string {
 	if req.SetProxy != "" {
 		buf.WriteString(" \\\n -X " + req.SetProxy)
 	}
+	if req.CookieFile != "" {
+		buf.WriteString(" \\\n -b " + strconv.Quote(req.CookieFile))
+	}
+	if req.CookieSaveTo != "" {
+		buf.WriteString(" \\\n -c " + strconv.Quote(req.CookieSaveTo))
+	}
+	for _, one := range req.ResolveList {
+		buf.WriteString(" \\\n --resolve " + strconv.Quote(one))
+	}
+	for _, one := range req.ConnectToList {
+		buf.WriteString(" \\\n --connect-to " + strconv.Quote(one))
+	}
+	if req.DnsServer != "" {
+		buf.WriteString(" \\\n --dns-servers " + strconv.Quote(req.DnsServer))
+	}
+	if req.CaCertFile != "" {
+		buf.WriteString(" \\\n --cacert " + strconv.Quote(req.CaCertFile))
+	}
+	if req.ClientCertFile != "" {
+		buf.WriteString(" \\\n --cert " + strconv.Quote(strings.ReplaceAll(req.ClientCertFile, ":", "\\:")))
+	}
+	if req.ClientKeyFile != "" {
+		buf.WriteString(" \\\n --key " + strconv.Quote(req.ClientKeyFile))
+	}
+	if req.ClientCertPass != "" {
+		buf.WriteString(" \\\n --pass " + strconv.Quote(req.ClientCertPass))
+	}
+	if req.TlsMinVersion != "" {
+		buf.WriteString(" \\\n --tlsv" + req.TlsMinVersion)
+	}
+	if req.MaxRedirect != 0 {
+		maxRedirect := req.MaxRedirect
+		if maxRedirect < 0 {
+			maxRedirect = 0
+		}
+		buf.WriteString(" \\\n --max-redirs " + strconv.Itoa(maxRedirect))
+	}
+	if req.RedirectKeepAuth {
+		buf.WriteString(" \\\n --location-trusted")
+	}
 	for key, vList := range req.HeaderMap {
 		if len(vList) == 0 {
 			continue
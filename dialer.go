@@ -0,0 +1,198 @@
+package m3u8d
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hostDialer 支持 curl 的 --resolve、--connect-to 以及自定义dns服务器
+type hostDialer struct {
+	dialer        net.Dialer
+	resolveMap    map[string][]string // key: 小写的 host:port
+	connectToList []connectToRule
+	resolver      *net.Resolver // 为nil时使用系统的dns
+}
+
+type connectToRule struct {
+	FromHost string // 为空表示匹配所有host
+	FromPort string // 为空表示匹配所有端口
+	ToHost   string // 为空表示不修改host
+	ToPort   string // 为空表示不修改端口
+}
+
+func newHostDialer(req StartDownload_Req) (dialer *hostDialer, errMsg string) {
+	dialer = &hostDialer{
+		// 和 http.DefaultTransport 一致
+		dialer: net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		},
+		resolveMap: map[string][]string{},
+	}
+	for _, one := range req.ResolveList {
+		key, addrList, errMsg := parseResolveRule(one)
+		if errMsg != "" {
+			return nil, errMsg
+		}
+		if key != "" {
+			dialer.resolveMap[key] = addrList
+		}
+	}
+	for _, one := range req.ConnectToList {
+		rule, errMsg := parseConnectToRule(one)
+		if errMsg != "" {
+			return nil, errMsg
+		}
+		dialer.connectToList = append(dialer.connectToList, rule)
+	}
+	if req.DnsServer != "" {
+		var serverList []string
+		for _, one := range strings.Split(req.DnsServer, ",") {
+			one = strings.TrimSpace(one)
+			if one == "" {
+				continue
+			}
+			if net.ParseIP(strings.Trim(one, "[]")) != nil {
+				one = net.JoinHostPort(strings.Trim(one, "[]"), "53")
+			} else if _, _, err := net.SplitHostPort(one); err != nil {
+				return nil, "dns服务器格式错误: " + strconv.Quote(one)
+			}
+			serverList = append(serverList, one)
+		}
+		dialer.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (conn net.Conn, err error) {
+				for _, server := range serverList {
+					conn, err = dialer.dialer.DialContext(ctx, network, server)
+					if err == nil {
+						return conn, nil
+					}
+				}
+				return nil, err
+			},
+		}
+	}
+	return dialer, ""
+}
+
+// parseResolveRule 解析 host:port:addr[,addr]..., 以"-"开头表示删除, 忽略
+func parseResolveRule(rule string) (key string, addrList []string, errMsg string) {
+	rule = strings.TrimPrefix(strings.TrimSpace(rule), "+")
+	if strings.HasPrefix(rule, "-") {
+		return "", nil, ""
+	}
+	tmp := strings.SplitN(rule, ":", 3)
+	if len(tmp) != 3 || tmp[0] == "" || isValidPort(tmp[1]) == false || tmp[1] == "" {
+		return "", nil, "resolve格式错误, 应为 host:port:addr " + strconv.Quote(rule)
+	}
+	for _, addr := range strings.Split(tmp[2], ",") {
+		addr = strings.Trim(strings.TrimSpace(addr), "[]")
+		if net.ParseIP(addr) == nil {
+			return "", nil, "resolve地址错误: " + strconv.Quote(rule)
+		}
+		addrList = append(addrList, addr)
+	}
+	return strings.ToLower(net.JoinHostPort(tmp[0], tmp[1])), addrList, ""
+}
+
+// parseConnectToRule 解析 HOST1:PORT1:HOST2:PORT2, ipv6地址需要使用[]包围
+func parseConnectToRule(rule string) (result connectToRule, errMsg string) {
+	var ok bool
+	errMsg = "connect-to格式错误, 应为 HOST1:PORT1:HOST2:PORT2 " + strconv.Quote(rule)
+	remain := strings.TrimSpace(rule)
+	result.FromHost, remain, ok = cutRuleHost(remain)
+	if ok == false {
+		return result, errMsg
+	}
+	result.FromPort, remain, ok = cutRuleHost(remain)
+	if ok == false {
+		return result, errMsg
+	}
+	result.ToHost, result.ToPort, ok = cutRuleHost(remain)
+	if ok == false || isValidPort(result.FromPort) == false || isValidPort(result.ToPort) == false {
+		return result, errMsg
+	}
+	result.FromHost = strings.ToLower(result.FromHost)
+	return result, ""
+}
+
+// cutRuleHost 以第一个不在[]里的":"切分
+func cutRuleHost(s string) (before string, after string, ok bool) {
+	if strings.HasPrefix(s, "[") {
+		idx := strings.Index(s, "]")
+		if idx < 0 || idx+1 >= len(s) || s[idx+1] != ':' {
+			return "", "", false
+		}
+		return s[1:idx], s[idx+2:], true
+	}
+	idx := strings.Index(s, ":")
+	if idx < 0 {
+		return "", "", false
+	}
+	return s[:idx], s[idx+1:], true
+}
+
+func isValidPort(port string) bool {
+	if port == "" {
+		return true
+	}
+	v, err := strconv.Atoi(port)
+	return err == nil && v > 0 && v <= 65535
+}
+
+// getDialAddrList 返回实际需要连接的地址, 按顺序尝试
+func (this *hostDialer) getDialAddrList(ctx context.Context, address string) (list []string, err error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range this.connectToList {
+		if (rule.FromHost == "" || rule.FromHost == strings.ToLower(host)) && (rule.FromPort == "" || rule.FromPort == port) {
+			if rule.ToHost != "" {
+				host = rule.ToHost
+			}
+			if rule.ToPort != "" {
+				port = rule.ToPort
+			}
+			break
+		}
+	}
+	if addrList, ok := this.resolveMap[strings.ToLower(net.JoinHostPort(host, port))]; ok {
+		for _, addr := range addrList {
+			list = append(list, net.JoinHostPort(addr, port))
+		}
+		return list, nil
+	}
+	if this.resolver == nil || net.ParseIP(host) != nil {
+		return []string{net.JoinHostPort(host, port)}, nil
+	}
+	ipList, err := this.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ipList {
+		list = append(list, net.JoinHostPort(ip.String(), port))
+	}
+	return list, nil
+}
+
+func (this *hostDialer) DialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
+	addrList, err := this.getDialAddrList(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrList) == 0 {
+		return nil, errors.New("no address for " + address)
+	}
+	for _, addr := range addrList {
+		conn, err = this.dialer.DialContext(ctx, network, addr)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,73 @@
+package m3u8d
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseConnectToRule(t *testing.T) {
+	for _, one := range []struct {
+		rule   string
+		expect connectToRule
+		isErr  bool
+	}{
+		{rule: "example.com:443:cdn.example.com:8443", expect: connectToRule{FromHost: "example.com", FromPort: "443", ToHost: "cdn.example.com", ToPort: "8443"}},
+		{rule: "::[::1]:", expect: connectToRule{ToHost: "::1"}},
+		{rule: "[::1]:80:127.0.0.1:", expect: connectToRule{FromHost: "::1", FromPort: "80", ToHost: "127.0.0.1"}},
+		{rule: "example.com:443", isErr: true},
+		{rule: "example.com:abc:b:1", isErr: true},
+	} {
+		rule, errMsg := parseConnectToRule(one.rule)
+		if (errMsg != "") != one.isErr {
+			t.Fatal(one.rule, errMsg)
+		}
+		if one.isErr == false && rule != one.expect {
+			t.Fatal(one.rule, rule)
+		}
+	}
+}
+
+func TestHostDialer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte(request.Host))
+	}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	dialer, errMsg := newHostDialer(StartDownload_Req{
+		ResolveList:   []string{"cdn.m3u8d.invalid:" + port + ":127.0.0.1"},
+		ConnectToList: []string{"www.m3u8d.invalid:80:cdn.m3u8d.invalid:" + port},
+	})
+	if errMsg != "" {
+		t.Fatal(errMsg)
+	}
+	addrList, err := dialer.getDialAddrList(context.Background(), "WWW.m3u8d.invalid:80")
+	if err != nil || reflect.DeepEqual(addrList, []string{"127.0.0.1:" + port}) == false {
+		t.Fatal(addrList, err)
+	}
+	client := &http.Client{Transport: &http.Transport{DialContext: dialer.DialContext}}
+	resp, err := client.Get("http://www.m3u8d.invalid/index.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if string(data) != "www.m3u8d.invalid" { // Host头不变
+		t.Fatal(string(data))
+	}
+
+	for _, req := range []StartDownload_Req{
+		{ResolveList: []string{"example.com:443"}},
+		{ResolveList: []string{"example.com:443:not-ip"}},
+		{DnsServer: "example.com"},
+	} {
+		if _, errMsg = newHostDialer(req); errMsg == "" {
+			t.Fatal(req)
+		}
+	}
+}
@@ -40,6 +40,15 @@ type GetStatus_Resp struct {
 	IsSkipped     bool
 	SaveFileTo    string
 	TaskId        string	// 任务id, 库用户自己传入的 StartDownload_Req.TaskId
+	IsQueued      bool     // 在TaskManager里排队等待下载
+	IsPaused      bool     // 已暂停, 正在下载的ts会继续下载完成
+	TotalBytes    int      // 预计的ts总大小, 0表示未知
+	FetchedBytes  int      // 本次从网络下载的ts字节数
+	CachedBytes   int      // 使用已下载ts的字节数
+	ErrCode       string   // 失败原因, 见 ErrCode_*, 成功时为空
+	ErrTsName     string   // 出错的ts文件名
+	ErrUrl        string   // 出错的m3u8、key、ts地址
+	SaveFileList  []string // 分割输出时的所有文件, SaveFileTo 为第一个
 }
 
 var PNG_SIGN = []byte{0x89, 0x50, 0x4E, 0x47, 0x0D, 0x0A, 0x1A, 0x0A}
@@ -55,24 +64,60 @@ type StartDownload_Req struct {
 	SkipRemoveTs      bool                // 不删除ts文件
 	ProgressBarShow   bool                // 在控制台打印进度条
 	ThreadCount       int                 // 线程数
-	SkipCacheCheck    bool                // 不缓存已下载的m3u8的文件信息
+	SkipCacheCheck    bool                // 不检查下载历史, 即使之前下载过并且文件还在也重新下载
 	SkipMergeTs       bool                // 不合并ts为mp4
 	DebugLog          bool                // 调试日志
 	TsTempDir         string              // 临时ts文件目录
 	UseServerSideTime bool                // 使用服务端提供的文件时间
 	WithSkipLog       bool                // 在mp4旁记录跳过ts文件的信息
 	TaskId            string			  // 用户自定义的任务id, GetStatus会原样传回来
+	SkipTsValidate    bool                // 不校验下载的ts文件(长度、188字节对齐、PAT/PMT)
+	VerifyCache       bool                // 续传时重新计算已下载ts文件的hash, 不一致则重新下载
+	CookieFile        string              // 导入Netscape格式的cookies.txt
+	CookieSaveTo      string              // 任务结束后把cookie导出为Netscape格式的文件
+	ResolveList       []string            // 指定域名的ip, 同curl的--resolve: host:port:addr[,addr]...
+	ConnectToList     []string            // 连接到其他的地址, 同curl的--connect-to: HOST1:PORT1:HOST2:PORT2
+	DnsServer         string              // 自定义dns服务器, 例如 127.0.0.1:5353, 多个用逗号分隔
+	CaCertFile        string              // 额外信任的CA证书(PEM), 同curl的--cacert
+	ClientCertFile    string              // 客户端证书, PEM或者PKCS#12, 同curl的--cert
+	ClientKeyFile     string              // 客户端私钥(PEM), 私钥和证书不在同一个文件时使用, 同curl的--key
+	ClientCertPass    string              // PKCS#12客户端证书的密码
+	TlsMinVersion     string              // 最低tls版本: 1.0 1.1 1.2 1.3
+	TlsServerName     string              // 覆盖tls握手时的SNI, 同时用于校验服务器证书. 只用于m3u8所在的host
+	MaxRedirect       int                 // 最多跳转次数, 0表示默认的10次, 小于0表示不跟随跳转
+	RedirectKeepAuth  bool                // 跳转到其他host时保留Authorization、Cookie等header
+	ProbeTotalSize    bool                // 下载前对部分ts发送HEAD请求估算总大小, 进度和剩余时间更准确
+	OutputFormat      string              // 合并后的格式: mp4(默认)、fmp4、mkv、ts
+	TsFixContinuity   bool                // 合并为ts时重写连续计数器, 在不是以PAT开头的ts前面插入PAT/PMT
+	StreamMerge       bool                // 边下载边合并: 按顺序合并已经下载完成的ts, 不用等所有ts下载完成
+	StreamRemoveTs    bool                // 边下载边合并为fmp4(不分割)时, 每个ts完整写入输出文件后马上删除, 中断后从合并进度继续. 即使 SkipRemoveTs 为true
+	SplitMode         string              // 分割输出文件: discontinuity、duration、size, 为空时不分割. 文件名为 FileName_part001 ...
+	SplitValue        int                 // SplitMode为duration时的分钟数、size时的MB数
+	TrackMode         string              // 只保留音频(audio, 输出为m4a, 嵌套的m3u8里有只有音频的播放列表时下载它)或者视频(video), 默认都保留
+	FastStart         bool                // 输出为mp4时把moov移动到文件开头, 网页上可以边下载边播放
 }
 
 type DownloadEnv struct {
-	cancelFn      func()
-	ctx           context.Context
-	nowClient     *http.Client
-	header        http.Header
-	sleepTh       int32
-	status        SpeedStatus
-	logFile       *os.File
-	logFileLocker sync.Mutex
+	cancelFn       func()
+	ctx            context.Context
+	nowClient      *http.Client
+	header         http.Header
+	sleepTh        int32
+	status         SpeedStatus
+	logFile        *os.File
+	logFileLocker  sync.Mutex
+	tsManifest     *tsManifest
+	cookieJar      *cookieJar
+	onFinished     func()        // 任务结束后的回调, TaskManager用来启动下一个排队的任务
+	finishCh       chan struct{} // 发送 EventType_Finish 后关闭
+	pauseCh        chan struct{}
+	resumeSeq      int
+	urlRefresher   *tsUrlRefresher
+	streamMerger   *streamMerger      // 边下载边合并, 没有开启时为nil
+	isAudioOnly    bool               // 只保留音频, 嵌套的m3u8里优先选择 #EXT-X-MEDIA 的音轨或者只有音频的播放列表
+	fetcherMap     map[string]Fetcher // RegisterFetcher 注册的自定义scheme
+	fetcherLocker  sync.RWMutex
+	allowSchemeMap map[string]bool // 内置Fetcher允许的scheme, 见 getAllowSchemeMap
 }
 
 // 获取m3u8地址的host
@@ -141,13 +186,30 @@ func UpdateMediaKeyContent(m3u8Url string, tsList []mformat.TsInfo, getFunc func
 
 // 下载ts文件
 // @modify: 2020-08-13 修复ts格式SyncByte合并不能播放问题
-func (this *DownloadEnv) downloadTsFile(ts *mformat.TsInfo, skipInfo SkipTsInfo, downloadDir string, useServerSideTime bool) (err error) {
+func (this *DownloadEnv) downloadTsFile(ts *mformat.TsInfo, skipInfo SkipTsInfo, downloadDir string, req StartDownload_Req) (err error) {
 	currPath := filepath.Join(downloadDir, ts.Name)
 	var stat os.FileInfo
 	stat, err = os.Stat(currPath)
 	if err == nil && stat.Mode().IsRegular() {
-		this.status.SpeedAdd1Block(stat.ModTime(), int(stat.Size()))
-		return nil
+		ok, reason := this.tsManifest.isTsCacheMatch(ts, currPath, stat, req.VerifyCache)
+		if ok == false && this.tsManifest.isLegacyTs(ts.Name) {
+			err = this.tsManifest.adoptLegacyTs(ts, currPath, req.SkipTsValidate == false)
+			ok = err == nil
+			if err != nil {
+				reason = "legacy ts: " + err.Error()
+			}
+		}
+		if ok {
+			event := newTsEvent(EventType_TsFinish, ts)
+			event.IsCache = true
+			event.Bytes = stat.Size()
+			this.emitEvent(event)
+			// 和下载的ts一样按照响应body的长度计算进度, 与探测的总大小一致
+			this.status.addTsBytes(int(this.tsManifest.getRespSize(ts.Name, stat.Size())), true)
+			this.status.SpeedAdd1Block(stat.ModTime(), int(stat.Size()))
+			return nil
+		}
+		this.logToFile("ts cache " + strconv.Quote(ts.Name) + " mismatch, download again: " + reason)
 	}
 	beginTime := time.Now()
 	data, httpResp, err := this.doGetRequest(ts.Url, false)
@@ -160,12 +222,16 @@ func (this *DownloadEnv) downloadTsFile(ts *mformat.TsInfo, skipInfo SkipTsInfo,
 			ts.SkipByHttpCode = true
 			ts.HttpCode = httpResp.StatusCode
 			this.logToFile("skip ts " + strconv.Quote(ts.Name) + " byHttpCode: " + strconv.Itoa(httpResp.StatusCode))
+			event := newTsEvent(EventType_TsSkip, ts)
+			event.Reason = "http.code=" + strconv.Itoa(httpResp.StatusCode)
+			this.emitEvent(event)
+			this.status.skipTsBytes()
 			return nil
 		}
-		return errors.New(`invalid http status code: ` + strconv.Itoa(httpResp.StatusCode) + ` url: ` + ts.Url)
+		return &tsHttpCodeError{code: httpResp.StatusCode, url: ts.Url}
 	}
 	var mTime time.Time
-	if mStr := httpResp.Header.Get("Last-Modified"); mStr != "" && useServerSideTime {
+	if mStr := httpResp.Header.Get("Last-Modified"); mStr != "" && req.UseServerSideTime {
 		this.logToFile("get mtime " + strconv.Quote(mStr))
 		mTime, err = time.Parse(time.RFC1123, mStr)
 		// 这个错误不重要, 所以只记录日志
@@ -191,15 +257,26 @@ func (this *DownloadEnv) downloadTsFile(ts *mformat.TsInfo, skipInfo SkipTsInfo,
 		origData = origData[8:]
 	}
 
-	// https://en.wikipedia.org/wiki/MPEG_transport_stream
-	// Some TS files do not start with SyncByte 0x47, they can not be played after merging,
-	// Need to remove the bytes before the SyncByte 0x47(71).
-	syncByte := uint8(71) //0x47
-	bLen := len(origData)
-	for j := 0; j < bLen; j++ {
-		if origData[j] == syncByte {
-			origData = origData[j:]
-			break
+	// fMP4、packed audio 分片不是ts, 不能去掉0x47之前的内容, 也不能按ts校验
+	segmentFormat := mformat.SniffSegmentFormat(ts, origData)
+	if segmentFormat == mformat.SegmentFormat_Ts {
+		// https://en.wikipedia.org/wiki/MPEG_transport_stream
+		// Some TS files do not start with SyncByte 0x47, they can not be played after merging,
+		// Need to remove the bytes before the SyncByte 0x47(71).
+		syncByte := uint8(71) //0x47
+		bLen := len(origData)
+		for j := 0; j < bLen; j++ {
+			if origData[j] == syncByte {
+				origData = origData[j:]
+				break
+			}
+		}
+	}
+	if req.SkipTsValidate == false {
+		err = validateTsResp(httpResp, data, origData, segmentFormat)
+		if err != nil {
+			this.logToFile("validate ts " + strconv.Quote(ts.Name) + " failed: " + err.Error())
+			return err
 		}
 	}
 	tmpPath := currPath + ".tmp"
@@ -211,6 +288,18 @@ func (this *DownloadEnv) downloadTsFile(ts *mformat.TsInfo, skipInfo SkipTsInfo,
 	if err != nil {
 		return err
 	}
+	err = this.tsManifest.set(tsManifestUnit{
+		Name:     ts.Name,
+		Url:      ts.Url,
+		Size:     int64(len(origData)),
+		Sha256:   getBytesSha256(origData),
+		KeyURI:   ts.Key.KeyURI,
+		RespSize: int64(len(data)),
+	})
+	// 记录失败只影响下次续传, 所以只记录日志
+	if err != nil {
+		this.logToFile("write " + tsManifestLogFileName + " error: " + err.Error())
+	}
 	if mTime.IsZero() == false {
 		err = os.Chtimes(currPath, mTime, mTime)
 		// 这个错误不重要, 所以只记录日志
@@ -218,10 +307,37 @@ func (this *DownloadEnv) downloadTsFile(ts *mformat.TsInfo, skipInfo SkipTsInfo,
 			this.logToFile("os.Chtimes error " + err.Error())
 		}
 	}
-	this.status.SpeedAdd1Block(beginTime, len(origData))
+	event := newTsEvent(EventType_TsFinish, ts)
+	event.Bytes = int64(len(origData))
+	this.emitEvent(event)
+	this.status.addTsBytes(len(data), false)
+	this.status.SpeedAdd1Block(beginTime, len(data))
+	return nil
+}
+
+var errTsInvalid = errors.New("invalid ts")
+
+// validateTsResp 校验下载到的ts是否完整, 避免把错误页面、被截断的内容、解密失败的内容合并到mp4里
+func validateTsResp(httpResp *http.Response, data []byte, origData []byte, segmentFormat string) error {
+	// 有Content-Encoding时Content-Length是压缩后的长度, 无法校验
+	if httpResp.ContentLength >= 0 && httpResp.Header.Get("Content-Encoding") == "" && int64(len(data)) != httpResp.ContentLength {
+		return fmt.Errorf("%w: Content-Length %d != body length %d", errTsInvalid, httpResp.ContentLength, len(data))
+	}
+	err := mformat.SegmentValidate(origData, segmentFormat)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errTsInvalid, err)
+	}
 	return nil
 }
 
+// getTsFailReason 区分校验失败和网络错误, 返回错误码和记录到 tsNotWriteReason 的原因
+func getTsFailReason(err error) (errCode string, reason string) {
+	if errors.Is(err, errTsInvalid) {
+		return ErrCode_SegmentInvalid, "validate: " + err.Error()
+	}
+	return ErrCode_SegmentFailed, "download: " + err.Error()
+}
+
 func isInIntSlice(i int, list []int) bool {
 	for _, one := range list {
 		if i == one {
@@ -245,13 +361,42 @@ func (this *DownloadEnv) downloader(tsList []mformat.TsInfo, skipInfo SkipTsInfo
 	task := gopool.NewThreadPool(req.ThreadCount)
 	var locker sync.Mutex
 
+	this.tsManifest = loadTsManifest(downloadDir)
+	// 合并上次被中断时留下的追加记录
+	errSave := this.tsManifest.save()
+	if errSave != nil {
+		this.logToFile("save " + tsManifestFileName + " error: " + errSave.Error())
+	}
+	defer func() {
+		// 取消、出错时也要保存, 下次续传时才能复用已下载的ts
+		errSave := this.tsManifest.save()
+		if errSave != nil {
+			this.logToFile("save " + tsManifestFileName + " error: " + errSave.Error())
+		}
+	}()
+
 	this.status.SpeedResetTotalBlockCount(len(tsList))
+	this.status.initTsBytes(len(tsList))
 
 	for idx := range tsList {
+		idx := idx
 		ts := &tsList[idx]
+		// 暂停时不再把ts交给下载线程, 正在下载的ts不受影响
+		this.waitResume()
 		task.AddJob(func() {
+			if this.streamMerger != nil && this.streamMerger.isRemoved(idx) {
+				// 上次已经合并到输出文件并且删除了
+				event := newTsEvent(EventType_TsFinish, ts)
+				event.IsCache = true
+				this.emitEvent(event)
+				this.status.addTsBytes(int(this.tsManifest.getRespSize(ts.Name, 0)), true)
+				this.status.SpeedAdd1Block(time.Now(), 0)
+				return
+			}
 			var lastErr error
+			var isUrlRefreshed bool
 			for i := 0; i < 5; i++ {
+				this.waitResume()
 				if this.GetIsCancel() {
 					break
 				}
@@ -262,24 +407,47 @@ func (this *DownloadEnv) downloader(tsList []mformat.TsInfo, skipInfo SkipTsInfo
 					return
 				}
 				locker.Unlock()
-				if i > 0 {
-					atomic.AddInt32(&this.sleepTh, 1)
-					this.SleepDur(time.Second * time.Duration(i))
-					atomic.AddInt32(&this.sleepTh, -1)
+				if i == 0 {
+					this.emitEvent(newTsEvent(EventType_TsStart, ts))
+				} else {
+					event := newTsEvent(EventType_TsRetry, ts)
+					event.Retry = i
+					event.Reason = lastErr.Error()
+					this.emitEvent(event)
+					if isUrlRefreshed == false {
+						atomic.AddInt32(&this.sleepTh, 1)
+						this.SleepDur(time.Second * time.Duration(i))
+						atomic.AddInt32(&this.sleepTh, -1)
+					}
 				}
-				lastErr = this.downloadTsFile(ts, skipInfo, downloadDir, req.UseServerSideTime)
+				lastErr = this.downloadTsFile(ts, skipInfo, downloadDir, req)
 				if lastErr == nil {
+					if this.streamMerger != nil {
+						this.streamMerger.setTsDone(idx)
+					}
 					break
 				}
+				// 地址已经更新时马上重试
+				isUrlRefreshed = this.urlRefresher != nil && this.urlRefresher.refreshIfExpired(this, ts, lastErr)
 			}
 			if lastErr != nil {
+				errCode, reason := getTsFailReason(lastErr)
 				locker.Lock()
 				if err == nil {
-					err = fmt.Errorf("%v: %v", ts.Name, lastErr.Error())
+					err = &DownloadError{
+						Code:    errCode,
+						Message: ts.Name + ": " + lastErr.Error(),
+						Cause:   lastErr,
+						TsName:  ts.Name,
+						Url:     ts.Url,
+					}
 				}
 				locker.Unlock()
 
-				this.status.setTsNotWriteReason(ts, "download: "+lastErr.Error())
+				this.status.setTsNotWriteReason(ts, reason)
+				event := newTsEvent(EventType_TsFail, ts)
+				event.Reason = lastErr.Error()
+				this.emitEvent(event)
 			} else if ts.SkipByHttpCode {
 				this.status.setTsNotWriteReason(ts, "skipByHttpCode: "+strconv.Itoa(ts.HttpCode))
 			} else if this.GetIsCancel() {
@@ -302,42 +470,55 @@ func isDirExists(path string) bool {
 	return err == nil && stat.IsDir()
 }
 
-func (this *DownloadEnv) sniffM3u8(urlS string) (afterUrl string, info mformat.M3U8File, errMsg string) {
+// sniffM3u8 afterUrl 是请求的m3u8地址, 用于计算videoId;
+// baseUrl 是跳转后实际返回m3u8内容的地址, 用于拼接ts、key的相对地址
+func (this *DownloadEnv) sniffM3u8(urlS string) (afterUrl string, baseUrl string, info mformat.M3U8File, errMsg string) {
+	afterUrl, baseUrl, info, _, errMsg = this.sniffM3u8Variant(urlS)
+	return afterUrl, baseUrl, info, errMsg
+}
+
+// sniffM3u8Variant 同 sniffM3u8, variant 为嵌套的m3u8里选择的清晰度, 不是嵌套的m3u8时为nil
+func (this *DownloadEnv) sniffM3u8Variant(urlS string) (afterUrl string, baseUrl string, info mformat.M3U8File, variant *mformat.M3U8Playlist, errMsg string) {
 	for idx := 0; idx < 5; idx++ {
 		content, httpResp, err := this.doGetRequest(urlS, true)
 		if err != nil {
-			return "", info, err.Error()
+			return "", "", info, variant, err.Error()
 		}
 		if httpResp.StatusCode != 200 {
-			return "", info, "invalid httpCode " + strconv.Itoa(httpResp.StatusCode)
+			return "", "", info, variant, "invalid httpCode " + strconv.Itoa(httpResp.StatusCode)
 		}
+		baseUrl = httpResp.Request.URL.String()
 		var ok bool
 		info, ok = mformat.M3U8Parse(content)
 		if ok {
 			// 看这个是不是嵌套的m3u8
 			if info.IsNestedPlaylists() {
 				playlist := info.LookupHDPlaylist()
+				if audioPlaylist := info.LookupAudioPlaylist(); audioPlaylist != nil && this.isAudioOnly {
+					playlist = audioPlaylist
+				}
+				variant = playlist
 				if playlist == nil {
-					return "", info, "lookup playlist failed"
+					return "", "", info, variant, "lookup playlist failed"
 				}
-				urlS, errMsg = ResolveRefUrl(urlS, playlist.URI)
+				urlS, errMsg = ResolveRefUrl(baseUrl, playlist.URI)
 				if errMsg != "" {
-					return "", info, errMsg
+					return "", "", info, variant, errMsg
 				}
 				continue
 			}
 			if info.ContainsMediaSegment() {
-				return urlS, info, ""
+				return urlS, baseUrl, info, variant, ""
 			}
-			return "", info, "未发现m3u8资源_1"
+			return "", "", info, variant, "未发现m3u8资源_1"
 		}
 		groups := regexp.MustCompile(`http[s]://[a-zA-Z0-9/\\.%_-]+.m3u8`).FindSubmatch(content)
 		if len(groups) == 0 {
-			return "", info, "未发现m3u8资源_2"
+			return "", "", info, variant, "未发现m3u8资源_2"
 		}
 		urlS = string(groups[0])
 	}
-	return "", info, "未发现m3u8资源_3"
+	return "", "", info, variant, "未发现m3u8资源_3"
 }
 
 func ResolveRefUrl(baseUrl string, extUrl string) (after string, errMsg string) {
@@ -366,7 +547,8 @@ func (this *DownloadEnv) doGetRequest(urlS string, dumpRespBody bool) (data []by
 		return nil, nil, err
 	}
 	req = req.WithContext(this.ctx)
-	req.Header = this.header
+	// 多个线程同时请求, http.Client会把cookie jar里的cookie写入req.Header, 所以需要复制一份
+	req.Header = this.header.Clone()
 
 	var logBuf *bytes.Buffer
 
@@ -381,8 +563,19 @@ func (this *DownloadEnv) doGetRequest(urlS string, dumpRespBody bool) (data []by
 
 	beginTime := time.Now()
 
-	resp, err = this.nowClient.Do(req)
+	fetcher := this.getFetcher(req.URL.Scheme)
+	if fetcher == nil {
+		err = errors.New("unsupported url scheme " + strconv.Quote(req.URL.Scheme))
+	} else {
+		resp, err = fetcher.Fetch(req)
+	}
+	if resp != nil && resp.Request == nil {
+		resp.Request = req
+	}
 	if logBuf != nil && resp != nil {
+		if chain := getRedirectChain(resp); chain != "" {
+			logBuf.WriteString("redirect: " + chain + "\n")
+		}
 		respBytes, _ := httputil.DumpResponse(resp, false)
 		logBuf.WriteString("httpResp:\n" + string(respBytes) + "\n")
 		logBuf.WriteString("time1: " + time.Since(beginTime).String() + "\n")
@@ -429,7 +622,7 @@ func (this *DownloadEnv) doGetRequest(urlS string, dumpRespBody bool) (data []by
 		}
 		return nil, nil, err
 	}
-	content, err = this.status.SpeedReadAll(readCloser)
+	content, err = this.status.speedReadAll(urlS, readCloser)
 	if logBuf != nil {
 		logBuf.WriteString("time4: " + time.Since(beginTime).String() + ", bytes: " + strconv.Itoa(len(content)) + "\n")
 	}
@@ -449,6 +642,97 @@ func (this *DownloadEnv) doGetRequest(urlS string, dumpRespBody bool) (data []by
 	return content, resp, nil
 }
 
+// getRedirectChain 返回跳转过程, 例如: url1 -(302)-> url2 -(301)-> url3, 没有跳转时返回空字符串
+func getRedirectChain(resp *http.Response) string {
+	var list []string
+	for req := resp.Request; req != nil; {
+		list = append([]string{strconv.Quote(req.URL.String())}, list...)
+		if req.Response == nil {
+			break
+		}
+		list = append([]string{"-(" + strconv.Itoa(req.Response.StatusCode) + ")->"}, list...)
+		req = req.Response.Request
+	}
+	if len(list) <= 1 {
+		return ""
+	}
+	return strings.Join(list, " ")
+}
+
+// 跨host跳转时 http.Client 会去掉这些header
+var gSensitiveHeaderList = []string{"Authorization", "Www-Authenticate", "Cookie", "Cookie2"}
+
+// getRedactedReq 去掉请求参数里的cookie、认证header、证书密码、代理密码, 用于写日志、保存任务列表.
+//
+//	placeholder为空时删除, 否则替换为placeholder
+func getRedactedReq(req StartDownload_Req, placeholder string) StartDownload_Req {
+	if len(req.HeaderMap) > 0 {
+		headerMap := map[string][]string{}
+		for key, vList := range req.HeaderMap {
+			if isSensitiveHeader(key) {
+				if placeholder == "" {
+					continue
+				}
+				vList = []string{placeholder}
+			}
+			headerMap[key] = vList
+		}
+		req.HeaderMap = headerMap
+	}
+	if req.ClientCertPass != "" {
+		req.ClientCertPass = placeholder
+	}
+	if urlObj, err := url.Parse(req.SetProxy); err == nil && urlObj.User != nil {
+		if _, ok := urlObj.User.Password(); ok {
+			if placeholder == "" {
+				urlObj.User = url.User(urlObj.User.Username())
+			} else {
+				urlObj.User = url.UserPassword(urlObj.User.Username(), placeholder)
+			}
+			req.SetProxy = urlObj.String()
+		}
+	}
+	return req
+}
+
+func isSensitiveHeader(key string) bool {
+	key = http.CanonicalHeaderKey(key)
+	if key == "Proxy-Authorization" {
+		return true
+	}
+	for _, one := range gSensitiveHeaderList {
+		if key == one {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRedirect MaxRedirect为0时最多跳转10次(和http.Client一致), 小于0时不跟随跳转
+func (this *DownloadEnv) checkRedirect(req StartDownload_Req) func(newReq *http.Request, via []*http.Request) error {
+	maxRedirect := req.MaxRedirect
+	if maxRedirect == 0 {
+		maxRedirect = 10
+	}
+	return func(newReq *http.Request, via []*http.Request) error {
+		if maxRedirect < 0 {
+			return http.ErrUseLastResponse
+		}
+		if len(via) > maxRedirect {
+			return errors.New("stopped after " + strconv.Itoa(maxRedirect) + " redirects")
+		}
+		if req.RedirectKeepAuth && newReq.URL.Host != via[0].URL.Host {
+			// 只恢复用户设置的header, cookie jar 里的cookie由http.Client按照新的host添加
+			for _, key := range gSensitiveHeaderList {
+				if vList, ok := this.header[key]; ok && newReq.Header.Get(key) == "" {
+					newReq.Header[key] = append([]string{}, vList...)
+				}
+			}
+		}
+		return nil
+	}
+}
+
 func (this *DownloadEnv) logToFile(body string) {
 	this.logFileLocker.Lock()
 	defer this.logFileLocker.Unlock()
@@ -610,7 +894,7 @@ func GetFileNameFromUrl(u string) string {
 		return "all"
 	}
 	name := path.Base(urlObj.Path)
-	if name == "" {
+	if name == "" || name == "." || name == "/" { // data: 等没有路径的url
 		return "all"
 	}
 	ext := path.Ext(name)
@@ -1,12 +1,18 @@
 package m3u8d
 
 import (
+	"bytes"
+	"context"
 	"embed"
+	"github.com/orestonce/m3u8d/mformat"
 	"io/fs"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -85,14 +91,14 @@ func TestFull(t *testing.T) {
 		panic(err)
 	}
 	var instance DownloadEnv
-	errMsg := instance.StartDownload(StartDownload_Req{
+	ok := instance.StartDownload(StartDownload_Req{
 		M3u8Url:     m3u8Url,
 		SaveDir:     saveDir,
 		FileName:    "all",
 		ThreadCount: 8,
 	})
-	if errMsg != "" {
-		panic(errMsg)
+	if !ok {
+		panic("StartDownload failed")
 	}
 	status := instance.WaitDownloadFinish()
 	if status.ErrMsg != "" {
@@ -105,6 +111,21 @@ func TestFull(t *testing.T) {
 	if fState.Size() <= 100*1000 { // 100KB
 		panic("state error")
 	}
+
+	// 再次下载时, 直接返回之前下载的文件
+	ok = instance.StartDownload(StartDownload_Req{
+		M3u8Url:     m3u8Url,
+		SaveDir:     saveDir,
+		FileName:    "all",
+		ThreadCount: 8,
+	})
+	if !ok {
+		panic("StartDownload failed")
+	}
+	status = instance.WaitDownloadFinish()
+	if status.ErrMsg != "" || status.IsSkipped == false || status.SaveFileTo != filepath.Join(saveDir, "all.mp4") {
+		panic(status)
+	}
 }
 
 func TestGetFileName(t *testing.T) {
@@ -124,3 +145,128 @@ func TestGetFileName(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func newTestDownloadEnv(t *testing.T, req StartDownload_Req, header http.Header) *DownloadEnv {
+	env := &DownloadEnv{ctx: context.Background(), header: header}
+	dialer, errMsg := newHostDialer(req)
+	if errMsg != "" {
+		t.Fatal(errMsg)
+	}
+	tlsConfig, errMsg := newTlsConfig(req)
+	if errMsg != "" {
+		t.Fatal(errMsg)
+	}
+	env.setupClient(req, nil, dialer, tlsConfig)
+	env.allowSchemeMap = getAllowSchemeMap(localPathToFileUrl(req.M3u8Url))
+	return env
+}
+
+func TestSniffM3u8Redirect(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/index.m3u8", func(writer http.ResponseWriter, request *http.Request) {
+		// 跳转到 localhost, 和 127.0.0.1 是不同的host
+		_, port, _ := net.SplitHostPort(request.Host)
+		http.Redirect(writer, request, "http://localhost:"+port+"/cdn/v1/index.m3u8", http.StatusFound)
+	})
+	mux.HandleFunc("/cdn/v1/index.m3u8", func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("X-Auth", request.Header.Get("Authorization"))
+		writer.Write([]byte("#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"key.bin\"\n#EXTINF:10,\n1.ts\n#EXT-X-ENDLIST\n"))
+	})
+	mux.HandleFunc("/loop", func(writer http.ResponseWriter, request *http.Request) {
+		http.Redirect(writer, request, "/loop", http.StatusFound)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	m3u8Url := "http://127.0.0.1:" + port + "/index.m3u8"
+	header := http.Header{"Authorization": []string{"Bearer m3u8d"}}
+	env := newTestDownloadEnv(t, StartDownload_Req{}, header)
+	afterUrl, baseUrl, info, errMsg := env.sniffM3u8(m3u8Url)
+	if errMsg != "" {
+		t.Fatal(errMsg)
+	}
+	if afterUrl != m3u8Url || baseUrl != "http://localhost:"+port+"/cdn/v1/index.m3u8" {
+		t.Fatal(afterUrl, baseUrl)
+	}
+	tsList := info.GetTsList()
+	if errMsg = updateTsUrl(baseUrl, tsList); errMsg != "" {
+		t.Fatal(errMsg)
+	}
+	if tsList[0].Url != "http://localhost:"+port+"/cdn/v1/1.ts" {
+		t.Fatal(tsList[0].Url)
+	}
+
+	// 跨host跳转时默认去掉Authorization
+	_, resp, err := env.doGetRequest(m3u8Url, false)
+	if err != nil || resp.Header.Get("X-Auth") != "" {
+		t.Fatal(err, resp.Header)
+	}
+	if chain := getRedirectChain(resp); chain != strconv.Quote(m3u8Url)+" -(302)-> "+strconv.Quote(baseUrl) {
+		t.Fatal(chain)
+	}
+	env = newTestDownloadEnv(t, StartDownload_Req{RedirectKeepAuth: true}, header)
+	_, resp, err = env.doGetRequest(m3u8Url, false)
+	if err != nil || resp.Header.Get("X-Auth") != "Bearer m3u8d" {
+		t.Fatal(err, resp.Header)
+	}
+
+	env = newTestDownloadEnv(t, StartDownload_Req{MaxRedirect: 3}, header)
+	if _, _, err = env.doGetRequest(server.URL+"/loop", false); err == nil || strings.Contains(err.Error(), "stopped after 3 redirects") == false {
+		t.Fatal(err)
+	}
+	env = newTestDownloadEnv(t, StartDownload_Req{MaxRedirect: -1}, header)
+	if _, resp, err = env.doGetRequest(m3u8Url, false); err != nil || resp.StatusCode != http.StatusFound {
+		t.Fatal(err)
+	}
+}
+
+func TestDownloadNonTsSegment(t *testing.T) {
+	// 0x47 不是开头, 按ts处理时会被截断
+	adts := []byte{0xFF, 0xF1, 0x50, 0x80, 0x02, 0x1F, 0xFC, 0x21, 0x47, 0x10, 0x05}
+	id3 := append([]byte("ID3\x04\x00\x00\x00\x00\x00\x00"), adts...)
+	fmp4 := append(append(makeMp4Box("styp", []byte("msdh\x00\x00\x00\x00")), makeMp4Box("moof", []byte{0x47, 0x01})...), makeMp4Box("mdat", []byte{0x00, 0x47})...)
+	segmentMap := map[string][]byte{
+		"/a.aac":  id3,
+		"/b.aac":  adts,
+		"/c.m4s":  fmp4,
+		"/d.m4s":  fmp4[:len(fmp4)-1],
+		"/e.html": []byte("<html>"),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write(segmentMap[request.URL.Path])
+	}))
+	defer server.Close()
+
+	req := StartDownload_Req{M3u8Url: server.URL + "/index.m3u8"}
+	env := newTestDownloadEnv(t, req, http.Header{})
+	dir := t.TempDir()
+	env.tsManifest = loadTsManifest(dir)
+	for idx, one := range []struct {
+		uri       string
+		mapURI    string
+		isInvalid bool
+	}{
+		{uri: "a.aac"},
+		{uri: "b.aac"},
+		{uri: "c.m4s", mapURI: "init.mp4"},
+		{uri: "d.m4s", mapURI: "init.mp4", isInvalid: true},
+		{uri: "e.html", isInvalid: true},
+	} {
+		ts := &mformat.TsInfo{Name: strconv.Itoa(idx) + ".ts", Url: server.URL + "/" + one.uri, URI: one.uri, MapURI: one.mapURI}
+		err := env.downloadTsFile(ts, SkipTsInfo{}, dir, req)
+		if one.isInvalid {
+			if errCode, _ := getTsFailReason(err); errCode != ErrCode_SegmentInvalid {
+				t.Fatal(one.uri, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(one.uri, err)
+		}
+		data, err := os.ReadFile(filepath.Join(dir, ts.Name))
+		if err != nil || bytes.Equal(data, segmentMap["/"+one.uri]) == false {
+			t.Fatal(one.uri, err, data)
+		}
+	}
+}
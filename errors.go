@@ -0,0 +1,94 @@
+package m3u8d
+
+import (
+	"errors"
+	"runtime"
+	"syscall"
+)
+
+// 错误码, 脚本、界面可以根据错误码判断失败原因, 不需要匹配 ErrMsg
+const (
+	ErrCode_Unknown         = "Unknown"
+	ErrCode_InvalidArgs     = "InvalidArgs"     // 参数错误: url、跳过表达式、代理、证书、cookie文件等
+	ErrCode_SniffFailed     = "SniffFailed"     // 获取m3u8失败, 或者没有找到m3u8
+	ErrCode_PlaylistInvalid = "PlaylistInvalid" // m3u8里的ts地址错误
+	ErrCode_PlaylistEmpty   = "PlaylistEmpty"   // 没有需要下载、合并的ts
+	ErrCode_KeyFetchFailed  = "KeyFetchFailed"  // 下载aes key失败
+	ErrCode_SegmentFailed   = "SegmentFailed"   // 重试多次后ts仍然下载失败
+	ErrCode_SegmentInvalid  = "SegmentInvalid"  // 重试多次后下载的ts仍然校验失败(长度、188字节对齐、PAT/PMT)
+	ErrCode_SegmentSkipped  = "SegmentSkipped"  // 使用http.code跳过了ts, 需要用户自行合并
+	ErrCode_MergeFailed     = "MergeFailed"     // 合并ts失败
+	ErrCode_IOFailed        = "IOFailed"        // 读写本地文件失败
+	ErrCode_DiskFull        = "DiskFull"        // 磁盘空间不足
+	ErrCode_Cancelled       = "Cancelled"       // 用户取消
+)
+
+// DownloadError 下载失败的原因
+type DownloadError struct {
+	Code    string // ErrCode_*
+	Message string // 和 GetStatus_Resp.ErrMsg 相同
+	Cause   error  // 原始错误, 可能为nil
+	TsName  string // 出错的ts文件名
+	Url     string // 出错的m3u8、key、ts地址
+}
+
+func (this *DownloadError) Error() string {
+	return this.Message
+}
+
+func (this *DownloadError) Unwrap() error {
+	return this.Cause
+}
+
+func newDownloadError(code string, message string, cause error) *DownloadError {
+	return &DownloadError{
+		Code:    code,
+		Message: message,
+		Cause:   cause,
+	}
+}
+
+func isDiskFullError(err error) bool {
+	if errors.Is(err, syscall.ENOSPC) {
+		return true
+	}
+	var errno syscall.Errno
+	if runtime.GOOS == "windows" && errors.As(err, &errno) {
+		return errno == 39 || errno == 112 // ERROR_HANDLE_DISK_FULL, ERROR_DISK_FULL
+	}
+	return false
+}
+
+// GetError 获取失败原因, 没有失败时返回nil
+func (this *DownloadEnv) GetError() *DownloadError {
+	this.status.Locker.Lock()
+	defer this.status.Locker.Unlock()
+
+	if this.status.lastErr == nil {
+		return nil
+	}
+	tmp := *this.status.lastErr
+	return &tmp
+}
+
+func (this *DownloadEnv) setError(err *DownloadError) {
+	if this.GetIsCancel() {
+		err.Code = ErrCode_Cancelled
+	} else if isDiskFullError(err.Cause) {
+		err.Code = ErrCode_DiskFull
+	}
+	this.status.Locker.Lock()
+	this.status.errMsg = err.Message
+	this.status.lastErr = err
+	this.status.Locker.Unlock()
+
+	this.logToFile("errMsg " + err.Code + " " + err.Message)
+	this.emitEvent(DownloadEvent{
+		Type:     EventType_Error,
+		ErrMsg:   err.Message,
+		ErrCode:  err.Code,
+		IsCancel: err.Code == ErrCode_Cancelled,
+		TsName:   err.TsName,
+		TsUrl:    err.Url,
+	})
+}
@@ -0,0 +1,83 @@
+package m3u8d
+
+import (
+	"errors"
+	"github.com/orestonce/m3u8d/mformat"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestIsDiskFullError(t *testing.T) {
+	err := &os.PathError{Op: "write", Path: "a.ts", Err: syscall.ENOSPC}
+	if isDiskFullError(err) == false || isDiskFullError(newDownloadError(ErrCode_IOFailed, "", err)) == false {
+		t.Fatal("expect disk full")
+	}
+	if isDiskFullError(nil) || isDiskFullError(errors.New("no space")) {
+		t.Fatal("expect not disk full")
+	}
+}
+
+func TestDownloadErrorCode(t *testing.T) {
+	dir := t.TempDir()
+	m3u8Path := filepath.Join(dir, "index.m3u8")
+	err := os.WriteFile(m3u8Path, []byte("#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"missing.key\"\n#EXTINF:10,\n1.ts\n#EXT-X-ENDLIST\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, one := range []struct {
+		m3u8Url string
+		errCode string
+		errUrl  string
+	}{
+		{m3u8Url: "m3u8d:not_exists", errCode: ErrCode_InvalidArgs, errUrl: "m3u8d:not_exists"},
+		{m3u8Url: "file:///not_exists/index.m3u8", errCode: ErrCode_SniffFailed, errUrl: "file:///not_exists/index.m3u8"},
+		{m3u8Url: m3u8Path, errCode: ErrCode_KeyFetchFailed, errUrl: "/missing.key"},
+	} {
+		var env DownloadEnv
+		var eventErrCode string
+		env.AddEventListener(func(event DownloadEvent) {
+			if event.Type == EventType_Error {
+				eventErrCode = event.ErrCode
+			}
+		})
+		if env.StartDownload(StartDownload_Req{M3u8Url: one.m3u8Url, SaveDir: t.TempDir(), ThreadCount: 1}) == false {
+			t.Fatal("StartDownload failed")
+		}
+		status := env.WaitDownloadFinish()
+		if status.ErrMsg == "" || status.ErrCode != one.errCode || eventErrCode != one.errCode || strings.HasSuffix(status.ErrUrl, one.errUrl) == false {
+			t.Fatal(one.m3u8Url, status.ErrCode, status.ErrUrl, status.ErrMsg)
+		}
+		downloadErr := env.GetError()
+		if downloadErr == nil || downloadErr.Code != one.errCode || downloadErr.Error() != status.ErrMsg {
+			t.Fatal(downloadErr)
+		}
+	}
+
+	var env DownloadEnv
+	if env.GetError() != nil {
+		t.Fatal("expect nil")
+	}
+}
+
+func TestGetTsFailReason(t *testing.T) {
+	httpResp := &http.Response{ContentLength: -1, Header: http.Header{}}
+	validateErr := validateTsResp(httpResp, []byte("<html>"), []byte("<html>"), mformat.SegmentFormat_Ts)
+	errCode, reason := getTsFailReason(validateErr)
+	if errCode != ErrCode_SegmentInvalid || strings.HasPrefix(reason, "validate: invalid ts: ") == false {
+		t.Fatal(errCode, reason)
+	}
+	httpResp.ContentLength = 10
+	errCode, reason = getTsFailReason(validateTsResp(httpResp, []byte("123"), []byte("123"), mformat.SegmentFormat_Ts))
+	if errCode != ErrCode_SegmentInvalid || strings.Contains(reason, "Content-Length 10 != body length 3") == false {
+		t.Fatal(errCode, reason)
+	}
+	errCode, reason = getTsFailReason(errors.New("invalid http status code: 404"))
+	if errCode != ErrCode_SegmentFailed || reason != "download: invalid http status code: 404" {
+		t.Fatal(errCode, reason)
+	}
+}
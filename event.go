@@ -0,0 +1,243 @@
+package m3u8d
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/orestonce/m3u8d/mformat"
+)
+
+const (
+	EventType_Phase    = "phase"     // 进入新的阶段, 见 Phase_*
+	EventType_TsStart  = "ts_start"  // 开始下载ts
+	EventType_TsRetry  = "ts_retry"  // 下载ts失败, 准备重试
+	EventType_TsFinish = "ts_finish" // ts下载完成, 或者使用了已下载的缓存
+	EventType_TsSkip   = "ts_skip"   // 跳过ts: 跳过表达式、http.code
+	EventType_TsFail   = "ts_fail"   // 重试多次后ts仍然下载失败
+	EventType_Progress = "progress"  // 下载、合并的进度
+	EventType_Error    = "error"     // 任务出错, 之后会有 EventType_Finish
+	EventType_Finish   = "finish"    // 任务结束: 成功、失败、取消
+	EventType_Pause    = "pause"     // 暂停下载, 正在下载的ts会继续下载完成
+	EventType_Resume   = "resume"    // 继续下载
+)
+
+const (
+	Phase_Sniff    = "sniff"    // 嗅探m3u8
+	Phase_List     = "list"     // 获取ts列表
+	Phase_Probe    = "probe"    // 估算ts总大小, 只有 StartDownload_Req.ProbeTotalSize 为true时才有, 属于获取ts列表阶段
+	Phase_Download = "download" // 下载ts
+	Phase_Analyze  = "analyze"  // 分析ts列表
+	Phase_Merge    = "merge"    // 合并ts
+	PhaseCount     = 5
+)
+
+// DownloadEvent 下载过程中的事件, 不同的 Type 使用不同的字段
+type DownloadEvent struct {
+	Type   string
+	TaskId string
+	Time   time.Time
+
+	// EventType_Phase, EventType_Progress
+	Phase      string
+	PhaseIndex int    // 从1开始
+	Title      string // 显示给用户的标题, 例如 "[3/5]下载ts"
+
+	// EventType_Ts*
+	TsIdx   int // ts编号, 从1开始
+	TsName  string
+	TsUrl   string
+	Retry   int    // EventType_TsRetry: 第几次重试
+	Reason  string // EventType_TsRetry、EventType_TsSkip、EventType_TsFail 的原因
+	IsCache bool   // EventType_TsFinish: 使用了已下载的ts
+
+	// EventType_TsFinish: ts的字节数; EventType_Progress: 当前阶段已处理的字节数
+	Bytes      int64
+	TotalBytes int64 // EventType_Progress: 下载ts阶段预计的总字节数, 0表示未知
+
+	// EventType_Progress
+	DoneCount  int
+	TotalCount int
+	Percent    int
+
+	// EventType_Error, EventType_Finish
+	ErrMsg     string
+	ErrCode    string // 见 ErrCode_*
+	IsCancel   bool
+	SaveFileTo string
+	IsSkipped  bool
+}
+
+func newTsEvent(eventType string, ts *mformat.TsInfo) DownloadEvent {
+	return DownloadEvent{
+		Type:   eventType,
+		TsIdx:  int(ts.Idx),
+		TsName: ts.Name,
+		TsUrl:  ts.Url,
+	}
+}
+
+// AddEventListener 注册事件回调, 返回取消注册的函数.
+//
+//	回调在单独的goroutine里按事件的顺序调用, 同一时刻只会有一个回调在执行. 回调阻塞时不影响下载, 后面的事件会排队等待
+func (this *DownloadEnv) AddEventListener(fn func(event DownloadEvent)) (removeFn func()) {
+	return this.status.addEventListener(fn)
+}
+
+func (this *DownloadEnv) emitEvent(event DownloadEvent) {
+	this.status.emitEvent(event)
+}
+
+// setPhase 设置进度条标题, 并发送 EventType_Phase
+func (this *DownloadEnv) setPhase(phase string) {
+	var index int
+	var title string
+	switch phase {
+	case Phase_Sniff:
+		index, title = 1, "嗅探m3u8"
+	case Phase_List:
+		index, title = 2, "获取ts列表"
+	case Phase_Probe:
+		index, title = 2, "估算ts总大小"
+	case Phase_Download:
+		index, title = 3, "下载ts"
+	case Phase_Analyze:
+		index, title = 4, "分析ts列表"
+	case Phase_Merge:
+		index, title = 5, "合并ts为mp4"
+	}
+	title = fmt.Sprintf("[%d/%d]%s", index, PhaseCount, title)
+
+	this.status.Locker.Lock()
+	this.status.phase = phase
+	this.status.phaseIndex = index
+	this.status.Locker.Unlock()
+
+	this.status.SetProgressBarTitle(title)
+	this.emitEvent(DownloadEvent{
+		Type:       EventType_Phase,
+		Phase:      phase,
+		PhaseIndex: index,
+		Title:      title,
+	})
+}
+
+func (this *SpeedStatus) addEventListener(fn func(event DownloadEvent)) (removeFn func()) {
+	this.Locker.Lock()
+	defer this.Locker.Unlock()
+
+	if this.eventListenerMap == nil {
+		this.eventListenerMap = map[int]func(event DownloadEvent){}
+	}
+	this.eventListenerIdAlloc++
+	id := this.eventListenerIdAlloc
+	this.eventListenerMap[id] = fn
+	return func() {
+		this.Locker.Lock()
+		delete(this.eventListenerMap, id)
+		this.Locker.Unlock()
+	}
+}
+
+func (this *SpeedStatus) emitEvent(event DownloadEvent) {
+	this.Locker.Lock()
+	event.TaskId = this.TaskId
+	event.Time = time.Now()
+	if event.Type == EventType_Progress && event.Phase == "" {
+		event.Phase = this.phase
+		event.PhaseIndex = this.phaseIndex
+	}
+	this.updateSegmentNoLock(event)
+	job := eventJob{event: event, showBar: this.ProgressBarShow}
+	var idList []int
+	for id := range this.eventListenerMap {
+		idList = append(idList, id)
+	}
+	sort.Ints(idList)
+	for _, id := range idList {
+		job.fnList = append(job.fnList, this.eventListenerMap[id])
+	}
+	if job.showBar == false && len(job.fnList) == 0 {
+		this.Locker.Unlock()
+		return
+	}
+	this.pushEventJobNoLock(job)
+	this.Locker.Unlock()
+}
+
+// waitEventDispatched 等待已经发送的事件的回调都执行完
+func (this *SpeedStatus) waitEventDispatched() {
+	doneCh := make(chan struct{})
+	this.Locker.Lock()
+	this.pushEventJobNoLock(eventJob{fnList: []func(event DownloadEvent){func(event DownloadEvent) {
+		close(doneCh)
+	}}})
+	this.Locker.Unlock()
+	<-doneCh
+}
+
+func (this *SpeedStatus) pushEventJobNoLock(job eventJob) {
+	this.eventQueue = append(this.eventQueue, job)
+	if this.isDispatching == false {
+		this.isDispatching = true
+		go this.dispatchEvent()
+	}
+}
+
+// eventJob 等待调用回调的事件, 以及发送事件时已经注册的回调
+type eventJob struct {
+	event   DownloadEvent
+	showBar bool
+	fnList  []func(event DownloadEvent)
+}
+
+// dispatchEvent 按顺序调用排队的事件的回调, 队列为空时退出, 下载线程不会等待回调执行完
+func (this *SpeedStatus) dispatchEvent() {
+	for {
+		this.Locker.Lock()
+		if len(this.eventQueue) == 0 {
+			this.isDispatching = false
+			this.eventQueue = nil
+			this.Locker.Unlock()
+			return
+		}
+		job := this.eventQueue[0]
+		this.eventQueue[0] = eventJob{}
+		this.eventQueue = this.eventQueue[1:]
+		this.Locker.Unlock()
+
+		// 回调里可能会调用 GetStatus, 所以不能持有 this.Locker
+		if job.showBar {
+			this.consoleBar.OnEvent(job.event)
+		}
+		for _, fn := range job.fnList {
+			fn(job.event)
+		}
+	}
+}
+
+// consoleProgressBar 在控制台打印进度条
+type consoleProgressBar struct {
+	lastDraw time.Time
+}
+
+func (this *consoleProgressBar) OnEvent(event DownloadEvent) {
+	if event.Type != EventType_Progress || event.TotalCount <= 0 {
+		return
+	}
+	// 限制刷新频率, 但是开始、结束时一定要打印
+	now := time.Now()
+	if event.DoneCount != 0 && event.DoneCount != event.TotalCount && now.Sub(this.lastDraw) < 100*time.Millisecond {
+		return
+	}
+	this.lastDraw = now
+
+	proportion := float32(event.DoneCount) / float32(event.TotalCount)
+	if event.TotalBytes > 0 {
+		proportion = float32(event.Percent) / 100
+	}
+	width := 50
+	pos := int(proportion * float32(width))
+	fmt.Printf(event.Title+" %s%*s %6.2f%%\r", strings.Repeat("■", pos), width-pos, "", proportion*100)
+}
@@ -0,0 +1,112 @@
+package m3u8d
+
+import (
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDownloadEvent(t *testing.T) {
+	var locker sync.Mutex
+	var eventList []DownloadEvent
+
+	var env DownloadEnv
+	removeFn := env.AddEventListener(func(event DownloadEvent) {
+		locker.Lock()
+		eventList = append(eventList, event)
+		locker.Unlock()
+	})
+	ok := env.StartDownload(StartDownload_Req{
+		M3u8Url:     filepath.Join("testdata", "TestFull", "jhxy.01.m3u8"),
+		SaveDir:     t.TempDir(),
+		ThreadCount: 2,
+		TaskId:      "event",
+	})
+	if !ok {
+		t.Fatal("StartDownload failed")
+	}
+	status := env.WaitDownloadFinish()
+	removeFn()
+	if status.ErrMsg != "" {
+		t.Fatal(status.ErrMsg)
+	}
+
+	locker.Lock()
+	defer locker.Unlock()
+
+	var phaseList []string
+	countMap := map[string]int{}
+	for _, event := range eventList {
+		if event.TaskId != "event" || event.Time.IsZero() {
+			t.Fatal(event)
+		}
+		countMap[event.Type]++
+		if event.Type == EventType_Phase {
+			phaseList = append(phaseList, event.Phase)
+		}
+	}
+	if reflect.DeepEqual(phaseList, []string{Phase_Sniff, Phase_List, Phase_Download, Phase_Analyze, Phase_Merge}) == false {
+		t.Fatal(phaseList)
+	}
+	if countMap[EventType_TsStart] != 3 || countMap[EventType_TsFinish] != 3 || countMap[EventType_Progress] == 0 || countMap[EventType_Error] != 0 {
+		t.Fatal(countMap)
+	}
+	last := eventList[len(eventList)-1]
+	if last.Type != EventType_Finish || last.SaveFileTo != status.SaveFileTo {
+		t.Fatal(last)
+	}
+
+	for _, event := range eventList {
+		if event.Type == EventType_TsFinish && (event.TsIdx <= 0 || event.TsName == "" || event.Bytes <= 0) {
+			t.Fatal(event)
+		}
+	}
+}
+
+// 回调阻塞时不影响下载, 之后按顺序收到所有事件
+func TestDownloadEventBlockingListener(t *testing.T) {
+	release := make(chan struct{})
+	var locker sync.Mutex
+	var typeList []string
+
+	var env DownloadEnv
+	env.AddEventListener(func(event DownloadEvent) {
+		<-release
+		locker.Lock()
+		typeList = append(typeList, event.Type)
+		locker.Unlock()
+	})
+	ok := env.StartDownload(StartDownload_Req{
+		M3u8Url:     filepath.Join("testdata", "TestFull", "jhxy.01.m3u8"),
+		SaveDir:     t.TempDir(),
+		ThreadCount: 2,
+	})
+	if !ok {
+		t.Fatal("StartDownload failed")
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for env.GetStatus().IsDownloading {
+		if time.Now().After(deadline) {
+			t.Fatal("download blocked by listener")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	locker.Lock()
+	if len(typeList) != 0 {
+		t.Fatal(typeList)
+	}
+	locker.Unlock()
+
+	close(release)
+	status := env.WaitDownloadFinish()
+	if status.ErrMsg != "" {
+		t.Fatal(status.ErrMsg)
+	}
+	locker.Lock()
+	defer locker.Unlock()
+	if len(typeList) == 0 || typeList[0] != EventType_Phase || typeList[len(typeList)-1] != EventType_Finish {
+		t.Fatal(typeList)
+	}
+}
@@ -124,10 +124,26 @@ func CreateLibForQtUi(goarch string, buildmode string) {
 	})
 	ctx.Generate1(m3u8dcpp.StartDownload)
 	ctx.Generate1(m3u8dcpp.CloseOldEnv)
+	ctx.Generate1(m3u8dcpp.Pause)
+	ctx.Generate1(m3u8dcpp.Resume)
 	ctx.Generate1(m3u8dcpp.GetStatus)
+	ctx.Generate1(m3u8dcpp.GetSegmentList)
 	ctx.Generate1(m3u8dcpp.WaitDownloadFinish)
+	ctx.Generate1(m3u8dcpp.TaskSetMaxRunning)
+	ctx.Generate1(m3u8dcpp.TaskAdd)
+	ctx.Generate1(m3u8dcpp.TaskGetStatus)
+	ctx.Generate1(m3u8dcpp.TaskGetSegmentList)
+	ctx.Generate1(m3u8dcpp.TaskCancel)
+	ctx.Generate1(m3u8dcpp.TaskPause)
+	ctx.Generate1(m3u8dcpp.TaskResume)
+	ctx.Generate1(m3u8dcpp.TaskRemove)
+	ctx.Generate1(m3u8dcpp.TaskList)
+	ctx.Generate1(m3u8dcpp.TaskLoadStateFile)
+	ctx.Generate1(m3u8dcpp.TaskRetry)
+	ctx.Generate1(m3u8dcpp.TaskPurge)
 	ctx.Generate1(m3u8d.GetWd)
 	ctx.Generate1(m3u8d.ParseCurlStr)
+	ctx.Generate1(m3u8d.PlanDownload)
 	ctx.Generate1(m3u8d.RunDownload_Req_ToCurlStr)
 	ctx.Generate1(m3u8d.GetFileNameFromUrl)
 	ctx.Generate1(m3u8dcpp.MergeTsDir)
@@ -0,0 +1,218 @@
+package m3u8d
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/yapingcat/gomedia/go-mp4"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+type mp4FastStartBox struct {
+	boxType    string
+	offset     int64
+	size       int64
+	headerSize int
+	entryCount int // 只用于stco、co64
+}
+
+// Mp4FastStart 把mp4文件的moov移动到mdat前面, 网页上边下载边播放时不需要先读取文件末尾.
+//
+//	mdat通过临时文件逐段复制, 不全部读到内存里. moov已经在mdat前面(包括fmp4)时不修改文件
+func Mp4FastStart(mp4FileName string) error {
+	mp4Fd, err := os.Open(mp4FileName)
+	if err != nil {
+		return err
+	}
+	defer mp4Fd.Close()
+
+	var topList []mp4FastStartBox
+	err = mp4WalkBox(mp4Fd, func(box mp4.BasicBox, offset int64, headerSize int) (isEnter bool, err error) {
+		topList = append(topList, mp4FastStartBox{
+			boxType:    string(box.Type[:]),
+			offset:     offset,
+			size:       int64(box.Size),
+			headerSize: headerSize,
+		})
+		return false, nil
+	})
+	if err != nil {
+		return err
+	}
+	moovIdx, mdatIdx := -1, -1
+	for idx, one := range topList {
+		if one.boxType == "moov" && moovIdx == -1 {
+			moovIdx = idx
+		} else if one.boxType == "mdat" && mdatIdx == -1 {
+			mdatIdx = idx
+		}
+	}
+	if moovIdx == -1 {
+		return errors.New("mp4 moov not found")
+	}
+	if mdatIdx == -1 || moovIdx < mdatIdx {
+		return nil
+	}
+
+	moov := make([]byte, topList[moovIdx].size)
+	_, err = mp4Fd.ReadAt(moov, topList[moovIdx].offset)
+	if err != nil {
+		return err
+	}
+	// 第一个mdat以及后面的内容都向后移动moov的大小, stco转换为co64时moov会变大
+	newMoov, err := mp4ShiftChunkOffset(moov, uint64(len(moov)))
+	if err != nil {
+		return err
+	}
+	if len(newMoov) != len(moov) {
+		newMoov, err = mp4ShiftChunkOffset(moov, uint64(len(newMoov)))
+		if err != nil {
+			return err
+		}
+	}
+
+	tmpName := mp4FileName + ".faststart"
+	tmpFd, err := os.OpenFile(tmpName, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpName)
+	defer tmpFd.Close()
+	for idx, one := range topList {
+		if idx == mdatIdx {
+			_, err = tmpFd.Write(newMoov)
+			if err != nil {
+				return err
+			}
+		}
+		if idx == moovIdx {
+			continue
+		}
+		_, err = io.Copy(tmpFd, io.NewSectionReader(mp4Fd, one.offset, one.size))
+		if err != nil {
+			return err
+		}
+	}
+	err = tmpFd.Sync()
+	if err != nil {
+		return err
+	}
+	err = tmpFd.Close()
+	if err != nil {
+		return err
+	}
+	mp4Fd.Close()
+	return os.Rename(tmpName, mp4FileName)
+}
+
+// mp4ShiftChunkOffset 把moov里stco、co64记录的chunk偏移量都加上delta. 有偏移量超过32位时把所有的stco转换为co64, 同时修改上层box的大小
+func mp4ShiftChunkOffset(moov []byte, delta uint64) ([]byte, error) {
+	var containerList []mp4FastStartBox
+	var offsetBoxList []mp4FastStartBox
+	r := bytes.NewReader(moov)
+	err := mp4WalkBox(r, func(box mp4.BasicBox, offset int64, headerSize int) (isEnter bool, err error) {
+		one := mp4FastStartBox{
+			boxType:    string(box.Type[:]),
+			offset:     offset,
+			size:       int64(box.Size),
+			headerSize: headerSize,
+		}
+		if offset+one.size > int64(len(moov)) {
+			return false, errors.New("invalid mp4 box size " + one.boxType)
+		}
+		switch one.boxType {
+		case "moov", "trak", "mdia", "minf", "stbl":
+			containerList = append(containerList, one)
+			return true, nil
+		case "stco", "co64":
+			if one.size < int64(headerSize)+8 {
+				return false, errors.New("invalid mp4 " + one.boxType)
+			}
+			one.entryCount = int(binary.BigEndian.Uint32(moov[offset+int64(headerSize)+4:]))
+			entrySize := 4
+			if one.boxType == "co64" {
+				entrySize = 8
+			}
+			if int64(headerSize)+8+int64(one.entryCount*entrySize) > one.size {
+				return false, errors.New("invalid mp4 " + one.boxType)
+			}
+			offsetBoxList = append(offsetBoxList, one)
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var isCo64 bool
+	for _, one := range offsetBoxList {
+		if one.boxType != "stco" {
+			continue
+		}
+		for idx := 0; idx < one.entryCount; idx++ {
+			pos := one.offset + int64(one.headerSize) + 8 + int64(idx*4)
+			if uint64(binary.BigEndian.Uint32(moov[pos:]))+delta > math.MaxUint32 {
+				isCo64 = true
+			}
+		}
+	}
+
+	sort.Slice(offsetBoxList, func(i, j int) bool {
+		return offsetBoxList[i].offset < offsetBoxList[j].offset
+	})
+	var ret []byte
+	var lastPos int64
+	for _, one := range offsetBoxList {
+		ret = append(ret, moov[lastPos:one.offset]...)
+		lastPos = one.offset + one.size
+		body := moov[one.offset+int64(one.headerSize) : one.offset+one.size]
+		if one.boxType == "stco" && isCo64 {
+			newBody := make([]byte, 8+one.entryCount*8)
+			copy(newBody, body[:8])
+			for idx := 0; idx < one.entryCount; idx++ {
+				binary.BigEndian.PutUint64(newBody[8+idx*8:], uint64(binary.BigEndian.Uint32(body[8+idx*4:]))+delta)
+			}
+			ret = append(ret, makeMp4Box("co64", newBody)...)
+			continue
+		}
+		start := len(ret)
+		ret = append(ret, moov[one.offset:lastPos]...)
+		body = ret[start+one.headerSize:]
+		for idx := 0; idx < one.entryCount; idx++ {
+			if one.boxType == "co64" {
+				binary.BigEndian.PutUint64(body[8+idx*8:], binary.BigEndian.Uint64(body[8+idx*8:])+delta)
+			} else {
+				binary.BigEndian.PutUint32(body[8+idx*4:], binary.BigEndian.Uint32(body[8+idx*4:])+uint32(delta))
+			}
+		}
+	}
+	ret = append(ret, moov[lastPos:]...)
+	if isCo64 == false {
+		return ret, nil
+	}
+
+	// stco转换为co64后每项多4个字节, 修改包含它的容器的大小
+	getGrowth := func(begin int64, end int64) (growth int64) {
+		for _, one := range offsetBoxList {
+			if one.boxType == "stco" && one.offset >= begin && one.offset < end {
+				growth += int64(one.entryCount * 4)
+			}
+		}
+		return growth
+	}
+	for _, one := range containerList {
+		pos := one.offset + getGrowth(0, one.offset)
+		size := one.size + getGrowth(one.offset, one.offset+one.size)
+		if one.headerSize == 16 {
+			binary.BigEndian.PutUint64(ret[pos+8:], uint64(size))
+		} else if size > math.MaxUint32 {
+			return nil, errors.New("mp4 " + one.boxType + " too large")
+		} else {
+			binary.BigEndian.PutUint32(ret[pos:], uint32(size))
+		}
+	}
+	return ret, nil
+}
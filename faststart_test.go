@@ -0,0 +1,174 @@
+package m3u8d
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mp4ChunkOffsetForTest 读取所有trak的stco/co64
+func mp4ChunkOffsetForTest(t *testing.T, name string) (list []uint64) {
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var walk func(parent fmp4Box)
+	walk = func(parent fmp4Box) {
+		for _, box := range fmp4ReadChildren(f, parent) {
+			switch box.boxType {
+			case "trak", "mdia", "minf", "stbl":
+				walk(box)
+			case "stco", "co64":
+				body, err := fmp4ReadBody(f, box)
+				if err != nil {
+					t.Fatal(err)
+				}
+				count := int(binary.BigEndian.Uint32(body[4:8]))
+				for idx := 0; idx < count; idx++ {
+					if box.boxType == "co64" {
+						list = append(list, binary.BigEndian.Uint64(body[8+idx*8:]))
+					} else {
+						list = append(list, uint64(binary.BigEndian.Uint32(body[8+idx*4:])))
+					}
+				}
+			}
+		}
+	}
+	for _, box := range fmp4TopBoxListForTest(t, name) {
+		if box.boxType == "moov" {
+			walk(box)
+		}
+	}
+	return list
+}
+
+func TestMp4FastStart(t *testing.T) {
+	dir := t.TempDir()
+	var tsFileList []string
+	for _, name := range []string{"jhxy.016.ts", "jhxy.017.ts", "jhxy.018.ts"} {
+		tsFileList = append(tsFileList, filepath.Join("testdata", "TestFull", name))
+	}
+	normal := filepath.Join(dir, "normal.mp4")
+	err := MergeTsFileListToSingleMp4(MergeTsFileListToSingleMp4_Req{
+		TsFileList: tsFileList,
+		OutputMp4:  normal,
+		Ctx:        context.Background(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	origin, err := os.ReadFile(normal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	originOffsetList := mp4ChunkOffsetForTest(t, normal)
+	if len(originOffsetList) == 0 {
+		t.Fatal("no chunk")
+	}
+
+	checkTopBox := func(name string) {
+		var typeList []string
+		for _, box := range fmp4TopBoxListForTest(t, name) {
+			typeList = append(typeList, box.boxType)
+		}
+		if len(typeList) < 3 || typeList[0] != "ftyp" || typeList[len(typeList)-2] != "moov" || typeList[len(typeList)-1] != "mdat" {
+			t.Fatal(name, typeList)
+		}
+	}
+	fastStart := filepath.Join(dir, "faststart.mp4")
+	err = os.WriteFile(fastStart, origin, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Mp4FastStart(fastStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTopBox(fastStart)
+	content, err := os.ReadFile(fastStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(content) != len(origin) {
+		t.Fatal(len(content), len(origin))
+	}
+	offsetList := mp4ChunkOffsetForTest(t, fastStart)
+	if len(offsetList) != len(originOffsetList) {
+		t.Fatal(len(offsetList), len(originOffsetList))
+	}
+	for idx, offset := range offsetList {
+		originOffset := originOffsetList[idx]
+		if offset <= originOffset || bytes.Equal(content[offset:offset+16], origin[originOffset:originOffset+16]) == false {
+			t.Fatal(idx, offset, originOffset)
+		}
+	}
+	if mp4DurationMsForTest(t, fastStart) != mp4DurationMsForTest(t, normal) {
+		t.Fatal("duration changed")
+	}
+
+	mergeName := filepath.Join(dir, "merge.mp4")
+	err = MergeTsFileListToSingleMp4(MergeTsFileListToSingleMp4_Req{
+		TsFileList: tsFileList,
+		OutputMp4:  mergeName,
+		FastStart:  true,
+		Ctx:        context.Background(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTopBox(mergeName)
+
+	// 已经是faststart时不修改
+	err = Mp4FastStart(fastStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := os.ReadFile(fastStart)
+	if err != nil || bytes.Equal(again, content) == false {
+		t.Fatal("file changed", err)
+	}
+	fmp4 := filepath.Join(dir, "fmp4.mp4")
+	fmp4Content := mergeFmp4ForTest(t, tsFileList, fmp4, false)
+	err = Mp4FastStart(fmp4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err = os.ReadFile(fmp4)
+	if err != nil || bytes.Equal(again, fmp4Content) == false {
+		t.Fatal("fmp4 changed", err)
+	}
+
+	// 偏移量超过32位时stco转换为co64
+	var moov []byte
+	for _, box := range fmp4TopBoxListForTest(t, normal) {
+		if box.boxType == "moov" {
+			moov = origin[box.offset : box.offset+box.size]
+		}
+	}
+	const delta = uint64(1) << 32
+	newMoov, err := mp4ShiftChunkOffset(moov, delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(newMoov) != len(moov)+len(originOffsetList)*4 || int(binary.BigEndian.Uint32(newMoov)) != len(newMoov) {
+		t.Fatal(len(newMoov), len(moov))
+	}
+	co64Name := filepath.Join(dir, "co64.mp4")
+	err = os.WriteFile(co64Name, newMoov, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offsetList = mp4ChunkOffsetForTest(t, co64Name)
+	if len(offsetList) != len(originOffsetList) {
+		t.Fatal(len(offsetList), len(originOffsetList))
+	}
+	for idx, offset := range offsetList {
+		if offset != originOffsetList[idx]+delta {
+			t.Fatal(idx, offset, originOffsetList[idx])
+		}
+	}
+}
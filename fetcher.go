@@ -0,0 +1,202 @@
+package m3u8d
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Fetcher 获取m3u8、key、ts的内容, 按照url的scheme选择.
+//
+//	返回的 resp.Request 为实际请求的地址(例如跳转后的地址), 为nil时使用req
+type Fetcher interface {
+	Fetch(req *http.Request) (resp *http.Response, err error)
+}
+
+// RegisterFetcher 给这个DownloadEnv注册自定义scheme的Fetcher, 可以覆盖内置的 http、https、file、data, 不影响其它的DownloadEnv.
+//
+//	fetcher为nil时取消注册. 注册的scheme不受 getAllowSchemeMap 的限制
+func (this *DownloadEnv) RegisterFetcher(scheme string, fetcher Fetcher) {
+	this.fetcherLocker.Lock()
+	defer this.fetcherLocker.Unlock()
+
+	scheme = strings.ToLower(scheme)
+	if fetcher == nil {
+		delete(this.fetcherMap, scheme)
+		return
+	}
+	if this.fetcherMap == nil {
+		this.fetcherMap = map[string]Fetcher{}
+	}
+	this.fetcherMap[scheme] = fetcher
+}
+
+// getAllowSchemeMap 内置Fetcher允许的scheme, 类似ffmpeg的protocol_whitelist.
+//
+//	只有m3u8本身是本地文件时才允许file, 防止网络上的m3u8读取本机的文件
+func getAllowSchemeMap(m3u8Url string) map[string]bool {
+	ret := map[string]bool{
+		"http":  true,
+		"https": true,
+		"data":  true,
+	}
+	if urlObj, err := url.Parse(m3u8Url); err == nil && strings.EqualFold(urlObj.Scheme, "file") {
+		ret["file"] = true
+	}
+	return ret
+}
+
+// getFetcher 不支持或者不允许的scheme返回nil
+func (this *DownloadEnv) getFetcher(scheme string) Fetcher {
+	scheme = strings.ToLower(scheme)
+	this.fetcherLocker.RLock()
+	fetcher, ok := this.fetcherMap[scheme]
+	this.fetcherLocker.RUnlock()
+	if ok {
+		return fetcher
+	}
+	if this.allowSchemeMap[scheme] == false {
+		return nil
+	}
+	switch scheme {
+	case "http", "https":
+		return httpFetcher{client: this.nowClient}
+	case "file":
+		return fileFetcher{}
+	case "data":
+		return dataFetcher{}
+	}
+	return nil
+}
+
+type httpFetcher struct {
+	client *http.Client
+}
+
+func (this httpFetcher) Fetch(req *http.Request) (resp *http.Response, err error) {
+	return this.client.Do(req)
+}
+
+// fileFetcher 读取本地文件, 文件不存在时返回404, 方便使用 http.code=404 跳过ts
+type fileFetcher struct{}
+
+func (fileFetcher) Fetch(req *http.Request) (resp *http.Response, err error) {
+	file, err := os.Open(getFileUrlPath(req.URL))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return newFetcherResp(req, http.StatusNotFound, nil), nil
+		}
+		return nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if stat.IsDir() {
+		file.Close()
+		return newFetcherResp(req, http.StatusNotFound, nil), nil
+	}
+	resp = newFetcherResp(req, http.StatusOK, nil)
+	resp.Body = file
+	resp.ContentLength = stat.Size()
+	resp.Header.Set("Content-Length", strconv.FormatInt(stat.Size(), 10))
+	resp.Header.Set("Last-Modified", stat.ModTime().UTC().Format(http.TimeFormat))
+	return resp, nil
+}
+
+// dataFetcher 解析 data:[<mediatype>][;base64],<data>
+type dataFetcher struct{}
+
+func (dataFetcher) Fetch(req *http.Request) (resp *http.Response, err error) {
+	contentType, data, err := parseDataUrl(req.URL.String())
+	if err != nil {
+		return nil, err
+	}
+	resp = newFetcherResp(req, http.StatusOK, data)
+	resp.Header.Set("Content-Type", contentType)
+	return resp, nil
+}
+
+func parseDataUrl(urlS string) (contentType string, data []byte, err error) {
+	if len(urlS) < 5 || strings.EqualFold(urlS[:5], "data:") == false {
+		return "", nil, errors.New("invalid data url")
+	}
+	idx := strings.Index(urlS, ",")
+	if idx < 0 {
+		return "", nil, errors.New("invalid data url: missing ','")
+	}
+	contentType = urlS[5:idx]
+	body, err := url.PathUnescape(urlS[idx+1:])
+	if err != nil {
+		return "", nil, errors.New("invalid data url: " + err.Error())
+	}
+	if strings.HasSuffix(strings.ToLower(contentType), ";base64") {
+		contentType = contentType[:len(contentType)-len(";base64")]
+		body = strings.TrimRight(strings.Join(strings.Fields(body), ""), "=")
+		data, err = base64.RawStdEncoding.DecodeString(body)
+		if err != nil {
+			return "", nil, errors.New("invalid data url: " + err.Error())
+		}
+	} else {
+		data = []byte(body)
+	}
+	if contentType == "" {
+		contentType = "text/plain;charset=US-ASCII"
+	}
+	return contentType, data, nil
+}
+
+func newFetcherResp(req *http.Request, statusCode int, data []byte) *http.Response {
+	return &http.Response{
+		Status:        strconv.Itoa(statusCode) + " " + http.StatusText(statusCode),
+		StatusCode:    statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		Body:          io.NopCloser(bytes.NewReader(data)),
+		ContentLength: int64(len(data)),
+		Request:       req,
+	}
+}
+
+var gWindowsDriveRegexp = regexp.MustCompile(`^/[a-zA-Z]:`)
+
+// getFileUrlPath file:///C:/a.m3u8 => C:\a.m3u8, file://server/share/a.m3u8 => \\server\share\a.m3u8
+func getFileUrlPath(urlObj *url.URL) string {
+	p := urlObj.Path
+	if urlObj.Host != "" && urlObj.Host != "localhost" {
+		p = "//" + urlObj.Host + p
+	} else if gWindowsDriveRegexp.MatchString(p) {
+		p = p[1:]
+	}
+	return filepath.FromSlash(p)
+}
+
+// localPathToFileUrl 把本地存在的m3u8文件路径转换为file://地址, 这样m3u8里的相对地址会按照本地文件处理
+func localPathToFileUrl(s string) string {
+	if urlObj, err := url.Parse(s); err == nil && len(urlObj.Scheme) > 1 { // 排除windows的盘符
+		return s
+	}
+	if _, err := os.Stat(s); err != nil {
+		return s
+	}
+	absPath, err := filepath.Abs(s)
+	if err != nil {
+		return s
+	}
+	p := filepath.ToSlash(absPath)
+	if strings.HasPrefix(p, "/") == false {
+		p = "/" + p
+	}
+	return (&url.URL{Scheme: "file", Path: p}).String()
+}
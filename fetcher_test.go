@@ -0,0 +1,113 @@
+package m3u8d
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseDataUrl(t *testing.T) {
+	for _, one := range []struct {
+		urlS        string
+		contentType string
+		data        string
+	}{
+		{urlS: "data:,hello%20world", contentType: "text/plain;charset=US-ASCII", data: "hello world"},
+		{urlS: "data:application/octet-stream;base64,AAECAwQFBgcICQoLDA0ODw==", contentType: "application/octet-stream", data: "\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f"},
+		{urlS: "data:text/plain;BASE64,aGk", contentType: "text/plain", data: "hi"},
+	} {
+		contentType, data, err := parseDataUrl(one.urlS)
+		if err != nil || contentType != one.contentType || string(data) != one.data {
+			t.Fatal(one.urlS, contentType, string(data), err)
+		}
+	}
+	if _, _, err := parseDataUrl("data:text/plain"); err == nil {
+		t.Fatal("expect error")
+	}
+}
+
+func TestGetFileUrlPath(t *testing.T) {
+	for _, one := range []struct {
+		urlS   string
+		expect string
+	}{
+		{urlS: "file:///root/a%20b/index.m3u8", expect: "/root/a b/index.m3u8"},
+		{urlS: "file://localhost/root/index.m3u8", expect: "/root/index.m3u8"},
+		{urlS: "file:///C:/video/index.m3u8", expect: "C:/video/index.m3u8"},
+		{urlS: "file://server/share/index.m3u8", expect: "//server/share/index.m3u8"},
+	} {
+		urlObj, _ := url.Parse(one.urlS)
+		if p := getFileUrlPath(urlObj); p != filepath.FromSlash(one.expect) {
+			t.Fatal(one.urlS, p)
+		}
+	}
+}
+
+type testFetcher struct{}
+
+func (testFetcher) Fetch(req *http.Request) (resp *http.Response, err error) {
+	return newFetcherResp(req, http.StatusOK, []byte(req.URL.Opaque)), nil
+}
+
+func TestFetcher(t *testing.T) {
+	env := newTestDownloadEnv(t, StartDownload_Req{M3u8Url: "https://example.com/index.m3u8"}, http.Header{})
+	data, resp, err := env.doGetRequest("data:;base64,aGVsbG8=", false)
+	if err != nil || string(data) != "hello" || resp.StatusCode != http.StatusOK {
+		t.Fatal(string(data), err)
+	}
+	fileUrl := "file://" + filepath.ToSlash(t.TempDir()) + "/not_exists.ts"
+	// 网络上的m3u8不能读取本地文件
+	if _, _, err = env.doGetRequest(fileUrl, false); err == nil {
+		t.Fatal("expect error")
+	}
+	localEnv := newTestDownloadEnv(t, StartDownload_Req{M3u8Url: filepath.Join("testdata", "TestFull", "jhxy.01.m3u8")}, http.Header{})
+	_, resp, err = localEnv.doGetRequest(fileUrl, false)
+	if err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatal(err)
+	}
+	if _, _, err = env.doGetRequest("m3u8d:hello", false); err == nil {
+		t.Fatal("expect error")
+	}
+	env.RegisterFetcher("M3U8D", testFetcher{})
+	if data, _, err = env.doGetRequest("m3u8d:hello", false); err != nil || string(data) != "hello" {
+		t.Fatal(string(data), err)
+	}
+	// 只对注册的env生效
+	if _, _, err = localEnv.doGetRequest("m3u8d:hello", false); err == nil {
+		t.Fatal("expect error")
+	}
+	env.RegisterFetcher("m3u8d", nil)
+	if _, _, err = env.doGetRequest("m3u8d:hello", false); err == nil {
+		t.Fatal("expect error")
+	}
+}
+
+func TestLocalM3u8(t *testing.T) {
+	m3u8Path := filepath.Join("testdata", "TestFull", "jhxy.01.m3u8")
+	urlS := localPathToFileUrl(m3u8Path)
+	if strings.HasPrefix(urlS, "file:///") == false || strings.HasSuffix(urlS, "/testdata/TestFull/jhxy.01.m3u8") == false {
+		t.Fatal(urlS)
+	}
+	if localPathToFileUrl("https://example.com/index.m3u8") != "https://example.com/index.m3u8" {
+		t.Fatal("url changed")
+	}
+
+	saveDir := t.TempDir()
+	var env DownloadEnv
+	if env.StartDownload(StartDownload_Req{M3u8Url: m3u8Path, SaveDir: saveDir, ThreadCount: 2}) == false {
+		t.Fatal("StartDownload failed")
+	}
+	status := env.WaitDownloadFinish()
+	if status.ErrMsg != "" {
+		t.Fatal(status.ErrMsg)
+	}
+	if status.SaveFileTo != filepath.Join(saveDir, "jhxy.01.mp4") {
+		t.Fatal(status.SaveFileTo)
+	}
+	if _, err := os.Stat(status.SaveFileTo); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,411 @@
+package m3u8d
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+const (
+	fmp4TrackAudio = "soun"
+	fmp4TrackVideo = "vide"
+
+	fmp4AudioOnlyFragmentMs = 5000 // 只有音频时每个分片的时长
+)
+
+var errFmp4ResumeMismatch = errors.New("fmp4 resume mismatch")
+
+// 合并进度之前的ts已经删除, 不能重新合并
+var errFmp4CheckpointMismatch = errors.New("输出文件里的分片比合并进度少, 合并进度之前的ts已经删除, 无法继续合并")
+
+// mergeCheckpoint 合并fmp4的进度: TsFile 之前的ts都已经完整写入输出文件并同步到磁盘, 可以删除.
+//
+//	保存的是开始合并 TsFile 之前的状态, 继续合并时从 TsFile 开始, 已经写入文件的帧由 fmp4ResumeInfo.isWritten 跳过
+type mergeCheckpoint struct {
+	TsFile        string
+	FragmentCount uint32 // 保存进度时输出文件里的分片数
+	FragmentMs    uint64 // 只有音频时, 当前分片开始的时间. 继续合并时分片的位置和一次合并完成时相同
+	Rebaser       tsTimestampRebaserState
+	AudioSplitter tsAudioSplitterState
+}
+
+type fmp4TrackRange struct {
+	firstDts int64 // 第一个分片的第一个样本
+	lastDts  int64 // 最后一个完整分片的最后一个样本
+	isFirst  bool  // 已经检查过输入的第一个帧
+}
+
+// fmp4ResumeInfo 已经写入文件的完整分片
+type fmp4ResumeInfo struct {
+	fragmentCount uint32
+	trackMap      map[string]*fmp4TrackRange // fmp4Track* => 时间范围
+	trackIdMap    map[string]uint32          // fmp4Track* => 文件里的track id
+	isCheckpoint  bool                       // 从合并进度继续, 输入不是从第一个ts开始
+}
+
+// isWritten 继续合并时, 判断这个帧是否已经在文件里. 输入的第一个帧和文件里的不一致时返回 errFmp4ResumeMismatch
+func (this *fmp4ResumeInfo) isWritten(trackType string, dts uint64) (bool, error) {
+	if this == nil {
+		return false, nil
+	}
+	one, ok := this.trackMap[trackType]
+	if ok == false {
+		return false, nil
+	}
+	if one.isFirst == false && this.isCheckpoint == false {
+		one.isFirst = true
+		if int64(dts) != one.firstDts {
+			return false, errFmp4ResumeMismatch
+		}
+	}
+	return int64(dts) <= one.lastDts, nil
+}
+
+type fmp4Box struct {
+	boxType    string
+	offset     int64
+	headerSize int64
+	size       int64
+}
+
+func fmp4ReadBox(r io.ReaderAt, offset int64, end int64) (box fmp4Box, ok bool) {
+	var header [16]byte
+	if end-offset < 8 {
+		return box, false
+	}
+	if _, err := r.ReadAt(header[:8], offset); err != nil {
+		return box, false
+	}
+	box = fmp4Box{
+		boxType:    string(header[4:8]),
+		offset:     offset,
+		headerSize: 8,
+		size:       int64(binary.BigEndian.Uint32(header[:4])),
+	}
+	if box.size == 1 {
+		if end-offset < 16 {
+			return box, false
+		}
+		if _, err := r.ReadAt(header[8:16], offset+8); err != nil {
+			return box, false
+		}
+		box.headerSize = 16
+		box.size = int64(binary.BigEndian.Uint64(header[8:16]))
+	}
+	if box.size < box.headerSize || box.size > end-offset {
+		return box, false
+	}
+	return box, true
+}
+
+func fmp4ReadChildren(r io.ReaderAt, parent fmp4Box) (list []fmp4Box) {
+	end := parent.offset + parent.size
+	for offset := parent.offset + parent.headerSize; offset < end; {
+		box, ok := fmp4ReadBox(r, offset, end)
+		if ok == false {
+			break
+		}
+		list = append(list, box)
+		offset += box.size
+	}
+	return list
+}
+
+func fmp4ReadBody(r io.ReaderAt, box fmp4Box) ([]byte, error) {
+	body := make([]byte, box.size-box.headerSize)
+	_, err := r.ReadAt(body, box.offset+box.headerSize)
+	return body, err
+}
+
+// scanFmp4 找到完整的 ftyp、moov 以及后面成对出现的 moof+mdat, 返回最后一个完整分片结束的位置
+func scanFmp4(f *os.File) (info *fmp4ResumeInfo, validSize int64, err error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	fileSize := stat.Size()
+
+	var topList []fmp4Box
+	for offset := int64(0); offset < fileSize; {
+		box, ok := fmp4ReadBox(f, offset, fileSize)
+		if ok == false {
+			break
+		}
+		topList = append(topList, box)
+		offset += box.size
+	}
+	if len(topList) < 4 || topList[0].boxType != "ftyp" || topList[1].boxType != "moov" {
+		return nil, 0, nil
+	}
+	trackTypeMap, err := fmp4ReadTrackType(f, topList[1])
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info = &fmp4ResumeInfo{
+		trackMap:   map[string]*fmp4TrackRange{},
+		trackIdMap: map[string]uint32{},
+	}
+	for trackId, trackType := range trackTypeMap {
+		if _, ok := info.trackIdMap[trackType]; ok {
+			// 同一个类型有多个轨道(旧版本留下的空AAC轨道), 无法对应新的muxer的轨道, 重新合并
+			return nil, 0, nil
+		}
+		info.trackIdMap[trackType] = trackId
+	}
+	for idx := 2; idx+1 < len(topList); idx += 2 {
+		moof, mdat := topList[idx], topList[idx+1]
+		if moof.boxType != "moof" || mdat.boxType != "mdat" {
+			break
+		}
+		err = info.addFragment(f, moof, trackTypeMap)
+		if err != nil {
+			return nil, 0, err
+		}
+		validSize = mdat.offset + mdat.size
+	}
+	if info.fragmentCount == 0 {
+		return nil, 0, nil
+	}
+	return info, validSize, nil
+}
+
+// fmp4ReadTrackType track id => fmp4Track*
+func fmp4ReadTrackType(r io.ReaderAt, moov fmp4Box) (m map[uint32]string, err error) {
+	m = map[uint32]string{}
+	for _, trak := range fmp4ReadChildren(r, moov) {
+		if trak.boxType != "trak" {
+			continue
+		}
+		var trackId uint32
+		var handlerType string
+		for _, child := range fmp4ReadChildren(r, trak) {
+			switch child.boxType {
+			case "tkhd":
+				body, err := fmp4ReadBody(r, child)
+				if err != nil {
+					return nil, err
+				}
+				trackId = fmp4ParseTkhdTrackId(body)
+			case "mdia":
+				for _, hdlr := range fmp4ReadChildren(r, child) {
+					if hdlr.boxType != "hdlr" {
+						continue
+					}
+					body, err := fmp4ReadBody(r, hdlr)
+					if err != nil {
+						return nil, err
+					}
+					if len(body) >= 12 {
+						handlerType = string(body[8:12])
+					}
+				}
+			}
+		}
+		m[trackId] = handlerType
+	}
+	return m, nil
+}
+
+func fmp4ParseTkhdTrackId(body []byte) uint32 {
+	if len(body) >= 24 && body[0] == 1 {
+		return binary.BigEndian.Uint32(body[20:24])
+	} else if len(body) >= 16 {
+		return binary.BigEndian.Uint32(body[12:16])
+	}
+	return 0
+}
+
+func (this *fmp4ResumeInfo) addFragment(r io.ReaderAt, moof fmp4Box, trackTypeMap map[uint32]string) error {
+	for _, child := range fmp4ReadChildren(r, moof) {
+		body, err := fmp4ReadBody(r, child)
+		if err != nil {
+			return err
+		}
+		switch child.boxType {
+		case "mfhd":
+			if len(body) >= 8 {
+				this.fragmentCount = binary.BigEndian.Uint32(body[4:8])
+			}
+		case "traf":
+			err = this.addTraf(r, child, trackTypeMap)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (this *fmp4ResumeInfo) addTraf(r io.ReaderAt, traf fmp4Box, trackTypeMap map[uint32]string) error {
+	var trackType string
+	var defaultDuration uint32
+	var baseDts int64
+	var durationList []uint32
+	for _, child := range fmp4ReadChildren(r, traf) {
+		body, err := fmp4ReadBody(r, child)
+		if err != nil {
+			return err
+		}
+		if len(body) < 8 {
+			continue
+		}
+		flags := binary.BigEndian.Uint32(body[:4]) & 0xFFFFFF
+		switch child.boxType {
+		case "tfhd":
+			trackType = trackTypeMap[binary.BigEndian.Uint32(body[4:8])]
+			pos := 8
+			if flags&0x01 != 0 { // base-data-offset-present
+				pos += 8
+			}
+			if flags&0x02 != 0 { // sample-description-index-present
+				pos += 4
+			}
+			if flags&0x08 != 0 && len(body) >= pos+4 { // default-sample-duration-present
+				defaultDuration = binary.BigEndian.Uint32(body[pos : pos+4])
+			}
+		case "tfdt":
+			if body[0] == 1 && len(body) >= 12 {
+				baseDts = int64(binary.BigEndian.Uint64(body[4:12]))
+			} else {
+				baseDts = int64(binary.BigEndian.Uint32(body[4:8]))
+			}
+		case "trun":
+			sampleCount := int(binary.BigEndian.Uint32(body[4:8]))
+			pos := 8
+			if flags&0x01 != 0 { // data-offset-present
+				pos += 4
+			}
+			if flags&0x04 != 0 { // first-sample-flags-present
+				pos += 4
+			}
+			entrySize := 0
+			for _, one := range []uint32{0x100, 0x200, 0x400, 0x800} {
+				if flags&one != 0 {
+					entrySize += 4
+				}
+			}
+			for idx := 0; idx < sampleCount; idx++ {
+				if len(body) < pos+entrySize {
+					return errors.New("invalid trun")
+				}
+				duration := defaultDuration
+				if flags&0x100 != 0 { // sample-duration-present
+					duration = binary.BigEndian.Uint32(body[pos : pos+4])
+				}
+				durationList = append(durationList, duration)
+				pos += entrySize
+			}
+		}
+	}
+	if trackType == "" || len(durationList) == 0 {
+		return nil
+	}
+	one, ok := this.trackMap[trackType]
+	if ok == false {
+		one = &fmp4TrackRange{firstDts: baseDts}
+		this.trackMap[trackType] = one
+	}
+	// 最后一个样本的时长是估算的, 所以只累加前面的样本
+	one.lastDts = baseDts
+	for _, duration := range durationList[:len(durationList)-1] {
+		one.lastDts += int64(duration)
+	}
+	return nil
+}
+
+// prepareFmp4Resume 截断到最后一个完整的分片, 文件不是fmp4或者没有完整的分片时清空文件
+func prepareFmp4Resume(f *os.File) (info *fmp4ResumeInfo, err error) {
+	info, validSize, err := scanFmp4(f)
+	if err != nil {
+		return nil, err
+	}
+	err = f.Truncate(validSize)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Seek(validSize, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// fmp4ResumeWriter 继续合并时包装输出文件: 丢弃新的muxer写入的 ftyp、moov、mfra, moof的序号接着已有的分片, track id换成文件里的.
+//
+//	gomedia的muxer每次Write都从一个box的开头开始, 或者是mdat的内容, 所以按照box的大小就能找到每个box的开头
+type fmp4ResumeWriter struct {
+	file        *os.File
+	seqOffset   uint32
+	trackIdMap  map[uint32]uint32 // 新的muxer的track id => 文件里的track id
+	boxRemain   int64
+	isDiscarded bool
+}
+
+func newFmp4ResumeWriter(file *os.File, seqOffset uint32) *fmp4ResumeWriter {
+	return &fmp4ResumeWriter{
+		file:       file,
+		seqOffset:  seqOffset,
+		trackIdMap: map[uint32]uint32{},
+	}
+}
+
+func (this *fmp4ResumeWriter) Write(p []byte) (n int, err error) {
+	if this.boxRemain == 0 {
+		if len(p) < 8 {
+			return 0, errors.New("fmp4ResumeWriter: invalid box header")
+		}
+		this.boxRemain = int64(binary.BigEndian.Uint32(p[:4]))
+		if this.boxRemain == 1 && len(p) >= 16 {
+			this.boxRemain = int64(binary.BigEndian.Uint64(p[8:16]))
+		}
+		boxType := string(p[4:8])
+		this.isDiscarded = boxType == "ftyp" || boxType == "moov" || boxType == "mfra"
+		if boxType == "moof" && len(p) >= 24 && string(p[12:16]) == "mfhd" {
+			tmp := make([]byte, len(p))
+			copy(tmp, p)
+			seq := binary.BigEndian.Uint32(tmp[20:24])
+			binary.BigEndian.PutUint32(tmp[20:24], seq+this.seqOffset)
+			this.rewriteTrackId(tmp)
+			p = tmp
+		}
+	}
+	if int64(len(p)) > this.boxRemain {
+		return 0, errors.New("fmp4ResumeWriter: write across box")
+	}
+	this.boxRemain -= int64(len(p))
+	if this.isDiscarded {
+		return len(p), nil
+	}
+	return this.file.Write(p)
+}
+
+// rewriteTrackId 修改moof里每个traf的tfhd的track id
+func (this *fmp4ResumeWriter) rewriteTrackId(moof []byte) {
+	for offset := 8; offset+8 <= len(moof); {
+		size := int(binary.BigEndian.Uint32(moof[offset:]))
+		if size < 8 || offset+size > len(moof) {
+			return
+		}
+		if string(moof[offset+4:offset+8]) == "traf" {
+			for child := offset + 8; child+16 <= offset+size; {
+				childSize := int(binary.BigEndian.Uint32(moof[child:]))
+				if childSize < 8 {
+					break
+				}
+				if string(moof[child+4:child+8]) == "tfhd" {
+					if fileTid, ok := this.trackIdMap[binary.BigEndian.Uint32(moof[child+12:])]; ok {
+						binary.BigEndian.PutUint32(moof[child+12:], fileTid)
+					}
+				}
+				child += childSize
+			}
+		}
+		offset += size
+	}
+}
+
+func (this *fmp4ResumeWriter) Seek(offset int64, whence int) (int64, error) {
+	return this.file.Seek(offset, whence)
+}
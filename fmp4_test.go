@@ -0,0 +1,298 @@
+package m3u8d
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/yapingcat/gomedia/go-mpeg2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func mergeFmp4ForTest(t *testing.T, tsFileList []string, outputName string, resume bool) []byte {
+	err := MergeTsFileListToSingleMp4(MergeTsFileListToSingleMp4_Req{
+		TsFileList:   tsFileList,
+		OutputMp4:    outputName,
+		OutputFormat: OutputFormat_Fmp4,
+		Resume:       resume,
+		Ctx:          context.Background(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(outputName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func fmp4TopBoxListForTest(t *testing.T, name string) (list []fmp4Box) {
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for offset := int64(0); offset < stat.Size(); {
+		box, ok := fmp4ReadBox(f, offset, stat.Size())
+		if ok == false {
+			t.Fatal("invalid box", offset)
+		}
+		list = append(list, box)
+		offset += box.size
+	}
+	return list
+}
+
+func scanFmp4ForTest(t *testing.T, name string) (info *fmp4ResumeInfo, validSize int64) {
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	info, validSize, err = scanFmp4(f)
+	if err != nil || info == nil {
+		t.Fatal(err)
+	}
+	return info, validSize
+}
+
+func TestMergeToFmp4(t *testing.T) {
+	tsFileList, err := filepath.Glob("testdata/TestFull/*.ts")
+	if err != nil || len(tsFileList) == 0 {
+		t.Fatal(tsFileList, err)
+	}
+	dir := t.TempDir()
+	fullName := filepath.Join(dir, "full.mp4")
+	full := mergeFmp4ForTest(t, tsFileList, fullName, false)
+
+	boxList := fmp4TopBoxListForTest(t, fullName)
+	var typeList []string
+	for _, box := range boxList {
+		typeList = append(typeList, box.boxType)
+	}
+	if len(boxList) < 6 || typeList[0] != "ftyp" || typeList[1] != "moov" || typeList[len(typeList)-1] != "mfra" {
+		t.Fatal(typeList)
+	}
+	for idx := 2; idx < len(typeList)-1; idx += 2 {
+		if typeList[idx] != "moof" || typeList[idx+1] != "mdat" {
+			t.Fatal(typeList)
+		}
+	}
+
+	info, validSize := scanFmp4ForTest(t, fullName)
+	mfra := boxList[len(boxList)-1]
+	if validSize != mfra.offset || int(info.fragmentCount) != (len(boxList)-3)/2 {
+		t.Fatal(validSize, info.fragmentCount)
+	}
+	video, audio := info.trackMap[fmp4TrackVideo], info.trackMap[fmp4TrackAudio]
+	if video == nil || audio == nil || video.lastDts <= video.firstDts || audio.lastDts <= audio.firstDts {
+		t.Fatal(info.trackMap)
+	}
+
+	// 在第二个分片的mdat中间中断, 继续合并后保留第一个分片, 后面的分片和一次合并完成的文件时间、序号相同.
+	//	新的muxer会在第一个关键帧里保留sps/pps, 所以内容不完全相同; 继续合并时不写mfra
+	partName := filepath.Join(dir, "part.mp4")
+	secondMoof, secondMdat := boxList[4], boxList[5]
+	err = os.WriteFile(partName, full[:secondMdat.offset+secondMdat.size/2], 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumed := mergeFmp4ForTest(t, tsFileList, partName, true)
+	if bytes.Equal(resumed[:secondMoof.offset], full[:secondMoof.offset]) == false {
+		t.Fatal("first fragment changed")
+	}
+	resumedBoxList := fmp4TopBoxListForTest(t, partName)
+	if len(resumedBoxList) != len(boxList)-1 {
+		t.Fatal(len(resumedBoxList), len(boxList))
+	}
+	resumedInfo, resumedSize := scanFmp4ForTest(t, partName)
+	if resumedSize != int64(len(resumed)) || resumedInfo.fragmentCount != info.fragmentCount {
+		t.Fatal(resumedSize, resumedInfo.fragmentCount)
+	}
+	for trackType, one := range info.trackMap {
+		if *resumedInfo.trackMap[trackType] != *one {
+			t.Fatal(trackType, *resumedInfo.trackMap[trackType], *one)
+		}
+	}
+
+	// 不是这些ts合并出来的文件, 重新合并.
+	//	moov里有合并时的时间, gomedia写mfra时遍历map, track的顺序不固定, 所以只比较中间的分片
+	moov := boxList[1]
+	isSameAsFull := func(content []byte) bool {
+		begin := moov.offset + moov.size
+		return len(content) == len(full) && bytes.Equal(content[begin:mfra.offset], full[begin:mfra.offset])
+	}
+	otherName := filepath.Join(dir, "other.mp4")
+	mergeFmp4ForTest(t, tsFileList[1:], otherName, false)
+	other := mergeFmp4ForTest(t, tsFileList, otherName, true)
+	if isSameAsFull(other) == false {
+		t.Fatal(len(other), len(full))
+	}
+
+	// 不完整的文件, 重新合并
+	err = os.WriteFile(otherName, full[:100], 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other = mergeFmp4ForTest(t, tsFileList, otherName, true)
+	if isSameAsFull(other) == false {
+		t.Fatal(len(other), len(full))
+	}
+}
+
+func TestFmp4ResumeWriterTrackId(t *testing.T) {
+	// 新的muxer里音频是2、视频是1, 文件里相反
+	traf := func(trackId uint32) []byte {
+		tfhd := make([]byte, 8)
+		binary.BigEndian.PutUint32(tfhd[4:], trackId)
+		return makeMp4Box("traf", makeMp4Box("tfhd", tfhd))
+	}
+	mfhd := make([]byte, 8)
+	binary.BigEndian.PutUint32(mfhd[4:], 1)
+	moof := makeMp4Box("moof", append(append(makeMp4Box("mfhd", mfhd), traf(1)...), traf(2)...))
+
+	name := filepath.Join(t.TempDir(), "a.mp4")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := newFmp4ResumeWriter(f, 3)
+	w.trackIdMap[1] = 2
+	w.trackIdMap[2] = 1
+	_, err = w.Write(moof)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(content) != len(moof) || binary.BigEndian.Uint32(content[20:24]) != 4 {
+		t.Fatal(len(content), content[20:24])
+	}
+	// moof(8) + mfhd(16) + traf(8) + tfhd(8) + version/flags(4)
+	first, second := binary.BigEndian.Uint32(content[44:48]), binary.BigEndian.Uint32(content[44+24:48+24])
+	if first != 2 || second != 1 {
+		t.Fatal(first, second)
+	}
+}
+
+func TestMergeFmp4Checkpoint(t *testing.T) {
+	dir := t.TempDir()
+	// 只有音频时按照时长分片, 开始合并ts时 tsAudioSplitter 里还有上一个ts的最后一帧
+	mp3 := makeAudioFrameForTest([]byte{0xFF, 0xFB, 0x94, 0x44}, 384)
+	var mp3List []string
+	for idx := 0; idx < 3; idx++ {
+		name := filepath.Join(dir, "mp3-"+strconv.Itoa(idx)+".ts")
+		err := os.WriteFile(name, makeAudioTsForTest(t, mpeg2.TS_STREAM_AUDIO_MPEG1, mp3, 300, 24), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mp3List = append(mp3List, name)
+	}
+	videoList, err := filepath.Glob("testdata/TestFull/*.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for caseIdx, tsFileList := range [][]string{mp3List, videoList} {
+		fullName := filepath.Join(dir, strconv.Itoa(caseIdx)+"-full.mp4")
+		var checkpointList []mergeCheckpoint
+		_, err = MergeTsFileListToMultiFile(MergeTsFileListToSingleMp4_Req{
+			TsFileList:   tsFileList,
+			OutputMp4:    fullName,
+			OutputFormat: OutputFormat_Fmp4,
+			Ctx:          context.Background(),
+			onCheckpoint: func(checkpoint mergeCheckpoint) error {
+				checkpointList = append(checkpointList, checkpoint)
+				return nil
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(checkpointList) < 2 {
+			t.Fatal(caseIdx, len(checkpointList))
+		}
+		// 保存后面的合并进度之后中断, 文件里只有合并进度时的分片
+		data, err := json.Marshal(checkpointList[len(checkpointList)-1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		var checkpoint mergeCheckpoint
+		err = json.Unmarshal(data, &checkpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		boxList := fmp4TopBoxListForTest(t, fullName)
+		lastMdat := boxList[1+2*checkpoint.FragmentCount]
+		full, err := os.ReadFile(fullName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		partName := filepath.Join(dir, strconv.Itoa(caseIdx)+"-part.mp4")
+		err = os.WriteFile(partName, full[:lastMdat.offset+lastMdat.size], 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var startIdx int
+		for startIdx < len(tsFileList) && tsFileList[startIdx] != checkpoint.TsFile {
+			startIdx++
+		}
+		_, err = MergeTsFileListToMultiFile(MergeTsFileListToSingleMp4_Req{
+			TsFileList:   tsFileList[startIdx:],
+			OutputMp4:    partName,
+			OutputFormat: OutputFormat_Fmp4,
+			Ctx:          context.Background(),
+			checkpoint:   &checkpoint,
+		})
+		if err != nil {
+			t.Fatal(caseIdx, err)
+		}
+		info, _ := scanFmp4ForTest(t, fullName)
+		resumedInfo, _ := scanFmp4ForTest(t, partName)
+		if resumedInfo.fragmentCount != info.fragmentCount {
+			t.Fatal(caseIdx, resumedInfo.fragmentCount, info.fragmentCount)
+		}
+		for trackType, one := range info.trackMap {
+			if *resumedInfo.trackMap[trackType] != *one {
+				t.Fatal(caseIdx, trackType, *resumedInfo.trackMap[trackType], *one)
+			}
+		}
+		if caseIdx == 0 {
+			// 音频的分片内容相同
+			mfra := boxList[len(boxList)-1]
+			resumed, err := os.ReadFile(partName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Equal(resumed, full[:mfra.offset]) == false {
+				t.Fatal(len(resumed), mfra.offset)
+			}
+		}
+
+		// 输出文件里的分片比合并进度少时不能继续合并
+		err = os.WriteFile(partName, full[:boxList[2].offset], 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = MergeTsFileListToMultiFile(MergeTsFileListToSingleMp4_Req{
+			TsFileList:   tsFileList[startIdx:],
+			OutputMp4:    partName,
+			OutputFormat: OutputFormat_Fmp4,
+			Ctx:          context.Background(),
+			checkpoint:   &checkpoint,
+		})
+		if err != errFmp4CheckpointMismatch {
+			t.Fatal(caseIdx, err)
+		}
+	}
+}
@@ -9,7 +9,8 @@ require (
 	github.com/spf13/cobra v1.8.0
 	github.com/xiaoqidun/setft v0.0.0-20220310121541-be86327699ad
 	github.com/yapingcat/gomedia v0.0.0-20240823161909-e61bbaf17c9a
-	golang.org/x/text v0.3.3
+	golang.org/x/crypto v0.14.0
+	golang.org/x/text v0.13.0
 )
 
 require (
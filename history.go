@@ -0,0 +1,162 @@
+package m3u8d
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 下载历史, 保存在下载目录里. 再次下载同一个m3u8时, 如果之前的mp4还在, 则直接返回之前的mp4
+const downloadHistoryFileName = "m3u8d_history.json"
+
+type downloadHistoryFile struct {
+	List []downloadHistoryUnit
+}
+
+// downloadHistoryKey 同一个url使用不同的参数下载时是不同的文件
+type downloadHistoryKey struct {
+	M3u8Url      string // normalizeM3u8Url 处理后的url
+	TrackMode    string // 只保留音频或者视频
+	OutputFormat string
+	SplitMode    string
+	SplitValue   int // 只用于 SplitMode_Duration、SplitMode_Size
+}
+
+type downloadHistoryUnit struct {
+	downloadHistoryKey
+	FileList []downloadHistoryFileUnit // 所有输出文件, 分割时有多个
+	Time     string
+}
+
+type downloadHistoryFileUnit struct {
+	SaveFileTo string
+	Size       int64
+	Sha256     string
+}
+
+// newDownloadHistoryKey 使用 initRequest 处理过的参数
+func newDownloadHistoryKey(req StartDownload_Req) downloadHistoryKey {
+	key := downloadHistoryKey{
+		M3u8Url:      normalizeM3u8Url(req.M3u8Url),
+		TrackMode:    req.TrackMode,
+		OutputFormat: req.OutputFormat,
+		SplitMode:    req.SplitMode,
+	}
+	if key.SplitMode == SplitMode_Duration || key.SplitMode == SplitMode_Size {
+		key.SplitValue = req.SplitValue
+	}
+	return key
+}
+
+func (this downloadHistoryUnit) getSaveFileList() (list []string) {
+	for _, one := range this.FileList {
+		list = append(list, one.SaveFileTo)
+	}
+	return list
+}
+
+// 同一个进程里可能同时有多个任务写入同一个下载目录
+var gDownloadHistoryLocker sync.Mutex
+
+// normalizeM3u8Url 去掉url里不影响内容的差异: scheme、host大小写, 默认端口, 多余的路径分隔符, query顺序, fragment
+func normalizeM3u8Url(urlS string) string {
+	urlObj, err := url.Parse(strings.TrimSpace(urlS))
+	if err != nil {
+		return urlS
+	}
+	urlObj.Scheme = strings.ToLower(urlObj.Scheme)
+	urlObj.Host = strings.ToLower(urlObj.Host)
+	if (urlObj.Scheme == "http" && strings.HasSuffix(urlObj.Host, ":80")) || (urlObj.Scheme == "https" && strings.HasSuffix(urlObj.Host, ":443")) {
+		urlObj.Host = urlObj.Host[:strings.LastIndex(urlObj.Host, ":")]
+	}
+	if urlObj.Path != "" {
+		urlObj.Path = path.Clean(urlObj.Path)
+		urlObj.RawPath = ""
+	}
+	urlObj.RawQuery = urlObj.Query().Encode()
+	urlObj.Fragment = ""
+	return urlObj.String()
+}
+
+func readDownloadHistory(saveDir string) (file downloadHistoryFile) {
+	data, err := os.ReadFile(filepath.Join(saveDir, downloadHistoryFileName))
+	if err != nil {
+		return file
+	}
+	_ = json.Unmarshal(data, &file)
+	return file
+}
+
+// lookupDownloadHistory 查找下载历史, 只有之前保存的所有文件都还存在、大小没变时才返回
+func lookupDownloadHistory(saveDir string, key downloadHistoryKey) (unit downloadHistoryUnit, ok bool) {
+	gDownloadHistoryLocker.Lock()
+	defer gDownloadHistoryLocker.Unlock()
+
+	for _, one := range readDownloadHistory(saveDir).List {
+		if one.downloadHistoryKey != key || len(one.FileList) == 0 {
+			continue
+		}
+		isAllExists := true
+		for _, file := range one.FileList {
+			stat, err := os.Stat(file.SaveFileTo)
+			if err != nil || stat.Mode().IsRegular() == false || stat.Size() != file.Size {
+				isAllExists = false
+				break
+			}
+		}
+		if isAllExists {
+			return one, true
+		}
+	}
+	return unit, false
+}
+
+func addDownloadHistory(saveDir string, key downloadHistoryKey, saveFileList []string) error {
+	unit := downloadHistoryUnit{
+		downloadHistoryKey: key,
+		Time:               time.Now().Format(time.RFC3339),
+	}
+	for _, saveFileTo := range saveFileList {
+		stat, err := os.Stat(saveFileTo)
+		if err != nil {
+			return err
+		}
+		hash, err := getFileSha256(saveFileTo)
+		if err != nil {
+			return err
+		}
+		unit.FileList = append(unit.FileList, downloadHistoryFileUnit{
+			SaveFileTo: saveFileTo,
+			Size:       stat.Size(),
+			Sha256:     hash,
+		})
+	}
+
+	gDownloadHistoryLocker.Lock()
+	defer gDownloadHistoryLocker.Unlock()
+
+	file := readDownloadHistory(saveDir)
+	var list []downloadHistoryUnit
+	for _, one := range file.List {
+		// 同样的参数只保留最新的记录
+		if one.downloadHistoryKey != key {
+			list = append(list, one)
+		}
+	}
+	file.List = append(list, unit)
+	data, err := json.MarshalIndent(file, "", "\t")
+	if err != nil {
+		return err
+	}
+	historyPath := filepath.Join(saveDir, downloadHistoryFileName)
+	err = os.WriteFile(historyPath+".tmp", data, 0666)
+	if err != nil {
+		return err
+	}
+	return os.Rename(historyPath+".tmp", historyPath)
+}
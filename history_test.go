@@ -0,0 +1,89 @@
+package m3u8d
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNormalizeM3u8Url(t *testing.T) {
+	for _, one := range []struct {
+		in     string
+		expect string
+	}{
+		{in: "HTTPS://Example.COM:443/a//b/../index.m3u8?b=2&a=1#x", expect: "https://example.com/a/index.m3u8?a=1&b=2"},
+		{in: "http://example.com:80/index.m3u8", expect: "http://example.com/index.m3u8"},
+		{in: "http://example.com:8080/index.m3u8", expect: "http://example.com:8080/index.m3u8"},
+	} {
+		if after := normalizeM3u8Url(one.in); after != one.expect {
+			t.Fatal(one.in, after)
+		}
+	}
+}
+
+func TestDownloadHistory(t *testing.T) {
+	saveDir := t.TempDir()
+	mp4Path := filepath.Join(saveDir, "all.mp4")
+	err := os.WriteFile(mp4Path, []byte("mp4"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := StartDownload_Req{M3u8Url: "https://example.com/index.m3u8?a=1&b=2", OutputFormat: OutputFormat_Mp4}
+	err = addDownloadHistory(saveDir, newDownloadHistoryKey(req), []string{mp4Path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.M3u8Url = "https://EXAMPLE.com/index.m3u8?b=2&a=1"
+	unit, ok := lookupDownloadHistory(saveDir, newDownloadHistoryKey(req))
+	if !ok || len(unit.FileList) != 1 || unit.FileList[0].SaveFileTo != mp4Path || unit.FileList[0].Sha256 != getBytesSha256([]byte("mp4")) {
+		t.Fatal(unit)
+	}
+	for _, other := range []StartDownload_Req{
+		{M3u8Url: "https://example.com/index2.m3u8", OutputFormat: OutputFormat_Mp4},
+		{M3u8Url: req.M3u8Url, OutputFormat: OutputFormat_Mp4, TrackMode: TrackMode_Audio},
+		{M3u8Url: req.M3u8Url, OutputFormat: OutputFormat_Mkv},
+		{M3u8Url: req.M3u8Url, OutputFormat: OutputFormat_Mp4, SplitMode: SplitMode_Duration, SplitValue: 10},
+	} {
+		if _, ok = lookupDownloadHistory(saveDir, newDownloadHistoryKey(other)); ok {
+			t.Fatal("other request", other)
+		}
+	}
+	// discontinuity不使用SplitValue
+	if newDownloadHistoryKey(StartDownload_Req{SplitMode: SplitMode_Discontinuity, SplitValue: 3}).SplitValue != 0 {
+		t.Fatal("SplitValue")
+	}
+	err = os.Remove(mp4Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok = lookupDownloadHistory(saveDir, newDownloadHistoryKey(req)); ok {
+		t.Fatal("file removed")
+	}
+
+	// 分割的所有文件都还在时才跳过
+	req.SplitMode = SplitMode_Discontinuity
+	var partList []string
+	for idx := 1; idx <= 2; idx++ {
+		name := GetSplitOutputName(mp4Path, idx)
+		err = os.WriteFile(name, []byte("part"), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		partList = append(partList, name)
+	}
+	err = addDownloadHistory(saveDir, newDownloadHistoryKey(req), partList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unit, ok = lookupDownloadHistory(saveDir, newDownloadHistoryKey(req))
+	if !ok || len(unit.getSaveFileList()) != 2 || unit.getSaveFileList()[1] != partList[1] {
+		t.Fatal(unit)
+	}
+	err = os.Remove(partList[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok = lookupDownloadHistory(saveDir, newDownloadHistoryKey(req)); ok {
+		t.Fatal("part removed")
+	}
+}
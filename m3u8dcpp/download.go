@@ -14,10 +14,22 @@ func CloseOldEnv() {
 	gOldEnv.CloseEnv()
 }
 
+func Pause() bool {
+	return gOldEnv.Pause()
+}
+
+func Resume() bool {
+	return gOldEnv.Resume()
+}
+
 func GetStatus() (resp m3u8d.GetStatus_Resp) {
 	return gOldEnv.GetStatus()
 }
 
+func GetSegmentList() (list []m3u8d.SegmentInfo) {
+	return gOldEnv.GetSegmentList()
+}
+
 func WaitDownloadFinish() (resp m3u8d.GetStatus_Resp) {
 	return gOldEnv.WaitDownloadFinish()
 }
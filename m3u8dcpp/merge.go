@@ -62,6 +62,13 @@ func MergeTsDir(InputTsDir string, OutputMp4Name string, UseFirstTsMTime bool, S
 	} else if !filepath.IsAbs(OutputMp4Name) {
 		OutputMp4Name = filepath.Join(InputTsDir, OutputMp4Name)
 	}
+	// 根据扩展名选择格式, 例如 all.mkv
+	outputFormat := m3u8d.GetOutputFormatByName(OutputMp4Name)
+	tsFileList = m3u8d.ExcludeOutputFile(tsFileList, OutputMp4Name)
+	if len(tsFileList) == 0 {
+		resp.ErrMsg = "目录下不存在ts文件: " + InputTsDir
+		return
+	}
 	ctx, cancelFn := context.WithCancel(context.Background())
 	defer cancelFn()
 
@@ -84,13 +91,16 @@ func MergeTsDir(InputTsDir string, OutputMp4Name string, UseFirstTsMTime bool, S
 	gMergeStatus.SpeedResetTotalBlockCount(len(tsFileList))
 
 	err = m3u8d.MergeTsFileListToSingleMp4(m3u8d.MergeTsFileListToSingleMp4_Req{
-		TsFileList: tsFileList,
-		OutputMp4:  OutputMp4Name,
-		Ctx:        ctx,
-		Status:     &gMergeStatus,
+		TsFileList:   tsFileList,
+		OutputMp4:    OutputMp4Name,
+		OutputFormat: outputFormat,
+		// 界面上没有这个选项, 输出ts时总是修正, 合并后的文件可以连续播放
+		TsFixContinuity: true,
+		Ctx:             ctx,
+		Status:          &gMergeStatus,
 	})
 	if err == nil && UseFirstTsMTime {
-		err = m3u8d.UpdateMp4Time(tsFileList[0], OutputMp4Name)
+		err = m3u8d.UpdateOutputFileTime(tsFileList[0], OutputMp4Name, outputFormat)
 	}
 	if err != nil {
 		resp.ErrMsg = "合并错误: " + err.Error()
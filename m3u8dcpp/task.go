@@ -0,0 +1,62 @@
+package m3u8dcpp
+
+import (
+	"github.com/orestonce/m3u8d"
+)
+
+var gTaskManager = m3u8d.NewTaskManager(1)
+
+func TaskSetMaxRunning(maxRunning int) {
+	gTaskManager.SetMaxRunning(maxRunning)
+}
+
+func TaskAdd(req m3u8d.StartDownload_Req, priority int) (resp m3u8d.AddTask_Resp) {
+	return gTaskManager.AddTask(req, priority)
+}
+
+func TaskGetStatus(taskId string) (resp m3u8d.GetStatus_Resp) {
+	resp, _ = gTaskManager.GetStatus(taskId)
+	return resp
+}
+
+func TaskGetSegmentList(taskId string) (list []m3u8d.SegmentInfo) {
+	return gTaskManager.GetSegmentList(taskId)
+}
+
+func TaskCancel(taskId string) {
+	gTaskManager.CancelTask(taskId)
+}
+
+func TaskPause(taskId string) (errMsg string) {
+	return gTaskManager.PauseTask(taskId)
+}
+
+func TaskResume(taskId string) (errMsg string) {
+	return gTaskManager.ResumeTask(taskId)
+}
+
+func TaskRemove(taskId string) {
+	gTaskManager.RemoveTask(taskId)
+}
+
+func TaskList() (list []m3u8d.TaskStatus) {
+	return gTaskManager.ListTasks()
+}
+
+// TaskLoadStateFile 读取保存的任务列表, 并继续下载上次没有完成的任务
+func TaskLoadStateFile(path string) (errMsg string) {
+	errMsg = gTaskManager.LoadStateFile(path)
+	if errMsg != "" {
+		return errMsg
+	}
+	gTaskManager.ResumeQueued()
+	return ""
+}
+
+func TaskRetry(taskId string) (errMsg string) {
+	return gTaskManager.RetryTask(taskId)
+}
+
+func TaskPurge() (count int) {
+	return gTaskManager.PurgeTasks()
+}
@@ -7,119 +7,463 @@ import (
 	"github.com/yapingcat/gomedia/go-codec"
 	"github.com/yapingcat/gomedia/go-mp4"
 	"github.com/yapingcat/gomedia/go-mpeg2"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 )
 
+const (
+	OutputFormat_Mp4  = "mp4"
+	OutputFormat_Fmp4 = "fmp4" // 分片的mp4(moof/mdat), 合并过程中的文件也可以播放, 中断后可以继续合并
+	OutputFormat_Mkv  = "mkv"  // Matroska, 可以容纳中途变化的编码参数
+	OutputFormat_Ts   = "ts"   // 直接拼接ts文件, 不修改时间戳
+)
+
+const (
+	TrackMode_All   = ""      // 保留音频和视频
+	TrackMode_Audio = "audio" // 只保留音频, mp4/fmp4的扩展名为m4a, mkv为mka
+	TrackMode_Video = "video" // 只保留视频
+)
+
+// ParseOutputFormat 检查输出格式, 空字符串为mp4
+func ParseOutputFormat(format string) (ret string, errMsg string) {
+	switch strings.ToLower(strings.TrimSpace(format)) {
+	case "", OutputFormat_Mp4:
+		return OutputFormat_Mp4, ""
+	case OutputFormat_Fmp4:
+		return OutputFormat_Fmp4, ""
+	case OutputFormat_Mkv:
+		return OutputFormat_Mkv, ""
+	case OutputFormat_Ts:
+		return OutputFormat_Ts, ""
+	}
+	return "", "不支持的输出格式 " + strconv.Quote(format)
+}
+
+// GetOutputFormatExt 输出文件的扩展名, 不包括"."
+func GetOutputFormatExt(format string) string {
+	switch format {
+	case OutputFormat_Mkv:
+		return "mkv"
+	case OutputFormat_Ts:
+		return "ts"
+	}
+	return "mp4"
+}
+
+// ParseTrackMode 检查保留的轨道, 输出为ts时不解封装, 只支持 TrackMode_All
+func ParseTrackMode(mode string, format string) (ret string, errMsg string) {
+	switch ret = strings.ToLower(strings.TrimSpace(mode)); ret {
+	case TrackMode_All:
+		return ret, ""
+	case TrackMode_Audio, TrackMode_Video:
+		if format == OutputFormat_Ts {
+			return "", "输出格式为ts时不支持只保留音频或者视频"
+		}
+		return ret, ""
+	}
+	return "", "不支持的轨道选择 " + strconv.Quote(mode)
+}
+
+// GetOutputFileExt 同 GetOutputFormatExt, 只保留音频时为m4a、mka
+func GetOutputFileExt(format string, trackMode string) string {
+	if trackMode == TrackMode_Audio {
+		switch format {
+		case OutputFormat_Mp4, OutputFormat_Fmp4:
+			return "m4a"
+		case OutputFormat_Mkv:
+			return "mka"
+		}
+	}
+	return GetOutputFormatExt(format)
+}
+
+// GetOutputFormatByName 根据输出文件的扩展名判断格式, 未知的扩展名为mp4
+func GetOutputFormatByName(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case "." + OutputFormat_Mkv, ".mka":
+		return OutputFormat_Mkv
+	case "." + OutputFormat_Ts:
+		return OutputFormat_Ts
+	}
+	return OutputFormat_Mp4
+}
+
 type MergeTsFileListToSingleMp4_Req struct {
-	TsFileList []string
-	OutputMp4  string
-	Status     *SpeedStatus
-	Ctx        context.Context
+	TsFileList       []string
+	OutputMp4        string
+	OutputFormat     string               // OutputFormat_*, 默认为mp4
+	Resume           bool                 // 只对fmp4有效: 输出文件已存在时保留完整的分片, 从中断的位置继续合并
+	TsFixContinuity  bool                 // 只对ts有效: 重写连续计数器, 在不是以PAT开头的ts文件(例如#EXT-X-DISCONTINUITY之后)前面插入PAT/PMT
+	TsFileCh         <-chan string        // 不为nil时忽略TsFileList, 按顺序合并从channel收到的ts文件, channel关闭时结束. 不支持Resume, 只能从 checkpoint 继续
+	DiscontinuityMap map[string]int       // ts文件 => mformat.TsInfo.Idx_EXT_X_DISCONTINUITY, 编号变化的位置重新计算时间戳. 不在map里的ts只根据时间戳的跳变判断
+	SplitMode        string               // SplitMode_*, 为空时不分割. 分割时不支持Resume
+	SplitValue       int                  // SplitMode_Duration: 分钟; SplitMode_Size: MB
+	SplitOutputName  func(idx int) string // 分割时第idx(从1开始)个文件的名字, 为nil时使用 GetSplitOutputName(OutputMp4, idx)
+	TrackMode        string               // TrackMode_*, 默认保留音频和视频
+	FastStart        bool                 // 只对mp4有效: 合并完成后把moov移动到mdat前面, 网页上可以边下载边播放
+	Status           *SpeedStatus
+	Ctx              context.Context
+
+	// 边下载边合并时删除ts用到的合并进度, 只支持不分割的fmp4
+	checkpoint   *mergeCheckpoint                       // 不为nil时从合并进度继续: 保留输出文件里的分片, TsFileList/TsFileCh 从 checkpoint.TsFile 开始
+	onCheckpoint func(checkpoint mergeCheckpoint) error // 新的分片同步到磁盘后调用, checkpoint.TsFile 之前的ts已经完整写入输出文件
+}
+
+// mergeWriter 把ts解封装出来的帧写入不同格式的文件
+type mergeWriter interface {
+	WriteFrame(cid mpeg2.TS_STREAM_TYPE, frame []byte, pts uint64, dts uint64) error
+	WriteTrailer() error
 }
 
 func MergeTsFileListToSingleMp4(req MergeTsFileListToSingleMp4_Req) (err error) {
-	mp4file, err := os.OpenFile(req.OutputMp4, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+	_, err = MergeTsFileListToMultiFile(req)
+	return err
+}
+
+// MergeTsFileListToMultiFile 合并ts文件, 返回输出的文件列表. 不分割时只有 OutputMp4
+func MergeTsFileListToMultiFile(req MergeTsFileListToSingleMp4_Req) (outputList []string, err error) {
+	format, errMsg := ParseOutputFormat(req.OutputFormat)
+	if errMsg != "" {
+		return nil, errors.New(errMsg)
+	}
+	req.SplitMode, errMsg = ParseSplitMode(req.SplitMode, req.SplitValue)
+	if errMsg != "" {
+		return nil, errors.New(errMsg)
+	}
+	req.TrackMode, errMsg = ParseTrackMode(req.TrackMode, format)
+	if errMsg != "" {
+		return nil, errors.New(errMsg)
+	}
+	if req.checkpoint != nil || req.onCheckpoint != nil {
+		if format != OutputFormat_Fmp4 || req.SplitMode != "" {
+			return nil, errors.New("合并进度只支持不分割的fmp4")
+		}
+	}
+	if req.checkpoint != nil {
+		req.Resume = true
+	} else if req.TsFileCh != nil || req.SplitMode != "" {
+		// 继续合并失败时需要重新读取已经收到的ts; 分割时每个文件都重新合并
+		req.Resume = false
+	}
+	outputList, err = mergeTsFileList(req, format)
+	if err == errFmp4ResumeMismatch && req.checkpoint == nil {
+		// 已有的文件不是这些ts合并出来的, 重新合并
+		req.Resume = false
+		outputList, err = mergeTsFileList(req, format)
+	}
+	return outputList, err
+}
+
+func mergeTsFileList(req MergeTsFileListToSingleMp4_Req, format string) (outputList []string, err error) {
+	output := newMergeOutput(req, format, req.Resume && format == OutputFormat_Fmp4)
+	defer output.close()
+	err = output.open()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer mp4file.Close()
 
 	if req.Status != nil {
 		req.Status.SpeedResetBytes()
 	}
 
-	muxer, err := mp4.CreateMp4Muxer(mp4file)
-	if err != nil {
-		return err
-	}
-	var vtid uint32 // video track id
-	atid := muxer.AddAudioTrack(mp4.MP4_CODEC_AAC)
-
-	demuxer := mpeg2.NewTSDemuxer()
-	var OnFrameErr error
-	var audioTimestamp uint64 = 0
-	aacSampleRate := -1
-	demuxer.OnFrame = func(cid mpeg2.TS_STREAM_TYPE, frame []byte, pts uint64, dts uint64) {
-		if OnFrameErr != nil {
-			return
-		}
-		if cid == mpeg2.TS_STREAM_AAC {
-			audioTimestamp = pts
-			codec.SplitAACFrame(frame, func(aac []byte) {
-				if aacSampleRate == -1 {
-					adts := codec.NewAdtsFrameHeader()
-					adts.Decode(aac)
-					aacSampleRate = codec.AACSampleIdxToSample(int(adts.Fix_Header.Sampling_frequency_index))
-				}
-				err = muxer.Write(atid, aac, audioTimestamp, audioTimestamp)
-				audioTimestamp += uint64(1024 * 1000 / aacSampleRate) //每帧aac采样固定为1024。aac_sampleRate 为采样率
-				if err != nil {
-					OnFrameErr = err
-					return
-				}
-			})
-		} else if cid == mpeg2.TS_STREAM_H264 || cid == mpeg2.TS_STREAM_H265 {
-			if vtid == 0 {
-				switch cid {
-				case mpeg2.TS_STREAM_H264:
-					vtid = muxer.AddVideoTrack(mp4.MP4_CODEC_H264)
-				case mpeg2.TS_STREAM_H265:
-					vtid = muxer.AddVideoTrack(mp4.MP4_CODEC_H265)
-				default:
-					OnFrameErr = errors.New("unknown cid2 " + strconv.Itoa(int(cid)))
-					return
-				}
-			}
-			err = muxer.Write(vtid, frame, pts, dts)
-			if err != nil {
-				OnFrameErr = err
+	if format == OutputFormat_Ts {
+		err = concatTsFileList(req, output)
+	} else {
+		demuxer := newTsDemuxer()
+		rebaser := newTsTimestampRebaser()
+		var OnFrameErr error
+		// 从合并进度继续时, 输出文件里已经有帧
+		hasFrame := req.checkpoint != nil
+		if req.checkpoint != nil {
+			rebaser.loadState(req.checkpoint.Rebaser)
+		}
+		demuxer.OnFrame = func(cid mpeg2.TS_STREAM_TYPE, frame []byte, pts uint64, dts uint64) {
+			if OnFrameErr != nil {
 				return
 			}
-		} else {
-			OnFrameErr = errors.New("unknown cid " + strconv.Itoa(int(cid)))
-			return
+			if req.TrackMode != TrackMode_All && isTsVideoStream(cid) != (req.TrackMode == TrackMode_Video) {
+				return
+			}
+			hasFrame = true
+			pts, dts = rebaser.rebase(cid, pts, dts)
+			OnFrameErr = output.WriteFrame(cid, frame, pts, dts)
+			if OnFrameErr == nil && req.onCheckpoint != nil {
+				OnFrameErr = output.saveCheckpoint()
+			}
+		}
+
+		err = req.forEachTsFile(func(tsFile string, buf []byte) error {
+			if req.onCheckpoint != nil {
+				output.beginCheckpoint(tsFile, rebaser)
+			}
+			if idx, ok := req.DiscontinuityMap[tsFile]; ok {
+				rebaser.setDiscontinuityIdx(idx)
+			}
+			err := output.beforeTsFile(tsFile, buf)
+			if err != nil {
+				return err
+			}
+			err = demuxer.Input(bytes.NewReader(buf))
+			if err != nil {
+				return err
+			}
+			return OnFrameErr
+		})
+		if err == nil && hasFrame == false && req.TrackMode != TrackMode_All {
+			err = errors.New("ts文件里没有需要保留的轨道: " + req.TrackMode)
 		}
 	}
+	if err != nil {
+		return nil, err
+	}
 
+	err = output.finish()
+	if err != nil {
+		return nil, err
+	}
 	if req.Status != nil {
+		req.Status.DrawProgressBar(1, 1)
+	}
+	return output.outputList, nil
+}
+
+func isTsVideoStream(cid mpeg2.TS_STREAM_TYPE) bool {
+	return cid == mpeg2.TS_STREAM_H264 || cid == mpeg2.TS_STREAM_H265
+}
+
+// forEachTsFile 按顺序读取需要合并的ts文件, 交给fn处理
+func (req MergeTsFileListToSingleMp4_Req) forEachTsFile(fn func(tsFile string, buf []byte) error) error {
+	if req.Status != nil && req.TsFileCh == nil {
 		req.Status.SpeedResetTotalBlockCount(len(req.TsFileList))
 	}
-	for _, tsFile := range req.TsFileList {
-		select {
-		case <-req.Ctx.Done():
-			return req.Ctx.Err()
-		default:
+	for idx := 0; ; idx++ {
+		var tsFile string
+		if req.TsFileCh != nil {
+			var ok bool
+			select {
+			case <-req.Ctx.Done():
+				return req.Ctx.Err()
+			case tsFile, ok = <-req.TsFileCh:
+			}
+			if ok == false {
+				return nil
+			}
+		} else if idx < len(req.TsFileList) {
+			select {
+			case <-req.Ctx.Done():
+				return req.Ctx.Err()
+			default:
+			}
+			tsFile = req.TsFileList[idx]
+		} else {
+			return nil
 		}
-		var buf []byte
-		buf, err = ioutil.ReadFile(tsFile)
+		buf, err := ioutil.ReadFile(tsFile)
 		if err != nil {
 			return err
 		}
-		err = demuxer.Input(bytes.NewReader(buf))
+		err = fn(tsFile, buf)
 		if err != nil {
 			return err
 		}
-		if OnFrameErr != nil {
-			return OnFrameErr
-		}
 		if req.Status != nil {
 			req.Status.SpeedAdd1Block(time.Now(), len(buf))
 		}
 	}
+}
+
+type mp4MergeWriter struct {
+	muxer           *mp4.Movmuxer
+	entryWriter     *mp4SampleEntryWriter
+	vtid            uint32 // video track id
+	atid            uint32
+	otid            uint32 // mpeg音频/AC-3/E-AC-3的track id
+	otherCid        mpeg2.TS_STREAM_TYPE
+	audioSplitter   tsAudioSplitter
+	audioTimestamp  uint64
+	aacSampleRate   int
+	isFragment      bool
+	fragmentMs      uint64 // 只有音频时, 当前分片开始的时间
+	hasFragmentData bool
+	fragmentCount   uint32 // 输出文件里的分片数, 包括继续合并之前的
+	resume          *fmp4ResumeInfo
+	resumeWriter    *fmp4ResumeWriter
+}
 
-	err = muxer.WriteTrailer()
+// newMp4MergeWriter isFragment为true时写入fmp4, 每个视频关键帧开始一个新的分片. resume不为nil时跳过已经写入的帧
+func newMp4MergeWriter(mp4file *os.File, isFragment bool, resume *fmp4ResumeInfo) (*mp4MergeWriter, error) {
+	var w io.WriteSeeker = mp4file
+	var options []mp4.MuxerOption
+	if isFragment {
+		options = append(options, mp4.WithMp4Flag(mp4.MP4_FLAG_FRAGMENT))
+	}
+	var resumeWriter *fmp4ResumeWriter
+	if resume != nil {
+		resumeWriter = newFmp4ResumeWriter(mp4file, resume.fragmentCount)
+		w = resumeWriter
+	}
+	entryWriter := newMp4SampleEntryWriter(w)
+	muxer, err := mp4.CreateMp4Muxer(entryWriter, options...)
 	if err != nil {
+		return nil, err
+	}
+	this := &mp4MergeWriter{
+		muxer:         muxer,
+		entryWriter:   entryWriter,
+		aacSampleRate: -1,
+		isFragment:    isFragment,
+		resume:        resume,
+		resumeWriter:  resumeWriter,
+	}
+	if resume != nil {
+		this.fragmentCount = resume.fragmentCount
+	}
+	// 有视频时muxer在关键帧的位置写入分片, 只有音频时由 checkAudioFragment 写入
+	muxer.OnNewFragment(func(duration uint32, firstPts, firstDts uint64) {
+		this.fragmentCount++
+	})
+	return this, nil
+}
+
+// addTrack 收到轨道的第一帧时创建轨道, 没有的轨道不会在moov里留下空的trak.
+//
+//	继续合并时新的muxer按照帧出现的顺序分配track id, 写入moof时换成文件里相同类型(fmp4Track*)的轨道, 文件里没有这个类型时返回 errFmp4ResumeMismatch
+func (this *mp4MergeWriter) addTrack(trackType string, cid mp4.MP4_CODEC_TYPE, options ...mp4.TrackOption) (tid uint32, err error) {
+	if trackType == fmp4TrackVideo {
+		tid = this.muxer.AddVideoTrack(cid, options...)
+	} else {
+		tid = this.muxer.AddAudioTrack(cid, options...)
+	}
+	if this.resume != nil {
+		fileTid, ok := this.resume.trackIdMap[trackType]
+		if ok == false {
+			return 0, errFmp4ResumeMismatch
+		}
+		this.resumeWriter.trackIdMap[tid] = fileTid
+	}
+	return tid, nil
+}
+
+func (this *mp4MergeWriter) WriteFrame(cid mpeg2.TS_STREAM_TYPE, frame []byte, pts uint64, dts uint64) (err error) {
+	if cid == mpeg2.TS_STREAM_AAC {
+		if this.atid == 0 {
+			this.atid, err = this.addTrack(fmp4TrackAudio, mp4.MP4_CODEC_AAC)
+			if err != nil {
+				return err
+			}
+		}
+		this.audioTimestamp = pts
+		codec.SplitAACFrame(frame, func(aac []byte) {
+			if err != nil {
+				return
+			}
+			if this.aacSampleRate == -1 {
+				adts := codec.NewAdtsFrameHeader()
+				adts.Decode(aac)
+				this.aacSampleRate = codec.AACSampleIdxToSample(int(adts.Fix_Header.Sampling_frequency_index))
+			}
+			var isSkip bool
+			isSkip, err = this.resume.isWritten(fmp4TrackAudio, this.audioTimestamp)
+			if err == nil && isSkip == false {
+				err = this.muxer.Write(this.atid, aac, this.audioTimestamp, this.audioTimestamp)
+				this.hasFragmentData = true
+			}
+			this.audioTimestamp += uint64(1024 * 1000 / this.aacSampleRate) //每帧aac采样固定为1024。aac_sampleRate 为采样率
+		})
+		if err != nil {
+			return err
+		}
+		return this.checkAudioFragment()
+	} else if cid == mpeg2.TS_STREAM_AUDIO_MPEG1 || cid == mpeg2.TS_STREAM_AUDIO_MPEG2 || cid == tsStreamAc3 || cid == tsStreamEac3 {
+		err = this.audioSplitter.input(cid, frame, pts, this.writeOtherAudio)
+		if err != nil {
+			return err
+		}
+		return this.checkAudioFragment()
+	} else if isTsVideoStream(cid) {
+		if this.vtid == 0 {
+			switch cid {
+			case mpeg2.TS_STREAM_H264:
+				this.vtid, err = this.addTrack(fmp4TrackVideo, mp4.MP4_CODEC_H264)
+			case mpeg2.TS_STREAM_H265:
+				this.vtid, err = this.addTrack(fmp4TrackVideo, mp4.MP4_CODEC_H265)
+			default:
+				return errors.New("unknown cid2 " + strconv.Itoa(int(cid)))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		isSkip, err := this.resume.isWritten(fmp4TrackVideo, dts)
+		if err != nil || isSkip {
+			return err
+		}
+		return this.muxer.Write(this.vtid, frame, pts, dts)
+	}
+	return errors.New("unknown cid " + strconv.Itoa(int(cid)))
+}
+
+// checkAudioFragment 没有视频时不会按照关键帧分片, 按照时长分片
+func (this *mp4MergeWriter) checkAudioFragment() (err error) {
+	if this.isFragment && this.vtid == 0 && this.audioTimestamp-this.fragmentMs >= fmp4AudioOnlyFragmentMs {
+		if this.fragmentMs > 0 && this.hasFragmentData {
+			err = this.muxer.FlushFragment()
+			this.hasFragmentData = false
+			this.fragmentCount++
+		}
+		this.fragmentMs = this.audioTimestamp
+	}
+	return err
+}
+
+// writeOtherAudio 写入mpeg音频/AC-3/E-AC-3的一个样本.
+//
+//	mpeg音频使用gomedia的mp4a+esds; gomedia不支持AC-3/E-AC-3, 按照G711原样写入, 样本描述由 mp4SampleEntryWriter 替换
+func (this *mp4MergeWriter) writeOtherAudio(header tsAudioHeader, sample []byte, pts uint64) error {
+	if this.otid == 0 {
+		// esds的objectType: MP4_CODEC_MP2 为MPEG-1音频(0x6B), MP4_CODEC_MP3 为MPEG-2音频(0x69).
+		// 设置了采样率时gomedia不会再根据第一帧修改codec
+		mp4Cid := mp4.MP4_CODEC_MP3
+		if header.mpegVersion == 1 {
+			mp4Cid = mp4.MP4_CODEC_MP2
+		}
+		if header.cid == tsStreamAc3 || header.cid == tsStreamEac3 {
+			mp4Cid = mp4.MP4_CODEC_G711A
+		}
+		var err error
+		this.otid, err = this.addTrack(fmp4TrackAudio, mp4Cid,
+			mp4.WithAudioSampleRate(uint32(header.sampleRate)),
+			mp4.WithAudioChannelCount(uint8(header.channels)),
+			mp4.WithAudioSampleBits(16),
+		)
+		if err != nil {
+			return err
+		}
+		this.otherCid = header.cid
+		if mp4Cid == mp4.MP4_CODEC_G711A {
+			this.entryWriter.entryMap[this.otid] = makeMp4Ac3SampleEntry(header)
+		}
+	} else if header.cid != this.otherCid {
+		return errors.New("mp4 audio codec changed " + getTsCodecName(header.cid, sample))
+	}
+	this.audioTimestamp = pts
+	isSkip, err := this.resume.isWritten(fmp4TrackAudio, pts)
+	if err != nil || isSkip {
 		return err
 	}
-	err = mp4file.Sync()
+	this.hasFragmentData = true
+	return this.muxer.Write(this.otid, sample, pts, pts)
+}
+
+func (this *mp4MergeWriter) WriteTrailer() error {
+	err := this.audioSplitter.flush(this.writeOtherAudio)
 	if err != nil {
 		return err
 	}
-	if req.Status != nil {
-		req.Status.DrawProgressBar(1, 1)
-	}
-	return nil
+	return this.muxer.WriteTrailer()
 }
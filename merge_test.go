@@ -0,0 +1,158 @@
+package m3u8d
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mp4TrackCountForTest 返回moov里trak的数量
+func mp4TrackCountForTest(t *testing.T, name string) (count int) {
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, moov := range fmp4TopBoxListForTest(t, name) {
+		if moov.boxType != "moov" {
+			continue
+		}
+		for _, trak := range fmp4ReadChildren(f, moov) {
+			if trak.boxType == "trak" {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+func TestParseTrackMode(t *testing.T) {
+	for _, one := range []struct {
+		mode   string
+		format string
+		ret    string
+		hasErr bool
+	}{
+		{mode: "", format: OutputFormat_Ts, ret: TrackMode_All},
+		{mode: " Audio", format: OutputFormat_Mp4, ret: TrackMode_Audio},
+		{mode: "video", format: OutputFormat_Mkv, ret: TrackMode_Video},
+		{mode: "audio", format: OutputFormat_Ts, hasErr: true},
+		{mode: "subtitle", format: OutputFormat_Mp4, hasErr: true},
+	} {
+		ret, errMsg := ParseTrackMode(one.mode, one.format)
+		if ret != one.ret || (errMsg != "") != one.hasErr {
+			t.Fatal(one, ret, errMsg)
+		}
+	}
+	if GetOutputFileExt(OutputFormat_Fmp4, TrackMode_Audio) != "m4a" || GetOutputFileExt(OutputFormat_Mkv, TrackMode_Audio) != "mka" || GetOutputFileExt(OutputFormat_Mp4, TrackMode_Video) != "mp4" {
+		t.Fatal()
+	}
+	if GetOutputFormatByName("a.mka") != OutputFormat_Mkv || GetOutputFormatByName("a.m4a") != OutputFormat_Mp4 {
+		t.Fatal()
+	}
+}
+
+func TestMergeTrackMode(t *testing.T) {
+	dir := t.TempDir()
+	tsFileList := []string{filepath.Join("testdata", "TestFull", "jhxy.016.ts"), filepath.Join("testdata", "TestFull", "jhxy.017.ts")}
+	for _, one := range []struct {
+		trackMode  string
+		format     string
+		trackCount int
+	}{
+		{trackMode: TrackMode_All, format: OutputFormat_Mp4, trackCount: 2},
+		{trackMode: TrackMode_Audio, format: OutputFormat_Mp4, trackCount: 1},
+		{trackMode: TrackMode_Video, format: OutputFormat_Mp4, trackCount: 1},
+		{trackMode: TrackMode_Audio, format: OutputFormat_Fmp4, trackCount: 1},
+		{trackMode: TrackMode_Audio, format: OutputFormat_Mkv},
+		{trackMode: TrackMode_Video, format: OutputFormat_Mkv},
+	} {
+		outputName := filepath.Join(dir, one.trackMode+"-"+one.format+"."+GetOutputFileExt(one.format, one.trackMode))
+		err := MergeTsFileListToSingleMp4(MergeTsFileListToSingleMp4_Req{
+			TsFileList:   tsFileList,
+			OutputMp4:    outputName,
+			OutputFormat: one.format,
+			TrackMode:    one.trackMode,
+			Ctx:          context.Background(),
+		})
+		if err != nil {
+			t.Fatal(one, err)
+		}
+		if one.format == OutputFormat_Mkv {
+			continue
+		}
+		if count := mp4TrackCountForTest(t, outputName); count != one.trackCount {
+			t.Fatal(one, count)
+		}
+		if one.trackMode == TrackMode_Audio {
+			_, entryType, _ := mp4AudioTrackForTest(t, outputName)
+			if entryType != "mp4a" {
+				t.Fatal(one, entryType)
+			}
+		}
+	}
+
+	// 只有音频的ts不能只保留视频
+	ac3 := makeAudioFrameForTest([]byte{0x0B, 0x77, 0, 0, 0x08, 0x40, 0x40}, 512)
+	tsName := filepath.Join(dir, "ac3.ts")
+	err := os.WriteFile(tsName, makeAudioTsForTest(t, tsStreamAc3, ac3, 6, 32), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = MergeTsFileListToSingleMp4(MergeTsFileListToSingleMp4_Req{
+		TsFileList: []string{tsName},
+		OutputMp4:  filepath.Join(dir, "ac3.mp4"),
+		TrackMode:  TrackMode_Video,
+		Ctx:        context.Background(),
+	})
+	if err == nil {
+		t.Fatal("expect error")
+	}
+}
+
+func TestDownloadAudioOnly(t *testing.T) {
+	m3u8Dir := t.TempDir()
+	for _, name := range []string{"jhxy.016.ts", "jhxy.017.ts", "jhxy.018.ts"} {
+		content, err := os.ReadFile(filepath.Join("testdata", "TestFull", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(m3u8Dir, name), content, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, content := range map[string]string{
+		"master.m3u8": "#EXTM3U\n" +
+			"#EXT-X-STREAM-INF:BANDWIDTH=2000000,RESOLUTION=1280x720,CODECS=\"avc1.64001f,mp4a.40.2\"\nvideo.m3u8\n" +
+			"#EXT-X-STREAM-INF:BANDWIDTH=64000,CODECS=\"mp4a.40.2\"\naudio.m3u8\n",
+		"video.m3u8": "#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXTINF:2,\njhxy.016.ts\n#EXTINF:3,\njhxy.017.ts\n#EXTINF:3,\njhxy.018.ts\n#EXT-X-ENDLIST\n",
+		// 只有音频的播放列表只有一个ts, 用来区分下载的是哪个播放列表
+		"audio.m3u8": "#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXTINF:2,\njhxy.016.ts\n#EXT-X-ENDLIST\n",
+	} {
+		err := os.WriteFile(filepath.Join(m3u8Dir, name), []byte(content), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	saveDir := t.TempDir()
+	var durationMap = map[string]uint32{}
+	for _, trackMode := range []string{TrackMode_Audio, TrackMode_All} {
+		var env DownloadEnv
+		if env.StartDownload(StartDownload_Req{M3u8Url: filepath.Join(m3u8Dir, "master.m3u8"), SaveDir: saveDir, FileName: "all", ThreadCount: 2, TrackMode: trackMode}) == false {
+			t.Fatal("StartDownload failed")
+		}
+		status := env.WaitDownloadFinish()
+		if status.ErrMsg != "" || status.IsSkipped {
+			t.Fatal(trackMode, status.ErrMsg, status.IsSkipped)
+		}
+		if status.SaveFileTo != filepath.Join(saveDir, "all."+GetOutputFileExt(OutputFormat_Mp4, trackMode)) {
+			t.Fatal(status.SaveFileTo)
+		}
+		durationMap[trackMode] = mp4DurationMsForTest(t, status.SaveFileTo)
+	}
+	if durationMap[TrackMode_Audio]*2 > durationMap[TrackMode_All] {
+		t.Fatal(durationMap)
+	}
+}
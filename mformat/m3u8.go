@@ -22,14 +22,16 @@ type M3U8File struct {
 	MediaSequence  int
 	TargetDuration float64 // 秒
 	PartList       []M3U8Part
+	MediaList      []M3U8Media // #EXT-X-MEDIA
 }
 
 type M3U8Part struct {
 	Key                    *M3U8Key
 	Segment                *M3U8Segment
 	Playlist               *M3U8Playlist
-	Is_EXT_X_DISCONTINUITY bool //#EXT-X-DISCONTINUITY
-	Is_EXT_X_ENDLIST       bool //#EXT-X-ENDLIST
+	Map                    *M3U8Map // #EXT-X-MAP
+	Is_EXT_X_DISCONTINUITY bool     //#EXT-X-DISCONTINUITY
+	Is_EXT_X_ENDLIST       bool     //#EXT-X-ENDLIST
 }
 
 type M3U8Key struct {
@@ -38,6 +40,12 @@ type M3U8Key struct {
 	IV     string
 }
 
+// M3U8Map fMP4分片的初始化分片
+type M3U8Map struct {
+	URI       string
+	ByteRange string
+}
+
 type M3U8Segment struct {
 	URI      string
 	Duration float64 // 秒
@@ -48,6 +56,18 @@ type M3U8Playlist struct {
 	URI        string
 	Bandwidth  int
 	Resolution M3U8Resolution
+	Codecs     string // 例如 avc1.64001f,mp4a.40.2
+	Audio      string // AUDIO属性, 对应 M3U8Media.GroupId
+}
+
+// M3U8Media #EXT-X-MEDIA 描述的其它版本(rendition), 例如单独的音轨
+type M3U8Media struct {
+	Type      string // AUDIO、VIDEO、SUBTITLES、CLOSED-CAPTIONS
+	GroupId   string
+	Name      string
+	Language  string
+	URI       string // 为空时这个版本的内容在 #EXT-X-STREAM-INF 的播放列表里
+	IsDefault bool
 }
 
 type M3U8Resolution struct {
@@ -74,6 +94,8 @@ func M3U8Parse(content []byte) (info M3U8File, ok bool) {
 	rMedia := regexp.MustCompile(`^#EXTINF:`)
 	rEndList := regexp.MustCompile(`^#EXT-X-ENDLIST`)
 	rPlaylist := regexp.MustCompile(`^#EXT-X-STREAM-INF:`)
+	rMediaGroup := regexp.MustCompile(`^#EXT-X-MEDIA:`)
+	rMap := regexp.MustCompile(`^#EXT-X-MAP:`)
 
 	var curSeg *M3U8Segment
 	var curPlaylist *M3U8Playlist
@@ -125,6 +147,25 @@ func M3U8Parse(content []byte) (info M3U8File, ok bool) {
 			info.PartList = append(info.PartList, M3U8Part{
 				Key: &key,
 			})
+		case rMap.MatchString(line):
+			var m M3U8Map
+			for _, part := range splitTagPropertyPart(line) {
+				if strings.HasPrefix(part, "URI=") {
+					m.URI = strings.TrimPrefix(part, "URI=")
+					if strings.HasPrefix(m.URI, `"`) {
+						m.URI, _ = strconv.Unquote(m.URI)
+					}
+				}
+				if strings.HasPrefix(part, "BYTERANGE=") {
+					m.ByteRange = strings.TrimPrefix(part, "BYTERANGE=")
+					if strings.HasPrefix(m.ByteRange, `"`) {
+						m.ByteRange, _ = strconv.Unquote(m.ByteRange)
+					}
+				}
+			}
+			info.PartList = append(info.PartList, M3U8Part{
+				Map: &m,
+			})
 		case rDiscontinuity.MatchString(line):
 			info.PartList = append(info.PartList, M3U8Part{
 				Is_EXT_X_DISCONTINUITY: true,
@@ -174,7 +215,46 @@ func M3U8Parse(content []byte) (info M3U8File, ok bool) {
 						curPlaylist.Bandwidth = bw
 					}
 				}
+				if strings.HasPrefix(part, "CODECS=") {
+					curPlaylist.Codecs = strings.TrimPrefix(part, "CODECS=")
+					if strings.HasPrefix(curPlaylist.Codecs, `"`) {
+						curPlaylist.Codecs, _ = strconv.Unquote(curPlaylist.Codecs)
+					}
+				}
+				if strings.HasPrefix(part, "AUDIO=") {
+					curPlaylist.Audio = strings.TrimPrefix(part, "AUDIO=")
+					if strings.HasPrefix(curPlaylist.Audio, `"`) {
+						curPlaylist.Audio, _ = strconv.Unquote(curPlaylist.Audio)
+					}
+				}
+			}
+		case rMediaGroup.MatchString(line):
+			var media M3U8Media
+			for _, part := range splitTagPropertyPart(line) {
+				temp := strings.SplitN(part, "=", 2)
+				if len(temp) != 2 {
+					continue
+				}
+				value := temp[1]
+				if strings.HasPrefix(value, `"`) {
+					value, _ = strconv.Unquote(value)
+				}
+				switch temp[0] {
+				case "TYPE":
+					media.Type = value
+				case "GROUP-ID":
+					media.GroupId = value
+				case "NAME":
+					media.Name = value
+				case "LANGUAGE":
+					media.Language = value
+				case "URI":
+					media.URI = value
+				case "DEFAULT":
+					media.IsDefault = value == "YES"
+				}
 			}
+			info.MediaList = append(info.MediaList, media)
 		default:
 			if strings.HasPrefix(line, "#") {
 				break
@@ -200,19 +280,32 @@ func M3U8Parse(content []byte) (info M3U8File, ok bool) {
 }
 
 // splitTagPropertyPart
-// 以逗号为分隔符拆分冒号以后的部分为字符串列表
+// 以逗号为分隔符拆分冒号以后的部分为字符串列表, 双引号里的逗号不拆分
 //
 //	例子 #EXT-X-KEY:METHOD=AES-128,URI="/20230502/xthms/2000kb/hls/key.key"
 //			METHOD=AES-128
 //			URI="/20230502/xthms/2000kb/hls/key.key"
+//	例子 #EXT-X-STREAM-INF:BANDWIDTH=128000,CODECS="avc1.64001f,mp4a.40.2"
+//			BANDWIDTH=128000
+//			CODECS="avc1.64001f,mp4a.40.2"
 func splitTagPropertyPart(line string) (list []string) {
 	temp := strings.SplitN(line, ":", 2)
 	if len(temp) != 2 {
 		return nil
 	}
-	for _, part := range strings.Split(temp[1], ",") {
-		part = strings.TrimSpace(part)
-		list = append(list, part)
+	var isQuoted bool
+	var start int
+	for idx := 0; idx <= len(temp[1]); idx++ {
+		if idx < len(temp[1]) {
+			if temp[1][idx] == '"' {
+				isQuoted = !isQuoted
+			}
+			if temp[1][idx] != ',' || isQuoted {
+				continue
+			}
+		}
+		list = append(list, strings.TrimSpace(temp[1][start:idx]))
+		start = idx + 1
 	}
 	return list
 }
@@ -265,3 +265,41 @@ https://bobo.example.com/20240816/mU723LBo/2000kb/hls/wDuqI6ER.ts
 		t.Fatal()
 	}
 }
+
+func TestM3U8ParseMap(t *testing.T) {
+	info, ok := M3U8Parse([]byte(`#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:4
+#EXT-X-MAP:URI="init.mp4",BYTERANGE="720@0"
+#EXTINF:4,
+seg1.m4s
+#EXTINF:4,
+seg2.m4s
+#EXT-X-ENDLIST`))
+	if ok == false || len(info.PartList) != 4 || info.PartList[0].Map == nil || info.PartList[0].Map.URI != "init.mp4" || info.PartList[0].Map.ByteRange != "720@0" {
+		t.Fatal(info)
+	}
+	tsList := info.GetTsList()
+	if len(tsList) != 2 || tsList[0].MapURI != "init.mp4" || tsList[1].MapURI != "init.mp4" {
+		t.Fatal(tsList)
+	}
+	if SniffSegmentFormat(&tsList[0], nil) != SegmentFormat_Fmp4 {
+		t.Fatal()
+	}
+	for _, one := range []struct {
+		uri    string
+		data   []byte
+		format string
+	}{
+		{uri: "1.ts", data: []byte{TsSyncByte, 0x40}, format: SegmentFormat_Ts},
+		{uri: "1.aac?sign=1", data: []byte{0xFF, 0xF1}, format: SegmentFormat_PackedAudio},
+		{uri: "1.ts", data: []byte("ID3\x04"), format: SegmentFormat_PackedAudio},
+		{uri: "1.mp4", data: []byte("\x00\x00\x00\x10styp"), format: SegmentFormat_Fmp4},
+		{uri: "1.aac", data: []byte{TsSyncByte, 0x40}, format: SegmentFormat_Ts},
+		{uri: "1.ts", data: []byte("<html>"), format: SegmentFormat_Ts},
+	} {
+		if format := SniffSegmentFormat(&TsInfo{URI: one.uri}, one.data); format != one.format {
+			t.Fatal(one.uri, format)
+		}
+	}
+}
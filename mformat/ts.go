@@ -1,12 +1,14 @@
 package mformat
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"path"
 	"strconv"
 	"strings"
 )
@@ -21,6 +23,7 @@ type TsInfo struct {
 	TimeSec                 float64 // 此ts片段占用多少秒
 	Idx_EXT_X_DISCONTINUITY int     // 分段编号
 	Key                     TsKeyInfo
+	MapURI                  string // #EXT-X-MAP 的URI, 不为空时是fMP4分片
 
 	SkipByHttpCode bool
 	HttpCode       int
@@ -72,14 +75,103 @@ func (this *M3U8File) LookupHDPlaylist() (playlist *M3U8Playlist) {
 	return playlist
 }
 
+// LookupAudioPlaylist 找个只有音频的播放列表, 没有时返回nil.
+//
+//	优先使用 #EXT-X-MEDIA:TYPE=AUDIO 里有URI的版本(最高清的播放列表使用的组, 组里DEFAULT=YES的), 其次是CODECS里只有音频的播放列表, 有多个时选择带宽最大的
+func (this *M3U8File) LookupAudioPlaylist() (playlist *M3U8Playlist) {
+	if media := this.lookupAudioMedia(); media != nil {
+		playlist = &M3U8Playlist{URI: media.URI, Audio: media.GroupId}
+		// 使用这个组的播放列表里的音频编码
+		for _, one := range this.PartList {
+			if one.Playlist != nil && one.Playlist.Audio == media.GroupId {
+				playlist.Codecs = getAudioCodecs(one.Playlist.Codecs)
+				break
+			}
+		}
+		return playlist
+	}
+	for _, one := range this.PartList {
+		if one.Playlist != nil && one.Playlist.IsAudioOnly() {
+			if playlist == nil || one.Playlist.Bandwidth > playlist.Bandwidth {
+				playlist = one.Playlist
+			}
+		}
+	}
+	return playlist
+}
+
+func (this *M3U8File) lookupAudioMedia() (media *M3U8Media) {
+	var groupId string
+	if hd := this.LookupHDPlaylist(); hd != nil {
+		groupId = hd.Audio
+	}
+	for idx := range this.MediaList {
+		one := &this.MediaList[idx]
+		if one.Type != "AUDIO" || one.URI == "" {
+			continue
+		}
+		if media == nil {
+			media = one
+			continue
+		}
+		isSameGroup := one.GroupId == groupId
+		if isSameGroup != (media.GroupId == groupId) {
+			if isSameGroup {
+				media = one
+			}
+			continue
+		}
+		if one.GroupId == media.GroupId && one.IsDefault && media.IsDefault == false {
+			media = one
+		}
+	}
+	return media
+}
+
+// IsAudioOnly CODECS里只有音频编码时返回true. 没有CODECS时无法判断, 返回false
+func (this *M3U8Playlist) IsAudioOnly() bool {
+	if this.Codecs == "" {
+		return false
+	}
+	for _, one := range strings.Split(this.Codecs, ",") {
+		if isAudioCodec(one) == false {
+			return false
+		}
+	}
+	return true
+}
+
+func isAudioCodec(codec string) bool {
+	switch strings.ToLower(strings.SplitN(strings.TrimSpace(codec), ".", 2)[0]) {
+	case "mp4a", "ac-3", "ec-3", "mp3", "opus", "flac":
+		return true
+	}
+	return false
+}
+
+// getAudioCodecs 只保留CODECS里的音频编码
+func getAudioCodecs(codecs string) string {
+	var list []string
+	for _, one := range strings.Split(codecs, ",") {
+		if isAudioCodec(one) {
+			list = append(list, strings.TrimSpace(one))
+		}
+	}
+	return strings.Join(list, ",")
+}
+
 // GetTsList 获取ts文件列表, 此处不组装url, 不下载key内容
 func (this *M3U8File) GetTsList() (list []TsInfo) {
 	var beginSeq = uint64(this.MediaSequence)
 	var index = 0
 	var discontinutyIdx = 0
 	var curKey *M3U8Key
+	var curMapURI string
 
 	for _, part := range this.PartList {
+		if part.Map != nil {
+			curMapURI = part.Map.URI
+		}
 		if part.Is_EXT_X_DISCONTINUITY && len(list) > 0 {
 			discontinutyIdx++
 		}
@@ -101,6 +193,7 @@ func (this *M3U8File) GetTsList() (list []TsInfo) {
 				Seq:                     beginSeq + uint64(index-1),
 				TimeSec:                 seg.Duration,
 				Idx_EXT_X_DISCONTINUITY: discontinutyIdx,
+				MapURI:                  curMapURI,
 			}
 			if curKey != nil {
 				iv := []byte(strings.TrimPrefix(strings.ToLower(curKey.IV), "0x"))
@@ -152,3 +245,345 @@ func AesDecrypt(encrypted []byte, key TsKeyInfo) ([]byte, error) {
 	}
 	return origData[:(length - unpadding)], nil
 }
+
+const (
+	TsPacketSize     = 188
+	TsSyncByte       = 0x47
+	tsPidPat         = 0x0000
+	tsPidNull        = 0x1FFF
+	tsTableIdPat     = 0x00
+	tsTableIdPmt     = 0x02
+	TsMinPacketCount = 3 // 最少需要 PAT + PMT + 1个音视频包
+)
+
+type tsPacketHeader struct {
+	pid     uint16
+	isStart bool   // payload_unit_start_indicator
+	payload []byte // 去掉头部、adaptation_field之后的数据
+}
+
+// parseTsPacketHeader 解析一个188字节ts包的头部
+func parseTsPacketHeader(pkt []byte) (header tsPacketHeader, ok bool) {
+	if len(pkt) != TsPacketSize || pkt[0] != TsSyncByte {
+		return header, false
+	}
+	header.isStart = pkt[1]&0x40 != 0
+	header.pid = uint16(pkt[1]&0x1F)<<8 | uint16(pkt[2])
+	adaptationFieldControl := (pkt[3] >> 4) & 0x03
+	offset := 4
+	if adaptationFieldControl&0x02 != 0 {
+		offset += 1 + int(pkt[4])
+	}
+	if adaptationFieldControl&0x01 == 0 || offset > TsPacketSize {
+		return header, true
+	}
+	header.payload = pkt[offset:]
+	return header, true
+}
+
+// readTsPsiSection 读取PAT/PMT的section, 返回section_length之后、CRC之前的部分
+func readTsPsiSection(header tsPacketHeader, tableId byte) (body []byte, ok bool) {
+	if header.isStart == false || len(header.payload) < 1 {
+		return nil, false
+	}
+	pointer := int(header.payload[0])
+	section := header.payload[1:]
+	if pointer >= len(section) {
+		return nil, false
+	}
+	section = section[pointer:]
+	if len(section) < 8 || section[0] != tableId {
+		return nil, false
+	}
+	sectionLength := int(section[1]&0x0F)<<8 | int(section[2])
+	end := 3 + sectionLength - 4 // 去掉CRC32
+	if end > len(section) {
+		end = len(section) // section跨越了多个ts包, 只解析当前包里的部分
+	}
+	if end < 8 {
+		return nil, false
+	}
+	return section[8:end], true
+}
+
+// TsValidate 校验ts文件内容是否完整:
+//
+//  1. 长度是188的整数倍, 每个包都以0x47开头
+//  2. 包含可以解析的PAT、PMT
+//  3. 至少有一个属于PMT中声明的音视频流的数据包
+func TsValidate(data []byte) error {
+	if len(data) < TsMinPacketCount*TsPacketSize {
+		return errors.New("ts data too short, len " + strconv.Itoa(len(data)))
+	}
+	if len(data)%TsPacketSize != 0 {
+		return errors.New("ts data not aligned to " + strconv.Itoa(TsPacketSize) + " bytes, len " + strconv.Itoa(len(data)))
+	}
+	var pmtPidMap = map[uint16]bool{}
+	var esPidMap = map[uint16]bool{}
+	var esPacketCount int
+
+	for offset := 0; offset < len(data); offset += TsPacketSize {
+		header, ok := parseTsPacketHeader(data[offset : offset+TsPacketSize])
+		if ok == false {
+			return errors.New("invalid ts sync byte at offset " + strconv.Itoa(offset))
+		}
+		switch {
+		case header.pid == tsPidNull:
+		case header.pid == tsPidPat:
+			body, ok := readTsPsiSection(header, tsTableIdPat)
+			if ok == false {
+				continue
+			}
+			for idx := 0; idx+4 <= len(body); idx += 4 {
+				programNumber := binary.BigEndian.Uint16(body[idx:])
+				if programNumber == 0 { // network_PID
+					continue
+				}
+				pmtPidMap[binary.BigEndian.Uint16(body[idx+2:])&0x1FFF] = true
+			}
+		case pmtPidMap[header.pid]:
+			body, ok := readTsPsiSection(header, tsTableIdPmt)
+			if ok == false || len(body) < 4 {
+				continue
+			}
+			programInfoLength := int(binary.BigEndian.Uint16(body[2:]) & 0x0FFF)
+			for idx := 4 + programInfoLength; idx+5 <= len(body); {
+				esPidMap[binary.BigEndian.Uint16(body[idx+1:])&0x1FFF] = true
+				idx += 5 + int(binary.BigEndian.Uint16(body[idx+3:])&0x0FFF)
+			}
+		case esPidMap[header.pid]:
+			if len(header.payload) > 0 {
+				esPacketCount++
+			}
+		}
+	}
+	if len(pmtPidMap) == 0 {
+		return errors.New("ts PAT not found")
+	}
+	if len(esPidMap) == 0 {
+		return errors.New("ts PMT not found")
+	}
+	if esPacketCount == 0 {
+		return errors.New("ts has no audio/video packet")
+	}
+	return nil
+}
+
+const (
+	SegmentFormat_Ts          = "ts"
+	SegmentFormat_Fmp4        = "fmp4"        // fMP4/CMAF, 播放列表里有 #EXT-X-MAP
+	SegmentFormat_PackedAudio = "packedAudio" // .aac/.mp3/.ac3/.ec3, 一般以ID3开头
+)
+
+// SniffSegmentFormat 根据 #EXT-X-MAP、分片扩展名和内容判断分片的格式, 无法判断时返回 SegmentFormat_Ts
+func SniffSegmentFormat(ts *TsInfo, data []byte) string {
+	if ts.MapURI != "" || isFmp4BoxData(data) {
+		return SegmentFormat_Fmp4
+	}
+	if bytes.HasPrefix(data, []byte("ID3")) {
+		return SegmentFormat_PackedAudio
+	}
+	if len(data) > 0 && data[0] == TsSyncByte {
+		return SegmentFormat_Ts
+	}
+	uri := ts.URI
+	if idx := strings.IndexAny(uri, "?#"); idx >= 0 {
+		uri = uri[:idx]
+	}
+	switch strings.ToLower(path.Ext(uri)) {
+	case ".aac", ".mp3", ".ac3", ".ec3":
+		return SegmentFormat_PackedAudio
+	}
+	return SegmentFormat_Ts
+}
+
+func isFmp4BoxData(data []byte) bool {
+	if len(data) < 8 {
+		return false
+	}
+	switch string(data[4:8]) {
+	case "ftyp", "styp", "sidx", "moof", "emsg", "prft":
+		return true
+	}
+	return false
+}
+
+// SegmentValidate 按分片格式校验内容是否完整, ts见 TsValidate, fMP4校验顶层box的长度, packed audio只能校验不为空
+func SegmentValidate(data []byte, format string) error {
+	switch format {
+	case SegmentFormat_Fmp4:
+		return fmp4Validate(data)
+	case SegmentFormat_PackedAudio:
+		if len(data) == 0 {
+			return errors.New("packed audio data is empty")
+		}
+		return nil
+	}
+	return TsValidate(data)
+}
+
+func fmp4Validate(data []byte) error {
+	var hasMdat bool
+	for offset := 0; offset < len(data); {
+		if offset+8 > len(data) {
+			return errors.New("fmp4 box header truncated at offset " + strconv.Itoa(offset))
+		}
+		size := uint64(binary.BigEndian.Uint32(data[offset:]))
+		headerSize := uint64(8)
+		switch size {
+		case 0: // 到文件结尾
+			size = uint64(len(data) - offset)
+		case 1:
+			if offset+16 > len(data) {
+				return errors.New("fmp4 box header truncated at offset " + strconv.Itoa(offset))
+			}
+			size = binary.BigEndian.Uint64(data[offset+8:])
+			headerSize = 16
+		}
+		if size < headerSize || size > uint64(len(data)-offset) {
+			return errors.New("fmp4 box " + strconv.Quote(string(data[offset+4:offset+8])) + " truncated at offset " + strconv.Itoa(offset))
+		}
+		if string(data[offset+4:offset+8]) == "mdat" {
+			hasMdat = true
+		}
+		offset += int(size)
+	}
+	if hasMdat == false {
+		return errors.New("fmp4 mdat not found")
+	}
+	return nil
+}
+
+// tsPsiPacketList 返回ts里第一个PAT包, 以及PAT中声明的每个PMT的第一个包
+//
+//	只支持单个包就能放下的PAT/PMT, 没有找到时返回nil
+func tsPsiPacketList(data []byte) (list [][]byte) {
+	var pat []byte
+	var pmtPidList []uint16
+	var pmtMap = map[uint16][]byte{}
+	for offset := 0; offset+TsPacketSize <= len(data); offset += TsPacketSize {
+		pkt := data[offset : offset+TsPacketSize]
+		header, ok := parseTsPacketHeader(pkt)
+		if ok == false {
+			continue
+		}
+		if pat == nil {
+			if header.pid != tsPidPat {
+				continue
+			}
+			body, ok := readTsPsiSection(header, tsTableIdPat)
+			if ok == false {
+				continue
+			}
+			for idx := 0; idx+4 <= len(body); idx += 4 {
+				if binary.BigEndian.Uint16(body[idx:]) == 0 { // network_PID
+					continue
+				}
+				pmtPidList = append(pmtPidList, binary.BigEndian.Uint16(body[idx+2:])&0x1FFF)
+			}
+			if len(pmtPidList) > 0 {
+				pat = pkt
+			}
+			continue
+		}
+		if _, ok := pmtMap[header.pid]; ok {
+			continue
+		}
+		for _, pid := range pmtPidList {
+			if pid != header.pid {
+				continue
+			}
+			if _, ok := readTsPsiSection(header, tsTableIdPmt); ok {
+				pmtMap[pid] = pkt
+			}
+		}
+		if len(pmtMap) == len(pmtPidList) {
+			break
+		}
+	}
+	if pat == nil || len(pmtMap) != len(pmtPidList) {
+		return nil
+	}
+	list = append(list, pat)
+	for _, pid := range pmtPidList {
+		list = append(list, pmtMap[pid])
+	}
+	return list
+}
+
+// TsConcatFixer 拼接多个ts文件时修正每个文件开头的内容, 使拼接后的文件可以连续播放:
+//
+//  1. 第一个音视频包之前没有PAT时, 插入这个文件(或者之前的文件)的PAT/PMT
+//  2. 重写每个PID的连续计数器(continuity_counter), 避免播放器在文件边界丢包
+type TsConcatFixer struct {
+	ccMap   map[uint16]byte // pid => 上一个包的连续计数器
+	psiList [][]byte
+}
+
+func NewTsConcatFixer() *TsConcatFixer {
+	return &TsConcatFixer{
+		ccMap: map[uint16]byte{},
+	}
+}
+
+// Fix 处理一个ts文件的内容, data的长度必须是188的整数倍, 返回新的数据, 不修改data
+func (this *TsConcatFixer) Fix(data []byte) []byte {
+	if list := tsPsiPacketList(data); list != nil {
+		this.psiList = list
+	}
+	out := make([]byte, 0, len(data)+len(this.psiList)*TsPacketSize)
+	if len(this.psiList) > 0 && this.hasPatBeforeEs(data) == false {
+		for _, pkt := range this.psiList {
+			out = this.appendPacket(out, pkt)
+		}
+	}
+	for offset := 0; offset+TsPacketSize <= len(data); offset += TsPacketSize {
+		out = this.appendPacket(out, data[offset:offset+TsPacketSize])
+	}
+	return out
+}
+
+// hasPatBeforeEs 在第一个音视频包之前有没有PAT, 0x0000-0x001F是PAT、SDT等表的pid
+func (this *TsConcatFixer) hasPatBeforeEs(data []byte) bool {
+	var pmtPidMap = map[uint16]bool{}
+	for _, pkt := range this.psiList[1:] {
+		pmtPidMap[tsPacketPid(pkt)] = true
+	}
+	for offset := 0; offset+TsPacketSize <= len(data); offset += TsPacketSize {
+		pid := tsPacketPid(data[offset:])
+		if pid == tsPidPat {
+			return true
+		}
+		if pid >= 0x20 && pid != tsPidNull && pmtPidMap[pid] == false {
+			return false
+		}
+	}
+	return false
+}
+
+func tsPacketPid(pkt []byte) uint16 {
+	return uint16(pkt[1]&0x1F)<<8 | uint16(pkt[2])
+}
+
+func (this *TsConcatFixer) appendPacket(out []byte, pkt []byte) []byte {
+	begin := len(out)
+	out = append(out, pkt...)
+	if pkt[0] != TsSyncByte {
+		return out
+	}
+	pid := tsPacketPid(pkt)
+	if pid == tsPidNull {
+		return out
+	}
+	cc, ok := this.ccMap[pid]
+	if pkt[3]&0x10 != 0 { // 有payload的包计数器加1, 只有adaptation_field的包保持不变
+		if ok {
+			cc = (cc + 1) & 0x0F
+		} else {
+			cc = 0
+		}
+	}
+	this.ccMap[pid] = cc
+	out[begin+3] = out[begin+3]&0xF0 | cc
+	return out
+}
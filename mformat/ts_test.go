@@ -97,3 +97,159 @@ master_2560X1440.m3u8
 		t.Fatal(playlist.URI)
 	}
 }
+
+func TestM3U8File_LookupAudioPlaylist(t *testing.T) {
+	info, ok := M3U8Parse([]byte(`#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=2560000,RESOLUTION=1280x720,CODECS="avc1.64001f,mp4a.40.2"
+video_720.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=64000,CODECS="mp4a.40.5"
+audio_64k.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=128000,CODECS="mp4a.40.2"
+audio_128k.m3u8
+`))
+	if ok == false || len(info.PartList) != 3 || info.PartList[0].Playlist.Codecs != "avc1.64001f,mp4a.40.2" || info.PartList[0].Playlist.Resolution.Width != 1280 {
+		t.Fatal(info)
+	}
+	if playlist := info.LookupAudioPlaylist(); playlist == nil || playlist.URI != "audio_128k.m3u8" {
+		t.Fatal(playlist)
+	}
+	if playlist := info.LookupHDPlaylist(); playlist == nil || playlist.URI != "video_720.m3u8" {
+		t.Fatal(playlist)
+	}
+	info.PartList = info.PartList[:1]
+	if info.LookupAudioPlaylist() != nil {
+		t.Fatal()
+	}
+}
+
+func TestM3U8File_LookupAudioMedia(t *testing.T) {
+	info, ok := M3U8Parse([]byte(`#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac-lo",NAME="English",LANGUAGE="en",DEFAULT=YES,URI="lo/en.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac-hi",NAME="English",LANGUAGE="en",DEFAULT=NO,URI="hi/en.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac-hi",NAME="Deutsch",LANGUAGE="de",DEFAULT=YES,URI="hi/de.m3u8"
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="English",DEFAULT=YES,URI="subs/en.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360,CODECS="avc1.4d401e,mp4a.40.5",AUDIO="aac-lo"
+video_360.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2560000,RESOLUTION=1280x720,CODECS="avc1.64001f,mp4a.40.2",AUDIO="aac-hi",SUBTITLES="subs"
+video_720.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=64000,CODECS="mp4a.40.5"
+audio_64k.m3u8
+`))
+	if ok == false || len(info.MediaList) != 4 || len(info.PartList) != 3 {
+		t.Fatal(info)
+	}
+	if media := info.MediaList[2]; media.Type != "AUDIO" || media.GroupId != "aac-hi" || media.Name != "Deutsch" || media.Language != "de" || media.IsDefault == false || media.URI != "hi/de.m3u8" {
+		t.Fatal(media)
+	}
+	if info.PartList[1].Playlist.Audio != "aac-hi" || info.PartList[1].Playlist.Codecs != "avc1.64001f,mp4a.40.2" {
+		t.Fatal(info.PartList[1].Playlist)
+	}
+	// 最高清的播放列表使用的组里 DEFAULT=YES 的音轨优先于只有音频的 #EXT-X-STREAM-INF
+	if playlist := info.LookupAudioPlaylist(); playlist == nil || playlist.URI != "hi/de.m3u8" || playlist.Codecs != "mp4a.40.2" {
+		t.Fatal(playlist)
+	}
+	// 组里没有 DEFAULT=YES 时使用第一个
+	info.MediaList[2].IsDefault = false
+	if playlist := info.LookupAudioPlaylist(); playlist == nil || playlist.URI != "hi/en.m3u8" {
+		t.Fatal(playlist)
+	}
+	// 最高清的播放列表没有引用音频组时使用第一个有URI的音频
+	info.PartList[1].Playlist.Audio = ""
+	if playlist := info.LookupAudioPlaylist(); playlist == nil || playlist.URI != "lo/en.m3u8" || playlist.Codecs != "mp4a.40.5" {
+		t.Fatal(playlist)
+	}
+	// 音频没有URI时(内容在 #EXT-X-STREAM-INF 的播放列表里), 使用只有音频的 #EXT-X-STREAM-INF
+	for idx := range info.MediaList {
+		info.MediaList[idx].URI = ""
+	}
+	if playlist := info.LookupAudioPlaylist(); playlist == nil || playlist.URI != "audio_64k.m3u8" {
+		t.Fatal(playlist)
+	}
+}
+
+func buildTestTsPacket(pid uint16, isStart bool, payload []byte) []byte {
+	pkt := make([]byte, TsPacketSize)
+	for idx := range pkt {
+		pkt[idx] = 0xFF
+	}
+	pkt[0] = TsSyncByte
+	pkt[1] = byte(pid>>8) & 0x1F
+	if isStart {
+		pkt[1] |= 0x40
+	}
+	pkt[2] = byte(pid)
+	pkt[3] = 0x10 // 只有payload
+	copy(pkt[4:], payload)
+	return pkt
+}
+
+func buildTestTsData() []byte {
+	var data []byte
+	// PAT: program 1 -> PMT pid 0x1000
+	data = append(data, buildTestTsPacket(0, true, []byte{0x00, 0x00, 0xB0, 0x0D, 0x00, 0x01, 0xC1, 0x00, 0x00, 0x00, 0x01, 0xF0, 0x00, 0, 0, 0, 0})...)
+	// PMT: H264 pid 0x100
+	data = append(data, buildTestTsPacket(0x1000, true, []byte{0x00, 0x02, 0xB0, 0x12, 0x00, 0x01, 0xC1, 0x00, 0x00, 0xE1, 0x00, 0xF0, 0x00, 0x1B, 0xE1, 0x00, 0xF0, 0x00, 0, 0, 0, 0})...)
+	data = append(data, buildTestTsPacket(0x100, true, []byte{0x00, 0x00, 0x01, 0xE0})...)
+	return data
+}
+
+func TestTsValidate(t *testing.T) {
+	data := buildTestTsData()
+	if err := TsValidate(data); err != nil {
+		t.Fatal(err)
+	}
+	// 被截断
+	if err := TsValidate(data[:len(data)-10]); err == nil {
+		t.Fatal()
+	}
+	// html错误页面
+	html := bytes.Repeat([]byte("<html>404 not found</html>"), 100)
+	if err := TsValidate(html); err == nil {
+		t.Fatal()
+	}
+	// 缺少PAT
+	if err := TsValidate(append(append([]byte{}, data[TsPacketSize:]...), data[TsPacketSize:2*TsPacketSize]...)); err == nil {
+		t.Fatal()
+	}
+	// 只有PAT/PMT, 没有音视频数据
+	noEs := append(append([]byte{}, data[:2*TsPacketSize]...), buildTestTsPacket(tsPidNull, false, nil)...)
+	if err := TsValidate(noEs); err == nil {
+		t.Fatal()
+	}
+}
+
+func TestTsConcatFixer(t *testing.T) {
+	data := buildTestTsData()
+	esOnly := data[2*TsPacketSize:]
+
+	fixer := NewTsConcatFixer()
+	var out []byte
+	out = append(out, fixer.Fix(data)...)
+	// 不是以PAT开头的ts, 插入之前的PAT/PMT
+	second := fixer.Fix(esOnly)
+	if len(second) != 3*TsPacketSize || tsPacketPid(second) != tsPidPat || tsPacketPid(second[TsPacketSize:]) != 0x1000 {
+		t.Fatal(len(second))
+	}
+	out = append(out, second...)
+	if err := TsValidate(second); err != nil {
+		t.Fatal(err)
+	}
+	// 每个pid的连续计数器都是连续的
+	var ccMap = map[uint16]byte{}
+	for offset := 0; offset < len(out); offset += TsPacketSize {
+		pkt := out[offset : offset+TsPacketSize]
+		pid := tsPacketPid(pkt)
+		cc, ok := ccMap[pid]
+		if ok && pkt[3]&0x0F != (cc+1)&0x0F {
+			t.Fatal(offset, pid, pkt[3]&0x0F, cc)
+		}
+		ccMap[pid] = pkt[3] & 0x0F
+	}
+	if len(ccMap) != 3 || ccMap[tsPidPat] != 1 {
+		t.Fatal(ccMap)
+	}
+	// 没有PAT/PMT时不插入
+	if got := NewTsConcatFixer().Fix(esOnly); len(got) != len(esOnly) {
+		t.Fatal(len(got))
+	}
+}
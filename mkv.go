@@ -0,0 +1,725 @@
+package m3u8d
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/yapingcat/gomedia/go-codec"
+	"github.com/yapingcat/gomedia/go-mpeg2"
+)
+
+// Matroska 用到的EBML元素id, https://www.matroska.org/technical/elements.html
+const (
+	mkvIdEBML               = 0x1A45DFA3
+	mkvIdEBMLVersion        = 0x4286
+	mkvIdEBMLReadVersion    = 0x42F7
+	mkvIdEBMLMaxIDLength    = 0x42F2
+	mkvIdEBMLMaxSizeLength  = 0x42F3
+	mkvIdDocType            = 0x4282
+	mkvIdDocTypeVersion     = 0x4287
+	mkvIdDocTypeReadVersion = 0x4285
+	mkvIdVoid               = 0xEC
+
+	mkvIdSegment      = 0x18538067
+	mkvIdSeekHead     = 0x114D9B74
+	mkvIdSeek         = 0x4DBB
+	mkvIdSeekID       = 0x53AB
+	mkvIdSeekPosition = 0x53AC
+
+	mkvIdInfo           = 0x1549A966
+	mkvIdTimestampScale = 0x2AD7B1
+	mkvIdDuration       = 0x4489
+	mkvIdMuxingApp      = 0x4D80
+	mkvIdWritingApp     = 0x5741
+
+	mkvIdTracks            = 0x1654AE6B
+	mkvIdTrackEntry        = 0xAE
+	mkvIdTrackNumber       = 0xD7
+	mkvIdTrackUID          = 0x73C5
+	mkvIdTrackType         = 0x83
+	mkvIdFlagLacing        = 0x9C
+	mkvIdCodecID           = 0x86
+	mkvIdCodecPrivate      = 0x63A2
+	mkvIdVideo             = 0xE0
+	mkvIdPixelWidth        = 0xB0
+	mkvIdPixelHeight       = 0xBA
+	mkvIdAudio             = 0xE1
+	mkvIdSamplingFrequency = 0xB5
+	mkvIdChannels          = 0x9F
+
+	mkvIdCluster     = 0x1F43B675
+	mkvIdTimestamp   = 0xE7
+	mkvIdSimpleBlock = 0xA3
+
+	mkvIdCues               = 0x1C53BB6B
+	mkvIdCuePoint           = 0xBB
+	mkvIdCueTime            = 0xB3
+	mkvIdCueTrackPositions  = 0xB7
+	mkvIdCueTrack           = 0xF7
+	mkvIdCueClusterPosition = 0xF1
+)
+
+const (
+	mkvTrackTypeVideo = 1
+	mkvTrackTypeAudio = 2
+
+	mkvSeekHeadReserveSize = 128     // 给SeekHead预留的空间, 写完后剩余部分用Void填充
+	mkvMaxPendingFrames    = 1000    // 等待音视频参数时最多缓存的帧数, 超过后按照已经找到的轨道写入
+	mkvClusterMinMs        = 1000    // 有视频时, 至少间隔这么久才在关键帧处开始新的Cluster
+	mkvClusterMaxMs        = 5000    // Cluster的最大时长
+	mkvClusterMaxBytes     = 5 << 20 // Cluster的最大字节数
+)
+
+type mkvTrack struct {
+	number       uint64
+	trackType    int
+	codecId      string
+	codecPrivate []byte
+	width        uint32
+	height       uint32
+	sampleRate   int
+	channels     int
+}
+
+type mkvFrame struct {
+	track      *mkvTrack
+	data       []byte
+	pts        int64 // 毫秒
+	dts        int64
+	isKeyFrame bool
+}
+
+type mkvCuePoint struct {
+	timeMs   int64
+	track    uint64
+	position int64 // Cluster相对于Segment数据开始的位置
+}
+
+// mkvWriter 把ts里的 H.264/H.265/AAC/mpeg音频/AC-3/E-AC-3 写入mkv. 轨道信息需要在Cluster之前写入, 所以找到音视频参数之前先缓存帧.
+//
+//	视频使用长度前缀的NALU(同mp4), 码流中间变化的SPS/PPS保留在帧里; aac去掉ADTS头, 其它音频保留帧头
+type mkvWriter struct {
+	w io.WriteSeeker
+
+	video         *mkvTrack
+	audio         *mkvTrack
+	audioSplitter tsAudioSplitter
+	// 找到参数之前的视频、音频
+	h264SpsList [][]byte
+	h264PpsList [][]byte
+	hevcConfig  *codec.HEVCRecordConfiguration
+	hevcHasVps  bool
+	hevcHasSps  bool
+	hevcHasPps  bool
+
+	pendingList     []mkvFrame
+	isHeaderWritten bool
+	isBaseSet       bool
+	baseMs          int64 // 第一帧的dts, 输出的时间戳从0开始
+
+	segmentSizePos  int64 // Segment大小的位置
+	segmentDataPos  int64 // Segment数据开始的位置
+	seekHeadPos     int64
+	infoPos         int64
+	durationPos     int64 // Duration数据的位置
+	tracksPos       int64
+	clusterBuf      bytes.Buffer
+	clusterStartMs  int64
+	clusterHasFrame bool
+	cueList         []mkvCuePoint
+	maxPtsMs        int64
+}
+
+func newMkvWriter(w io.WriteSeeker) (*mkvWriter, error) {
+	this := &mkvWriter{w: w}
+	var buf bytes.Buffer
+	mkvWriteMaster(&buf, mkvIdEBML, func(b *bytes.Buffer) {
+		mkvWriteUint(b, mkvIdEBMLVersion, 1)
+		mkvWriteUint(b, mkvIdEBMLReadVersion, 1)
+		mkvWriteUint(b, mkvIdEBMLMaxIDLength, 4)
+		mkvWriteUint(b, mkvIdEBMLMaxSizeLength, 8)
+		mkvWriteString(b, mkvIdDocType, "matroska")
+		mkvWriteUint(b, mkvIdDocTypeVersion, 4)
+		mkvWriteUint(b, mkvIdDocTypeReadVersion, 2)
+	})
+	mkvWriteId(&buf, mkvIdSegment)
+	this.segmentSizePos = int64(buf.Len())
+	buf.Write(mkvUnknownSize[:]) // 写完后回填
+	this.segmentDataPos = int64(buf.Len())
+	this.seekHeadPos = int64(buf.Len())
+	mkvWriteVoid(&buf, mkvSeekHeadReserveSize)
+
+	this.infoPos = int64(buf.Len())
+	var info bytes.Buffer
+	mkvWriteUint(&info, mkvIdTimestampScale, 1000000) // 时间戳单位为毫秒
+	mkvWriteId(&info, mkvIdDuration)
+	mkvWriteSize(&info, 8)
+	durationOffset := int64(info.Len())
+	info.Write(make([]byte, 8)) // 写完后回填
+	mkvWriteString(&info, mkvIdMuxingApp, "m3u8d")
+	mkvWriteString(&info, mkvIdWritingApp, "m3u8d "+GetVersion())
+	mkvWriteId(&buf, mkvIdInfo)
+	mkvWriteSize(&buf, uint64(info.Len()))
+	this.durationPos = int64(buf.Len()) + durationOffset
+	buf.Write(info.Bytes())
+	_, err := w.Write(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return this, nil
+}
+
+func (this *mkvWriter) WriteFrame(cid mpeg2.TS_STREAM_TYPE, frame []byte, pts uint64, dts uint64) (err error) {
+	switch cid {
+	case mpeg2.TS_STREAM_AAC:
+		// 一个PES里可能有多个aac帧, 只有第一个帧有时间戳
+		ptsMs := int64(pts)
+		codec.SplitAACFrame(frame, func(aac []byte) {
+			if err != nil {
+				return
+			}
+			if len(aac) < 7 {
+				err = errors.New("invalid adts frame")
+				return
+			}
+			adts := codec.NewAdtsFrameHeader()
+			adts.Decode(aac)
+			sampleRate := codec.AACSampleIdxToSample(int(adts.Fix_Header.Sampling_frequency_index))
+			if sampleRate <= 0 {
+				err = errors.New("invalid aac sample rate index " + strconv.Itoa(int(adts.Fix_Header.Sampling_frequency_index)))
+				return
+			}
+			headerLen := 7
+			if adts.Fix_Header.Protection_absent == 0 {
+				headerLen = 9
+			}
+			if len(aac) <= headerLen {
+				return
+			}
+			if this.audio == nil {
+				asc, _ := codec.ConvertADTSToASC(aac)
+				this.audio = &mkvTrack{
+					trackType:    mkvTrackTypeAudio,
+					codecId:      "A_AAC",
+					codecPrivate: asc.Encode(),
+					sampleRate:   sampleRate,
+					channels:     int(adts.Fix_Header.Channel_configuration),
+				}
+			} else if this.audio.codecId != "A_AAC" {
+				err = errors.New("mkv audio codec changed A_AAC")
+				return
+			}
+			err = this.addFrame(mkvFrame{
+				track:      this.audio,
+				data:       aac[headerLen:],
+				pts:        ptsMs,
+				dts:        ptsMs,
+				isKeyFrame: true,
+			})
+			ptsMs += 1024 * 1000 / int64(sampleRate) //每帧aac采样固定为1024
+		})
+		return err
+	case mpeg2.TS_STREAM_AUDIO_MPEG1, mpeg2.TS_STREAM_AUDIO_MPEG2, tsStreamAc3, tsStreamEac3:
+		return this.audioSplitter.input(cid, frame, pts, this.writeOtherAudio)
+	case mpeg2.TS_STREAM_H264, mpeg2.TS_STREAM_H265:
+		isH265 := cid == mpeg2.TS_STREAM_H265
+		if this.video != nil && this.video.codecId != mkvCodecIdForVideo(isH265) {
+			return errors.New("mkv video codec changed " + strconv.Itoa(int(cid)))
+		}
+		data, isKeyFrame := this.convertVideoFrame(frame, isH265)
+		if len(data) == 0 {
+			return nil
+		}
+		if this.video == nil {
+			this.video = this.newVideoTrack(isH265)
+		}
+		return this.addFrame(mkvFrame{
+			track:      this.video,
+			data:       data,
+			pts:        int64(pts),
+			dts:        int64(dts),
+			isKeyFrame: isKeyFrame,
+		})
+	}
+	return errors.New("unknown cid " + strconv.Itoa(int(cid)))
+}
+
+func (this *mkvWriter) writeOtherAudio(header tsAudioHeader, sample []byte, pts uint64) error {
+	var codecId string
+	switch header.cid {
+	case tsStreamAc3:
+		codecId = "A_AC3"
+	case tsStreamEac3:
+		codecId = "A_EAC3"
+	default:
+		codecId = "A_MPEG/L" + strconv.Itoa(header.mpegLayer)
+	}
+	if this.audio == nil {
+		this.audio = &mkvTrack{
+			trackType:  mkvTrackTypeAudio,
+			codecId:    codecId,
+			sampleRate: header.sampleRate,
+			channels:   header.channels,
+		}
+	} else if this.audio.codecId != codecId {
+		return errors.New("mkv audio codec changed " + codecId)
+	}
+	return this.addFrame(mkvFrame{
+		track:      this.audio,
+		data:       sample,
+		pts:        int64(pts),
+		dts:        int64(pts),
+		isKeyFrame: true,
+	})
+}
+
+func mkvCodecIdForVideo(isH265 bool) string {
+	if isH265 {
+		return "V_MPEGH/ISO/HEVC"
+	}
+	return "V_MPEG4/ISO/AVC"
+}
+
+// convertVideoFrame Annex-B转换为4字节长度前缀的NALU, 去掉AUD, 同时记录参数集
+func (this *mkvWriter) convertVideoFrame(frame []byte, isH265 bool) (data []byte, isKeyFrame bool) {
+	codec.SplitFrame(frame, func(nalu []byte) bool {
+		if len(nalu) == 0 {
+			return true
+		}
+		if isH265 {
+			switch codec.H265NaluTypeWithoutStartCode(nalu) {
+			case codec.H265_NAL_AUD:
+				return true
+			case codec.H265_NAL_VPS:
+				if this.isHeaderWritten == false {
+					this.getHevcConfig().UpdateVPS(mkvWithStartCode(nalu))
+					this.hevcHasVps = true
+				}
+			case codec.H265_NAL_SPS:
+				if this.isHeaderWritten == false {
+					this.getHevcConfig().UpdateSPS(mkvWithStartCode(nalu))
+					this.hevcHasSps = true
+				}
+			case codec.H265_NAL_PPS:
+				if this.isHeaderWritten == false {
+					this.getHevcConfig().UpdatePPS(mkvWithStartCode(nalu))
+					this.hevcHasPps = true
+				}
+			default:
+				naluType := codec.H265NaluTypeWithoutStartCode(nalu)
+				if naluType >= 16 && naluType <= 23 { // IRAP
+					isKeyFrame = true
+				}
+			}
+		} else {
+			switch codec.H264NaluTypeWithoutStartCode(nalu) {
+			case codec.H264_NAL_AUD:
+				return true
+			case codec.H264_NAL_SPS:
+				if this.isHeaderWritten == false && len(this.h264SpsList) == 0 {
+					this.h264SpsList = append(this.h264SpsList, mkvWithStartCode(nalu))
+				}
+			case codec.H264_NAL_PPS:
+				if this.isHeaderWritten == false && len(this.h264PpsList) == 0 {
+					this.h264PpsList = append(this.h264PpsList, mkvWithStartCode(nalu))
+				}
+			case codec.H264_NAL_I_SLICE:
+				isKeyFrame = true
+			}
+		}
+		size := make([]byte, 4)
+		binary.BigEndian.PutUint32(size, uint32(len(nalu)))
+		data = append(data, size...)
+		data = append(data, nalu...)
+		return true
+	})
+	return data, isKeyFrame
+}
+
+// mkvWithStartCode gomedia的参数集函数需要带起始码的NALU
+func mkvWithStartCode(nalu []byte) []byte {
+	return append([]byte{0, 0, 0, 1}, nalu...)
+}
+
+func (this *mkvWriter) getHevcConfig() *codec.HEVCRecordConfiguration {
+	if this.hevcConfig == nil {
+		this.hevcConfig = codec.NewHEVCRecordConfiguration()
+	}
+	return this.hevcConfig
+}
+
+func (this *mkvWriter) isVideoConfigReady() bool {
+	if this.hevcConfig != nil {
+		return this.hevcHasVps && this.hevcHasSps && this.hevcHasPps
+	}
+	return len(this.h264SpsList) > 0 && len(this.h264PpsList) > 0
+}
+
+// newVideoTrack 第一个视频帧时创建, CodecPrivate在写入轨道信息时生成
+func (this *mkvWriter) newVideoTrack(isH265 bool) *mkvTrack {
+	return &mkvTrack{
+		trackType: mkvTrackTypeVideo,
+		codecId:   mkvCodecIdForVideo(isH265),
+	}
+}
+
+func (this *mkvWriter) updateVideoCodecPrivate() {
+	if this.video == nil || this.isVideoConfigReady() == false {
+		return
+	}
+	if this.hevcConfig != nil {
+		this.video.codecPrivate, _ = this.hevcConfig.Encode()
+		for _, array := range this.hevcConfig.Arrays {
+			if array.NAL_unit_type == uint8(codec.H265_NAL_SPS) && len(array.NalUnits) > 0 {
+				this.video.width, this.video.height = codec.GetH265Resolution(mkvWithStartCode(array.NalUnits[0].Nalu))
+			}
+		}
+		return
+	}
+	this.video.width, this.video.height = codec.GetH264Resolution(this.h264SpsList[0])
+	this.video.codecPrivate, _ = codec.CreateH264AVCCExtradata(this.h264SpsList, this.h264PpsList)
+}
+
+func (this *mkvWriter) addFrame(frame mkvFrame) error {
+	if this.isHeaderWritten {
+		// 轨道信息写入后才出现的轨道没有编号, 不能写入
+		if frame.track.number == 0 {
+			return nil
+		}
+		return this.writeFrame(frame)
+	}
+	this.pendingList = append(this.pendingList, frame)
+	isVideoReady := this.video != nil && this.isVideoConfigReady()
+	if (isVideoReady && this.audio != nil) || len(this.pendingList) >= mkvMaxPendingFrames {
+		return this.flushPending()
+	}
+	return nil
+}
+
+// flushPending 写入轨道信息和缓存的帧
+func (this *mkvWriter) flushPending() error {
+	if this.isHeaderWritten {
+		return nil
+	}
+	this.isHeaderWritten = true
+	this.updateVideoCodecPrivate()
+	if this.video != nil && this.video.codecPrivate == nil {
+		return errors.New("mkv: sps/pps not found")
+	}
+
+	var trackList []*mkvTrack
+	for _, track := range []*mkvTrack{this.video, this.audio} {
+		if track != nil {
+			track.number = uint64(len(trackList) + 1)
+			trackList = append(trackList, track)
+		}
+	}
+	var buf bytes.Buffer
+	mkvWriteMaster(&buf, mkvIdTracks, func(b *bytes.Buffer) {
+		for _, track := range trackList {
+			mkvWriteTrackEntry(b, track)
+		}
+	})
+	pos, err := this.w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	this.tracksPos = pos
+	_, err = this.w.Write(buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	for _, frame := range this.pendingList {
+		if this.isBaseSet == false || frame.dts < this.baseMs {
+			this.baseMs = frame.dts
+			this.isBaseSet = true
+		}
+	}
+	for _, frame := range this.pendingList {
+		err = this.writeFrame(frame)
+		if err != nil {
+			return err
+		}
+	}
+	this.pendingList = nil
+	return nil
+}
+
+func mkvWriteTrackEntry(b *bytes.Buffer, track *mkvTrack) {
+	mkvWriteMaster(b, mkvIdTrackEntry, func(b *bytes.Buffer) {
+		mkvWriteUint(b, mkvIdTrackNumber, track.number)
+		mkvWriteUint(b, mkvIdTrackUID, track.number)
+		mkvWriteUint(b, mkvIdTrackType, uint64(track.trackType))
+		mkvWriteUint(b, mkvIdFlagLacing, 0)
+		mkvWriteString(b, mkvIdCodecID, track.codecId)
+		if len(track.codecPrivate) > 0 {
+			mkvWriteBinary(b, mkvIdCodecPrivate, track.codecPrivate)
+		}
+		switch track.trackType {
+		case mkvTrackTypeVideo:
+			mkvWriteMaster(b, mkvIdVideo, func(b *bytes.Buffer) {
+				mkvWriteUint(b, mkvIdPixelWidth, uint64(track.width))
+				mkvWriteUint(b, mkvIdPixelHeight, uint64(track.height))
+			})
+		case mkvTrackTypeAudio:
+			mkvWriteMaster(b, mkvIdAudio, func(b *bytes.Buffer) {
+				mkvWriteFloat(b, mkvIdSamplingFrequency, float64(track.sampleRate))
+				mkvWriteUint(b, mkvIdChannels, uint64(track.channels))
+			})
+		}
+	})
+}
+
+func (this *mkvWriter) writeFrame(frame mkvFrame) error {
+	pts := frame.pts - this.baseMs
+	if pts < 0 {
+		pts = 0
+	}
+	if this.isNeedNewCluster(frame, pts) {
+		err := this.flushCluster()
+		if err != nil {
+			return err
+		}
+		this.clusterStartMs = pts
+		this.clusterHasFrame = true
+		mkvWriteUint(&this.clusterBuf, mkvIdTimestamp, uint64(pts))
+
+		isCue := frame.track.trackType == mkvTrackTypeVideo || this.video == nil
+		if isCue {
+			pos, err := this.w.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return err
+			}
+			this.cueList = append(this.cueList, mkvCuePoint{
+				timeMs:   pts,
+				track:    frame.track.number,
+				position: pos - this.segmentDataPos,
+			})
+		}
+	}
+
+	// SimpleBlock: 轨道号 + 相对于Cluster的时间戳(int16) + 标志
+	var header [4]byte
+	header[0] = 0x80 | byte(frame.track.number)
+	binary.BigEndian.PutUint16(header[1:3], uint16(int16(pts-this.clusterStartMs)))
+	if frame.isKeyFrame {
+		header[3] = 0x80
+	}
+	mkvWriteId(&this.clusterBuf, mkvIdSimpleBlock)
+	mkvWriteSize(&this.clusterBuf, uint64(len(header)+len(frame.data)))
+	this.clusterBuf.Write(header[:])
+	this.clusterBuf.Write(frame.data)
+	if pts > this.maxPtsMs {
+		this.maxPtsMs = pts
+	}
+	return nil
+}
+
+func (this *mkvWriter) isNeedNewCluster(frame mkvFrame, pts int64) bool {
+	if this.clusterHasFrame == false {
+		return true
+	}
+	diff := pts - this.clusterStartMs
+	if diff > math.MaxInt16 || diff < math.MinInt16 || diff >= mkvClusterMaxMs || this.clusterBuf.Len() >= mkvClusterMaxBytes {
+		return true
+	}
+	if diff < mkvClusterMinMs {
+		return false
+	}
+	if this.video == nil {
+		return true
+	}
+	return frame.track == this.video && frame.isKeyFrame
+}
+
+func (this *mkvWriter) flushCluster() error {
+	if this.clusterHasFrame == false {
+		return nil
+	}
+	var buf bytes.Buffer
+	mkvWriteId(&buf, mkvIdCluster)
+	mkvWriteSize(&buf, uint64(this.clusterBuf.Len()))
+	buf.Write(this.clusterBuf.Bytes())
+	this.clusterBuf.Reset()
+	this.clusterHasFrame = false
+	_, err := this.w.Write(buf.Bytes())
+	return err
+}
+
+func (this *mkvWriter) WriteTrailer() error {
+	err := this.audioSplitter.flush(this.writeOtherAudio)
+	if err != nil {
+		return err
+	}
+	err = this.flushPending()
+	if err != nil {
+		return err
+	}
+	err = this.flushCluster()
+	if err != nil {
+		return err
+	}
+
+	cuesPos, err := this.w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if len(this.cueList) > 0 {
+		mkvWriteMaster(&buf, mkvIdCues, func(b *bytes.Buffer) {
+			for _, cue := range this.cueList {
+				mkvWriteMaster(b, mkvIdCuePoint, func(b *bytes.Buffer) {
+					mkvWriteUint(b, mkvIdCueTime, uint64(cue.timeMs))
+					mkvWriteMaster(b, mkvIdCueTrackPositions, func(b *bytes.Buffer) {
+						mkvWriteUint(b, mkvIdCueTrack, cue.track)
+						mkvWriteUint(b, mkvIdCueClusterPosition, uint64(cue.position))
+					})
+				})
+			}
+		})
+	}
+	_, err = this.w.Write(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	endPos, err := this.w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	// 回填 Segment大小、Duration、SeekHead
+	var segmentSize [8]byte
+	binary.BigEndian.PutUint64(segmentSize[:], uint64(endPos-this.segmentDataPos))
+	segmentSize[0] = 0x01
+	err = this.writeAt(this.segmentSizePos, segmentSize[:])
+	if err != nil {
+		return err
+	}
+	var duration [8]byte
+	binary.BigEndian.PutUint64(duration[:], math.Float64bits(float64(this.maxPtsMs)))
+	err = this.writeAt(this.durationPos, duration[:])
+	if err != nil {
+		return err
+	}
+
+	buf.Reset()
+	mkvWriteMaster(&buf, mkvIdSeekHead, func(b *bytes.Buffer) {
+		mkvWriteSeek(b, mkvIdInfo, this.infoPos-this.segmentDataPos)
+		mkvWriteSeek(b, mkvIdTracks, this.tracksPos-this.segmentDataPos)
+		if len(this.cueList) > 0 {
+			mkvWriteSeek(b, mkvIdCues, cuesPos-this.segmentDataPos)
+		}
+	})
+	mkvWriteVoid(&buf, mkvSeekHeadReserveSize-buf.Len())
+	err = this.writeAt(this.seekHeadPos, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = this.w.Seek(endPos, io.SeekStart)
+	return err
+}
+
+func (this *mkvWriter) writeAt(pos int64, data []byte) error {
+	_, err := this.w.Seek(pos, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = this.w.Write(data)
+	return err
+}
+
+func mkvWriteSeek(b *bytes.Buffer, id uint32, position int64) {
+	mkvWriteMaster(b, mkvIdSeek, func(b *bytes.Buffer) {
+		var idBuf bytes.Buffer
+		mkvWriteId(&idBuf, id)
+		mkvWriteBinary(b, mkvIdSeekID, idBuf.Bytes())
+		mkvWriteUint(b, mkvIdSeekPosition, uint64(position))
+	})
+}
+
+// Segment写完之前大小未知, 使用8字节的大小, 方便回填
+var mkvUnknownSize = [8]byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+func mkvWriteId(b *bytes.Buffer, id uint32) {
+	switch {
+	case id > 0xFFFFFF:
+		b.Write([]byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)})
+	case id > 0xFFFF:
+		b.Write([]byte{byte(id >> 16), byte(id >> 8), byte(id)})
+	case id > 0xFF:
+		b.Write([]byte{byte(id >> 8), byte(id)})
+	default:
+		b.WriteByte(byte(id))
+	}
+}
+
+// mkvWriteSize 使用最短的变长整数, 全1的值表示大小未知, 所以每种长度能表示的最大值为 2^(7*n)-2
+func mkvWriteSize(b *bytes.Buffer, size uint64) {
+	length := 1
+	for length < 8 && size >= (uint64(1)<<(7*uint(length)))-1 {
+		length++
+	}
+	tmp := make([]byte, length)
+	for idx := length - 1; idx >= 0; idx-- {
+		tmp[idx] = byte(size)
+		size >>= 8
+	}
+	tmp[0] |= 0x80 >> uint(length-1)
+	b.Write(tmp)
+}
+
+func mkvWriteMaster(b *bytes.Buffer, id uint32, fn func(b *bytes.Buffer)) {
+	var child bytes.Buffer
+	fn(&child)
+	mkvWriteBinary(b, id, child.Bytes())
+}
+
+func mkvWriteBinary(b *bytes.Buffer, id uint32, data []byte) {
+	mkvWriteId(b, id)
+	mkvWriteSize(b, uint64(len(data)))
+	b.Write(data)
+}
+
+func mkvWriteString(b *bytes.Buffer, id uint32, value string) {
+	mkvWriteBinary(b, id, []byte(value))
+}
+
+func mkvWriteUint(b *bytes.Buffer, id uint32, value uint64) {
+	length := 1
+	for length < 8 && value>>(8*uint(length)) != 0 {
+		length++
+	}
+	tmp := make([]byte, length)
+	for idx := length - 1; idx >= 0; idx-- {
+		tmp[idx] = byte(value)
+		value >>= 8
+	}
+	mkvWriteBinary(b, id, tmp)
+}
+
+func mkvWriteFloat(b *bytes.Buffer, id uint32, value float64) {
+	var tmp [8]byte
+	binary.BigEndian.PutUint64(tmp[:], math.Float64bits(value))
+	mkvWriteBinary(b, id, tmp[:])
+}
+
+// mkvWriteVoid 写入总长度为size的Void元素, size至少为2
+func mkvWriteVoid(b *bytes.Buffer, size int) {
+	b.WriteByte(mkvIdVoid)
+	if size-2 < 127 {
+		mkvWriteSize(b, uint64(size-2))
+		b.Write(make([]byte, size-2))
+		return
+	}
+	// 使用8字节的大小
+	var tmp [8]byte
+	binary.BigEndian.PutUint64(tmp[:], uint64(size-9))
+	tmp[0] = 0x01
+	b.Write(tmp[:])
+	b.Write(make([]byte, size-9))
+}
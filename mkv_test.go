@@ -0,0 +1,366 @@
+package m3u8d
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/yapingcat/gomedia/go-mpeg2"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type mkvTestElement struct {
+	id     uint32
+	offset int // 元素在父元素数据里的位置
+	data   []byte
+}
+
+func mkvTestReadVint(data []byte, keepMarker bool) (value uint64, length int, err error) {
+	if len(data) == 0 || data[0] == 0 {
+		return 0, 0, errors.New("invalid vint")
+	}
+	length = 1
+	for data[0]&(0x80>>uint(length-1)) == 0 {
+		length++
+	}
+	if len(data) < length {
+		return 0, 0, errors.New("vint too short")
+	}
+	value = uint64(data[0])
+	if keepMarker == false {
+		value &= uint64(0xFF >> uint(length))
+	}
+	for idx := 1; idx < length; idx++ {
+		value = value<<8 | uint64(data[idx])
+	}
+	return value, length, nil
+}
+
+func mkvTestParse(data []byte) (list []mkvTestElement, err error) {
+	offset := 0
+	for offset < len(data) {
+		id, idLen, err := mkvTestReadVint(data[offset:], true)
+		if err != nil {
+			return nil, err
+		}
+		size, sizeLen, err := mkvTestReadVint(data[offset+idLen:], false)
+		if err != nil {
+			return nil, err
+		}
+		begin := offset + idLen + sizeLen
+		if uint64(len(data)-begin) < size {
+			return nil, errors.New("element too large")
+		}
+		list = append(list, mkvTestElement{
+			id:     uint32(id),
+			offset: offset,
+			data:   data[begin : begin+int(size)],
+		})
+		offset = begin + int(size)
+	}
+	return list, nil
+}
+
+func mkvTestChildren(t *testing.T, element mkvTestElement) map[uint32][]mkvTestElement {
+	list, err := mkvTestParse(element.data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := map[uint32][]mkvTestElement{}
+	for _, one := range list {
+		m[one.id] = append(m[one.id], one)
+	}
+	return m
+}
+
+func mkvTestUint(data []byte) (value uint64) {
+	for _, b := range data {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+func TestMkvWriteSize(t *testing.T) {
+	for _, one := range []struct {
+		size   uint64
+		length int
+	}{
+		{0, 1}, {126, 1}, {127, 2}, {16382, 2}, {16383, 3}, {1 << 30, 5},
+	} {
+		var buf bytes.Buffer
+		mkvWriteSize(&buf, one.size)
+		if buf.Len() != one.length {
+			t.Fatal(one.size, buf.Len())
+		}
+		value, length, err := mkvTestReadVint(buf.Bytes(), false)
+		if err != nil || value != one.size || length != one.length {
+			t.Fatal(one.size, value, length, err)
+		}
+	}
+}
+
+func TestMergeToMkv(t *testing.T) {
+	tsFileList, err := filepath.Glob("testdata/TestFull/*.ts")
+	if err != nil || len(tsFileList) == 0 {
+		t.Fatal(tsFileList, err)
+	}
+	outputName := filepath.Join(t.TempDir(), "all.mkv")
+	err = MergeTsFileListToSingleMp4(MergeTsFileListToSingleMp4_Req{
+		TsFileList:   tsFileList,
+		OutputMp4:    outputName,
+		OutputFormat: OutputFormat_Mkv,
+		Ctx:          context.Background(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(outputName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topList, err := mkvTestParse(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(topList) != 2 || topList[0].id != mkvIdEBML || topList[1].id != mkvIdSegment {
+		t.Fatal(len(topList))
+	}
+	header := mkvTestChildren(t, topList[0])
+	if string(header[mkvIdDocType][0].data) != "matroska" {
+		t.Fatal(string(header[mkvIdDocType][0].data))
+	}
+
+	segment := topList[1]
+	segmentList, err := mkvTestParse(segment.data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if segmentList[0].id != mkvIdSeekHead {
+		t.Fatal(segmentList[0].id)
+	}
+	// SeekHead 和 Cues 里的位置都相对于Segment数据开始的位置
+	idAtPosition := func(position uint64) uint32 {
+		for _, one := range segmentList {
+			if uint64(one.offset) == position {
+				return one.id
+			}
+		}
+		return 0
+	}
+	seekHead := mkvTestChildren(t, segmentList[0])
+	if len(seekHead[mkvIdSeek]) != 3 {
+		t.Fatal(len(seekHead[mkvIdSeek]))
+	}
+	for _, seek := range seekHead[mkvIdSeek] {
+		children := mkvTestChildren(t, seek)
+		id := uint32(mkvTestUint(children[mkvIdSeekID][0].data))
+		position := mkvTestUint(children[mkvIdSeekPosition][0].data)
+		if idAtPosition(position) != id {
+			t.Fatal(id, position)
+		}
+	}
+
+	m := map[uint32][]mkvTestElement{}
+	for _, one := range segmentList {
+		m[one.id] = append(m[one.id], one)
+	}
+	if len(m[mkvIdInfo]) != 1 || len(m[mkvIdTracks]) != 1 || len(m[mkvIdCues]) != 1 || len(m[mkvIdCluster]) == 0 {
+		t.Fatal(len(m[mkvIdInfo]), len(m[mkvIdTracks]), len(m[mkvIdCues]), len(m[mkvIdCluster]))
+	}
+	info := mkvTestChildren(t, m[mkvIdInfo][0])
+	if mkvTestUint(info[mkvIdTimestampScale][0].data) != 1000000 {
+		t.Fatal("TimestampScale")
+	}
+	durationMs := math.Float64frombits(binary.BigEndian.Uint64(info[mkvIdDuration][0].data))
+	if durationMs <= 1000 {
+		t.Fatal(durationMs)
+	}
+
+	tracks := mkvTestChildren(t, m[mkvIdTracks][0])
+	if len(tracks[mkvIdTrackEntry]) != 2 {
+		t.Fatal(len(tracks[mkvIdTrackEntry]))
+	}
+	video := mkvTestChildren(t, tracks[mkvIdTrackEntry][0])
+	if string(video[mkvIdCodecID][0].data) != "V_MPEG4/ISO/AVC" || mkvTestUint(video[mkvIdTrackNumber][0].data) != 1 {
+		t.Fatal(string(video[mkvIdCodecID][0].data))
+	}
+	if avcC := video[mkvIdCodecPrivate][0].data; len(avcC) < 7 || avcC[0] != 1 {
+		t.Fatal(avcC)
+	}
+	videoSize := mkvTestChildren(t, video[mkvIdVideo][0])
+	if mkvTestUint(videoSize[mkvIdPixelWidth][0].data) != 1280 || mkvTestUint(videoSize[mkvIdPixelHeight][0].data) != 720 {
+		t.Fatal("video size")
+	}
+	audio := mkvTestChildren(t, tracks[mkvIdTrackEntry][1])
+	if string(audio[mkvIdCodecID][0].data) != "A_AAC" || len(audio[mkvIdCodecPrivate][0].data) != 2 {
+		t.Fatal(string(audio[mkvIdCodecID][0].data))
+	}
+
+	var blockCountMap = map[byte]int{}
+	var lastAudioMs int64 = -1
+	var maxMs int64
+	for clusterIdx, cluster := range m[mkvIdCluster] {
+		children := mkvTestChildren(t, cluster)
+		clusterMs := int64(mkvTestUint(children[mkvIdTimestamp][0].data))
+		for blockIdx, block := range children[mkvIdSimpleBlock] {
+			trackNumber := block.data[0] & 0x7F
+			blockMs := clusterMs + int64(int16(binary.BigEndian.Uint16(block.data[1:3])))
+			isKeyFrame := block.data[3]&0x80 != 0
+			frame := block.data[4:]
+			blockCountMap[trackNumber]++
+			if blockMs > maxMs {
+				maxMs = blockMs
+			}
+			switch trackNumber {
+			case 1:
+				if clusterIdx == 0 && blockCountMap[1] == 1 && isKeyFrame == false {
+					t.Fatal("first video frame is not key frame")
+				}
+				// 每个NALU都有4字节的长度
+				for len(frame) > 0 {
+					if len(frame) < 4 || int(binary.BigEndian.Uint32(frame)) > len(frame)-4 {
+						t.Fatal("invalid nalu length", clusterIdx, blockIdx)
+					}
+					frame = frame[4+binary.BigEndian.Uint32(frame):]
+				}
+			case 2:
+				if len(frame) > 1 && frame[0] == 0xFF && frame[1]&0xF0 == 0xF0 {
+					t.Fatal("adts header not removed")
+				}
+				if blockMs < lastAudioMs {
+					t.Fatal("audio timestamp", blockMs, lastAudioMs)
+				}
+				lastAudioMs = blockMs
+			default:
+				t.Fatal(trackNumber)
+			}
+		}
+	}
+	if blockCountMap[1] == 0 || blockCountMap[2] == 0 || int64(durationMs) != maxMs {
+		t.Fatal(blockCountMap, durationMs, maxMs)
+	}
+
+	cues := mkvTestChildren(t, m[mkvIdCues][0])
+	for _, cuePoint := range cues[mkvIdCuePoint] {
+		positions := mkvTestChildren(t, mkvTestChildren(t, cuePoint)[mkvIdCueTrackPositions][0])
+		if idAtPosition(mkvTestUint(positions[mkvIdCueClusterPosition][0].data)) != mkvIdCluster {
+			t.Fatal("cue position")
+		}
+	}
+}
+
+func TestParseOutputFormat(t *testing.T) {
+	for _, one := range []struct {
+		in  string
+		out string
+	}{
+		{"", OutputFormat_Mp4}, {"MP4", OutputFormat_Mp4}, {" mkv ", OutputFormat_Mkv},
+	} {
+		out, errMsg := ParseOutputFormat(one.in)
+		if errMsg != "" || out != one.out {
+			t.Fatal(one.in, out, errMsg)
+		}
+	}
+	if _, errMsg := ParseOutputFormat("avi"); errMsg == "" {
+		t.Fatal("avi")
+	}
+	if GetOutputFormatByName("a.MKV") != OutputFormat_Mkv || GetOutputFormatByName("") != OutputFormat_Mp4 {
+		t.Fatal("GetOutputFormatByName")
+	}
+}
+
+// 超过 mkvMaxPendingFrames 帧之后才出现的音频轨道没有写入Tracks, 丢弃它的帧
+func TestMkvLateTrack(t *testing.T) {
+	content, err := os.ReadFile(filepath.Join("testdata", "TestFull", "jhxy.016.ts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	type testFrame struct {
+		cid      mpeg2.TS_STREAM_TYPE
+		frame    []byte
+		pts, dts uint64
+	}
+	var videoList, audioList []testFrame
+	demuxer := newTsDemuxer()
+	demuxer.OnFrame = func(cid mpeg2.TS_STREAM_TYPE, frame []byte, pts uint64, dts uint64) {
+		one := testFrame{cid: cid, frame: append([]byte{}, frame...), pts: pts, dts: dts}
+		if isTsVideoStream(cid) {
+			videoList = append(videoList, one)
+		} else {
+			audioList = append(audioList, one)
+		}
+	}
+	err = demuxer.Input(bytes.NewReader(content))
+	if err != nil || len(videoList) == 0 || len(audioList) == 0 {
+		t.Fatal(len(videoList), len(audioList), err)
+	}
+
+	outputName := filepath.Join(t.TempDir(), "late.mkv")
+	f, err := os.Create(outputName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	writer, err := newMkvWriter(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 重复视频帧直到超过 mkvMaxPendingFrames, 然后才开始写入音频
+	var offset uint64
+	for count := 0; count <= mkvMaxPendingFrames; {
+		for _, one := range videoList {
+			err = writer.WriteFrame(one.cid, one.frame, one.pts+offset, one.dts+offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			count++
+		}
+		offset += videoList[len(videoList)-1].dts - videoList[0].dts + 40
+	}
+	for _, one := range audioList {
+		err = writer.WriteFrame(one.cid, one.frame, one.pts+offset, one.dts+offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = writer.WriteTrailer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err = os.ReadFile(outputName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topList, err := mkvTestParse(content)
+	if err != nil || len(topList) != 2 {
+		t.Fatal(len(topList), err)
+	}
+	segmentList, err := mkvTestParse(topList[1].data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blockCount int
+	for _, one := range segmentList {
+		switch one.id {
+		case mkvIdTracks:
+			if trackList := mkvTestChildren(t, one)[mkvIdTrackEntry]; len(trackList) != 1 {
+				t.Fatal(len(trackList))
+			}
+		case mkvIdCluster:
+			for _, block := range mkvTestChildren(t, one)[mkvIdSimpleBlock] {
+				if trackNumber := block.data[0] & 0x7F; trackNumber != 1 {
+					t.Fatal(trackNumber)
+				}
+				blockCount++
+			}
+		}
+	}
+	if blockCount <= mkvMaxPendingFrames {
+		t.Fatal(blockCount)
+	}
+}
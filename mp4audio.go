@@ -0,0 +1,183 @@
+package m3u8d
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// makeMp4Ac3SampleEntry AC-3/E-AC-3的样本描述: AC-3为 ac-3+dac3, E-AC-3为 ec-3+dec3
+func makeMp4Ac3SampleEntry(header tsAudioHeader) []byte {
+	var entryType string
+	var child []byte
+	if header.cid == tsStreamAc3 {
+		entryType = "ac-3"
+		bs := newTsBitWriter()
+		bs.write(header.fscod, 2)
+		bs.write(header.bsid, 5)
+		bs.write(header.bsmod, 3)
+		bs.write(header.acmod, 3)
+		bs.write(header.lfeon, 1)
+		bs.write(header.bitRateCode, 5)
+		bs.write(0, 5) // reserved
+		child = makeMp4Box("dac3", bs.bytes())
+	} else {
+		entryType = "ec-3"
+		bs := newTsBitWriter()
+		bs.write(header.frameSize*8*header.sampleRate/header.sampleCount/1000, 13) // data_rate, kbps
+		bs.write(0, 3)                                                             // num_ind_sub - 1
+		bs.write(header.fscod, 2)
+		bs.write(header.bsid, 5)
+		bs.write(0, 1) // reserved
+		bs.write(0, 1) // asvc
+		bs.write(header.bsmod, 3)
+		bs.write(header.acmod, 3)
+		bs.write(header.lfeon, 1)
+		bs.write(0, 3) // reserved
+		bs.write(0, 4) // num_dep_sub, 依赖流的声道不写在这里
+		bs.write(0, 1) // reserved
+		child = makeMp4Box("dec3", bs.bytes())
+	}
+	var body bytes.Buffer
+	body.Write(make([]byte, 6))
+	binary.Write(&body, binary.BigEndian, uint16(1)) // data_reference_index
+	body.Write(make([]byte, 8))
+	binary.Write(&body, binary.BigEndian, uint16(header.channels))
+	binary.Write(&body, binary.BigEndian, uint16(16)) // samplesize
+	body.Write(make([]byte, 4))
+	binary.Write(&body, binary.BigEndian, uint32(header.sampleRate)<<16)
+	body.Write(child)
+	return makeMp4Box(entryType, body.Bytes())
+}
+
+func makeMp4Box(boxType string, body []byte) []byte {
+	box := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(box, uint32(8+len(body)))
+	copy(box[4:], boxType)
+	return append(box, body...)
+}
+
+// mp4SampleEntryWriter gomedia不支持 ac-3、ec-3 的样本描述, 这些音轨先按照G711写入, 写moov时替换样本描述.
+//
+//	gomedia一次Write写入整个moov, 后面的偏移量都是通过Seek得到的, 所以moov的大小变化不影响其它box
+type mp4SampleEntryWriter struct {
+	w        io.WriteSeeker
+	entryMap map[uint32][]byte // track id => 样本描述
+}
+
+func newMp4SampleEntryWriter(w io.WriteSeeker) *mp4SampleEntryWriter {
+	return &mp4SampleEntryWriter{
+		w:        w,
+		entryMap: map[uint32][]byte{},
+	}
+}
+
+func (this *mp4SampleEntryWriter) Write(p []byte) (n int, err error) {
+	if len(this.entryMap) == 0 || len(p) < 8 || string(p[4:8]) != "moov" || int(binary.BigEndian.Uint32(p[:4])) != len(p) {
+		return this.w.Write(p)
+	}
+	moov := p
+	for trackId, entry := range this.entryMap {
+		moov, err = mp4ReplaceSampleEntry(moov, trackId, entry)
+		if err != nil {
+			return 0, err
+		}
+	}
+	_, err = this.w.Write(moov)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (this *mp4SampleEntryWriter) Seek(offset int64, whence int) (int64, error) {
+	return this.w.Seek(offset, whence)
+}
+
+// mp4ReplaceSampleEntry 把moov里trackId的第一个样本描述替换为entry, 修改上层box的大小
+func mp4ReplaceSampleEntry(moov []byte, trackId uint32, entry []byte) ([]byte, error) {
+	r := bytes.NewReader(moov)
+	moovBox, ok := fmp4ReadBox(r, 0, int64(len(moov)))
+	if ok == false {
+		return nil, errors.New("invalid moov")
+	}
+	for _, trak := range fmp4ReadChildren(r, moovBox) {
+		if trak.boxType != "trak" {
+			continue
+		}
+		pathList := []fmp4Box{moovBox, trak}
+		var isFound bool
+		for _, child := range fmp4ReadChildren(r, trak) {
+			if child.boxType == "tkhd" {
+				body, err := fmp4ReadBody(r, child)
+				if err != nil {
+					return nil, err
+				}
+				isFound = fmp4ParseTkhdTrackId(body) == trackId
+				break
+			}
+		}
+		if isFound == false {
+			continue
+		}
+		for _, boxType := range []string{"mdia", "minf", "stbl", "stsd"} {
+			var child fmp4Box
+			for _, one := range fmp4ReadChildren(r, pathList[len(pathList)-1]) {
+				if one.boxType == boxType {
+					child = one
+					break
+				}
+			}
+			if child.boxType == "" {
+				return nil, errors.New("mp4 " + boxType + " not found")
+			}
+			pathList = append(pathList, child)
+		}
+		stsd := pathList[len(pathList)-1]
+		old, ok := fmp4ReadBox(r, stsd.offset+stsd.headerSize+8, stsd.offset+stsd.size) // version, flags, entry_count
+		if ok == false {
+			return nil, errors.New("invalid mp4 stsd")
+		}
+		delta := uint32(len(entry)) - uint32(old.size)
+		ret := make([]byte, 0, len(moov)+len(entry))
+		ret = append(ret, moov[:old.offset]...)
+		ret = append(ret, entry...)
+		ret = append(ret, moov[old.offset+old.size:]...)
+		for _, one := range pathList {
+			if one.headerSize != 8 {
+				return nil, errors.New("unsupported mp4 box size " + one.boxType)
+			}
+			binary.BigEndian.PutUint32(ret[one.offset:], binary.BigEndian.Uint32(ret[one.offset:])+delta)
+		}
+		return ret, nil
+	}
+	return nil, errors.New("mp4 track not found " + strconv.Itoa(int(trackId)))
+}
+
+// tsBitWriter 按位写入, 和 tsBitReader 对应
+type tsBitWriter struct {
+	buf    []byte
+	bitPos int
+}
+
+func newTsBitWriter() *tsBitWriter {
+	return &tsBitWriter{}
+}
+
+func (this *tsBitWriter) write(v int, n int) {
+	for idx := n - 1; idx >= 0; idx-- {
+		if this.bitPos%8 == 0 {
+			this.buf = append(this.buf, 0)
+		}
+		if (v>>uint(idx))&1 != 0 {
+			this.buf[len(this.buf)-1] |= 0x80 >> uint(this.bitPos%8)
+		}
+		this.bitPos++
+	}
+}
+
+func (this *tsBitWriter) bytes() []byte {
+	return this.buf
+}
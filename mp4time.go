@@ -28,10 +28,63 @@ func UpdateMp4Time(firstTsName string, mp4FileName string) error {
 	return nil
 }
 
+// UpdateOutputFileTime 更新合并后的文件时间, mp4同时更新文件里记录的创建时间, 其他格式只更新文件时间属性
+func UpdateOutputFileTime(firstTsName string, outputName string, outputFormat string) error {
+	if outputFormat == "" || outputFormat == OutputFormat_Mp4 || outputFormat == OutputFormat_Fmp4 {
+		return UpdateMp4Time(firstTsName, outputName)
+	}
+	stat, err := os.Stat(firstTsName)
+	if err != nil {
+		return errors.New("读取文件状态失败: " + err.Error())
+	}
+	mTime := stat.ModTime()
+	err = setft.SetFileTime(outputName, mTime, mTime, mTime)
+	if err != nil {
+		return errors.New("更新文件时间属性失败: " + err.Error())
+	}
+	return nil
+}
+
 func mov_tag(tag [4]byte) uint32 {
 	return binary.LittleEndian.Uint32(tag[:])
 }
 
+// mp4WalkBox 按顺序遍历r里的box, 调用fn时r的位置在box头后面. fn返回isEnter为true时接着遍历这个box里的子box(只用于容器box), 否则跳到下一个box.
+//
+//	offset为box开始的位置, headerSize为box头的大小
+func mp4WalkBox(r io.ReadSeeker, fn func(box mp4.BasicBox, offset int64, headerSize int) (isEnter bool, err error)) error {
+	offset, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	for {
+		basebox := mp4.BasicBox{}
+		headerSize, err := basebox.Decode(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if basebox.Size < uint64(headerSize) {
+			return errors.New("mp4 Parser error")
+		}
+		isEnter, err := fn(basebox, offset, headerSize)
+		if err != nil {
+			return err
+		}
+		if isEnter {
+			offset += int64(headerSize)
+		} else {
+			offset += int64(basebox.Size)
+		}
+		_, err = r.Seek(offset, io.SeekStart)
+		if err != nil {
+			return err
+		}
+	}
+}
+
 func updateMp4CreateTime(mp4Path string, ctime time.Time) error {
 	timeBuf := make([]byte, 4)
 	binary.BigEndian.PutUint32(timeBuf, uint32(ctime.Unix()))
@@ -45,28 +98,19 @@ func updateMp4CreateTime(mp4Path string, ctime time.Time) error {
 	var posList []int64
 	var zeroPosList []int64
 
-	for err == nil {
-		basebox := mp4.BasicBox{}
-		_, err = basebox.Decode(mp4Fd)
-		if err != nil {
-			break
-		}
-		if basebox.Size < mp4.BasicBoxLen {
-			err = errors.New("mp4 Parser error")
-			break
-		}
+	err = mp4WalkBox(mp4Fd, func(basebox mp4.BasicBox, _ int64, _ int) (isEnter bool, err error) {
 		tagName := mov_tag(basebox.Type)
 		switch tagName {
 		case mov_tag([4]byte{'m', 'o', 'o', 'v'}):
-			break
+			return true, nil
 		case mov_tag([4]byte{'m', 'v', 'h', 'd'}):
 			var offset int64
 			if offset, err = mp4Fd.Seek(0, io.SeekCurrent); err != nil {
-				break
+				return false, err
 			}
 			mvhd := mp4.MovieHeaderBox{Box: new(mp4.FullBox)}
 			if _, err = mvhd.Decode(mp4Fd); err != nil {
-				break
+				return false, err
 			}
 			if mvhd.Box.Version == 0 {
 				posList = append(posList, offset+4) //create time
@@ -78,17 +122,17 @@ func updateMp4CreateTime(mp4Path string, ctime time.Time) error {
 				posList = append(posList, offset+16) //modify time
 			}
 		case mov_tag([4]byte{'t', 'r', 'a', 'k'}):
-			break
+			return true, nil
 		case mov_tag([4]byte{'m', 'd', 'i', 'a'}):
-			break
+			return true, nil
 		case mov_tag([4]byte{'m', 'd', 'h', 'd'}):
 			var offset int64
 			if offset, err = mp4Fd.Seek(0, io.SeekCurrent); err != nil {
-				break
+				return false, err
 			}
 			mdhd := mp4.MediaHeaderBox{Box: new(mp4.FullBox)}
 			if _, err = mdhd.Decode(mp4Fd); err != nil {
-				break
+				return false, err
 			}
 			if mdhd.Box.Version == 0 {
 				posList = append(posList, offset+4) //create time
@@ -102,11 +146,11 @@ func updateMp4CreateTime(mp4Path string, ctime time.Time) error {
 		case mov_tag([4]byte{'t', 'k', 'h', 'd'}):
 			var offset int64
 			if offset, err = mp4Fd.Seek(0, io.SeekCurrent); err != nil {
-				break
+				return false, err
 			}
 			tkhd := mp4.TrackHeaderBox{Box: new(mp4.FullBox)}
 			if _, err = tkhd.Decode(mp4Fd); err != nil {
-				break
+				return false, err
 			}
 			if tkhd.Box.Version == 0 {
 				posList = append(posList, offset+4) //create time
@@ -117,11 +161,10 @@ func updateMp4CreateTime(mp4Path string, ctime time.Time) error {
 				zeroPosList = append(zeroPosList, offset+12)
 				posList = append(posList, offset+16) //modify time
 			}
-		default:
-			_, err = mp4Fd.Seek(int64(basebox.Size)-mp4.BasicBoxLen, io.SeekCurrent)
 		}
-	}
-	if err != io.EOF {
+		return false, nil
+	})
+	if err != nil {
 		return err
 	}
 
@@ -0,0 +1,165 @@
+package m3u8d
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/orestonce/m3u8d/mformat"
+)
+
+// Pause 暂停下载ts: 不再开始新的ts, 正在下载的ts会继续下载完成. 只有下载ts阶段及之前可以暂停
+func (this *DownloadEnv) Pause() (ok bool) {
+	this.status.Locker.Lock()
+	if this.status.IsRunning == false || this.pauseCh != nil || IsContextCancel(this.ctx) {
+		this.status.Locker.Unlock()
+		return false
+	}
+	if this.status.phase == Phase_Analyze || this.status.phase == Phase_Merge {
+		this.status.Locker.Unlock()
+		return false
+	}
+	this.pauseCh = make(chan struct{})
+	this.status.Locker.Unlock()
+
+	this.logToFile("pause")
+	this.emitEvent(DownloadEvent{Type: EventType_Pause})
+	return true
+}
+
+// Resume 继续下载, 复用之前获取到的ts列表和已经下载的ts
+func (this *DownloadEnv) Resume() (ok bool) {
+	this.status.Locker.Lock()
+	if this.pauseCh == nil {
+		this.status.Locker.Unlock()
+		return false
+	}
+	close(this.pauseCh)
+	this.pauseCh = nil
+	this.resumeSeq++
+	this.status.Locker.Unlock()
+
+	this.logToFile("resume")
+	this.emitEvent(DownloadEvent{Type: EventType_Resume})
+	return true
+}
+
+func (this *DownloadEnv) IsPaused() bool {
+	this.status.Locker.Lock()
+	defer this.status.Locker.Unlock()
+
+	return this.pauseCh != nil
+}
+
+// waitResume 暂停时阻塞, 直到 Resume 或者取消
+func (this *DownloadEnv) waitResume() {
+	this.status.Locker.Lock()
+	ch := this.pauseCh
+	ctx := this.ctx
+	this.status.Locker.Unlock()
+
+	if ch == nil {
+		return
+	}
+	select {
+	case <-ch:
+	case <-ctx.Done():
+	}
+}
+
+func (this *DownloadEnv) getResumeSeq() int {
+	this.status.Locker.Lock()
+	defer this.status.Locker.Unlock()
+
+	return this.resumeSeq
+}
+
+// tsHttpCodeError 下载ts时服务器返回的http状态码不是200
+type tsHttpCodeError struct {
+	code int
+	url  string
+}
+
+func (this *tsHttpCodeError) Error() string {
+	return `invalid http status code: ` + strconv.Itoa(this.code) + ` url: ` + this.url
+}
+
+// isTsUrlExpired 带签名的ts地址过期后, 服务器一般返回这些状态码
+func isTsUrlExpired(err error) bool {
+	var codeErr *tsHttpCodeError
+	if errors.As(err, &codeErr) == false {
+		return false
+	}
+	switch codeErr.code {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusGone:
+		return true
+	}
+	return false
+}
+
+// tsUrlRefresher 暂停时间太长时ts地址可能已经过期, Resume之后ts返回 401/403/404/410 时重新获取一次m3u8, 更新还没有下载完的ts地址.
+//
+//	每个下载线程只修改自己的ts, 所以更新后的地址先放在urlMap里
+type tsUrlRefresher struct {
+	locker     sync.Mutex
+	m3u8Url    string
+	tsCount    int
+	refreshSeq int               // 已经为第几次Resume刷新过
+	urlMap     map[uint32]string // ts.Idx => 新的地址
+}
+
+func newTsUrlRefresher(m3u8Url string, tsCount int) *tsUrlRefresher {
+	return &tsUrlRefresher{
+		m3u8Url: m3u8Url,
+		tsCount: tsCount,
+	}
+}
+
+// refreshIfExpired 返回true表示ts的地址已经更新, 可以马上重试
+func (this *tsUrlRefresher) refreshIfExpired(env *DownloadEnv, ts *mformat.TsInfo, err error) bool {
+	resumeSeq := env.getResumeSeq()
+	if resumeSeq == 0 || isTsUrlExpired(err) == false {
+		return false
+	}
+
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	if this.refreshSeq < resumeSeq {
+		this.refreshSeq = resumeSeq
+		this.urlMap = nil
+		errMsg := this.refreshNoLock(env)
+		if errMsg != "" {
+			env.logToFile("refresh ts url failed: " + errMsg)
+		}
+	}
+	newUrl, ok := this.urlMap[ts.Idx]
+	if ok == false || newUrl == ts.Url {
+		return false
+	}
+	env.logToFile("refresh ts url " + strconv.Quote(ts.Name) + ": " + newUrl)
+	ts.Url = newUrl
+	return true
+}
+
+func (this *tsUrlRefresher) refreshNoLock(env *DownloadEnv) (errMsg string) {
+	_, baseUrl, info, errMsg := env.sniffM3u8(this.m3u8Url)
+	if errMsg != "" {
+		return errMsg
+	}
+	tsList := info.GetTsList()
+	// ts数量变化时无法按照编号对应, 放弃更新
+	if len(tsList) != this.tsCount {
+		return "ts count changed " + strconv.Itoa(this.tsCount) + " => " + strconv.Itoa(len(tsList))
+	}
+	errMsg = updateTsUrl(baseUrl, tsList)
+	if errMsg != "" {
+		return errMsg
+	}
+	this.urlMap = map[uint32]string{}
+	for _, ts := range tsList {
+		this.urlMap[ts.Idx] = ts.Url
+	}
+	return ""
+}
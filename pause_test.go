@@ -0,0 +1,100 @@
+package m3u8d
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPauseResume(t *testing.T) {
+	var locker sync.Mutex
+	var token = 1
+	var m3u8Count int
+	var tsCount int
+	firstTsCh := make(chan struct{})
+	continueCh := make(chan struct{})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/index.m3u8", func(writer http.ResponseWriter, request *http.Request) {
+		locker.Lock()
+		m3u8Count++
+		tokenS := strconv.Itoa(token)
+		locker.Unlock()
+		writer.Write([]byte("#EXTM3U\n#EXT-X-TARGETDURATION:6\n" +
+			"#EXTINF:6,\n/ts/jhxy.016.ts?token=" + tokenS + "\n" +
+			"#EXTINF:6,\n/ts/jhxy.017.ts?token=" + tokenS + "\n" +
+			"#EXTINF:6,\n/ts/jhxy.018.ts?token=" + tokenS + "\n#EXT-X-ENDLIST\n"))
+	})
+	mux.HandleFunc("/ts/", func(writer http.ResponseWriter, request *http.Request) {
+		locker.Lock()
+		tsCount++
+		isFirst := tsCount == 1
+		isExpired := request.URL.Query().Get("token") != strconv.Itoa(token)
+		locker.Unlock()
+		// 模拟带签名的地址过期
+		if isExpired {
+			writer.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if isFirst {
+			close(firstTsCh)
+			<-continueCh
+		}
+		http.ServeFile(writer, request, filepath.Join("testdata", "TestFull", filepath.Base(request.URL.Path)))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	var env DownloadEnv
+	if env.Resume() || env.Pause() {
+		t.Fatal("not running")
+	}
+	saveDir := t.TempDir()
+	ok := env.StartDownload(StartDownload_Req{
+		M3u8Url:     server.URL + "/index.m3u8",
+		SaveDir:     saveDir,
+		ThreadCount: 1,
+		FileName:    "pause",
+	})
+	if !ok {
+		t.Fatal("StartDownload failed")
+	}
+	<-firstTsCh
+	if env.Pause() == false || env.Pause() {
+		t.Fatal("Pause failed")
+	}
+	locker.Lock()
+	token = 2
+	locker.Unlock()
+	close(continueCh) // 正在下载的ts继续下载完成
+
+	time.Sleep(time.Millisecond * 300)
+	status := env.GetStatus()
+	locker.Lock()
+	if tsCount != 1 || status.IsPaused == false || status.IsDownloading == false {
+		t.Fatal(tsCount, status)
+	}
+	locker.Unlock()
+
+	if env.Resume() == false || env.Resume() {
+		t.Fatal("Resume failed")
+	}
+	status = env.WaitDownloadFinish()
+	if status.ErrMsg != "" || status.IsPaused {
+		t.Fatal(status.ErrMsg)
+	}
+	locker.Lock()
+	defer locker.Unlock()
+	// 恢复后ts地址过期, 重新获取了一次m3u8
+	if m3u8Count != 2 {
+		t.Fatal(m3u8Count)
+	}
+	if _, err := os.Stat(filepath.Join(saveDir, "pause.mp4")); err != nil {
+		t.Fatal(err)
+	}
+}
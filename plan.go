@@ -0,0 +1,173 @@
+package m3u8d
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type PlanDownload_Resp struct {
+	ErrMsg  string
+	ErrCode string // 见 ErrCode_*
+
+	M3u8Url           string // 输入的m3u8地址
+	MediaUrl          string // 实际下载ts的m3u8地址
+	VariantBandwidth  int    // 嵌套的m3u8里选择的清晰度, 不是嵌套的m3u8时为0
+	VariantResolution string // 例如 1920x1080
+	SaveFileTo        string // 下载完成后的文件名
+	IsSkipped         bool   // 之前已经下载过, 不会重新下载, SaveFileTo 为之前下载的文件
+
+	TsCount          int
+	KeepCount        int
+	SkipCount        int
+	KeepDurationMs   int
+	KeepDurationText string // 例如 01:02:03
+	KeyUrlList       []string
+	TsList           []PlanTsInfo
+}
+
+type PlanTsInfo struct {
+	Idx        int // ts编号, 从1开始
+	Name       string
+	Url        string
+	DurationMs int
+	KeyUrl     string
+	IsSkipped  bool
+	SkipReason string // 跳过表达式的原因
+}
+
+// PlanDownload 只获取m3u8、计算需要下载的ts, 不下载ts和key, 用于检查跳过表达式、清晰度、保存的文件名
+func PlanDownload(req StartDownload_Req) (resp PlanDownload_Resp) {
+	env := &DownloadEnv{ctx: context.Background()}
+
+	resp.M3u8Url = req.M3u8Url
+	setErr := func(err *DownloadError) PlanDownload_Resp {
+		resp.ErrMsg = err.Message
+		resp.ErrCode = err.Code
+		return resp
+	}
+	skipInfo, downloadErr := env.initRequest(&req)
+	if downloadErr != nil {
+		return setErr(downloadErr)
+	}
+	if req.SkipCacheCheck == false {
+		if history, ok := lookupDownloadHistory(req.SaveDir, newDownloadHistoryKey(req)); ok {
+			resp.SaveFileTo = history.FileList[0].SaveFileTo
+			resp.IsSkipped = true
+		}
+	}
+
+	mediaUrl, baseUrl, info, variant, errMsg := env.sniffM3u8Variant(req.M3u8Url)
+	if errMsg != "" {
+		return setErr(newDownloadError(ErrCode_SniffFailed, "sniffM3u8: "+errMsg, nil))
+	}
+	resp.MediaUrl = mediaUrl
+	if variant != nil {
+		resp.VariantBandwidth = variant.Bandwidth
+		if variant.Resolution.Width > 0 {
+			resp.VariantResolution = strconv.Itoa(variant.Resolution.Width) + "x" + strconv.Itoa(variant.Resolution.Height)
+		}
+	}
+
+	tsList := info.GetTsList()
+	errMsg = updateTsUrl(baseUrl, tsList)
+	if errMsg != "" {
+		return setErr(newDownloadError(ErrCode_PlaylistInvalid, "updateTsUrl: "+errMsg, nil))
+	}
+	keepList, skipRecordList := skipApplyFilter(tsList, skipInfo)
+	skipReasonMap := map[uint32]string{}
+	for _, record := range skipRecordList {
+		skipReasonMap[record.ts.Idx] = record.reason
+	}
+	keepIdxMap := map[uint32]bool{}
+	for _, ts := range keepList {
+		keepIdxMap[ts.Idx] = true
+	}
+
+	keyUrlMap := map[string]string{}
+	var keepMs int
+	for _, ts := range tsList {
+		one := PlanTsInfo{
+			Idx:        int(ts.Idx),
+			Name:       ts.Name,
+			Url:        ts.Url,
+			DurationMs: int(ts.TimeSec * 1000),
+			IsSkipped:  keepIdxMap[ts.Idx] == false,
+			SkipReason: skipReasonMap[ts.Idx],
+		}
+		if ts.Key.KeyURI != "" {
+			keyUrl, ok := keyUrlMap[ts.Key.KeyURI]
+			if ok == false {
+				keyUrl, errMsg = ResolveRefUrl(baseUrl, ts.Key.KeyURI)
+				if errMsg != "" {
+					return setErr(newDownloadError(ErrCode_PlaylistInvalid, "ts.Key.KeyURI = "+ts.Key.KeyURI+", error "+errMsg, nil))
+				}
+				keyUrlMap[ts.Key.KeyURI] = keyUrl
+				resp.KeyUrlList = append(resp.KeyUrlList, keyUrl)
+			}
+			one.KeyUrl = keyUrl
+		}
+		if one.IsSkipped {
+			resp.SkipCount++
+		} else {
+			resp.KeepCount++
+			keepMs += one.DurationMs
+		}
+		resp.TsList = append(resp.TsList, one)
+	}
+	resp.TsCount = len(tsList)
+	resp.KeepDurationMs = keepMs
+	resp.KeepDurationText = formatDurationMs(keepMs)
+	if resp.KeepCount == 0 {
+		return setErr(newDownloadError(ErrCode_PlaylistEmpty, "需要下载的文件为空", nil))
+	}
+
+	if resp.IsSkipped == false && req.SkipMergeTs == false {
+		var ok bool
+		resp.SaveFileTo, ok = getSaveFileName(req.SaveDir, req.FileName, GetOutputFileExt(req.OutputFormat, req.TrackMode))
+		if ok == false {
+			return setErr(newDownloadError(ErrCode_IOFailed, "自动寻找文件名失败", nil))
+		}
+	}
+	return resp
+}
+
+// ToText 给命令行显示的文本
+func (this PlanDownload_Resp) ToText() string {
+	var buf strings.Builder
+	if this.ErrMsg != "" {
+		buf.WriteString("错误: " + this.ErrMsg + "\n")
+	}
+	buf.WriteString("m3u8地址: " + this.M3u8Url + "\n")
+	if this.MediaUrl != "" && this.MediaUrl != this.M3u8Url {
+		buf.WriteString("实际下载: " + this.MediaUrl + "\n")
+	}
+	if this.VariantBandwidth > 0 || this.VariantResolution != "" {
+		buf.WriteString(fmt.Sprintf("选择的清晰度: 带宽 %d, 分辨率 %s\n", this.VariantBandwidth, this.VariantResolution))
+	}
+	for _, one := range this.KeyUrlList {
+		buf.WriteString("key地址: " + one + "\n")
+	}
+	for _, one := range this.TsList {
+		state := "下载"
+		if one.IsSkipped {
+			state = "跳过(" + one.SkipReason + ")"
+		}
+		buf.WriteString(fmt.Sprintf("%5d %s %7.2fs %s %s\n", one.Idx, one.Name, float64(one.DurationMs)/1000, state, one.Url))
+	}
+	if this.TsCount > 0 {
+		buf.WriteString(fmt.Sprintf("共 %d 个ts, 下载 %d 个, 跳过 %d 个, 下载的时长 %s\n", this.TsCount, this.KeepCount, this.SkipCount, this.KeepDurationText))
+	}
+	if this.IsSkipped {
+		buf.WriteString("已经下载过了: " + this.SaveFileTo + "\n")
+	} else if this.SaveFileTo != "" {
+		buf.WriteString("保存路径: " + this.SaveFileTo + "\n")
+	}
+	return buf.String()
+}
+
+func formatDurationMs(ms int) string {
+	sec := ms / 1000
+	return fmt.Sprintf("%02d:%02d:%02d", sec/3600, sec/60%60, sec%60)
+}
@@ -0,0 +1,69 @@
+package m3u8d
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPlanDownload(t *testing.T) {
+	var mediaCount int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/master.m3u8", func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("#EXTM3U\n" +
+			"#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360\nlow/index.m3u8\n" +
+			"#EXT-X-STREAM-INF:BANDWIDTH=2000000,RESOLUTION=1280x720\nhigh/index.m3u8\n"))
+	})
+	mux.HandleFunc("/high/index.m3u8", func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("#EXTM3U\n#EXT-X-TARGETDURATION:10\n" +
+			"#EXT-X-KEY:METHOD=AES-128,URI=\"key.bin\"\n" +
+			"#EXTINF:10,\n1.ts\n#EXTINF:10,\n2.ts\n#EXTINF:5.5,\n3.ts\n#EXT-X-ENDLIST\n"))
+	})
+	mux.HandleFunc("/", func(writer http.ResponseWriter, request *http.Request) {
+		atomic.AddInt32(&mediaCount, 1)
+		writer.WriteHeader(http.StatusNotFound)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	saveDir := t.TempDir()
+	resp := PlanDownload(StartDownload_Req{
+		M3u8Url:    server.URL + "/master.m3u8",
+		SaveDir:    saveDir,
+		FileName:   "plan",
+		SkipTsExpr: "2",
+	})
+	if resp.ErrMsg != "" {
+		t.Fatal(resp.ErrMsg)
+	}
+	if resp.MediaUrl != server.URL+"/high/index.m3u8" || resp.VariantBandwidth != 2000000 || resp.VariantResolution != "1280x720" {
+		t.Fatal(resp.MediaUrl, resp.VariantBandwidth, resp.VariantResolution)
+	}
+	if resp.TsCount != 3 || resp.KeepCount != 2 || resp.SkipCount != 1 || resp.KeepDurationMs != 15500 || resp.KeepDurationText != "00:00:15" {
+		t.Fatal(resp.TsCount, resp.KeepCount, resp.SkipCount, resp.KeepDurationMs, resp.KeepDurationText)
+	}
+	if len(resp.KeyUrlList) != 1 || resp.KeyUrlList[0] != server.URL+"/high/key.bin" {
+		t.Fatal(resp.KeyUrlList)
+	}
+	if ts := resp.TsList[1]; ts.IsSkipped == false || ts.SkipReason == "" || ts.Url != server.URL+"/high/2.ts" || ts.KeyUrl != resp.KeyUrlList[0] {
+		t.Fatal(ts)
+	}
+	if resp.SaveFileTo != filepath.Join(saveDir, "plan.mp4") {
+		t.Fatal(resp.SaveFileTo)
+	}
+	if text := resp.ToText(); strings.Contains(text, "plan.mp4") == false {
+		t.Fatal(text)
+	}
+	// 不下载ts和key
+	if atomic.LoadInt32(&mediaCount) != 0 {
+		t.Fatal(mediaCount)
+	}
+
+	resp = PlanDownload(StartDownload_Req{M3u8Url: server.URL + "/master.m3u8", SkipTsExpr: "1-3"})
+	if resp.ErrCode != ErrCode_PlaylistEmpty {
+		t.Fatal(resp.ErrCode, resp.ErrMsg)
+	}
+}
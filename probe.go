@@ -0,0 +1,126 @@
+package m3u8d
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+
+	"github.com/orestonce/gopool"
+	"github.com/orestonce/m3u8d/mformat"
+)
+
+// 估算总大小时最多请求的ts数量
+const probeSampleCount = 10
+
+// probeTotalBytes 对部分ts发送HEAD请求(不支持时使用 Range: bytes=0-0)获取大小, 按照时长估算所有ts的总大小. 失败时返回0
+func (this *DownloadEnv) probeTotalBytes(tsList []mformat.TsInfo, threadCount int) (total int64) {
+	sampleList := getProbeSampleList(tsList, probeSampleCount)
+	if len(sampleList) == 0 {
+		return 0
+	}
+	if threadCount <= 0 || threadCount > len(sampleList) {
+		threadCount = len(sampleList)
+	}
+	var locker sync.Mutex
+	var sampleBytes int64
+	var sampleSec float64
+	var sampleOkCount int
+
+	task := gopool.NewThreadPool(threadCount)
+	for _, ts := range sampleList {
+		ts := ts
+		task.AddJob(func() {
+			if this.GetIsCancel() {
+				return
+			}
+			size, err := this.probeUrlSize(ts.Url)
+			if err != nil {
+				this.logToFile("probe " + strconv.Quote(ts.Name) + " failed: " + err.Error())
+				return
+			}
+			locker.Lock()
+			sampleBytes += size
+			sampleSec += ts.TimeSec
+			sampleOkCount++
+			locker.Unlock()
+		})
+	}
+	task.CloseAndWait()
+
+	if sampleOkCount == 0 {
+		return 0
+	}
+	var totalSec float64
+	for _, ts := range tsList {
+		totalSec += ts.TimeSec
+	}
+	if sampleSec > 0 && totalSec > 0 {
+		total = int64(float64(sampleBytes) * totalSec / sampleSec)
+	} else {
+		total = sampleBytes * int64(len(tsList)) / int64(sampleOkCount)
+	}
+	this.logToFile("probe total bytes " + strconv.FormatInt(total, 10) + ", sample " + strconv.Itoa(sampleOkCount) + "/" + strconv.Itoa(len(tsList)))
+	return total
+}
+
+// getProbeSampleList 均匀的选择最多count个ts
+func getProbeSampleList(tsList []mformat.TsInfo, count int) (list []mformat.TsInfo) {
+	if len(tsList) <= count {
+		return tsList
+	}
+	for idx := 0; idx < count; idx++ {
+		list = append(list, tsList[idx*len(tsList)/count])
+	}
+	return list
+}
+
+var gContentRangeTotalRegexp = regexp.MustCompile(`^bytes\s+\d+-\d+/(\d+)$`)
+
+func (this *DownloadEnv) probeUrlSize(urlS string) (size int64, err error) {
+	resp, err := this.doProbeRequest(http.MethodHead, urlS, "")
+	if err == nil && resp.StatusCode == http.StatusOK && resp.ContentLength > 0 {
+		return resp.ContentLength, nil
+	}
+	// 部分服务器不支持HEAD, 或者HEAD不返回Content-Length
+	resp, err = this.doProbeRequest(http.MethodGet, urlS, "bytes=0-0")
+	if err != nil {
+		return 0, err
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		groups := gContentRangeTotalRegexp.FindStringSubmatch(resp.Header.Get("Content-Range"))
+		if len(groups) > 0 {
+			return strconv.ParseInt(groups[1], 10, 64)
+		}
+	case http.StatusOK:
+		if resp.ContentLength > 0 {
+			return resp.ContentLength, nil
+		}
+	}
+	return 0, errors.New("unknown size, http code " + strconv.Itoa(resp.StatusCode))
+}
+
+// doProbeRequest 只读取响应头, 不读取body
+func (this *DownloadEnv) doProbeRequest(method string, urlS string, rangeS string) (resp *http.Response, err error) {
+	req, err := http.NewRequest(method, urlS, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(this.ctx)
+	req.Header = this.header.Clone()
+	if rangeS != "" {
+		req.Header.Set("Range", rangeS)
+	}
+	fetcher := this.getFetcher(req.URL.Scheme)
+	if fetcher == nil {
+		return nil, errors.New("unsupported url scheme " + strconv.Quote(req.URL.Scheme))
+	}
+	resp, err = fetcher.Fetch(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
@@ -0,0 +1,95 @@
+package m3u8d
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/orestonce/m3u8d/mformat"
+)
+
+func TestGetProbeSampleList(t *testing.T) {
+	var tsList []mformat.TsInfo
+	for idx := 1; idx <= 25; idx++ {
+		tsList = append(tsList, mformat.TsInfo{Idx: uint32(idx)})
+	}
+	if list := getProbeSampleList(tsList[:3], 10); len(list) != 3 {
+		t.Fatal(list)
+	}
+	list := getProbeSampleList(tsList, 10)
+	if len(list) != 10 || list[0].Idx != 1 || list[9].Idx != 23 {
+		t.Fatal(list)
+	}
+}
+
+func TestProbeTotalSize(t *testing.T) {
+	// ts前面有0x47之前的内容, 保存的文件比响应body小. 使用缓存时也要按照响应body的长度计算进度
+	tsPrefix := make([]byte, 16)
+	var tsTotal int
+	for _, name := range []string{"jhxy.016.ts", "jhxy.017.ts", "jhxy.018.ts"} {
+		stat, err := os.Stat(filepath.Join("testdata", "TestFull", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tsTotal += len(tsPrefix) + int(stat.Size())
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(writer http.ResponseWriter, request *http.Request) {
+		// 不支持HEAD, 只能使用Range获取大小
+		if request.Method == http.MethodHead {
+			writer.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		name := filepath.Base(request.URL.Path)
+		content, err := os.ReadFile(filepath.Join("testdata", "TestFull", name))
+		if err != nil {
+			writer.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if strings.HasSuffix(name, ".ts") {
+			content = append(append([]byte{}, tsPrefix...), content...)
+		}
+		http.ServeContent(writer, request, name, time.Time{}, bytes.NewReader(content))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	env := newTestDownloadEnv(t, StartDownload_Req{}, http.Header{})
+	size, err := env.probeUrlSize(server.URL + "/jhxy.016.ts")
+	if err != nil || size <= 0 {
+		t.Fatal(size, err)
+	}
+
+	saveDir := t.TempDir()
+	req := StartDownload_Req{
+		M3u8Url:        server.URL + "/jhxy.01.m3u8",
+		SaveDir:        saveDir,
+		ThreadCount:    2,
+		SkipRemoveTs:   true,
+		SkipCacheCheck: true,
+		ProbeTotalSize: true,
+	}
+	var env2 DownloadEnv
+	for idx := 0; idx < 2; idx++ {
+		if env2.StartDownload(req) == false {
+			t.Fatal("StartDownload failed")
+		}
+		status := env2.WaitDownloadFinish()
+		if status.ErrMsg != "" {
+			t.Fatal(status.ErrMsg)
+		}
+		// 第二次下载全部使用缓存
+		fetched, cached := tsTotal, 0
+		if idx == 1 {
+			fetched, cached = 0, tsTotal
+		}
+		if status.TotalBytes != tsTotal || status.FetchedBytes != fetched || status.CachedBytes != cached {
+			t.Fatal(idx, status.TotalBytes, status.FetchedBytes, status.CachedBytes)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package m3u8d
+
+import (
+	"time"
+
+	"github.com/orestonce/m3u8d/mformat"
+)
+
+const (
+	SegmentState_Pending     = "pending"     // 等待下载
+	SegmentState_Downloading = "downloading" // 下载中, 包括重试前的等待
+	SegmentState_Done        = "done"        // 下载完成, 或者使用了已下载的缓存
+	SegmentState_Skipped     = "skipped"     // 跳过表达式、http.code 跳过
+	SegmentState_Failed      = "failed"      // 重试多次后仍然下载失败
+)
+
+// SegmentInfo 单个ts的下载状态, 用于显示每个ts的下载情况
+type SegmentInfo struct {
+	Idx        int // ts编号, 从1开始
+	Name       string
+	Url        string
+	State      string // SegmentState_*
+	Bytes      int    // 已下载的字节数, 下载中的ts为当前请求已经收到的字节数
+	Attempts   int    // 请求次数, 包括重试
+	IsCache    bool   // 使用了已下载的ts
+	LastErr    string // 最后一次失败、跳过的原因
+	DurationMs int    // 从第一次请求到完成、失败的耗时, 下载中的ts为到现在的耗时
+}
+
+type segmentUnit struct {
+	info      SegmentInfo
+	startTime time.Time
+	endTime   time.Time
+}
+
+// GetSegmentList 获取所有ts的下载状态快照, 按照m3u8里的顺序. 获取到ts列表之前返回空
+func (this *DownloadEnv) GetSegmentList() (list []SegmentInfo) {
+	return this.status.getSegmentList()
+}
+
+func (this *SpeedStatus) initSegmentList(tsList []mformat.TsInfo) {
+	this.Locker.Lock()
+	defer this.Locker.Unlock()
+
+	this.segmentList = make([]*segmentUnit, 0, len(tsList))
+	this.segmentMap = map[string]*segmentUnit{}
+	for _, ts := range tsList {
+		unit := &segmentUnit{
+			info: SegmentInfo{
+				Idx:   int(ts.Idx),
+				Name:  ts.Name,
+				Url:   ts.Url,
+				State: SegmentState_Pending,
+			},
+		}
+		this.segmentList = append(this.segmentList, unit)
+		this.segmentMap[ts.Name] = unit
+	}
+}
+
+// updateSegmentNoLock 根据 EventType_Ts* 更新ts的状态
+func (this *SpeedStatus) updateSegmentNoLock(event DownloadEvent) {
+	unit, ok := this.segmentMap[event.TsName]
+	if ok == false {
+		return
+	}
+	if event.TsUrl != "" {
+		unit.info.Url = event.TsUrl
+	}
+	switch event.Type {
+	case EventType_TsStart:
+		unit.info.State = SegmentState_Downloading
+		unit.info.Attempts = 1
+		unit.startTime = event.Time
+	case EventType_TsRetry:
+		unit.info.State = SegmentState_Downloading
+		unit.info.Attempts++
+		unit.info.LastErr = event.Reason
+	case EventType_TsFinish:
+		unit.info.State = SegmentState_Done
+		unit.info.Bytes = int(event.Bytes)
+		unit.info.IsCache = event.IsCache
+		unit.endTime = event.Time
+	case EventType_TsSkip:
+		unit.info.State = SegmentState_Skipped
+		unit.info.LastErr = event.Reason
+		unit.endTime = event.Time
+	case EventType_TsFail:
+		unit.info.State = SegmentState_Failed
+		unit.info.LastErr = event.Reason
+		unit.endTime = event.Time
+	}
+}
+
+func (this *SpeedStatus) getSegmentList() (list []SegmentInfo) {
+	this.Locker.Lock()
+	defer this.Locker.Unlock()
+
+	now := time.Now()
+	// 正在下载的请求按照url对应到ts
+	doingBytesMap := map[string]int{}
+	for _, one := range this.doingBlockMap {
+		if one.url != "" {
+			doingBytesMap[one.url] = one.doneBytes
+		}
+	}
+	for _, unit := range this.segmentList {
+		info := unit.info
+		if info.State == SegmentState_Downloading {
+			if this.IsRunning {
+				info.Bytes = doingBytesMap[info.Url]
+			} else { // 任务已经结束(例如取消), 还没有下载完
+				info.State = SegmentState_Pending
+			}
+		}
+		if unit.startTime.IsZero() == false {
+			endTime := unit.endTime
+			if endTime.IsZero() {
+				endTime = now
+			}
+			info.DurationMs = int(endTime.Sub(unit.startTime) / time.Millisecond)
+		}
+		// 例如用户取消时, 下载中的ts不会有 EventType_TsFail
+		if reason, ok := this.tsNotWriteReasonMap[info.Name]; ok && info.LastErr == "" && info.State != SegmentState_Done {
+			info.LastErr = reason.reason
+		}
+		list = append(list, info)
+	}
+	return list
+}
@@ -0,0 +1,62 @@
+package m3u8d
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetSegmentList(t *testing.T) {
+	var env DownloadEnv
+	if list := env.GetSegmentList(); len(list) != 0 {
+		t.Fatal(list)
+	}
+
+	dir := t.TempDir()
+	var content = "#EXTM3U\n#EXT-X-TARGETDURATION:6\n"
+	for _, name := range []string{"jhxy.016.ts", "jhxy.017.ts", "jhxy.018.ts", "missing.ts"} {
+		content += "#EXTINF:6,\n" + localPathToFileUrl(filepath.Join("testdata", "TestFull", name)) + "\n"
+	}
+	content += "#EXTINF:6,\nmissing.ts\n#EXT-X-ENDLIST\n"
+	m3u8Path := filepath.Join(dir, "index.m3u8")
+	err := os.WriteFile(m3u8Path, []byte(content), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok := env.StartDownload(StartDownload_Req{
+		M3u8Url:     m3u8Path,
+		SaveDir:     dir,
+		ThreadCount: 2,
+		SkipTsExpr:  "1, http.code=404, if-http.code-merge_ts",
+	})
+	if !ok {
+		t.Fatal("StartDownload failed")
+	}
+	status := env.WaitDownloadFinish()
+	if status.ErrMsg != "" {
+		t.Fatal(status.ErrMsg)
+	}
+	list := env.GetSegmentList()
+	if len(list) != 5 {
+		t.Fatal(list)
+	}
+	for idx, one := range list {
+		if one.Idx != idx+1 || one.Name == "" || one.Url == "" {
+			t.Fatal(one)
+		}
+		switch one.Idx {
+		case 1: // 跳过表达式
+			if one.State != SegmentState_Skipped || one.Attempts != 0 || one.LastErr == "" {
+				t.Fatal(one)
+			}
+		case 2, 3:
+			if one.State != SegmentState_Done || one.Attempts != 1 || one.Bytes <= 0 || one.IsCache {
+				t.Fatal(one)
+			}
+		case 4, 5: // http.code=404
+			if one.State != SegmentState_Skipped || one.Attempts != 1 || one.LastErr != "http.code=404" {
+				t.Fatal(one)
+			}
+		}
+	}
+}
@@ -271,50 +271,137 @@ func (this *DownloadEnv) removeSkipList(tsSaveDir string, list []mformat.TsInfo)
 		return resp, errors.New("ts list is empty")
 	}
 
-	var inputVideoInfo *TsVideoInfo
-	var skipByHttpCodeBuffer bytes.Buffer
-	var skipByResolutionFpsBuffer bytes.Buffer
-
 	this.status.SpeedResetBytes()
 	this.status.SpeedResetTotalBlockCount(len(list))
 
+	checker := newTsSkipChecker(tsSaveDir)
 	for _, one := range list {
 		if this.GetIsCancel() {
 			return resp, errors.New("用户取消")
 		}
 		this.status.SpeedAdd1Block(time.Now(), 0)
-		if one.SkipByHttpCode {
-			resp.skipByHttpCodeCount++
-			if skipByHttpCodeBuffer.Len() == 0 {
-				skipByHttpCodeBuffer.WriteString("skipByHttpCode\n")
-			}
-			fmt.Fprintf(&skipByHttpCodeBuffer, "filename=%v,url=%v，http.code=%v\n", one.Name, one.Url, one.HttpCode)
-			continue
-		}
-		vInfo := GetTsVideoInfo(filepath.Join(tsSaveDir, one.Name))
-		if inputVideoInfo == nil {
-			inputVideoInfo = &vInfo
+		checker.check(one)
+	}
+	return this.finishSkipCheck(checker)
+}
+
+// tsSkipChecker 按照ts的顺序检查是否需要合并: 被http.code跳过的、分辨率/fps和第一个ts不同的都不合并
+type tsSkipChecker struct {
+	tsSaveDir                 string
+	inputVideoInfo            *TsVideoInfo
+	skipByHttpCodeBuffer      bytes.Buffer
+	skipByResolutionFpsBuffer bytes.Buffer
+	resp                      removeSkipListResp
+}
+
+func newTsSkipChecker(tsSaveDir string) *tsSkipChecker {
+	return &tsSkipChecker{
+		tsSaveDir: tsSaveDir,
+	}
+}
+
+func (this *tsSkipChecker) check(one mformat.TsInfo) (isMerge bool) {
+	if one.SkipByHttpCode {
+		this.resp.skipByHttpCodeCount++
+		if this.skipByHttpCodeBuffer.Len() == 0 {
+			this.skipByHttpCodeBuffer.WriteString("skipByHttpCode\n")
 		}
-		if vInfo.Fps == inputVideoInfo.Fps && vInfo.Width == inputVideoInfo.Width && vInfo.Height == inputVideoInfo.Height {
-			resp.mergeTsList = append(resp.mergeTsList, one)
-		} else {
-			if skipByResolutionFpsBuffer.Len() == 0 {
-				skipByResolutionFpsBuffer.WriteString("skipByResolutionFps\n")
-			}
-			fmt.Fprintf(&skipByResolutionFpsBuffer, "filename=%v,url=%v,resolution=%vx%v,fps=%v\n", one.Name, one.Url, vInfo.Width, vInfo.Height, vInfo.Fps)
+		fmt.Fprintf(&this.skipByHttpCodeBuffer, "filename=%v,url=%v，http.code=%v\n", one.Name, one.Url, one.HttpCode)
+		return false
+	}
+	vInfo := GetTsVideoInfo(filepath.Join(this.tsSaveDir, one.Name))
+	if this.inputVideoInfo == nil {
+		this.inputVideoInfo = &vInfo
+	}
+	if vInfo.Fps == this.inputVideoInfo.Fps && vInfo.Width == this.inputVideoInfo.Width && vInfo.Height == this.inputVideoInfo.Height {
+		this.resp.mergeTsList = append(this.resp.mergeTsList, one)
+		return true
+	}
+	if this.skipByResolutionFpsBuffer.Len() == 0 {
+		this.skipByResolutionFpsBuffer.WriteString("skipByResolutionFps\n")
+	}
+	fmt.Fprintf(&this.skipByResolutionFpsBuffer, "filename=%v,url=%v,resolution=%vx%v,fps=%v\n", one.Name, one.Url, vInfo.Width, vInfo.Height, vInfo.Fps)
+	return false
+}
+
+// tsSkipCheckerMark 检查某个ts之前的 tsSkipChecker. 只引用已有的内容, 后面检查的ts只会追加, 不影响它
+type tsSkipCheckerMark struct {
+	inputVideoInfo      *TsVideoInfo
+	skipByHttpCode      []byte
+	skipByResolutionFps []byte
+	skipByHttpCodeCount int
+	mergeTsList         []mformat.TsInfo
+}
+
+// tsSkipCheckerState 保存在合并进度里的 tsSkipChecker, 需要合并的ts只保存名字
+type tsSkipCheckerState struct {
+	InputVideoInfo      *TsVideoInfo
+	SkipByHttpCode      []byte
+	SkipByResolutionFps []byte
+	SkipByHttpCodeCount int
+	MergeTsNameList     []string
+}
+
+func (this *tsSkipChecker) mark() tsSkipCheckerMark {
+	return tsSkipCheckerMark{
+		inputVideoInfo:      this.inputVideoInfo,
+		skipByHttpCode:      this.skipByHttpCodeBuffer.Bytes(),
+		skipByResolutionFps: this.skipByResolutionFpsBuffer.Bytes(),
+		skipByHttpCodeCount: this.resp.skipByHttpCodeCount,
+		mergeTsList:         this.resp.mergeTsList[:len(this.resp.mergeTsList):len(this.resp.mergeTsList)],
+	}
+}
+
+func (this tsSkipCheckerMark) toState() tsSkipCheckerState {
+	state := tsSkipCheckerState{
+		InputVideoInfo:      this.inputVideoInfo,
+		SkipByHttpCode:      this.skipByHttpCode,
+		SkipByResolutionFps: this.skipByResolutionFps,
+		SkipByHttpCodeCount: this.skipByHttpCodeCount,
+	}
+	for _, one := range this.mergeTsList {
+		state.MergeTsNameList = append(state.MergeTsNameList, one.Name)
+	}
+	return state
+}
+
+// loadState 恢复合并进度里的状态, tsList 里找不到需要合并的ts时返回错误
+func (this *tsSkipChecker) loadState(state tsSkipCheckerState, tsList []mformat.TsInfo) error {
+	tsMap := map[string]mformat.TsInfo{}
+	for _, one := range tsList {
+		tsMap[one.Name] = one
+	}
+	for _, name := range state.MergeTsNameList {
+		one, ok := tsMap[name]
+		if ok == false {
+			return errors.New("合并进度里的ts " + strconv.Quote(name) + " 不在ts列表里")
 		}
+		this.resp.mergeTsList = append(this.resp.mergeTsList, one)
 	}
-	if skipByHttpCodeBuffer.Len() > 0 || skipByResolutionFpsBuffer.Len() > 0 {
-		resp.skipLogFileName = filepath.Join(tsSaveDir, logFileName)
-		resp.skipLogContent = append(skipByHttpCodeBuffer.Bytes(), skipByResolutionFpsBuffer.Bytes()...)
+	this.inputVideoInfo = state.InputVideoInfo
+	this.skipByHttpCodeBuffer.Write(state.SkipByHttpCode)
+	this.skipByResolutionFpsBuffer.Write(state.SkipByResolutionFps)
+	this.resp.skipByHttpCodeCount = state.SkipByHttpCodeCount
+	return nil
+}
+
+// finishSkipCheck 写入跳过的ts记录和ffmpeg合并命令
+func (this *DownloadEnv) finishSkipCheck(checker *tsSkipChecker) (resp removeSkipListResp, err error) {
+	resp = checker.resp
+	if checker.skipByHttpCodeBuffer.Len() > 0 || checker.skipByResolutionFpsBuffer.Len() > 0 {
+		resp.skipLogFileName = filepath.Join(checker.tsSaveDir, logFileName)
+		resp.skipLogContent = append(checker.skipByHttpCodeBuffer.Bytes(), checker.skipByResolutionFpsBuffer.Bytes()...)
 		err = os.WriteFile(resp.skipLogFileName, resp.skipLogContent, 0666)
 		if err != nil {
 			return resp, err
 		}
 	}
 
-	// 写入ffmpeg合并命令
-	err = this.writeFfmpegCmd(tsSaveDir, resp.mergeTsList)
+	// 写入ffmpeg合并命令. 合并完成后会删除ts时不写入, 避免命令指向不存在的文件
+	if this.streamMerger != nil && this.streamMerger.removeTs {
+		return resp, nil
+	}
+	err = this.writeFfmpegCmd(checker.tsSaveDir, resp.mergeTsList)
 	if err != nil {
 		return resp, err
 	}
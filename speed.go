@@ -5,7 +5,6 @@ import (
 	"github.com/orestonce/m3u8d/mformat"
 	"io"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 )
@@ -23,15 +22,32 @@ type SpeedStatus struct {
 	doingBlockMap   map[uint32]doingOneUnit
 
 	tsNotWriteReasonMap map[string]tsNotWriteReasonUnit
-
+	segmentList         []*segmentUnit
+	segmentMap          map[string]*segmentUnit
+
+	doneByteCount    int64
+	tsTotalCount     int64
+	tsDoneCount      int64 // 下载完成、使用缓存的ts数量, 不包括跳过的
+	tsFetchedBytes   int64
+	tsCachedBytes    int64
+	tsProbeBytes     int64 // 探测到的ts总大小, 0表示没有探测
 	progressPercent  int
 	progressBarTitle string
 	ProgressBarShow  bool
-	lastDrawProgress time.Time
-
-	errMsg     string
-	saveFileTo string
-	isSkipped  bool
+	phase            string
+	phaseIndex       int
+
+	eventListenerIdAlloc int
+	eventListenerMap     map[int]func(event DownloadEvent)
+	eventQueue           []eventJob // 等待 dispatchEvent 调用回调的事件
+	isDispatching        bool       // 有 dispatchEvent 在执行, 保证同一时刻只有一个事件回调在执行
+	consoleBar           consoleProgressBar
+
+	errMsg       string
+	lastErr      *DownloadError
+	saveFileTo   string
+	saveFileList []string
+	isSkipped    bool
 }
 
 type tsNotWriteReasonUnit struct {
@@ -48,6 +64,7 @@ type downOneUnit struct {
 type doingOneUnit struct {
 	startTime time.Time
 	doneBytes int
+	url       string
 }
 
 func (this *SpeedStatus) clearStatusNoLock() {
@@ -59,13 +76,25 @@ func (this *SpeedStatus) clearStatusNoLock() {
 	this.doingBlockMap = map[uint32]doingOneUnit{}
 
 	this.tsNotWriteReasonMap = map[string]tsNotWriteReasonUnit{}
-
+	this.segmentList = nil
+	this.segmentMap = map[string]*segmentUnit{}
+
+	this.doneByteCount = 0
+	this.tsTotalCount = 0
+	this.tsDoneCount = 0
+	this.tsFetchedBytes = 0
+	this.tsCachedBytes = 0
+	this.tsProbeBytes = 0
 	this.progressPercent = 0
 	this.progressBarTitle = ""
 	this.ProgressBarShow = false
+	this.phase = ""
+	this.phaseIndex = 0
 
 	this.errMsg = ""
+	this.lastErr = nil
 	this.saveFileTo = ""
+	this.saveFileList = nil
 	this.isSkipped = false
 }
 
@@ -77,15 +106,29 @@ func (this *SpeedStatus) DrawProgressBar(total int, current int) {
 
 	this.Locker.Lock()
 	this.progressPercent = int(proportion * 100)
-	title := this.progressBarTitle
-	if this.ProgressBarShow {
-		if this.lastDrawProgress.IsZero() || time.Now().Sub(this.lastDrawProgress).Milliseconds() > 100 {
-			width := 50
-			pos := int(proportion * float32(width))
-			fmt.Printf(title+" %s%*s %6.2f%%\r", strings.Repeat("■", pos), width-pos, "", proportion*100)
+	var totalBytes int64
+	// 下载ts时按照字节计算进度, ts大小不一样、使用缓存时更准确
+	if this.phase == Phase_Download && current < total {
+		totalBytes = this.getTsExpectedBytesNoLock()
+		if totalBytes > 0 {
+			this.progressPercent = int((this.tsFetchedBytes + this.tsCachedBytes) * 100 / totalBytes)
+			if this.progressPercent > 99 {
+				this.progressPercent = 99
+			}
 		}
 	}
+	event := DownloadEvent{
+		Type:       EventType_Progress,
+		Title:      this.progressBarTitle,
+		Bytes:      this.doneByteCount,
+		TotalBytes: totalBytes,
+		DoneCount:  current,
+		TotalCount: total,
+		Percent:    this.progressPercent,
+	}
 	this.Locker.Unlock()
+
+	this.emitEvent(event)
 }
 
 func (this *SpeedStatus) SpeedResetTotalBlockCount(count int) {
@@ -94,6 +137,7 @@ func (this *SpeedStatus) SpeedResetTotalBlockCount(count int) {
 
 	this.totalBlockCount = int64(count)
 	this.doneBlockCount = 0
+	this.doneByteCount = 0
 }
 
 func (this *SpeedStatus) SpeedAdd1Block(now time.Time, byteCount int) {
@@ -107,6 +151,7 @@ func (this *SpeedStatus) SpeedAdd1Block(now time.Time, byteCount int) {
 	}
 	this.doneBlockMap[now] = unit
 	this.doneBlockCount++
+	this.doneByteCount += int64(byteCount)
 
 	cur := this.doneBlockCount
 	total := this.totalBlockCount
@@ -117,6 +162,58 @@ func (this *SpeedStatus) SpeedAdd1Block(now time.Time, byteCount int) {
 	}
 }
 
+// initTsBytes 开始下载ts前调用, 保留探测到的总大小
+func (this *SpeedStatus) initTsBytes(tsCount int) {
+	this.Locker.Lock()
+	defer this.Locker.Unlock()
+
+	this.tsTotalCount = int64(tsCount)
+	this.tsDoneCount = 0
+	this.tsFetchedBytes = 0
+	this.tsCachedBytes = 0
+}
+
+func (this *SpeedStatus) setTsProbeBytes(total int64) {
+	this.Locker.Lock()
+	this.tsProbeBytes = total
+	this.Locker.Unlock()
+}
+
+// addTsBytes 记录下载完成的ts大小(响应body的长度, 和探测的大小一致), isCache表示使用了已下载的ts
+func (this *SpeedStatus) addTsBytes(byteCount int, isCache bool) {
+	this.Locker.Lock()
+	defer this.Locker.Unlock()
+
+	this.tsDoneCount++
+	if isCache {
+		this.tsCachedBytes += int64(byteCount)
+	} else {
+		this.tsFetchedBytes += int64(byteCount)
+	}
+}
+
+// skipTsBytes 跳过的ts不计入总大小
+func (this *SpeedStatus) skipTsBytes() {
+	this.Locker.Lock()
+	this.tsTotalCount--
+	this.Locker.Unlock()
+}
+
+// getTsExpectedBytesNoLock 预计的ts总大小: 优先使用探测的结果, 否则按照已完成ts的平均大小估算. 无法估算时返回0
+func (this *SpeedStatus) getTsExpectedBytesNoLock() int64 {
+	doneBytes := this.tsFetchedBytes + this.tsCachedBytes
+	if this.tsTotalCount > 0 && this.tsDoneCount >= this.tsTotalCount {
+		return doneBytes
+	}
+	if this.tsProbeBytes > 0 && this.tsProbeBytes >= doneBytes {
+		return this.tsProbeBytes
+	}
+	if this.tsDoneCount <= 0 || this.tsTotalCount <= 0 {
+		return 0
+	}
+	return doneBytes * this.tsTotalCount / this.tsDoneCount
+}
+
 func (this *SpeedStatus) SpeedResetBytes() {
 	this.Locker.Lock()
 	defer this.Locker.Unlock()
@@ -124,6 +221,7 @@ func (this *SpeedStatus) SpeedResetBytes() {
 	this.speedBeginTime = time.Now()
 	this.totalBlockCount = 0
 	this.doneBlockCount = 0
+	this.doneByteCount = 0
 	this.doneBlockMap = map[time.Time]downOneUnit{}
 }
 
@@ -190,7 +288,17 @@ func (this *SpeedStatus) SpeedRecent5sGetAndUpdate() (speed SpeedInfo) {
 		}
 	}
 
-	if this.totalBlockCount > 0 && total.blockCount > 0 && this.doneBlockCount < this.totalBlockCount {
+	if expected := this.getTsExpectedBytesNoLock(); this.phase == Phase_Download && expected > 0 && speed.BytePerSecond > 0 {
+		// 按照字节计算剩余时间, 正在下载的ts也算已完成的部分
+		doneBytes := this.tsFetchedBytes + this.tsCachedBytes
+		for _, one := range this.doingBlockMap {
+			doneBytes += int64(one.doneBytes)
+		}
+		if doneBytes < expected {
+			speed.RemainTime = int((expected - doneBytes) / int64(speed.BytePerSecond))
+			speed.RemainTimeText = fmt.Sprintf("%02d:%02d", speed.RemainTime/60, speed.RemainTime%60)
+		}
+	} else if this.totalBlockCount > 0 && total.blockCount > 0 && this.doneBlockCount < this.totalBlockCount {
 		secondPerBlock := realSecond / float64(total.blockCount)
 		speed.RemainTime = int(secondPerBlock * float64(this.totalBlockCount-this.doneBlockCount))
 		speed.RemainTimeText = fmt.Sprintf("%02d:%02d", speed.RemainTime/60, speed.RemainTime%60)
@@ -218,10 +326,16 @@ func (this *SpeedStatus) SetProgressBarTitle(title string) {
 }
 
 func (this *SpeedStatus) SpeedReadAll(r io.Reader) (b []byte, err error) {
+	return this.speedReadAll("", r)
+}
+
+// speedReadAll urlS用于把正在下载的字节数对应到ts
+func (this *SpeedStatus) speedReadAll(urlS string, r io.Reader) (b []byte, err error) {
 	b = make([]byte, 0, 512)
 	var n int
 	var unit doingOneUnit
 	unit.startTime = time.Now()
+	unit.url = urlS
 
 	var id uint32
 	this.Locker.Lock()
@@ -6,3 +6,31 @@ func TestSpeedStatus_GetPercent(t *testing.T) {
 	var status SpeedStatus
 	status.SpeedResetBytes()
 }
+
+func TestSpeedStatus_TsBytes(t *testing.T) {
+	var status SpeedStatus
+	status.phase = Phase_Download
+	status.initTsBytes(4)
+	if status.getTsExpectedBytesNoLock() != 0 {
+		t.Fatal("expect unknown")
+	}
+	status.addTsBytes(100, true)
+	status.addTsBytes(300, false)
+	if expected := status.getTsExpectedBytesNoLock(); expected != 800 {
+		t.Fatal(expected)
+	}
+	status.SpeedResetTotalBlockCount(4)
+	status.SpeedAdd1Block(status.speedBeginTime, 0)
+	if percent := status.GetPercent(); percent != 50 {
+		t.Fatal(percent)
+	}
+	status.setTsProbeBytes(1000)
+	if expected := status.getTsExpectedBytesNoLock(); expected != 1000 {
+		t.Fatal(expected)
+	}
+	status.skipTsBytes()
+	status.addTsBytes(200, false)
+	if expected := status.getTsExpectedBytesNoLock(); expected != 600 {
+		t.Fatal(expected)
+	}
+}
@@ -0,0 +1,385 @@
+package m3u8d
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/yapingcat/gomedia/go-codec"
+	"github.com/yapingcat/gomedia/go-mpeg2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	SplitMode_Discontinuity = "discontinuity" // #EXT-X-DISCONTINUITY 的编号变化时开始新的文件
+	SplitMode_Duration      = "duration"      // 每 SplitValue 分钟一个文件
+	SplitMode_Size          = "size"          // 每个文件不超过 SplitValue MB, 单个GOP超过限制时除外
+)
+
+// ParseSplitMode 检查分割方式, 空字符串为不分割
+func ParseSplitMode(mode string, value int) (ret string, errMsg string) {
+	switch ret = strings.ToLower(strings.TrimSpace(mode)); ret {
+	case "":
+		return "", ""
+	case SplitMode_Discontinuity:
+		return ret, ""
+	case SplitMode_Duration, SplitMode_Size:
+		if value <= 0 {
+			return "", "分割方式 " + ret + " 需要大于0的 SplitValue"
+		}
+		return ret, ""
+	}
+	return "", "不支持的分割方式 " + strconv.Quote(mode)
+}
+
+// GetSplitOutputName 分割后第idx(从1开始)个文件的名字: a.mp4 => a_part001.mp4
+func GetSplitOutputName(outputName string, idx int) string {
+	ext := filepath.Ext(outputName)
+	return getSplitFileName(strings.TrimSuffix(outputName, ext), idx) + ext
+}
+
+// getSplitFileName 不包括扩展名的 GetSplitOutputName
+func getSplitFileName(fileName string, idx int) string {
+	return fileName + fmt.Sprintf("_part%03d", idx)
+}
+
+// mergeOutput 合并的输出文件, 分割时决定在哪里开始新的文件.
+//
+//	ts只能在文件边界分割; 其它格式按时长/大小分割时在视频关键帧(没有视频时在音频帧)的位置开始新的文件
+type mergeOutput struct {
+	req      MergeTsFileListToSingleMp4_Req
+	format   string
+	isResume bool
+
+	file       *os.File
+	writer     mergeWriter
+	outputList []string
+
+	splitLimit          int64 // 毫秒或者字节
+	hasDiscontinuityIdx bool
+	discontinuityIdx    int
+	hasVideo            bool
+	isPartStarted       bool
+	partStartDts        uint64
+	partDurationMs      int64 // 只用于ts
+	partBytes           int64
+	gopBytes            int64                           // 当前GOP已经写入的字节数
+	lastGopBytes        int64                           // 上一个GOP的字节数, 用来估计下一个GOP的大小
+	paramSetMap         map[mpeg2.TS_STREAM_TYPE][]byte // 最后一次出现的VPS/SPS/PPS, 新文件的第一帧没有时加在前面
+
+	checkpoint              *mergeCheckpoint // 当前ts开始时的合并进度, 保存后为nil
+	checkpointFragmentCount uint32           // 当前ts开始时的分片数
+}
+
+func newMergeOutput(req MergeTsFileListToSingleMp4_Req, format string, isResume bool) *mergeOutput {
+	this := &mergeOutput{
+		req:         req,
+		format:      format,
+		isResume:    isResume,
+		paramSetMap: map[mpeg2.TS_STREAM_TYPE][]byte{},
+	}
+	switch req.SplitMode {
+	case SplitMode_Duration:
+		this.splitLimit = int64(req.SplitValue) * 60 * 1000
+	case SplitMode_Size:
+		this.splitLimit = int64(req.SplitValue) * 1024 * 1024
+	}
+	return this
+}
+
+// open 打开下一个输出文件
+func (this *mergeOutput) open() (err error) {
+	name := this.req.OutputMp4
+	if this.req.SplitMode != "" {
+		idx := len(this.outputList) + 1
+		if this.req.SplitOutputName != nil {
+			name = this.req.SplitOutputName(idx)
+		} else {
+			name = GetSplitOutputName(this.req.OutputMp4, idx)
+		}
+		if name == "" {
+			return fmt.Errorf("分割的第 %d 个文件没有名字", idx)
+		}
+	}
+	flag := os.O_CREATE | os.O_RDWR | os.O_TRUNC
+	if this.isResume {
+		flag = os.O_CREATE | os.O_RDWR
+	}
+	this.file, err = os.OpenFile(name, flag, 0666)
+	if err != nil {
+		return err
+	}
+	this.outputList = append(this.outputList, name)
+	this.isPartStarted = false
+	this.partDurationMs = 0
+	this.partBytes = 0
+
+	switch this.format {
+	case OutputFormat_Ts:
+		return nil
+	case OutputFormat_Mkv:
+		this.writer, err = newMkvWriter(this.file)
+	case OutputFormat_Fmp4:
+		var resume *fmp4ResumeInfo
+		if this.isResume {
+			resume, err = prepareFmp4Resume(this.file)
+			if err != nil {
+				return err
+			}
+		}
+		if this.req.checkpoint != nil {
+			if resume == nil || resume.fragmentCount < this.req.checkpoint.FragmentCount {
+				return errFmp4CheckpointMismatch
+			}
+			resume.isCheckpoint = true
+		}
+		var writer *mp4MergeWriter
+		writer, err = newMp4MergeWriter(this.file, true, resume)
+		if err != nil {
+			return err
+		}
+		this.writer = writer
+		if this.req.checkpoint != nil {
+			writer.fragmentMs = this.req.checkpoint.FragmentMs
+			err = writer.audioSplitter.loadState(this.req.checkpoint.AudioSplitter)
+		}
+	default:
+		this.writer, err = newMp4MergeWriter(this.file, false, nil)
+	}
+	return err
+}
+
+// finish 写入当前文件的结尾并关闭
+func (this *mergeOutput) finish() error {
+	if this.writer != nil {
+		err := this.writer.WriteTrailer()
+		if err != nil {
+			return err
+		}
+		this.writer = nil
+	}
+	err := this.file.Sync()
+	if err != nil {
+		return err
+	}
+	err = this.file.Close()
+	this.file = nil
+	if err != nil {
+		return err
+	}
+	if this.req.FastStart && this.format == OutputFormat_Mp4 {
+		return Mp4FastStart(this.outputList[len(this.outputList)-1])
+	}
+	return nil
+}
+
+// beginCheckpoint 开始合并一个ts之前记录合并进度, 只用于fmp4
+func (this *mergeOutput) beginCheckpoint(tsFile string, rebaser *tsTimestampRebaser) {
+	writer := this.writer.(*mp4MergeWriter)
+	this.checkpoint = &mergeCheckpoint{
+		TsFile:        tsFile,
+		FragmentMs:    writer.fragmentMs,
+		Rebaser:       rebaser.saveState(),
+		AudioSplitter: writer.audioSplitter.saveState(),
+	}
+	this.checkpointFragmentCount = writer.fragmentCount
+}
+
+// saveCheckpoint 当前ts开始之后写入了新的分片时, 前面的ts都已经在输出文件里: 同步到磁盘后交给 onCheckpoint
+func (this *mergeOutput) saveCheckpoint() error {
+	writer := this.writer.(*mp4MergeWriter)
+	if this.checkpoint == nil || writer.fragmentCount == this.checkpointFragmentCount {
+		return nil
+	}
+	err := this.file.Sync()
+	if err != nil {
+		return err
+	}
+	checkpoint := *this.checkpoint
+	checkpoint.FragmentCount = writer.fragmentCount
+	this.checkpoint = nil
+	return this.req.onCheckpoint(checkpoint)
+}
+
+// close 出错时关闭没有完成的文件
+func (this *mergeOutput) close() {
+	if this.file != nil {
+		this.file.Close()
+		this.file = nil
+	}
+}
+
+func (this *mergeOutput) next() error {
+	err := this.finish()
+	if err != nil {
+		return err
+	}
+	return this.open()
+}
+
+// beforeTsFile 开始合并一个ts文件之前调用, 在文件边界分割
+func (this *mergeOutput) beforeTsFile(tsFile string, buf []byte) error {
+	switch this.req.SplitMode {
+	case SplitMode_Discontinuity:
+		idx, ok := this.req.DiscontinuityMap[tsFile]
+		if ok == false {
+			return nil
+		}
+		isChanged := this.hasDiscontinuityIdx && idx != this.discontinuityIdx
+		this.hasDiscontinuityIdx = true
+		this.discontinuityIdx = idx
+		if isChanged && this.isPartStarted {
+			return this.next()
+		}
+	case SplitMode_Duration:
+		if this.format != OutputFormat_Ts {
+			return nil
+		}
+		if this.isPartStarted && this.partDurationMs >= this.splitLimit {
+			err := this.next()
+			if err != nil {
+				return err
+			}
+		}
+		this.partDurationMs += getTsDurationMs(buf)
+	case SplitMode_Size:
+		if this.format != OutputFormat_Ts {
+			return nil
+		}
+		if this.isPartStarted && this.partBytes+int64(len(buf)) > this.splitLimit {
+			return this.next()
+		}
+	}
+	return nil
+}
+
+// writeTs 写入ts格式的内容
+func (this *mergeOutput) writeTs(data []byte) error {
+	this.isPartStarted = true
+	this.partBytes += int64(len(data))
+	_, err := this.file.Write(data)
+	return err
+}
+
+func (this *mergeOutput) WriteFrame(cid mpeg2.TS_STREAM_TYPE, frame []byte, pts uint64, dts uint64) error {
+	isVideo := isTsVideoStream(cid)
+	if isVideo {
+		this.hasVideo = true
+	}
+	if this.splitLimit > 0 {
+		var isKeyFrame bool
+		if isVideo {
+			isKeyFrame = this.updateParamSet(cid, frame)
+		} else {
+			isKeyFrame = this.hasVideo == false
+		}
+		if isKeyFrame {
+			this.lastGopBytes = this.gopBytes
+			this.gopBytes = 0
+			if this.isPartStarted && this.isNeedSplit(dts) {
+				err := this.next()
+				if err != nil {
+					return err
+				}
+				if isVideo {
+					frame = this.withParamSet(cid, frame)
+				}
+			}
+		}
+		this.gopBytes += int64(len(frame))
+	}
+	if this.isPartStarted == false {
+		this.isPartStarted = true
+		this.partStartDts = dts
+	}
+	this.partBytes += int64(len(frame))
+	return this.writer.WriteFrame(cid, frame, pts, dts)
+}
+
+func (this *mergeOutput) isNeedSplit(dts uint64) bool {
+	switch this.req.SplitMode {
+	case SplitMode_Duration:
+		return dts >= this.partStartDts && int64(dts-this.partStartDts) >= this.splitLimit
+	case SplitMode_Size:
+		return this.partBytes+this.lastGopBytes > this.splitLimit
+	}
+	return false
+}
+
+// updateParamSet 保存帧里面的VPS/SPS/PPS, 返回是否为关键帧
+func (this *mergeOutput) updateParamSet(cid mpeg2.TS_STREAM_TYPE, frame []byte) (isKeyFrame bool) {
+	var paramSet []byte
+	codec.SplitFrameWithStartCode(frame, func(nalu []byte) bool {
+		if cid == mpeg2.TS_STREAM_H265 {
+			switch codec.H265NaluType(nalu) {
+			case codec.H265_NAL_VPS, codec.H265_NAL_SPS, codec.H265_NAL_PPS:
+				paramSet = append(paramSet, nalu...)
+			}
+		} else {
+			switch codec.H264NaluType(nalu) {
+			case codec.H264_NAL_SPS, codec.H264_NAL_PPS:
+				paramSet = append(paramSet, nalu...)
+			}
+		}
+		return true
+	})
+	if len(paramSet) > 0 {
+		this.paramSetMap[cid] = paramSet
+	}
+	if cid == mpeg2.TS_STREAM_H265 {
+		return codec.IsH265IDRFrame(frame)
+	}
+	return codec.IsH264IDRFrame(frame)
+}
+
+// withParamSet 新文件的第一帧没有VPS/SPS/PPS时, 使用前面出现过的
+func (this *mergeOutput) withParamSet(cid mpeg2.TS_STREAM_TYPE, frame []byte) []byte {
+	paramSet := this.paramSetMap[cid]
+	if len(paramSet) == 0 {
+		return frame
+	}
+	var hasParamSet bool
+	codec.SplitFrameWithStartCode(frame, func(nalu []byte) bool {
+		if cid == mpeg2.TS_STREAM_H265 {
+			hasParamSet = codec.H265NaluType(nalu) == codec.H265_NAL_SPS
+		} else {
+			hasParamSet = codec.H264NaluType(nalu) == codec.H264_NAL_SPS
+		}
+		return hasParamSet == false
+	})
+	if hasParamSet {
+		return frame
+	}
+	return append(append([]byte{}, paramSet...), frame...)
+}
+
+// getTsDurationMs 根据视频(没有视频时为音频)第一帧和最后一帧的dts估计ts文件的时长
+func getTsDurationMs(buf []byte) int64 {
+	type dtsRange struct {
+		first, last uint64
+		count       int
+	}
+	rangeMap := map[bool]*dtsRange{}
+	demuxer := newTsDemuxer()
+	demuxer.OnFrame = func(cid mpeg2.TS_STREAM_TYPE, frame []byte, pts uint64, dts uint64) {
+		isVideo := isTsVideoStream(cid)
+		one := rangeMap[isVideo]
+		if one == nil {
+			one = &dtsRange{first: dts}
+			rangeMap[isVideo] = one
+		}
+		one.last = dts
+		one.count++
+	}
+	_ = demuxer.Input(bytes.NewReader(buf))
+	one := rangeMap[true]
+	if one == nil {
+		one = rangeMap[false]
+	}
+	if one == nil || one.last <= one.first {
+		return 0
+	}
+	// 加上最后一帧的时长
+	return int64(one.last-one.first) * int64(one.count) / int64(one.count-1)
+}
@@ -0,0 +1,201 @@
+package m3u8d
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseSplitMode(t *testing.T) {
+	for _, one := range []struct {
+		mode   string
+		value  int
+		ret    string
+		hasErr bool
+	}{
+		{mode: "", ret: ""},
+		{mode: " Discontinuity ", ret: SplitMode_Discontinuity},
+		{mode: "duration", value: 10, ret: SplitMode_Duration},
+		{mode: "size", value: 0, hasErr: true},
+		{mode: "count", value: 1, hasErr: true},
+	} {
+		ret, errMsg := ParseSplitMode(one.mode, one.value)
+		if ret != one.ret || (errMsg != "") != one.hasErr {
+			t.Fatal(one, ret, errMsg)
+		}
+	}
+	if name := GetSplitOutputName(filepath.Join("dir", "a.b.mp4"), 2); name != filepath.Join("dir", "a.b_part002.mp4") {
+		t.Fatal(name)
+	}
+}
+
+func TestMergeSplit(t *testing.T) {
+	dir := t.TempDir()
+	ts016 := filepath.Join("testdata", "TestFull", "jhxy.016.ts")
+	ts017 := filepath.Join("testdata", "TestFull", "jhxy.017.ts")
+	ts018 := filepath.Join("testdata", "TestFull", "jhxy.018.ts")
+	tsFileList := []string{ts016, ts017, ts018}
+	discontinuityMap := map[string]int{ts016: 0, ts017: 1, ts018: 1}
+
+	// 按#EXT-X-DISCONTINUITY分割
+	for _, format := range []string{OutputFormat_Mp4, OutputFormat_Mkv, OutputFormat_Ts} {
+		outputList, err := MergeTsFileListToMultiFile(MergeTsFileListToSingleMp4_Req{
+			TsFileList:       tsFileList,
+			OutputMp4:        filepath.Join(dir, "discontinuity."+GetOutputFormatExt(format)),
+			OutputFormat:     format,
+			DiscontinuityMap: discontinuityMap,
+			SplitMode:        SplitMode_Discontinuity,
+			Ctx:              context.Background(),
+		})
+		if err != nil {
+			t.Fatal(format, err)
+		}
+		if len(outputList) != 2 || outputList[1] != filepath.Join(dir, "discontinuity_part002."+GetOutputFormatExt(format)) {
+			t.Fatal(format, outputList)
+		}
+		if format == OutputFormat_Ts {
+			info, err := os.Stat(outputList[0])
+			if err != nil || info.Size() != 180480 {
+				t.Fatal(info, err)
+			}
+		}
+	}
+	normal := filepath.Join(dir, "normal.mp4")
+	err := MergeTsFileListToSingleMp4(MergeTsFileListToSingleMp4_Req{
+		TsFileList: tsFileList,
+		OutputMp4:  normal,
+		Ctx:        context.Background(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := mp4DurationMsForTest(t, filepath.Join(dir, "discontinuity_part001.mp4"))
+	second := mp4DurationMsForTest(t, filepath.Join(dir, "discontinuity_part002.mp4"))
+	if total := mp4DurationMsForTest(t, normal); first+second+200 < total || first+second > total+200 || first*2 > second {
+		t.Fatal(first, second, total)
+	}
+
+	// 按大小分割, 每个文件在关键帧开始
+	var sizeList []string
+	for idx := 0; idx < 3; idx++ {
+		sizeList = append(sizeList, tsFileList...)
+	}
+	var nameList []string
+	outputList, err := MergeTsFileListToMultiFile(MergeTsFileListToSingleMp4_Req{
+		TsFileList: sizeList,
+		OutputMp4:  filepath.Join(dir, "size.mp4"),
+		SplitMode:  SplitMode_Size,
+		SplitValue: 1,
+		SplitOutputName: func(idx int) string {
+			name := filepath.Join(dir, "size-"+string(rune('a'+idx))+".mp4")
+			nameList = append(nameList, name)
+			return name
+		},
+		Ctx: context.Background(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outputList) < 3 || len(outputList) != len(nameList) || outputList[0] != filepath.Join(dir, "size-b.mp4") {
+		t.Fatal(outputList)
+	}
+	for _, one := range outputList {
+		info, err := os.Stat(one)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 1024*1024+64*1024 {
+			t.Fatal(one, info.Size())
+		}
+		if mp4DurationMsForTest(t, one) == 0 {
+			t.Fatal(one)
+		}
+	}
+}
+
+func TestMergeSplitDuration(t *testing.T) {
+	dir := t.TempDir()
+	var tsFileList []string
+	for idx := 0; idx < 8; idx++ {
+		for _, name := range []string{"jhxy.016.ts", "jhxy.017.ts", "jhxy.018.ts"} {
+			tsFileList = append(tsFileList, filepath.Join("testdata", "TestFull", name))
+		}
+	}
+	// 每次重复的时间戳都会跳回去, 重新计算时间戳后一共约68秒
+	for _, format := range []string{OutputFormat_Mp4, OutputFormat_Ts} {
+		outputList, err := MergeTsFileListToMultiFile(MergeTsFileListToSingleMp4_Req{
+			TsFileList:   tsFileList,
+			OutputMp4:    filepath.Join(dir, "duration."+GetOutputFormatExt(format)),
+			OutputFormat: format,
+			SplitMode:    SplitMode_Duration,
+			SplitValue:   1,
+			Ctx:          context.Background(),
+		})
+		if err != nil {
+			t.Fatal(format, err)
+		}
+		if len(outputList) != 2 {
+			t.Fatal(format, outputList)
+		}
+		if format == OutputFormat_Mp4 {
+			first := mp4DurationMsForTest(t, outputList[0])
+			second := mp4DurationMsForTest(t, outputList[1])
+			if first < 60000 || first > 62000 || second+first < 67000 {
+				t.Fatal(first, second)
+			}
+		}
+	}
+}
+
+func TestDownloadSplit(t *testing.T) {
+	m3u8Dir := t.TempDir()
+	for _, name := range []string{"jhxy.016.ts", "jhxy.017.ts", "jhxy.018.ts"} {
+		content, err := os.ReadFile(filepath.Join("testdata", "TestFull", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(m3u8Dir, name), content, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	m3u8Path := filepath.Join(m3u8Dir, "index.m3u8")
+	err := os.WriteFile(m3u8Path, []byte("#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXTINF:2,\njhxy.016.ts\n#EXT-X-DISCONTINUITY\n#EXTINF:3,\njhxy.017.ts\n#EXTINF:3,\njhxy.018.ts\n#EXT-X-ENDLIST\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, streamMerge := range []bool{false, true} {
+		saveDir := t.TempDir()
+		fileName := "split"
+		if streamMerge {
+			fileName = "stream"
+		}
+		var env DownloadEnv
+		if env.StartDownload(StartDownload_Req{M3u8Url: m3u8Path, SaveDir: saveDir, FileName: fileName, ThreadCount: 2, SplitMode: SplitMode_Discontinuity, StreamMerge: streamMerge}) == false {
+			t.Fatal("StartDownload failed")
+		}
+		status := env.WaitDownloadFinish()
+		if status.ErrMsg != "" {
+			t.Fatal(status.ErrMsg)
+		}
+		expect := []string{filepath.Join(saveDir, fileName+"_part001.mp4"), filepath.Join(saveDir, fileName+"_part002.mp4")}
+		if len(status.SaveFileList) != 2 || status.SaveFileList[0] != expect[0] || status.SaveFileList[1] != expect[1] || status.SaveFileTo != expect[0] {
+			t.Fatal(status.SaveFileTo, status.SaveFileList)
+		}
+		for _, one := range expect {
+			if _, err := os.Stat(one); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// 再次下载时跳过, 返回所有分割的文件
+		var again DownloadEnv
+		if again.StartDownload(StartDownload_Req{M3u8Url: m3u8Path, SaveDir: saveDir, FileName: fileName, ThreadCount: 2, SplitMode: SplitMode_Discontinuity, StreamMerge: streamMerge}) == false {
+			t.Fatal("StartDownload failed")
+		}
+		status = again.WaitDownloadFinish()
+		if status.ErrMsg != "" || status.IsSkipped == false || len(status.SaveFileList) != 2 || status.SaveFileList[1] != expect[1] {
+			t.Fatal(status.ErrMsg, status.IsSkipped, status.SaveFileList)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package m3u8d
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/orestonce/m3u8d/mformat"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// 合并时删除ts的合并进度, 保存在下载目录里. 中断后从这里继续合并, 进度之前的ts不再下载
+const streamMergeStateFileName = "stream_merge.json"
+
+type streamMergeState struct {
+	OutputName string // 合并中的 .temp 文件
+	Checkpoint mergeCheckpoint
+	Checker    tsSkipCheckerState // 检查 Checkpoint.TsFile 之前的状态
+}
+
+// streamMerger 边下载边合并: 下载线程每完成一个ts调用一次 setTsDone, 按照ts的顺序把已经下载完成的连续部分交给muxer.
+//
+//	跳过http.code、分辨率/fps变化的ts时使用和 removeSkipList 相同的规则.
+//	removeTs 为true时(只支持不分割的fmp4), 每次写入的分片同步到磁盘后保存合并进度, 然后删除已经完整写入输出文件的ts
+type streamMerger struct {
+	env         *DownloadEnv
+	tsList      []mformat.TsInfo
+	checker     *tsSkipChecker
+	removeTs    bool
+	keepFirstTs bool // 更新输出文件的时间时需要第一个ts, 合并完成后再删除
+	outputName  string
+	startIdx    int              // 上次合并进度之前的ts已经删除, 不用下载
+	checkpoint  *mergeCheckpoint // 上次的合并进度
+
+	locker       sync.Mutex
+	cond         *sync.Cond
+	doneList     []bool
+	isClosed     bool                         // 下载ts的阶段已经结束
+	markMap      map[string]tsSkipCheckerMark // 交给muxer的ts => 检查它之前的 tsSkipChecker
+	sentList     []int                        // 交给muxer的ts
+	removedCount int                          // sentList 里已经处理过的数量, 前面的ts已经删除(keepFirstTs 时保留第一个)
+
+	ctx        context.Context
+	cancelFn   func()
+	doneCh     chan struct{}
+	mergeErr   error
+	outputList []string
+}
+
+func newStreamMerger(env *DownloadEnv, tsList []mformat.TsInfo, tsSaveDir string, skipInfo SkipTsInfo, req StartDownload_Req) *streamMerger {
+	this := &streamMerger{
+		env:         env,
+		tsList:      tsList,
+		checker:     newTsSkipChecker(tsSaveDir),
+		removeTs:    req.StreamRemoveTs,
+		keepFirstTs: req.UseServerSideTime,
+		doneList:    make([]bool, len(tsList)),
+		markMap:     map[string]tsSkipCheckerMark{},
+		doneCh:      make(chan struct{}),
+	}
+	// 被http.code跳过时需要用户自行合并, 不能删除ts
+	if len(skipInfo.HttpCodeList) > 0 && skipInfo.IfHttpCodeMergeTs == false {
+		this.removeTs = false
+	}
+	this.cond = sync.NewCond(&this.locker)
+	this.ctx, this.cancelFn = context.WithCancel(env.ctx)
+	return this
+}
+
+func (this *streamMerger) getStatePath() string {
+	return filepath.Join(this.checker.tsSaveDir, streamMergeStateFileName)
+}
+
+// loadState 读取上次保存的合并进度, 在 start 之前调用. 进度之前的ts已经合并并且删除, 不再下载
+func (this *streamMerger) loadState(outputName string) error {
+	this.outputName = outputName
+	if this.removeTs == false {
+		return nil
+	}
+	data, err := os.ReadFile(this.getStatePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state streamMergeState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return errors.New("读取合并进度失败: " + err.Error())
+	}
+	if state.OutputName != outputName {
+		return errors.New("合并进度的输出文件 " + strconv.Quote(state.OutputName) + " 和 " + strconv.Quote(outputName) + " 不同, 合并进度之前的ts已经删除, 无法继续合并")
+	}
+	this.startIdx = -1
+	for idx, one := range this.tsList {
+		if filepath.Join(this.checker.tsSaveDir, one.Name) == state.Checkpoint.TsFile {
+			this.startIdx = idx
+			break
+		}
+	}
+	if this.startIdx < 0 {
+		return errors.New("合并进度里的ts " + strconv.Quote(state.Checkpoint.TsFile) + " 不在ts列表里, 无法继续合并")
+	}
+	err = this.checker.loadState(state.Checker, this.tsList)
+	if err != nil {
+		return err
+	}
+	for idx := 0; idx < this.startIdx; idx++ {
+		this.doneList[idx] = true
+	}
+	// 第一个ts在上次合并时已经保留
+	this.keepFirstTs = false
+	this.checkpoint = &state.Checkpoint
+	return nil
+}
+
+// isRemoved 第idx个ts已经在上次合并时写入输出文件并且删除
+func (this *streamMerger) isRemoved(idx int) bool {
+	return idx < this.startIdx
+}
+
+// start 开始合并到 loadState 的 outputName(分割时使用splitOutputName), 和下载ts同时进行
+func (this *streamMerger) start(splitOutputName func(idx int) string, req StartDownload_Req) {
+	tsFileCh := make(chan string)
+	discontinuityMap := map[string]int{}
+	for _, one := range this.tsList {
+		discontinuityMap[filepath.Join(this.checker.tsSaveDir, one.Name)] = one.Idx_EXT_X_DISCONTINUITY
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		this.feed(tsFileCh)
+	}()
+	go func() {
+		mergeReq := MergeTsFileListToSingleMp4_Req{
+			OutputMp4:        this.outputName,
+			OutputFormat:     req.OutputFormat,
+			TsFixContinuity:  req.TsFixContinuity,
+			TsFileCh:         tsFileCh,
+			DiscontinuityMap: discontinuityMap,
+			SplitMode:        req.SplitMode,
+			SplitValue:       req.SplitValue,
+			SplitOutputName:  splitOutputName,
+			TrackMode:        req.TrackMode,
+			FastStart:        req.FastStart,
+			Ctx:              this.ctx,
+			checkpoint:       this.checkpoint,
+		}
+		if this.removeTs {
+			mergeReq.onCheckpoint = this.onCheckpoint
+		}
+		this.outputList, this.mergeErr = MergeTsFileListToMultiFile(mergeReq)
+		this.cancelFn()
+		wg.Wait()
+		close(this.doneCh)
+	}()
+}
+
+// feed 按顺序等待每个ts下载完成, 需要合并的交给muxer. 有ts没有下载完成时取消合并, 避免写出不完整的文件
+func (this *streamMerger) feed(tsFileCh chan<- string) {
+	for idx := this.startIdx; idx < len(this.tsList); idx++ {
+		this.locker.Lock()
+		for this.doneList[idx] == false && this.isClosed == false {
+			this.cond.Wait()
+		}
+		isDone := this.doneList[idx]
+		this.locker.Unlock()
+
+		if isDone == false {
+			this.cancelFn()
+			return
+		}
+		mark := this.checker.mark()
+		if this.checker.check(this.tsList[idx]) == false {
+			continue
+		}
+		tsFile := filepath.Join(this.checker.tsSaveDir, this.tsList[idx].Name)
+		if this.removeTs {
+			this.locker.Lock()
+			this.markMap[tsFile] = mark
+			this.sentList = append(this.sentList, idx)
+			this.locker.Unlock()
+		}
+		select {
+		case tsFileCh <- tsFile:
+		case <-this.ctx.Done():
+			return
+		}
+	}
+	close(tsFileCh)
+}
+
+// setTsDone 第idx个ts已经下载完成或者被http.code跳过
+func (this *streamMerger) setTsDone(idx int) {
+	this.locker.Lock()
+	this.doneList[idx] = true
+	this.cond.Broadcast()
+	this.locker.Unlock()
+}
+
+// finish 下载ts的阶段结束后调用, 等待剩下的ts合并完成, 返回输出的文件列表
+func (this *streamMerger) finish() ([]string, error) {
+	this.locker.Lock()
+	this.isClosed = true
+	this.cond.Broadcast()
+	this.locker.Unlock()
+
+	<-this.doneCh
+	return this.outputList, this.mergeErr
+}
+
+// onCheckpoint 输出文件同步到磁盘后调用: 先保存合并进度, 再删除 checkpoint.TsFile 之前交给muxer的ts
+func (this *streamMerger) onCheckpoint(checkpoint mergeCheckpoint) error {
+	this.locker.Lock()
+	mark, ok := this.markMap[checkpoint.TsFile]
+	var removeList []int
+	for ok && this.removedCount < len(this.sentList) {
+		idx := this.sentList[this.removedCount]
+		tsFile := filepath.Join(this.checker.tsSaveDir, this.tsList[idx].Name)
+		if tsFile == checkpoint.TsFile {
+			break
+		}
+		delete(this.markMap, tsFile)
+		if this.keepFirstTs == false || this.removedCount > 0 {
+			removeList = append(removeList, idx)
+		}
+		this.removedCount++
+	}
+	this.locker.Unlock()
+	if ok == false {
+		return errors.New("没有ts的合并进度: " + checkpoint.TsFile)
+	}
+
+	data, err := json.MarshalIndent(streamMergeState{
+		OutputName: this.outputName,
+		Checkpoint: checkpoint,
+		Checker:    mark.toState(),
+	}, "", "\t")
+	if err != nil {
+		return err
+	}
+	err = writeFileSync(this.getStatePath(), data)
+	if err != nil {
+		return err
+	}
+	for _, idx := range removeList {
+		this.removeTsFile(this.tsList[idx])
+	}
+	return nil
+}
+
+// removeMergedTs 输出文件重命名完成后删除剩下的合并过的ts和合并进度
+func (this *streamMerger) removeMergedTs(mergeTsList []mformat.TsInfo) {
+	if this.removeTs == false {
+		return
+	}
+	for _, one := range mergeTsList {
+		this.removeTsFile(one)
+	}
+	err := os.Remove(this.getStatePath())
+	if err != nil && os.IsNotExist(err) == false {
+		this.env.logToFile("remove " + streamMergeStateFileName + " error: " + err.Error())
+	}
+}
+
+func (this *streamMerger) removeTsFile(one mformat.TsInfo) {
+	tsFile := filepath.Join(this.checker.tsSaveDir, one.Name)
+	err := os.Remove(tsFile)
+	if err != nil && os.IsNotExist(err) == false {
+		this.env.logToFile("remove merged ts " + tsFile + " error: " + err.Error())
+	}
+}
+
+// writeFileSync 写入临时文件并同步到磁盘后重命名, 断电时不会留下不完整的文件
+func writeFileSync(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	errClose := f.Close()
+	if err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return err
+	}
+	// 重命名也要同步到磁盘, 之后才能删除ts. windows上不能打开目录, 忽略错误
+	if dir, errDir := os.Open(filepath.Dir(path)); errDir == nil {
+		_ = dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+package m3u8d
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStreamMerge(t *testing.T) {
+	type tsGate struct {
+		ch   chan struct{}
+		once sync.Once
+	}
+	var locker sync.Mutex
+	gate := &tsGate{ch: make(chan struct{})}
+	var isSlowOpen bool
+	requestCountMap := map[string]int{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/index.m3u8", func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("#EXTM3U\n#EXT-X-TARGETDURATION:6\n" +
+			"#EXTINF:6,\n/ts/jhxy.016.ts\n" +
+			"#EXTINF:6,\n/ts/jhxy.017.ts\n" +
+			"#EXTINF:6,\n/ts/jhxy.018.ts\n#EXT-X-ENDLIST\n"))
+	})
+	mux.HandleFunc("/slow.m3u8", func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("#EXTM3U\n#EXT-X-TARGETDURATION:6\n" +
+			"#EXTINF:6,\n/ts/jhxy.016.ts\n" +
+			"#EXTINF:6,\n/ts/jhxy.017.ts\n" +
+			"#EXTINF:6,\n/slow/jhxy.018.ts\n#EXT-X-ENDLIST\n"))
+	})
+	// 一直等到取消
+	mux.HandleFunc("/slow/", func(writer http.ResponseWriter, request *http.Request) {
+		locker.Lock()
+		isOpen := isSlowOpen
+		locker.Unlock()
+		if isOpen {
+			http.ServeFile(writer, request, filepath.Join("testdata", "TestFull", filepath.Base(request.URL.Path)))
+			return
+		}
+		<-request.Context().Done()
+	})
+	mux.HandleFunc("/ts/", func(writer http.ResponseWriter, request *http.Request) {
+		name := filepath.Base(request.URL.Path)
+		locker.Lock()
+		g := gate
+		requestCountMap[name]++
+		locker.Unlock()
+		// 第一个ts最后下载完成, 合并时仍然按照ts的顺序
+		switch name {
+		case "jhxy.016.ts":
+			select {
+			case <-g.ch:
+			case <-request.Context().Done():
+			}
+		case "jhxy.018.ts":
+			defer g.once.Do(func() {
+				close(g.ch)
+			})
+		}
+		http.ServeFile(writer, request, filepath.Join("testdata", "TestFull", name))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	download := func(saveDir string, fileName string, isStream bool) GetStatus_Resp {
+		var env DownloadEnv
+		ok := env.StartDownload(StartDownload_Req{
+			M3u8Url:        server.URL + "/index.m3u8",
+			SaveDir:        saveDir,
+			FileName:       fileName,
+			ThreadCount:    3,
+			OutputFormat:   OutputFormat_Ts,
+			SkipRemoveTs:   true,
+			SkipCacheCheck: true,
+			StreamMerge:    isStream,
+		})
+		if !ok {
+			t.Fatal("StartDownload failed")
+		}
+		return env.WaitDownloadFinish()
+	}
+	findTsList := func(dir string) (list []string) {
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() && strings.HasSuffix(path, ".ts") {
+				list = append(list, path)
+			}
+			return nil
+		})
+		return list
+	}
+
+	normalDir := t.TempDir()
+	status := download(normalDir, "normal", false)
+	if status.ErrMsg != "" {
+		t.Fatal(status.ErrMsg)
+	}
+	streamDir := t.TempDir()
+	status = download(streamDir, "stream", true)
+	if status.ErrMsg != "" {
+		t.Fatal(status.ErrMsg)
+	}
+	normal, err := os.ReadFile(filepath.Join(normalDir, "normal.ts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := os.ReadFile(filepath.Join(streamDir, "stream.ts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stream) == 0 || bytes.Equal(stream, normal) == false {
+		t.Fatal(len(stream), len(normal))
+	}
+
+	// 不能继续合并的格式不支持合并时删除ts
+	var invalidEnv DownloadEnv
+	invalidEnv.StartDownload(StartDownload_Req{
+		M3u8Url:        server.URL + "/index.m3u8",
+		SaveDir:        t.TempDir(),
+		ThreadCount:    3,
+		OutputFormat:   OutputFormat_Ts,
+		StreamMerge:    true,
+		StreamRemoveTs: true,
+	})
+	if status = invalidEnv.WaitDownloadFinish(); status.ErrCode != ErrCode_InvalidArgs {
+		t.Fatal(status.ErrCode, status.ErrMsg)
+	}
+
+	// 取消时不生成输出文件
+	cancelDir := t.TempDir()
+	var env DownloadEnv
+	g := &tsGate{ch: make(chan struct{})}
+	locker.Lock()
+	gate = g
+	locker.Unlock()
+	ok := env.StartDownload(StartDownload_Req{
+		M3u8Url:        server.URL + "/index.m3u8",
+		SaveDir:        cancelDir,
+		FileName:       "cancel",
+		ThreadCount:    3,
+		OutputFormat:   OutputFormat_Ts,
+		SkipCacheCheck: true,
+		StreamMerge:    true,
+	})
+	if !ok {
+		t.Fatal("StartDownload failed")
+	}
+	<-g.ch
+	env.CloseEnv()
+	status = env.WaitDownloadFinish()
+	if status.ErrMsg == "" {
+		t.Fatal("expect error")
+	}
+	if _, err = os.Stat(filepath.Join(cancelDir, "cancel.ts")); err == nil {
+		t.Fatal("output file exists")
+	}
+
+	// 合并为fmp4时, 完整写入输出文件的ts马上删除; 取消后继续下载时不再下载它们, 从合并进度继续合并
+	removeDir := t.TempDir()
+	removeReq := StartDownload_Req{
+		M3u8Url:        server.URL + "/slow.m3u8",
+		SaveDir:        removeDir,
+		FileName:       "remove",
+		ThreadCount:    3,
+		OutputFormat:   OutputFormat_Fmp4,
+		SkipCacheCheck: true,
+		SkipRemoveTs:   true,
+		StreamMerge:    true,
+		StreamRemoveTs: true,
+	}
+	var removeEnv DownloadEnv
+	ok = removeEnv.StartDownload(removeReq)
+	if !ok {
+		t.Fatal("StartDownload failed")
+	}
+	// 第一个ts在第二个ts开始的分片写入后删除
+	for idx := 0; ; idx++ {
+		list := findTsList(removeDir)
+		if len(list) == 1 && filepath.Base(list[0]) == "00002.ts" {
+			break
+		}
+		if idx > 100 {
+			t.Fatal(list)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	removeEnv.CloseEnv()
+	status = removeEnv.WaitDownloadFinish()
+	if status.ErrMsg == "" {
+		t.Fatal("expect error")
+	}
+	if list, _ := filepath.Glob(filepath.Join(removeDir, "downloading", "*", streamMergeStateFileName)); len(list) != 1 {
+		t.Fatal(list)
+	}
+
+	locker.Lock()
+	isSlowOpen = true
+	requestCountMap = map[string]int{}
+	locker.Unlock()
+	var resumeEnv DownloadEnv
+	ok = resumeEnv.StartDownload(removeReq)
+	if !ok {
+		t.Fatal("StartDownload failed")
+	}
+	status = resumeEnv.WaitDownloadFinish()
+	if status.ErrMsg != "" {
+		t.Fatal(status.ErrMsg)
+	}
+	locker.Lock()
+	count := requestCountMap["jhxy.016.ts"]
+	locker.Unlock()
+	if count != 0 {
+		t.Fatal("download removed ts again", count)
+	}
+	// 所有的ts和合并进度都已经删除, 也没有指向ts的ffmpeg合并命令
+	if list := findTsList(removeDir); len(list) != 0 {
+		t.Fatal(list)
+	}
+	for _, pattern := range []string{streamMergeStateFileName, "merge-by-ffmpeg.*"} {
+		if list, _ := filepath.Glob(filepath.Join(removeDir, "downloading", "*", pattern)); len(list) != 0 {
+			t.Fatal(list)
+		}
+	}
+	// 和一次合并完成的文件的分片、时间相同
+	removeName := filepath.Join(removeDir, "remove.mp4")
+	fullName := filepath.Join(t.TempDir(), "full.mp4")
+	mergeFmp4ForTest(t, []string{"testdata/TestFull/jhxy.016.ts", "testdata/TestFull/jhxy.017.ts", "testdata/TestFull/jhxy.018.ts"}, fullName, false)
+	info, _ := scanFmp4ForTest(t, fullName)
+	removeInfo, _ := scanFmp4ForTest(t, removeName)
+	if removeInfo.fragmentCount != info.fragmentCount || len(removeInfo.trackMap) != len(info.trackMap) {
+		t.Fatal(removeInfo.fragmentCount, info.fragmentCount)
+	}
+	for trackType, one := range info.trackMap {
+		if *removeInfo.trackMap[trackType] != *one {
+			t.Fatal(trackType, *removeInfo.trackMap[trackType], *one)
+		}
+	}
+}
@@ -0,0 +1,632 @@
+package m3u8d
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TaskState_Queued    = "queued"    // 排队中
+	TaskState_Running   = "running"   // 下载中
+	TaskState_Finished  = "finished"  // 下载成功
+	TaskState_Failed    = "failed"    // 下载失败
+	TaskState_Cancelled = "cancelled" // 用户取消
+)
+
+// TaskManager 同时管理多个下载任务, 超过最大并行数量的任务按照优先级、添加顺序排队
+type TaskManager struct {
+	locker     sync.Mutex
+	maxRunning int
+	seqAlloc   uint64
+	taskMap    map[string]*managedTask
+	fetcherMap map[string]Fetcher // 之后启动的任务使用的自定义Fetcher
+
+	stateFileLocker sync.Mutex
+	stateFilePath   string // 为空时不保存任务列表
+}
+
+type managedTask struct {
+	req      StartDownload_Req
+	priority int
+	seq      uint64 // 添加顺序, 相同优先级先进先出
+	state    string
+	isCancel bool // 下载中的任务被取消, 等待env结束后才会变为 TaskState_Cancelled
+	env      *DownloadEnv
+	lastResp GetStatus_Resp // 已结束、排队时被取消的任务使用这里的状态
+}
+
+type TaskStatus struct {
+	TaskId   string
+	State    string
+	Priority int
+	M3u8Url  string
+	FileName string
+	Status   GetStatus_Resp
+}
+
+type AddTask_Resp struct {
+	TaskId string
+	ErrMsg string
+}
+
+func NewTaskManager(maxRunning int) *TaskManager {
+	if maxRunning <= 0 {
+		maxRunning = 1
+	}
+	return &TaskManager{
+		maxRunning: maxRunning,
+		taskMap:    map[string]*managedTask{},
+		fetcherMap: map[string]Fetcher{},
+	}
+}
+
+// RegisterFetcher 之后启动的任务都使用 DownloadEnv.RegisterFetcher 注册这个Fetcher, fetcher为nil时取消注册
+func (this *TaskManager) RegisterFetcher(scheme string, fetcher Fetcher) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	if fetcher == nil {
+		delete(this.fetcherMap, strings.ToLower(scheme))
+		return
+	}
+	this.fetcherMap[strings.ToLower(scheme)] = fetcher
+}
+
+func (this *TaskManager) SetMaxRunning(maxRunning int) {
+	if maxRunning <= 0 {
+		maxRunning = 1
+	}
+	this.locker.Lock()
+	this.maxRunning = maxRunning
+	this.locker.Unlock()
+
+	this.schedule()
+}
+
+// AddTask 添加任务, req.TaskId 为空时自动分配. priority越大越先下载
+func (this *TaskManager) AddTask(req StartDownload_Req, priority int) (resp AddTask_Resp) {
+	this.locker.Lock()
+	this.seqAlloc++
+	if req.TaskId == "" {
+		req.TaskId = "task-" + strconv.FormatUint(this.seqAlloc, 10) + "-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	if _, ok := this.taskMap[req.TaskId]; ok {
+		this.locker.Unlock()
+		resp.ErrMsg = "任务id已存在: " + req.TaskId
+		return resp
+	}
+	this.taskMap[req.TaskId] = &managedTask{
+		req:      req,
+		priority: priority,
+		seq:      this.seqAlloc,
+		state:    TaskState_Queued,
+	}
+	this.locker.Unlock()
+
+	this.schedule()
+	resp.TaskId = req.TaskId
+	return resp
+}
+
+// schedule 在有空闲名额时启动排队中的任务, 并保存任务列表
+func (this *TaskManager) schedule() {
+	this.startQueuedTasks()
+	this.saveStateFile()
+}
+
+func (this *TaskManager) startQueuedTasks() {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	var runningCount int
+	var queue []taskSortUnit
+	for _, task := range this.taskMap {
+		switch task.state {
+		case TaskState_Running:
+			runningCount++
+		case TaskState_Queued:
+			queue = append(queue, newTaskSortUnit(task))
+		}
+	}
+	sortTaskQueue(queue)
+
+	for _, one := range queue {
+		if runningCount >= this.maxRunning {
+			break
+		}
+		task := one.task
+		task.env = &DownloadEnv{}
+		for scheme, fetcher := range this.fetcherMap {
+			task.env.RegisterFetcher(scheme, fetcher)
+		}
+		task.env.onFinished = func() {
+			this.onTaskFinished(task)
+		}
+		task.state = TaskState_Running
+		if task.env.StartDownload(task.req) == false {
+			task.state = TaskState_Failed
+			task.lastResp.ErrMsg = "启动下载失败"
+			task.lastResp.ErrCode = ErrCode_Unknown
+			continue
+		}
+		runningCount++
+	}
+}
+
+// taskSortUnit 持有 locker 时复制的排序字段, 释放锁之后排序不会读取 managedTask
+type taskSortUnit struct {
+	task     *managedTask
+	priority int
+	seq      uint64
+}
+
+func newTaskSortUnit(task *managedTask) taskSortUnit {
+	return taskSortUnit{
+		task:     task,
+		priority: task.priority,
+		seq:      task.seq,
+	}
+}
+
+func sortTaskQueue(queue []taskSortUnit) {
+	sort.Slice(queue, func(i, j int) bool {
+		if queue[i].priority != queue[j].priority {
+			return queue[i].priority > queue[j].priority
+		}
+		return queue[i].seq < queue[j].seq
+	})
+}
+
+func (this *TaskManager) onTaskFinished(task *managedTask) {
+	resp := task.env.GetStatus()
+
+	this.locker.Lock()
+	task.lastResp = resp
+	if task.state == TaskState_Running {
+		if task.isCancel || resp.IsCancel {
+			task.state = TaskState_Cancelled
+		} else if resp.ErrMsg == "" {
+			task.state = TaskState_Finished
+		} else {
+			task.state = TaskState_Failed
+		}
+	}
+	this.locker.Unlock()
+
+	this.schedule()
+}
+
+// GetStatus 获取单个任务的状态, 任务不存在时返回false
+func (this *TaskManager) GetStatus(taskId string) (resp GetStatus_Resp, ok bool) {
+	this.locker.Lock()
+	task, ok := this.taskMap[taskId]
+	this.locker.Unlock()
+
+	if ok == false {
+		return resp, false
+	}
+	return this.getTaskStatus(task).Status, true
+}
+
+func (this *TaskManager) getTaskStatus(task *managedTask) (status TaskStatus) {
+	this.locker.Lock()
+	status = TaskStatus{
+		TaskId:   task.req.TaskId,
+		State:    task.state,
+		Priority: task.priority,
+		M3u8Url:  task.req.M3u8Url,
+		FileName: task.req.FileName,
+		Status:   task.lastResp,
+	}
+	env := task.env
+	this.locker.Unlock()
+
+	switch status.State {
+	case TaskState_Queued:
+		status.Status = GetStatus_Resp{
+			Title:    "排队中",
+			TaskId:   status.TaskId,
+			IsQueued: true,
+		}
+	case TaskState_Running:
+		status.Status = env.GetStatus()
+	}
+	return status
+}
+
+// CancelTask 取消排队中或者下载中的任务, 任务记录会保留, 可以用ListTasks查看
+func (this *TaskManager) CancelTask(taskId string) {
+	this.locker.Lock()
+	task, ok := this.taskMap[taskId]
+	if ok == false {
+		this.locker.Unlock()
+		return
+	}
+	switch task.state {
+	case TaskState_Queued:
+		task.state = TaskState_Cancelled
+		task.lastResp = GetStatus_Resp{
+			Title:    "已取消",
+			ErrMsg:   "用户取消",
+			ErrCode:  ErrCode_Cancelled,
+			IsCancel: true,
+			TaskId:   taskId,
+		}
+		this.locker.Unlock()
+		this.saveStateFile()
+		return
+	case TaskState_Running:
+		task.isCancel = true
+		env := task.env
+		this.locker.Unlock()
+		env.CloseEnv()
+		return
+	}
+	this.locker.Unlock()
+}
+
+// PauseTask 暂停下载中的任务, 暂停的任务仍然占用同时下载的名额
+func (this *TaskManager) PauseTask(taskId string) (errMsg string) {
+	env, errMsg := this.getRunningEnv(taskId)
+	if errMsg != "" {
+		return errMsg
+	}
+	if env.Pause() == false {
+		return "任务已暂停或者已经开始合并, 不能暂停: " + taskId
+	}
+	return ""
+}
+
+// ResumeTask 继续下载暂停的任务
+func (this *TaskManager) ResumeTask(taskId string) (errMsg string) {
+	env, errMsg := this.getRunningEnv(taskId)
+	if errMsg != "" {
+		return errMsg
+	}
+	if env.Resume() == false {
+		return "任务没有暂停: " + taskId
+	}
+	return ""
+}
+
+func (this *TaskManager) getRunningEnv(taskId string) (env *DownloadEnv, errMsg string) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	task, ok := this.taskMap[taskId]
+	if ok == false {
+		return nil, "任务不存在: " + taskId
+	}
+	if task.state != TaskState_Running || task.isCancel {
+		return nil, "任务状态为 " + task.state + ", 不是下载中: " + taskId
+	}
+	return task.env, ""
+}
+
+// RemoveTask 取消并删除任务
+func (this *TaskManager) RemoveTask(taskId string) {
+	this.CancelTask(taskId)
+
+	this.locker.Lock()
+	delete(this.taskMap, taskId)
+	this.locker.Unlock()
+
+	this.saveStateFile()
+}
+
+// RetryTask 重新下载失败、取消的任务, 已下载的ts会被复用
+func (this *TaskManager) RetryTask(taskId string) (errMsg string) {
+	return this.retryTask(taskId, nil)
+}
+
+// RetryTaskWithReq 使用新的下载参数(例如重新提供的cookie)重新下载失败、取消的任务, req.TaskId 为要重试的任务. 排队中的任务只更新参数
+func (this *TaskManager) RetryTaskWithReq(req StartDownload_Req) (errMsg string) {
+	return this.retryTask(req.TaskId, &req)
+}
+
+func (this *TaskManager) retryTask(taskId string, req *StartDownload_Req) (errMsg string) {
+	this.locker.Lock()
+	task, ok := this.taskMap[taskId]
+	if ok == false {
+		this.locker.Unlock()
+		return "任务不存在: " + taskId
+	}
+	if task.state == TaskState_Queued && req != nil {
+		task.req = *req
+		this.locker.Unlock()
+		return ""
+	}
+	if task.state != TaskState_Failed && task.state != TaskState_Cancelled {
+		this.locker.Unlock()
+		return "任务状态为 " + task.state + ", 不能重试: " + taskId
+	}
+	if req != nil {
+		task.req = *req
+	}
+	this.seqAlloc++
+	task.seq = this.seqAlloc
+	task.state = TaskState_Queued
+	task.isCancel = false
+	task.env = nil
+	task.lastResp = GetStatus_Resp{}
+	this.locker.Unlock()
+
+	this.schedule()
+	return ""
+}
+
+// SetPriority 修改任务的优先级, 排队中的任务按照新的优先级排序
+func (this *TaskManager) SetPriority(taskId string, priority int) (errMsg string) {
+	this.locker.Lock()
+	task, ok := this.taskMap[taskId]
+	if ok == false {
+		this.locker.Unlock()
+		return "任务不存在: " + taskId
+	}
+	task.priority = priority
+	this.locker.Unlock()
+
+	this.saveStateFile()
+	return ""
+}
+
+// PurgeTasks 删除所有已结束(成功、失败、取消)的任务记录
+func (this *TaskManager) PurgeTasks() (count int) {
+	this.locker.Lock()
+	for taskId, task := range this.taskMap {
+		if task.state == TaskState_Finished || task.state == TaskState_Failed || task.state == TaskState_Cancelled {
+			delete(this.taskMap, taskId)
+			count++
+		}
+	}
+	this.locker.Unlock()
+
+	this.saveStateFile()
+	return count
+}
+
+// ListTasks 获取所有任务的快照: 下载中的在前, 然后是排队中的(按照下载顺序), 最后是已结束的
+func (this *TaskManager) ListTasks() (list []TaskStatus) {
+	this.locker.Lock()
+	var running, queue, done []taskSortUnit
+	for _, task := range this.taskMap {
+		switch task.state {
+		case TaskState_Running:
+			running = append(running, newTaskSortUnit(task))
+		case TaskState_Queued:
+			queue = append(queue, newTaskSortUnit(task))
+		default:
+			done = append(done, newTaskSortUnit(task))
+		}
+	}
+	this.locker.Unlock()
+
+	sortTaskQueue(queue)
+	for _, one := range [][]taskSortUnit{running, done} {
+		sort.Slice(one, func(i, j int) bool {
+			return one[i].seq < one[j].seq
+		})
+	}
+	for _, one := range [][]taskSortUnit{running, queue, done} {
+		for _, unit := range one {
+			list = append(list, this.getTaskStatus(unit.task))
+		}
+	}
+	return list
+}
+
+// GetSegmentList 获取下载中的任务每个ts的下载状态, 排队中、已结束的任务返回空
+func (this *TaskManager) GetSegmentList(taskId string) (list []SegmentInfo) {
+	env, errMsg := this.getRunningEnv(taskId)
+	if errMsg != "" {
+		return nil
+	}
+	return env.GetSegmentList()
+}
+
+// IsAllFinished 是否没有排队中、下载中的任务
+func (this *TaskManager) IsAllFinished() bool {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	for _, task := range this.taskMap {
+		if task.state == TaskState_Queued || task.state == TaskState_Running {
+			return false
+		}
+	}
+	return true
+}
+
+func (this *TaskManager) WaitAllFinish() {
+	for this.IsAllFinished() == false {
+		time.Sleep(time.Millisecond * 100)
+	}
+}
+
+// 保存在下载目录里的任务列表, 进程重启后可以继续下载
+const TaskStateFileName = "m3u8d_tasks.json"
+
+// 任务列表里去掉的cookie、认证header、证书密码、代理密码保存在 任务列表文件名+taskSecretFileSuffix 里, 权限0600
+const taskSecretFileSuffix = ".secret"
+
+type taskStateFile struct {
+	List []taskStateUnit
+}
+
+type taskStateUnit struct {
+	Req      StartDownload_Req
+	Priority int
+	Seq      uint64
+	State    string
+	Status   GetStatus_Resp
+}
+
+type taskSecretFile struct {
+	SecretMap map[string]taskSecretUnit // key为TaskId
+}
+
+// taskSecretUnit getRedactedReq 去掉的内容
+type taskSecretUnit struct {
+	HeaderMap      map[string][]string // 只有cookie、认证header
+	ClientCertPass string
+	SetProxy       string // 带密码的代理地址
+}
+
+// getReqSecret 获取请求参数里的cookie、认证header、证书密码、代理密码, 没有时返回false
+func getReqSecret(req StartDownload_Req) (secret taskSecretUnit, ok bool) {
+	for key, vList := range req.HeaderMap {
+		if isSensitiveHeader(key) {
+			if secret.HeaderMap == nil {
+				secret.HeaderMap = map[string][]string{}
+			}
+			secret.HeaderMap[key] = vList
+			ok = true
+		}
+	}
+	if req.ClientCertPass != "" {
+		secret.ClientCertPass = req.ClientCertPass
+		ok = true
+	}
+	if getRedactedReq(req, "").SetProxy != req.SetProxy {
+		secret.SetProxy = req.SetProxy
+		ok = true
+	}
+	return secret, ok
+}
+
+// applyReqSecret 把 getReqSecret 的结果放回去掉了敏感信息的请求参数
+func applyReqSecret(req StartDownload_Req, secret taskSecretUnit) StartDownload_Req {
+	if len(secret.HeaderMap) > 0 {
+		headerMap := map[string][]string{}
+		for key, vList := range req.HeaderMap {
+			headerMap[key] = vList
+		}
+		for key, vList := range secret.HeaderMap {
+			headerMap[key] = vList
+		}
+		req.HeaderMap = headerMap
+	}
+	if secret.ClientCertPass != "" {
+		req.ClientCertPass = secret.ClientCertPass
+	}
+	if secret.SetProxy != "" {
+		req.SetProxy = secret.SetProxy
+	}
+	return req
+}
+
+// LoadStateFile 读取任务列表文件, 之后任务状态变化时都会写入此文件.
+//
+//	上次进程退出时没有下载完成的任务会重新排队, 调用 ResumeQueued 后开始下载.
+//	任务列表文件里不保存cookie、认证header、证书密码、代理密码, 这些保存在同目录下权限为0600的 path+".secret" 文件里, 读取时放回任务的下载参数
+func (this *TaskManager) LoadStateFile(path string) (errMsg string) {
+	var file taskStateFile
+	data, err := os.ReadFile(path)
+	if err != nil && os.IsNotExist(err) == false {
+		return "读取任务列表失败: " + err.Error()
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &file)
+		if err != nil {
+			return "解析任务列表失败: " + err.Error()
+		}
+	}
+	var secretFile taskSecretFile
+	data, err = os.ReadFile(path + taskSecretFileSuffix)
+	if err != nil && os.IsNotExist(err) == false {
+		return "读取任务列表失败: " + err.Error()
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &secretFile)
+		if err != nil {
+			return "解析任务列表失败: " + err.Error()
+		}
+	}
+
+	this.locker.Lock()
+	this.stateFilePath = path
+	for _, unit := range file.List {
+		if _, ok := this.taskMap[unit.Req.TaskId]; ok || unit.Req.TaskId == "" {
+			continue
+		}
+		if secret, ok := secretFile.SecretMap[unit.Req.TaskId]; ok {
+			unit.Req = applyReqSecret(unit.Req, secret)
+		}
+		task := &managedTask{
+			req:      unit.Req,
+			priority: unit.Priority,
+			seq:      unit.Seq,
+			state:    unit.State,
+			lastResp: unit.Status,
+		}
+		if task.state == TaskState_Running { // 上次进程退出时正在下载
+			task.state = TaskState_Queued
+		}
+		if task.seq > this.seqAlloc {
+			this.seqAlloc = task.seq
+		}
+		this.taskMap[task.req.TaskId] = task
+	}
+	this.locker.Unlock()
+	return ""
+}
+
+// ResumeQueued 开始下载排队中的任务
+func (this *TaskManager) ResumeQueued() {
+	this.schedule()
+}
+
+func (this *TaskManager) saveStateFile() {
+	this.stateFileLocker.Lock()
+	defer this.stateFileLocker.Unlock()
+
+	var file taskStateFile
+	var secretFile = taskSecretFile{SecretMap: map[string]taskSecretUnit{}}
+	this.locker.Lock()
+	path := this.stateFilePath
+	for _, task := range this.taskMap {
+		if secret, ok := getReqSecret(task.req); ok {
+			secretFile.SecretMap[task.req.TaskId] = secret
+		}
+		file.List = append(file.List, taskStateUnit{
+			Req:      getRedactedReq(task.req, ""),
+			Priority: task.priority,
+			Seq:      task.seq,
+			State:    task.state,
+			Status:   task.lastResp,
+		})
+	}
+	this.locker.Unlock()
+
+	if path == "" {
+		return
+	}
+	sort.Slice(file.List, func(i, j int) bool {
+		return file.List[i].Seq < file.List[j].Seq
+	})
+	// 写入失败不影响下载, 下次状态变化时会再次写入
+	if len(secretFile.SecretMap) > 0 {
+		writeTaskStateFile(path+taskSecretFileSuffix, secretFile)
+	} else {
+		_ = os.Remove(path + taskSecretFileSuffix)
+	}
+	writeTaskStateFile(path, file)
+}
+
+func writeTaskStateFile(path string, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return
+	}
+	tmpPath := path + ".tmp"
+	// 旧版本留下的临时文件权限可能是0666, 删除后重新创建
+	_ = os.Remove(tmpPath)
+	if os.WriteFile(tmpPath, data, 0600) == nil {
+		_ = os.Rename(tmpPath, path)
+	}
+}
@@ -0,0 +1,170 @@
+package m3u8d
+
+import (
+	"github.com/yapingcat/gomedia/go-mpeg2"
+)
+
+const (
+	tsTimestampWrapMs = (1 << 33) / 90 // 33位的PTS/DTS回绕, 单位毫秒
+
+	// 同一个轨道相邻两帧的dts超出这个范围时当作时间戳不连续(没有#EXT-X-DISCONTINUITY的插播、编码器重启)
+	tsTimestampMaxBackMs    = 1000
+	tsTimestampMaxForwardMs = 10000
+)
+
+type tsTimestampTrack struct {
+	lastDts   int64 // 输出的时间戳
+	lastDelta int64 // 最后两帧的间隔, 用来估计最后一帧的时长
+}
+
+// tsTimestampRebaser 合并时重新计算时间戳(毫秒): 处理33位回绕, 在不连续的位置让后面的时间戳接在前面的最后一帧之后.
+//
+//	同一个分段的音视频使用相同的偏移量, 不会改变音视频同步
+type tsTimestampRebaser struct {
+	trackMap map[mpeg2.TS_STREAM_TYPE]*tsTimestampTrack
+
+	isStarted  bool
+	lastRawDts int64 // 已经解开回绕的dts
+	wrapCount  int64
+	offset     int64
+
+	hasDiscontinuityIdx bool
+	discontinuityIdx    int
+	isPendingBoundary   bool // 下一帧开始新的分段
+}
+
+func newTsTimestampRebaser() *tsTimestampRebaser {
+	return &tsTimestampRebaser{
+		trackMap: map[mpeg2.TS_STREAM_TYPE]*tsTimestampTrack{},
+	}
+}
+
+// setDiscontinuityIdx 开始合并一个ts文件, idx为 mformat.TsInfo.Idx_EXT_X_DISCONTINUITY
+func (this *tsTimestampRebaser) setDiscontinuityIdx(idx int) {
+	if this.hasDiscontinuityIdx && idx != this.discontinuityIdx {
+		this.isPendingBoundary = true
+	}
+	this.hasDiscontinuityIdx = true
+	this.discontinuityIdx = idx
+}
+
+func (this *tsTimestampRebaser) rebase(cid mpeg2.TS_STREAM_TYPE, pts uint64, dts uint64) (uint64, uint64) {
+	rawDts := this.unwrap(int64(dts))
+	cts := int64(pts) - int64(dts)
+	if cts < -tsTimestampWrapMs/2 {
+		cts += tsTimestampWrapMs
+	} else if cts > tsTimestampWrapMs/2 {
+		cts -= tsTimestampWrapMs
+	}
+
+	track := this.trackMap[cid]
+	if this.isPendingBoundary == false && track != nil {
+		delta := rawDts + this.offset - track.lastDts
+		if delta < -tsTimestampMaxBackMs || delta > tsTimestampMaxForwardMs {
+			this.isPendingBoundary = true
+		}
+	}
+	if this.isPendingBoundary {
+		this.isPendingBoundary = false
+		var end int64
+		for _, one := range this.trackMap {
+			if one.lastDts+one.lastDelta > end {
+				end = one.lastDts + one.lastDelta
+			}
+		}
+		this.offset = end - rawDts
+	}
+
+	outDts := rawDts + this.offset
+	if outDts < 0 {
+		outDts = 0
+	}
+	if track == nil {
+		track = &tsTimestampTrack{}
+		this.trackMap[cid] = track
+	} else if outDts > track.lastDts {
+		track.lastDelta = outDts - track.lastDts
+	}
+	track.lastDts = outDts
+	outPts := outDts + cts
+	if outPts < 0 {
+		outPts = 0
+	}
+	return uint64(outPts), uint64(outDts)
+}
+
+// unwrap 解开33位回绕. 交错的音视频可能略早于上一帧, 所以和上一帧相差超过一半范围时才认为发生了回绕
+func (this *tsTimestampRebaser) unwrap(dts int64) int64 {
+	if this.isStarted == false || this.isPendingBoundary {
+		// 新的分段, 时间戳和前面的没有关系
+		this.isStarted = true
+		this.wrapCount = 0
+		this.lastRawDts = dts
+		return dts
+	}
+	ret := dts + this.wrapCount*tsTimestampWrapMs
+	if ret < this.lastRawDts-tsTimestampWrapMs/2 {
+		this.wrapCount++
+		ret += tsTimestampWrapMs
+	} else if ret > this.lastRawDts+tsTimestampWrapMs/2 {
+		// 回绕之前的帧
+		return ret - tsTimestampWrapMs
+	}
+	if ret > this.lastRawDts {
+		this.lastRawDts = ret
+	}
+	return ret
+}
+
+// tsTimestampRebaserState 保存在合并进度(mergeCheckpoint)里的 tsTimestampRebaser
+type tsTimestampRebaserState struct {
+	TrackList           []tsTimestampTrackState
+	IsStarted           bool
+	LastRawDts          int64
+	WrapCount           int64
+	Offset              int64
+	HasDiscontinuityIdx bool
+	DiscontinuityIdx    int
+	IsPendingBoundary   bool
+}
+
+type tsTimestampTrackState struct {
+	Cid       int
+	LastDts   int64
+	LastDelta int64
+}
+
+func (this *tsTimestampRebaser) saveState() (state tsTimestampRebaserState) {
+	for cid, one := range this.trackMap {
+		state.TrackList = append(state.TrackList, tsTimestampTrackState{
+			Cid:       int(cid),
+			LastDts:   one.lastDts,
+			LastDelta: one.lastDelta,
+		})
+	}
+	state.IsStarted = this.isStarted
+	state.LastRawDts = this.lastRawDts
+	state.WrapCount = this.wrapCount
+	state.Offset = this.offset
+	state.HasDiscontinuityIdx = this.hasDiscontinuityIdx
+	state.DiscontinuityIdx = this.discontinuityIdx
+	state.IsPendingBoundary = this.isPendingBoundary
+	return state
+}
+
+func (this *tsTimestampRebaser) loadState(state tsTimestampRebaserState) {
+	this.trackMap = map[mpeg2.TS_STREAM_TYPE]*tsTimestampTrack{}
+	for _, one := range state.TrackList {
+		this.trackMap[mpeg2.TS_STREAM_TYPE(one.Cid)] = &tsTimestampTrack{
+			lastDts:   one.LastDts,
+			lastDelta: one.LastDelta,
+		}
+	}
+	this.isStarted = state.IsStarted
+	this.lastRawDts = state.LastRawDts
+	this.wrapCount = state.WrapCount
+	this.offset = state.Offset
+	this.hasDiscontinuityIdx = state.HasDiscontinuityIdx
+	this.discontinuityIdx = state.DiscontinuityIdx
+	this.isPendingBoundary = state.IsPendingBoundary
+}
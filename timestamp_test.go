@@ -0,0 +1,121 @@
+package m3u8d
+
+import (
+	"context"
+	"encoding/binary"
+	"github.com/yapingcat/gomedia/go-mpeg2"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTsTimestampRebaser(t *testing.T) {
+	const video, audio = mpeg2.TS_STREAM_H264, mpeg2.TS_STREAM_AAC
+	type frame struct {
+		cid                 mpeg2.TS_STREAM_TYPE
+		pts, dts            uint64
+		outPts, outDts      uint64
+		discontinuityIdx    int
+		hasDiscontinuityIdx bool
+	}
+	for idx, list := range [][]frame{
+		// 连续的时间戳不变
+		{
+			{cid: video, pts: 1080, dts: 1000, outPts: 1080, outDts: 1000},
+			{cid: audio, pts: 990, dts: 990, outPts: 990, outDts: 990},
+			{cid: video, pts: 1120, dts: 1040, outPts: 1120, outDts: 1040},
+		},
+		// 33位回绕
+		{
+			{cid: video, pts: tsTimestampWrapMs - 40, dts: tsTimestampWrapMs - 80, outPts: tsTimestampWrapMs - 40, outDts: tsTimestampWrapMs - 80},
+			{cid: audio, pts: tsTimestampWrapMs - 10, dts: tsTimestampWrapMs - 10, outPts: tsTimestampWrapMs - 10, outDts: tsTimestampWrapMs - 10},
+			{cid: video, pts: 0, dts: tsTimestampWrapMs - 40, outPts: tsTimestampWrapMs, outDts: tsTimestampWrapMs - 40},
+			{cid: video, pts: 40, dts: 0, outPts: tsTimestampWrapMs + 40, outDts: tsTimestampWrapMs},
+			{cid: audio, pts: 10, dts: 10, outPts: tsTimestampWrapMs + 10, outDts: tsTimestampWrapMs + 10},
+		},
+		// #EXT-X-DISCONTINUITY: 接在前面的最后一帧之后, 音视频使用相同的偏移量
+		{
+			{cid: video, pts: 50000, dts: 50000, outPts: 50000, outDts: 50000, hasDiscontinuityIdx: true},
+			{cid: video, pts: 50040, dts: 50040, outPts: 50040, outDts: 50040},
+			{cid: audio, pts: 50050, dts: 50050, outPts: 50050, outDts: 50050},
+			{cid: audio, pts: 50070, dts: 50070, outPts: 50070, outDts: 50070},
+			{cid: audio, pts: 5000, dts: 5000, outPts: 50090, outDts: 50090, discontinuityIdx: 1, hasDiscontinuityIdx: true},
+			{cid: video, pts: 5010, dts: 5010, outPts: 50100, outDts: 50100},
+		},
+		// 没有#EXT-X-DISCONTINUITY的跳变
+		{
+			{cid: video, pts: 1000, dts: 1000, outPts: 1000, outDts: 1000},
+			{cid: video, pts: 1040, dts: 1040, outPts: 1040, outDts: 1040},
+			{cid: video, pts: 900000, dts: 900000, outPts: 1080, outDts: 1080},
+			{cid: video, pts: 900040, dts: 900040, outPts: 1120, outDts: 1120},
+			{cid: video, pts: 100, dts: 100, outPts: 1160, outDts: 1160},
+		},
+	} {
+		rebaser := newTsTimestampRebaser()
+		for frameIdx, one := range list {
+			if one.hasDiscontinuityIdx {
+				rebaser.setDiscontinuityIdx(one.discontinuityIdx)
+			}
+			pts, dts := rebaser.rebase(one.cid, one.pts, one.dts)
+			if pts != one.outPts || dts != one.outDts {
+				t.Fatal(idx, frameIdx, pts, dts)
+			}
+		}
+	}
+}
+
+func mp4DurationMsForTest(t *testing.T, name string) uint32 {
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, moov := range fmp4TopBoxListForTest(t, name) {
+		if moov.boxType != "moov" {
+			continue
+		}
+		for _, mvhd := range fmp4ReadChildren(f, moov) {
+			if mvhd.boxType != "mvhd" {
+				continue
+			}
+			body, err := fmp4ReadBody(f, mvhd)
+			if err != nil || body[0] != 0 {
+				t.Fatal(err)
+			}
+			return binary.BigEndian.Uint32(body[16:20]) * 1000 / binary.BigEndian.Uint32(body[12:16])
+		}
+	}
+	t.Fatal("mvhd not found")
+	return 0
+}
+
+func TestMergeDiscontinuity(t *testing.T) {
+	dir := t.TempDir()
+	merge := func(name string, tsFileList []string, discontinuityMap map[string]int) uint32 {
+		outputName := filepath.Join(dir, name)
+		err := MergeTsFileListToSingleMp4(MergeTsFileListToSingleMp4_Req{
+			TsFileList:       tsFileList,
+			OutputMp4:        outputName,
+			DiscontinuityMap: discontinuityMap,
+			Ctx:              context.Background(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mp4DurationMsForTest(t, outputName)
+	}
+	ts016 := filepath.Join("testdata", "TestFull", "jhxy.016.ts")
+	ts017 := filepath.Join("testdata", "TestFull", "jhxy.017.ts")
+	ts018 := filepath.Join("testdata", "TestFull", "jhxy.018.ts")
+	normal := merge("normal.mp4", []string{ts016, ts017, ts018}, nil)
+	// 跳过中间的ts后时间戳不连续, 不在DiscontinuityMap里时保留原来的时间戳
+	skip := merge("skip.mp4", []string{ts016, ts018}, nil)
+	if skip+200 < normal || skip > normal+200 {
+		t.Fatal(skip, normal)
+	}
+	rebased := merge("rebased.mp4", []string{ts016, ts018}, map[string]int{ts016: 0, ts018: 1})
+	twoThirds := normal * 2 / 3
+	if rebased+200 < twoThirds || rebased > twoThirds+200 {
+		t.Fatal(rebased, normal)
+	}
+}
@@ -0,0 +1,188 @@
+package m3u8d
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"golang.org/x/crypto/pkcs12"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var gTlsVersionMap = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func newTlsConfig(req StartDownload_Req) (config *tls.Config, errMsg string) {
+	// TlsServerName 只用于m3u8所在的host, 见 newTlsServerNameTransport
+	config = &tls.Config{
+		InsecureSkipVerify: req.Insecure,
+	}
+	if req.TlsMinVersion != "" {
+		version, ok := gTlsVersionMap[req.TlsMinVersion]
+		if ok == false {
+			return nil, "不支持的tls版本: " + strconv.Quote(req.TlsMinVersion)
+		}
+		config.MinVersion = version
+	}
+	if req.CaCertFile != "" {
+		data, err := os.ReadFile(req.CaCertFile)
+		if err != nil {
+			return nil, "读取CA证书失败: " + err.Error()
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if pool.AppendCertsFromPEM(data) == false {
+			return nil, "CA证书中没有PEM格式的证书: " + req.CaCertFile
+		}
+		config.RootCAs = pool
+	}
+	if req.ClientCertFile != "" {
+		cert, errMsg := loadClientCert(req.ClientCertFile, req.ClientKeyFile, req.ClientCertPass)
+		if errMsg != "" {
+			return nil, errMsg
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, ""
+}
+
+// loadClientCert 读取客户端证书, 支持PEM(证书、私钥可以在同一个文件)和PKCS#12
+func loadClientCert(certFile string, keyFile string, password string) (cert tls.Certificate, errMsg string) {
+	certData, err := os.ReadFile(certFile)
+	if err != nil {
+		return cert, "读取客户端证书失败: " + err.Error()
+	}
+	if bytes.Contains(certData, []byte("-----BEGIN")) == false {
+		return loadPkcs12ClientCert(certData, password)
+	}
+	keyData := certData
+	if keyFile != "" {
+		keyData, err = os.ReadFile(keyFile)
+		if err != nil {
+			return cert, "读取客户端私钥失败: " + err.Error()
+		}
+	}
+	cert, err = tls.X509KeyPair(certData, keyData)
+	if err != nil {
+		return cert, "解析客户端证书失败: " + err.Error()
+	}
+	return cert, ""
+}
+
+// loadPkcs12ClientCert 读取PKCS#12客户端证书.
+//
+//	只支持3DES、RC2加密的文件, openssl 3 默认使用AES加密, 需要加上 -legacy 导出或者转换为PEM
+func loadPkcs12ClientCert(data []byte, password string) (cert tls.Certificate, errMsg string) {
+	blockList, err := pkcs12.ToPEM(data, password)
+	if err != nil {
+		if err == pkcs12.ErrIncorrectPassword {
+			return cert, "解析客户端证书失败: 密码错误"
+		}
+		var notImplemented pkcs12.NotImplementedError
+		if errors.As(err, &notImplemented) {
+			return cert, "解析客户端证书失败: " + err.Error() + ", 请使用 openssl pkcs12 -export -legacy 重新导出或者转换为PEM"
+		}
+		return cert, "解析客户端证书失败: " + err.Error()
+	}
+	var privateKey interface{}
+	var certList []*x509.Certificate
+	for _, block := range blockList {
+		switch block.Type {
+		case "CERTIFICATE":
+			one, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return cert, "解析客户端证书失败: " + err.Error()
+			}
+			certList = append(certList, one)
+		case "PRIVATE KEY":
+			// ToPEM 把RSA私钥转换为PKCS#1, ECDSA私钥转换为SEC 1
+			privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+			if err != nil {
+				privateKey, err = x509.ParseECPrivateKey(block.Bytes)
+			}
+		}
+		if err != nil {
+			return cert, "解析客户端私钥失败: " + err.Error()
+		}
+	}
+	if privateKey == nil || len(certList) == 0 {
+		return cert, "客户端证书中没有私钥或者证书"
+	}
+	// 和私钥匹配的证书放在最前面, 其余的作为证书链
+	var leaf *x509.Certificate
+	for _, one := range certList {
+		if leaf == nil && isPublicKeyMatch(one, privateKey) {
+			leaf = one
+		}
+	}
+	if leaf == nil {
+		return cert, "客户端证书中没有和私钥匹配的证书"
+	}
+	cert.Certificate = append(cert.Certificate, leaf.Raw)
+	for _, one := range certList {
+		if one != leaf {
+			cert.Certificate = append(cert.Certificate, one.Raw)
+		}
+	}
+	cert.PrivateKey = privateKey
+	cert.Leaf = leaf
+	return cert, ""
+}
+
+func isPublicKeyMatch(cert *x509.Certificate, privateKey interface{}) bool {
+	key, ok := privateKey.(crypto.Signer)
+	if ok == false {
+		return false
+	}
+	pub, ok := key.Public().(interface {
+		Equal(x crypto.PublicKey) bool
+	})
+	return ok && pub.Equal(cert.PublicKey)
+}
+
+// tlsServerNameTransport m3u8所在的host使用 TlsServerName 作为SNI, key、ts所在的其他host(例如cdn)不受影响
+type tlsServerNameTransport struct {
+	host                string
+	transport           *http.Transport
+	serverNameTransport *http.Transport
+}
+
+func newTlsServerNameTransport(transport *http.Transport, m3u8Url string, serverName string) http.RoundTripper {
+	urlObj, err := url.Parse(m3u8Url)
+	if err != nil || urlObj.Hostname() == "" {
+		return transport
+	}
+	this := &tlsServerNameTransport{
+		host:                urlObj.Hostname(),
+		transport:           transport,
+		serverNameTransport: transport.Clone(),
+	}
+	if this.serverNameTransport.TLSClientConfig == nil {
+		this.serverNameTransport.TLSClientConfig = &tls.Config{}
+	}
+	this.serverNameTransport.TLSClientConfig.ServerName = serverName
+	return this
+}
+
+func (this *tlsServerNameTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if strings.EqualFold(req.URL.Hostname(), this.host) {
+		return this.serverNameTransport.RoundTrip(req)
+	}
+	return this.transport.RoundTrip(req)
+}
+
+func (this *tlsServerNameTransport) CloseIdleConnections() {
+	this.transport.CloseIdleConnections()
+	this.serverNameTransport.CloseIdleConnections()
+}
@@ -0,0 +1,167 @@
+package m3u8d
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodePkcs12(t *testing.T) {
+	crtData, err := os.ReadFile("testdata/tls/client.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(crtData)
+	// openssl 3 默认的AES加密不支持, 提示重新导出
+	_, errMsg := loadClientCert(filepath.Join("testdata/tls", "client.p12"), "", "m3u8d")
+	if strings.Contains(errMsg, "-legacy") == false {
+		t.Fatal(errMsg)
+	}
+	for _, name := range []string{"client_3des.p12"} {
+		cert, errMsg := loadClientCert(filepath.Join("testdata/tls", name), "", "m3u8d")
+		if errMsg != "" {
+			t.Fatal(name, errMsg)
+		}
+		if len(cert.Certificate) != 1 || string(cert.Certificate[0]) != string(block.Bytes) || cert.PrivateKey == nil {
+			t.Fatal(name)
+		}
+		_, errMsg = loadClientCert(filepath.Join("testdata/tls", name), "", "bad")
+		if strings.Contains(errMsg, "密码错误") == false {
+			t.Fatal(name, errMsg)
+		}
+	}
+}
+
+func writeTestCert(t *testing.T, dir string, name string, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (cert *x509.Certificate, key *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ = x509.ParseCertificate(der)
+	_ = os.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	_ = os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600)
+	return cert, key
+}
+
+func TestNewTlsConfig(t *testing.T) {
+	dir := t.TempDir()
+	notAfter := time.Now().Add(time.Hour)
+	caCert, caKey := writeTestCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "m3u8d-ca"},
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	writeTestCert(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		DNSNames:     []string{"media.internal"},
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, caCert, caKey)
+	writeTestCert(t, dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "m3u8d-client"},
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, caCert, caKey)
+
+	serverCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(caCert)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	req := StartDownload_Req{
+		CaCertFile:     filepath.Join(dir, "ca.crt"),
+		ClientCertFile: filepath.Join(dir, "client.crt"),
+		ClientKeyFile:  filepath.Join(dir, "client.key"),
+		TlsMinVersion:  "1.2",
+		TlsServerName:  "media.internal",
+	}
+	config, errMsg := newTlsConfig(req)
+	if errMsg != "" {
+		t.Fatal(errMsg)
+	}
+	m3u8Url := server.URL + "/index.m3u8"
+	client := &http.Client{Transport: newTlsServerNameTransport(&http.Transport{TLSClientConfig: config}, m3u8Url, req.TlsServerName)}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	// 其他host(例如key、ts所在的cdn)不使用 TlsServerName, 服务器证书里没有这个host
+	if resp, err = client.Get(strings.Replace(server.URL, "127.0.0.1", "localhost", 1)); err == nil {
+		resp.Body.Close()
+		t.Fatal("expect error")
+	} else if strings.Contains(err.Error(), "certificate") == false {
+		t.Fatal(err)
+	}
+
+	// 没有客户端证书时服务器拒绝握手
+	req.ClientCertFile = ""
+	config, _ = newTlsConfig(req)
+	client = &http.Client{Transport: newTlsServerNameTransport(&http.Transport{TLSClientConfig: config}, m3u8Url, req.TlsServerName)}
+	if resp, err = client.Get(server.URL); err == nil {
+		resp.Body.Close()
+		t.Fatal("expect error")
+	}
+
+	if _, errMsg = newTlsConfig(StartDownload_Req{TlsMinVersion: "1.4"}); errMsg == "" {
+		t.Fatal("expect error")
+	}
+}
+
+func TestParseCurlCertArg(t *testing.T) {
+	for _, one := range []struct {
+		value    string
+		file     string
+		password string
+	}{
+		{value: "client.p12", file: "client.p12"},
+		{value: "client.p12:m3u8d", file: "client.p12", password: "m3u8d"},
+		{value: `a\:b.pem:p:q`, file: "a:b.pem", password: "p:q"},
+		{value: `C:\certs\client.p12:m3u8d`, file: `C:\certs\client.p12`, password: "m3u8d"},
+	} {
+		file, password := parseCurlCertArg(one.value)
+		if file != one.file || password != one.password {
+			t.Fatal(one.value, file, password)
+		}
+	}
+}
@@ -0,0 +1,440 @@
+package m3u8d
+
+import (
+	"errors"
+	"github.com/yapingcat/gomedia/go-mpeg2"
+	"io"
+)
+
+// gomedia只解出 aac 和 mpeg音频(0x03/0x04), 下面这些私有流在 tsDemuxer 里处理
+const (
+	tsStreamPrivateData mpeg2.TS_STREAM_TYPE = 0x06 // PES私有数据, 根据内容判断是不是AC-3/E-AC-3
+	tsStreamAc3         mpeg2.TS_STREAM_TYPE = 0x81
+	tsStreamEac3        mpeg2.TS_STREAM_TYPE = 0x87
+)
+
+// tsDemuxer 在 mpeg2.TSDemuxer 的基础上解出AC-3/E-AC-3音频, OnFrame的参数和gomedia相同, 时间戳为毫秒.
+//
+//	gomedia会解码私有流的PES, 但是不回调OnFrame, 这里从OnTSPacket收集PES的内容.
+//	ts里已经有aac/mpeg音频时不处理AC-3, 多个AC-3音轨时只使用第一个
+type tsDemuxer struct {
+	demuxer *mpeg2.TSDemuxer
+	OnFrame func(cid mpeg2.TS_STREAM_TYPE, frame []byte, pts uint64, dts uint64)
+
+	privatePidMap map[uint16]bool // PMT里的私有流
+	hasAudio      bool            // PMT里有gomedia能处理的音频
+	audioPid      uint16
+	audioCid      mpeg2.TS_STREAM_TYPE // 还没有找到AC-3时为0
+	pes           []byte
+	pesPts        uint64 // 90kHz
+}
+
+func newTsDemuxer() *tsDemuxer {
+	this := &tsDemuxer{
+		demuxer:       mpeg2.NewTSDemuxer(),
+		privatePidMap: map[uint16]bool{},
+	}
+	this.demuxer.OnFrame = func(cid mpeg2.TS_STREAM_TYPE, frame []byte, pts uint64, dts uint64) {
+		if this.OnFrame != nil {
+			this.OnFrame(cid, frame, pts, dts)
+		}
+	}
+	this.demuxer.OnTSPacket = this.onTsPacket
+	return this
+}
+
+// Input 和gomedia一样, 每次Input结束时输出缓存的帧
+func (this *tsDemuxer) Input(r io.Reader) error {
+	err := this.demuxer.Input(r)
+	this.flush()
+	return err
+}
+
+func (this *tsDemuxer) onTsPacket(pkg *mpeg2.TSPacket) {
+	switch payload := pkg.Payload.(type) {
+	case *mpeg2.Pmt:
+		for _, one := range payload.Streams {
+			switch mpeg2.TS_STREAM_TYPE(one.StreamType) {
+			case mpeg2.TS_STREAM_AAC, mpeg2.TS_STREAM_AUDIO_MPEG1, mpeg2.TS_STREAM_AUDIO_MPEG2:
+				this.hasAudio = true
+			case tsStreamAc3, tsStreamEac3, tsStreamPrivateData:
+				this.privatePidMap[one.Elementary_PID] = true
+			}
+		}
+	case *mpeg2.PesPacket:
+		if this.hasAudio || this.privatePidMap[pkg.PID] == false {
+			return
+		}
+		if this.audioCid == 0 {
+			// 0x06 还可能是字幕等数据, 所以0x81/0x87也根据帧头判断编码
+			header, ok := parseAc3Header(payload.Pes_payload)
+			if ok == false {
+				return
+			}
+			this.audioPid = pkg.PID
+			this.audioCid = header.cid
+		}
+		if pkg.PID != this.audioPid {
+			return
+		}
+		this.flush()
+		this.pes = append(this.pes[:0], payload.Pes_payload...)
+		this.pesPts = payload.Pts
+	case []byte:
+		if this.audioCid != 0 && pkg.PID == this.audioPid && len(this.pes) > 0 {
+			this.pes = append(this.pes, payload...)
+		}
+	}
+}
+
+func (this *tsDemuxer) flush() {
+	if len(this.pes) == 0 {
+		return
+	}
+	if this.OnFrame != nil {
+		frame := make([]byte, len(this.pes))
+		copy(frame, this.pes)
+		this.OnFrame(this.audioCid, frame, this.pesPts/90, this.pesPts/90)
+	}
+	this.pes = this.pes[:0]
+}
+
+// tsAudioHeader mpeg音频/AC-3/E-AC-3帧头里的信息
+type tsAudioHeader struct {
+	cid         mpeg2.TS_STREAM_TYPE // mpeg2.TS_STREAM_AUDIO_MPEG1, tsStreamAc3, tsStreamEac3
+	frameSize   int                  // 包括帧头
+	sampleCount int                  // 每帧的采样数
+	sampleRate  int
+	channels    int
+
+	// AC-3/E-AC-3
+	fscod       int
+	bsid        int
+	bsmod       int
+	acmod       int
+	lfeon       int
+	bitRateCode int
+	strmtyp     int // E-AC-3: 0 独立流, 1 依赖流
+	substreamId int
+
+	// mpeg音频
+	mpegVersion int // 1: MPEG-1, 2: MPEG-2, 3: MPEG-2.5
+	mpegLayer   int
+}
+
+// isIndependent E-AC-3的依赖流、其它子流和前面的帧属于同一个时间段
+func (this tsAudioHeader) isIndependent() bool {
+	return this.cid != tsStreamEac3 || (this.strmtyp != 1 && this.substreamId == 0)
+}
+
+var ac3ChannelCountList = [8]int{2, 1, 2, 3, 3, 4, 4, 5}
+var ac3SampleRateList = [3]int{48000, 44100, 32000}
+var ac3BitRateList = [19]int{32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 448, 512, 576, 640}
+var eac3BlockCountList = [4]int{1, 2, 3, 6}
+
+// parseAc3Header 解析AC-3/E-AC-3的帧头, bsid大于10的是E-AC-3
+func parseAc3Header(data []byte) (header tsAudioHeader, ok bool) {
+	if len(data) < 8 || data[0] != 0x0B || data[1] != 0x77 {
+		return header, false
+	}
+	header.bsid = int(data[5] >> 3)
+	if header.bsid <= 10 {
+		header.cid = tsStreamAc3
+		header.fscod = int(data[4] >> 6)
+		frmsizecod := int(data[4] & 0x3F)
+		if header.fscod == 3 || frmsizecod/2 >= len(ac3BitRateList) {
+			return header, false
+		}
+		header.bitRateCode = frmsizecod / 2
+		bitRate := ac3BitRateList[header.bitRateCode]
+		var words int
+		switch header.fscod {
+		case 0:
+			words = bitRate * 2
+		case 1:
+			words = bitRate*320/147 + frmsizecod%2
+		case 2:
+			words = bitRate * 3
+		}
+		header.frameSize = words * 2
+		header.sampleCount = 1536
+		header.sampleRate = ac3SampleRateList[header.fscod]
+		if header.bsid > 8 {
+			header.sampleRate >>= uint(header.bsid - 8)
+		}
+		header.bsmod = int(data[5] & 0x07)
+		bs := newTsBitReader(data[6:])
+		header.acmod = bs.read(3)
+		if header.acmod&0x01 != 0 && header.acmod != 1 {
+			bs.read(2) // cmixlev
+		}
+		if header.acmod&0x04 != 0 {
+			bs.read(2) // surmixlev
+		}
+		if header.acmod == 2 {
+			bs.read(2) // dsurmod
+		}
+		header.lfeon = bs.read(1)
+	} else if header.bsid <= 16 {
+		header.cid = tsStreamEac3
+		header.strmtyp = int(data[2] >> 6)
+		header.substreamId = int(data[2]>>3) & 0x07
+		header.frameSize = (int(data[2]&0x07)<<8 | int(data[3]) + 1) * 2
+		bs := newTsBitReader(data[4:])
+		header.fscod = bs.read(2)
+		blockCount := 6
+		if header.fscod == 3 {
+			header.sampleRate = ac3SampleRateList[bs.read(2)] / 2
+		} else {
+			header.sampleRate = ac3SampleRateList[header.fscod]
+			blockCount = eac3BlockCountList[bs.read(2)]
+		}
+		header.sampleCount = 256 * blockCount
+		header.acmod = bs.read(3)
+		header.lfeon = bs.read(1)
+	} else {
+		return header, false
+	}
+	header.channels = ac3ChannelCountList[header.acmod] + header.lfeon
+	return header, header.sampleRate > 0 && header.frameSize > 0
+}
+
+var mpegAudioBitRateList = [5][15]int{
+	{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448}, // MPEG-1 Layer I
+	{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},    // MPEG-1 Layer II
+	{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},     // MPEG-1 Layer III
+	{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},    // MPEG-2/2.5 Layer I
+	{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},         // MPEG-2/2.5 Layer II/III
+}
+var mpegAudioSampleRateList = [3]int{44100, 48000, 32000}
+
+// parseMpegAudioHeader 解析mpeg音频(mp1/mp2/mp3)的帧头, 不支持free格式的码率
+func parseMpegAudioHeader(data []byte) (header tsAudioHeader, ok bool) {
+	if len(data) < 4 || data[0] != 0xFF || data[1]&0xE0 != 0xE0 {
+		return header, false
+	}
+	switch (data[1] >> 3) & 0x03 {
+	case 0:
+		header.mpegVersion = 3
+	case 2:
+		header.mpegVersion = 2
+	case 3:
+		header.mpegVersion = 1
+	default:
+		return header, false
+	}
+	header.mpegLayer = 4 - int((data[1]>>1)&0x03)
+	bitRateIdx := int(data[2] >> 4)
+	sampleRateIdx := int((data[2] >> 2) & 0x03)
+	if header.mpegLayer == 4 || bitRateIdx == 0 || bitRateIdx == 15 || sampleRateIdx == 3 {
+		return header, false
+	}
+	header.cid = mpeg2.TS_STREAM_AUDIO_MPEG1
+	header.sampleRate = mpegAudioSampleRateList[sampleRateIdx] >> uint(header.mpegVersion-1)
+	var bitRate int
+	if header.mpegVersion == 1 {
+		bitRate = mpegAudioBitRateList[header.mpegLayer-1][bitRateIdx]
+	} else if header.mpegLayer == 1 {
+		bitRate = mpegAudioBitRateList[3][bitRateIdx]
+	} else {
+		bitRate = mpegAudioBitRateList[4][bitRateIdx]
+	}
+	padding := int((data[2] >> 1) & 0x01)
+	switch {
+	case header.mpegLayer == 1:
+		header.sampleCount = 384
+		header.frameSize = (12*bitRate*1000/header.sampleRate + padding) * 4
+	case header.mpegLayer == 3 && header.mpegVersion != 1:
+		header.sampleCount = 576
+		header.frameSize = 72*bitRate*1000/header.sampleRate + padding
+	default:
+		header.sampleCount = 1152
+		header.frameSize = 144*bitRate*1000/header.sampleRate + padding
+	}
+	header.channels = 2
+	if data[3]>>6 == 3 {
+		header.channels = 1
+	}
+	return header, true
+}
+
+func parseTsAudioHeader(cid mpeg2.TS_STREAM_TYPE, data []byte) (tsAudioHeader, bool) {
+	if cid == mpeg2.TS_STREAM_AUDIO_MPEG1 || cid == mpeg2.TS_STREAM_AUDIO_MPEG2 {
+		return parseMpegAudioHeader(data)
+	}
+	return parseAc3Header(data)
+}
+
+// getTsCodecName 编码的名称, 用于显示
+func getTsCodecName(cid mpeg2.TS_STREAM_TYPE, frame []byte) string {
+	switch cid {
+	case mpeg2.TS_STREAM_H264:
+		return "h264"
+	case mpeg2.TS_STREAM_H265:
+		return "h265"
+	case mpeg2.TS_STREAM_AAC:
+		return "aac"
+	case tsStreamAc3:
+		return "ac3"
+	case tsStreamEac3:
+		return "eac3"
+	case mpeg2.TS_STREAM_AUDIO_MPEG1, mpeg2.TS_STREAM_AUDIO_MPEG2:
+		header, ok := parseMpegAudioHeader(frame)
+		if ok == false {
+			return "mp3"
+		}
+		return "mp" + string(rune('0'+header.mpegLayer))
+	}
+	return ""
+}
+
+// tsAudioSplitter 把mpeg音频/AC-3/E-AC-3的PES分成样本, 计算每个样本的时间戳(毫秒).
+//
+//	跨PES的帧和下一个PES拼在一起; E-AC-3的依赖流以及不足1536个采样的帧合并到一个样本里
+type tsAudioSplitter struct {
+	remain       []byte
+	basePts      uint64
+	baseSamples  int64 // basePts之后的采样数
+	sampleRate   int
+	group        []byte
+	groupHeader  tsAudioHeader
+	groupSamples int
+	groupPts     uint64
+}
+
+func (this *tsAudioSplitter) input(cid mpeg2.TS_STREAM_TYPE, data []byte, pts uint64, fn func(header tsAudioHeader, sample []byte, pts uint64) error) error {
+	if len(this.remain) > 0 {
+		data = append(this.remain, data...)
+		this.remain = nil
+	} else {
+		this.basePts = pts
+		this.baseSamples = 0
+	}
+	for len(data) > 0 {
+		header, ok := parseTsAudioHeader(cid, data)
+		if ok == false {
+			// 找下一个帧头
+			idx := 1
+			for idx < len(data) && data[idx] != 0xFF && data[idx] != 0x0B {
+				idx++
+			}
+			data = data[idx:]
+			continue
+		}
+		if header.frameSize > len(data) {
+			this.remain = append([]byte(nil), data...)
+			return nil
+		}
+		frame := data[:header.frameSize]
+		data = data[header.frameSize:]
+
+		if header.isIndependent() {
+			if len(this.group) > 0 && (header.cid != tsStreamEac3 || this.groupSamples >= 1536) {
+				err := this.flush(fn)
+				if err != nil {
+					return err
+				}
+			}
+			if this.sampleRate != header.sampleRate {
+				if this.sampleRate > 0 {
+					this.basePts = this.getPts()
+					this.baseSamples = 0
+				}
+				this.sampleRate = header.sampleRate
+			}
+			if len(this.group) == 0 {
+				this.groupHeader = header
+				this.groupPts = this.getPts()
+			}
+			this.groupSamples += header.sampleCount
+			this.baseSamples += int64(header.sampleCount)
+		} else if len(this.group) == 0 {
+			// 没有独立流的依赖流, 无法解码
+			continue
+		}
+		this.group = append(this.group, frame...)
+	}
+	return nil
+}
+
+func (this *tsAudioSplitter) getPts() uint64 {
+	return this.basePts + uint64(this.baseSamples*1000/int64(this.sampleRate))
+}
+
+// flush 输出缓存的样本, 结束时调用
+func (this *tsAudioSplitter) flush(fn func(header tsAudioHeader, sample []byte, pts uint64) error) error {
+	if len(this.group) == 0 {
+		return nil
+	}
+	sample := this.group
+	this.group = nil
+	this.groupSamples = 0
+	return fn(this.groupHeader, sample, this.groupPts)
+}
+
+// tsAudioSplitterState 保存在合并进度(mergeCheckpoint)里的 tsAudioSplitter, 包括还没有输出的帧
+type tsAudioSplitterState struct {
+	Remain       []byte
+	BasePts      uint64
+	BaseSamples  int64
+	SampleRate   int
+	Group        []byte
+	GroupCid     int
+	GroupSamples int
+	GroupPts     uint64
+}
+
+func (this *tsAudioSplitter) saveState() tsAudioSplitterState {
+	return tsAudioSplitterState{
+		Remain:       append([]byte(nil), this.remain...),
+		BasePts:      this.basePts,
+		BaseSamples:  this.baseSamples,
+		SampleRate:   this.sampleRate,
+		Group:        append([]byte(nil), this.group...),
+		GroupCid:     int(this.groupHeader.cid),
+		GroupSamples: this.groupSamples,
+		GroupPts:     this.groupPts,
+	}
+}
+
+func (this *tsAudioSplitter) loadState(state tsAudioSplitterState) error {
+	*this = tsAudioSplitter{
+		remain:       state.Remain,
+		basePts:      state.BasePts,
+		baseSamples:  state.BaseSamples,
+		sampleRate:   state.SampleRate,
+		group:        state.Group,
+		groupSamples: state.GroupSamples,
+		groupPts:     state.GroupPts,
+	}
+	if len(this.group) > 0 {
+		// groupHeader 是group里第一帧的帧头
+		var ok bool
+		this.groupHeader, ok = parseTsAudioHeader(mpeg2.TS_STREAM_TYPE(state.GroupCid), this.group)
+		if ok == false {
+			return errors.New("合并进度里缓存的音频帧无效")
+		}
+	}
+	return nil
+}
+
+// tsBitReader 按位读取帧头, 数据不够时返回0
+type tsBitReader struct {
+	data   []byte
+	bitPos int
+}
+
+func newTsBitReader(data []byte) *tsBitReader {
+	return &tsBitReader{data: data}
+}
+
+func (this *tsBitReader) read(n int) (v int) {
+	for idx := 0; idx < n; idx++ {
+		v <<= 1
+		if this.bitPos/8 < len(this.data) && this.data[this.bitPos/8]&(0x80>>uint(this.bitPos%8)) != 0 {
+			v |= 1
+		}
+		this.bitPos++
+	}
+	return v
+}
@@ -0,0 +1,323 @@
+package m3u8d
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"github.com/yapingcat/gomedia/go-mpeg2"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// makeAudioTsForTest 每个PES里放3帧
+func makeAudioTsForTest(t *testing.T, cid mpeg2.TS_STREAM_TYPE, frame []byte, frameCount int, frameMs uint64) []byte {
+	var buf bytes.Buffer
+	muxer := mpeg2.NewTSMuxer()
+	muxer.OnPacket = func(pkg []byte) {
+		buf.Write(pkg)
+	}
+	pid := muxer.AddStream(cid)
+	for idx := 0; idx < frameCount; idx += 3 {
+		var pes []byte
+		for one := idx; one < idx+3 && one < frameCount; one++ {
+			pes = append(pes, frame...)
+		}
+		pts := 1000 + uint64(idx)*frameMs
+		if err := muxer.Write(pid, pes, pts, pts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func makeAudioFrameForTest(header []byte, size int) []byte {
+	frame := make([]byte, size)
+	copy(frame, header)
+	return frame
+}
+
+// mp4AudioTrackForTest 文件里必须只有一个音频轨道, 返回它的track id、样本描述类型和样本数
+func mp4AudioTrackForTest(t *testing.T, name string) (trackId uint32, entryType string, sampleCount int) {
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var audioIdList []uint32
+	for _, moov := range fmp4TopBoxListForTest(t, name) {
+		if moov.boxType != "moov" {
+			continue
+		}
+		trackTypeMap, err := fmp4ReadTrackType(f, moov)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for id, trackType := range trackTypeMap {
+			if trackType == fmp4TrackAudio {
+				audioIdList = append(audioIdList, id)
+			}
+		}
+	}
+	if len(audioIdList) != 1 {
+		t.Fatal("audio track count", audioIdList)
+	}
+	entryType, sampleCount = mp4SampleEntryForTest(t, name, audioIdList[0])
+	return audioIdList[0], entryType, sampleCount
+}
+
+// mp4SampleEntryForTest 返回trackId的样本描述类型和样本数
+func mp4SampleEntryForTest(t *testing.T, name string, trackId uint32) (entryType string, sampleCount int) {
+	content, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bytes.NewReader(content)
+	for _, moov := range fmp4TopBoxListForTest(t, name) {
+		if moov.boxType != "moov" {
+			continue
+		}
+		for _, trak := range fmp4ReadChildren(r, moov) {
+			if trak.boxType != "trak" {
+				continue
+			}
+			var isFound bool
+			for _, child := range fmp4ReadChildren(r, trak) {
+				if child.boxType == "tkhd" {
+					body, _ := fmp4ReadBody(r, child)
+					isFound = fmp4ParseTkhdTrackId(body) == trackId
+				}
+			}
+			if isFound == false {
+				continue
+			}
+			box := trak
+			for _, boxType := range []string{"mdia", "minf", "stbl"} {
+				for _, child := range fmp4ReadChildren(r, box) {
+					if child.boxType == boxType {
+						box = child
+					}
+				}
+			}
+			for _, child := range fmp4ReadChildren(r, box) {
+				body, _ := fmp4ReadBody(r, child)
+				switch child.boxType {
+				case "stsd":
+					entryType = string(body[12:16])
+				case "stsz":
+					sampleCount = int(binary.BigEndian.Uint32(body[8:12]))
+				}
+			}
+			return entryType, sampleCount
+		}
+	}
+	t.Fatal("track not found", trackId)
+	return "", 0
+}
+
+// mp4SampleDurationForTest 返回trackId的mdhd里的timescale和stts展开后每个样本的时长
+func mp4SampleDurationForTest(t *testing.T, name string, trackId uint32) (timescale uint32, durationList []uint32) {
+	content, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bytes.NewReader(content)
+	findChild := func(parent fmp4Box, boxType string) (box fmp4Box) {
+		for _, child := range fmp4ReadChildren(r, parent) {
+			if child.boxType == boxType {
+				return child
+			}
+		}
+		t.Fatal(boxType + " not found")
+		return box
+	}
+	for _, moov := range fmp4TopBoxListForTest(t, name) {
+		if moov.boxType != "moov" {
+			continue
+		}
+		for _, trak := range fmp4ReadChildren(r, moov) {
+			if trak.boxType != "trak" {
+				continue
+			}
+			body, _ := fmp4ReadBody(r, findChild(trak, "tkhd"))
+			if fmp4ParseTkhdTrackId(body) != trackId {
+				continue
+			}
+			mdia := findChild(trak, "mdia")
+			body, _ = fmp4ReadBody(r, findChild(mdia, "mdhd"))
+			if body[0] == 1 {
+				timescale = binary.BigEndian.Uint32(body[20:24])
+			} else {
+				timescale = binary.BigEndian.Uint32(body[12:16])
+			}
+			body, _ = fmp4ReadBody(r, findChild(findChild(findChild(mdia, "minf"), "stbl"), "stts"))
+			count := int(binary.BigEndian.Uint32(body[4:8]))
+			for idx := 0; idx < count; idx++ {
+				sampleCount := int(binary.BigEndian.Uint32(body[8+idx*8:]))
+				delta := binary.BigEndian.Uint32(body[12+idx*8:])
+				for one := 0; one < sampleCount; one++ {
+					durationList = append(durationList, delta)
+				}
+			}
+			return timescale, durationList
+		}
+	}
+	t.Fatal("track not found", trackId)
+	return 0, nil
+}
+
+func TestMergeOtherAudio(t *testing.T) {
+	// AC-3: 48kHz, 128kbps, bsid 8, 2/0
+	ac3 := makeAudioFrameForTest([]byte{0x0B, 0x77, 0, 0, 0x08, 0x40, 0x40}, 512)
+	// E-AC-3: 48kHz, 6 blocks, 3/2+LFE, bsid 16; 后面跟一个依赖流
+	eac3 := makeAudioFrameForTest([]byte{0x0B, 0x77, 0x01, 0x7F, 0x3F, 0x80}, 768)
+	eac3 = append(eac3, makeAudioFrameForTest([]byte{0x0B, 0x77, 0x40, 0x7F, 0x3F, 0x80}, 256)...)
+	// MPEG-1 Layer III, 48kHz, 128kbps
+	mp3 := makeAudioFrameForTest([]byte{0xFF, 0xFB, 0x94, 0x44}, 384)
+	// MPEG-1 Layer II, 48kHz, 192kbps
+	mp2 := makeAudioFrameForTest([]byte{0xFF, 0xFD, 0xA4, 0x04}, 576)
+
+	dir := t.TempDir()
+	for _, one := range []struct {
+		name      string
+		cid       mpeg2.TS_STREAM_TYPE
+		frame     []byte
+		frameMs   uint64
+		codec     string
+		entryType string
+		mkvCodec  string
+	}{
+		{name: "ac3", cid: tsStreamAc3, frame: ac3, frameMs: 32, codec: "ac3", entryType: "ac-3", mkvCodec: "A_AC3"},
+		{name: "eac3", cid: tsStreamPrivateData, frame: eac3, frameMs: 32, codec: "eac3", entryType: "ec-3", mkvCodec: "A_EAC3"},
+		{name: "mp3", cid: mpeg2.TS_STREAM_AUDIO_MPEG1, frame: mp3, frameMs: 24, codec: "mp3", entryType: "mp4a", mkvCodec: "A_MPEG/L3"},
+		{name: "mp2", cid: mpeg2.TS_STREAM_AUDIO_MPEG2, frame: mp2, frameMs: 24, codec: "mp2", entryType: "mp4a", mkvCodec: "A_MPEG/L2"},
+	} {
+		const frameCount = 50 // 超过1秒, 第二个ts的时间戳回退时按照不连续处理
+		tsName := filepath.Join(dir, one.name+".ts")
+		err := os.WriteFile(tsName, makeAudioTsForTest(t, one.cid, one.frame, frameCount, one.frameMs), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info := GetTsVideoInfo(tsName)
+		if info.AudioCodec != one.codec || info.VideoCodec != "" {
+			t.Fatal(one.name, info)
+		}
+		for _, format := range []string{OutputFormat_Mp4, OutputFormat_Fmp4, OutputFormat_Mkv} {
+			outputName := filepath.Join(dir, one.name+"-"+format+"."+GetOutputFormatExt(format))
+			err = MergeTsFileListToSingleMp4(MergeTsFileListToSingleMp4_Req{
+				TsFileList:   []string{tsName, tsName},
+				OutputMp4:    outputName,
+				OutputFormat: format,
+				Ctx:          context.Background(),
+			})
+			if err != nil {
+				t.Fatal(one.name, format, err)
+			}
+			if format == OutputFormat_Mkv {
+				content, err := os.ReadFile(outputName)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if bytes.Contains(content, []byte(one.mkvCodec)) == false {
+					t.Fatal(one.name, "mkv codec id not found")
+				}
+				continue
+			}
+			trackId, entryType, sampleCount := mp4AudioTrackForTest(t, outputName)
+			if entryType != one.entryType {
+				t.Fatal(one.name, format, entryType)
+			}
+			if format != OutputFormat_Mp4 {
+				continue
+			}
+			if sampleCount != frameCount*2 {
+				t.Fatal(one.name, sampleCount)
+			}
+			// 样本时长按照timescale换算后等于每帧的时长. 两个ts之间的间隔由 tsTimestampRebaser 按照PES估计, 不检查
+			timescale, durationList := mp4SampleDurationForTest(t, outputName, trackId)
+			if timescale == 0 || len(durationList) != sampleCount {
+				t.Fatal(one.name, timescale, len(durationList))
+			}
+			for idx, duration := range durationList[:len(durationList)-1] {
+				if idx != frameCount-1 && uint64(duration)*1000 != one.frameMs*uint64(timescale) {
+					t.Fatal(one.name, idx, duration, timescale)
+				}
+			}
+		}
+	}
+}
+
+func TestParseTsAudioHeader(t *testing.T) {
+	// AC-3 44.1kHz的帧大小和frmsizecod的最低位有关
+	for _, one := range []struct {
+		frmsizecod byte
+		size       int
+	}{
+		{frmsizecod: 0, size: 138},
+		{frmsizecod: 1, size: 140},
+		{frmsizecod: 37, size: 2788},
+	} {
+		header, ok := parseAc3Header([]byte{0x0B, 0x77, 0, 0, 0x40 | one.frmsizecod, 0x40, 0xF1, 0})
+		if ok == false || header.frameSize != one.size || header.sampleRate != 44100 || header.channels != 6 {
+			t.Fatal(one, header)
+		}
+	}
+	// MPEG-2 Layer III, 24kHz, 单声道
+	header, ok := parseMpegAudioHeader([]byte{0xFF, 0xF3, 0x84, 0xC4})
+	if ok == false || header.sampleCount != 576 || header.sampleRate != 24000 || header.channels != 1 || header.frameSize != 192 {
+		t.Fatal(header)
+	}
+	if getTsCodecName(mpeg2.TS_STREAM_AUDIO_MPEG1, []byte{0xFF, 0xF3, 0x84, 0xC4}) != "mp3" {
+		t.Fatal()
+	}
+}
+
+func TestTsAudioSplitterState(t *testing.T) {
+	// 第二个PES的开头是上一个PES里没有完整的帧, 时间戳接着前面的帧计算
+	mp3 := makeAudioFrameForTest([]byte{0xFF, 0xFB, 0x94, 0x44}, 384)
+	var data []byte
+	for idx := 0; idx < 5; idx++ {
+		data = append(data, mp3...)
+	}
+	type sampleUnit struct {
+		size int
+		pts  uint64
+	}
+	split := func(isReload bool) (list []sampleUnit) {
+		fn := func(header tsAudioHeader, sample []byte, pts uint64) error {
+			list = append(list, sampleUnit{size: len(sample), pts: pts})
+			return nil
+		}
+		var splitter tsAudioSplitter
+		err := splitter.input(mpeg2.TS_STREAM_AUDIO_MPEG1, data[:1000], 1000, fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isReload {
+			state := splitter.saveState()
+			splitter = tsAudioSplitter{}
+			err = splitter.loadState(state)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = splitter.input(mpeg2.TS_STREAM_AUDIO_MPEG1, data[1000:], 9999, fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = splitter.flush(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return list
+	}
+	expect, list := split(false), split(true)
+	if len(expect) != 5 || len(list) != len(expect) {
+		t.Fatal(expect, list)
+	}
+	for idx := range expect {
+		if list[idx] != expect[idx] || expect[idx].pts != 1000+uint64(idx)*24 {
+			t.Fatal(idx, expect, list)
+		}
+	}
+}
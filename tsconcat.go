@@ -0,0 +1,49 @@
+package m3u8d
+
+import (
+	"bytes"
+	"github.com/orestonce/m3u8d/mformat"
+	"path/filepath"
+)
+
+// concatTsFileList 不解封装, 直接把ts文件拼接成一个ts文件, 保留原始的时间戳.
+//
+//	每个文件去掉0x47之前的内容和末尾不完整的包; fixContinuity为true时使用 mformat.TsConcatFixer 修正文件边界
+func concatTsFileList(req MergeTsFileListToSingleMp4_Req, output *mergeOutput) error {
+	var fixer *mformat.TsConcatFixer
+	var fixerPart int
+	return req.forEachTsFile(func(tsFile string, data []byte) error {
+		err := output.beforeTsFile(tsFile, data)
+		if err != nil {
+			return err
+		}
+		if req.TsFixContinuity && fixerPart != len(output.outputList) {
+			// 分割后的每个文件重新开始
+			fixer = mformat.NewTsConcatFixer()
+			fixerPart = len(output.outputList)
+		}
+		if idx := bytes.IndexByte(data, mformat.TsSyncByte); idx > 0 {
+			data = data[idx:]
+		}
+		data = data[:len(data)/mformat.TsPacketSize*mformat.TsPacketSize]
+		if fixer != nil {
+			data = fixer.Fix(data)
+		}
+		return output.writeTs(data)
+	})
+}
+
+// ExcludeOutputFile 输出ts文件和输入的ts在同一个目录时, 从输入里去掉输出文件, 避免把上次合并的结果再合并一次
+func ExcludeOutputFile(tsFileList []string, outputName string) (list []string) {
+	outputAbs, err := filepath.Abs(outputName)
+	if err != nil {
+		return tsFileList
+	}
+	for _, one := range tsFileList {
+		if abs, err := filepath.Abs(one); err == nil && abs == outputAbs {
+			continue
+		}
+		list = append(list, one)
+	}
+	return list
+}
@@ -0,0 +1,74 @@
+package m3u8d
+
+import (
+	"context"
+	"github.com/orestonce/m3u8d/mformat"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMergeToTs(t *testing.T) {
+	tsFileList, err := filepath.Glob("testdata/TestFull/*.ts")
+	if err != nil || len(tsFileList) == 0 {
+		t.Fatal(tsFileList, err)
+	}
+	var totalSize int
+	for _, one := range tsFileList {
+		content, err := os.ReadFile(one)
+		if err != nil {
+			t.Fatal(err)
+		}
+		totalSize += len(content) / mformat.TsPacketSize * mformat.TsPacketSize
+	}
+	dir := t.TempDir()
+	for _, fixContinuity := range []bool{false, true} {
+		outputName := filepath.Join(dir, "all.ts")
+		err = MergeTsFileListToSingleMp4(MergeTsFileListToSingleMp4_Req{
+			TsFileList:      tsFileList,
+			OutputMp4:       outputName,
+			OutputFormat:    OutputFormat_Ts,
+			TsFixContinuity: fixContinuity,
+			Ctx:             context.Background(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := os.ReadFile(outputName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 测试数据的每个ts在音视频包之前都有PAT, 不需要插入
+		if len(content) != totalSize {
+			t.Fatal(fixContinuity, len(content), totalSize)
+		}
+		err = mformat.TsValidate(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fixContinuity == false {
+			continue
+		}
+		var ccMap = map[int]byte{}
+		for offset := 0; offset < len(content); offset += mformat.TsPacketSize {
+			pkt := content[offset : offset+mformat.TsPacketSize]
+			pid := int(pkt[1]&0x1F)<<8 | int(pkt[2])
+			if pid == 0x1FFF || pkt[3]&0x10 == 0 {
+				continue
+			}
+			cc, ok := ccMap[pid]
+			if ok && pkt[3]&0x0F != (cc+1)&0x0F {
+				t.Fatal(offset, pid)
+			}
+			ccMap[pid] = pkt[3] & 0x0F
+		}
+	}
+
+	list := ExcludeOutputFile(append(tsFileList, filepath.Join(dir, "all.ts")), filepath.Join(dir, ".", "all.ts"))
+	if len(list) != len(tsFileList) {
+		t.Fatal(list)
+	}
+	if GetOutputFormatByName("a.TS") != OutputFormat_Ts || GetOutputFormatExt(OutputFormat_Ts) != "ts" {
+		t.Fatal("ts format")
+	}
+}
@@ -8,16 +8,28 @@ import (
 )
 
 type TsVideoInfo struct {
-	Width  uint32
-	Height uint32
-	Fps    int
+	Width      uint32
+	Height     uint32
+	Fps        int
+	VideoCodec string // h264, h265
+	AudioCodec string // aac, mp1, mp2, mp3, ac3, eac3
 }
 
 // GetTsVideoInfo
 // 参考: https://github.com/yapingcat/gomedia/issues/154
 func GetTsVideoInfo(tsPath string) (info TsVideoInfo) {
-	demuxer := mpeg2.NewTSDemuxer()
+	demuxer := newTsDemuxer()
 	demuxer.OnFrame = func(cid mpeg2.TS_STREAM_TYPE, frame []byte, pts uint64, dts uint64) {
+		switch cid {
+		case mpeg2.TS_STREAM_H264, mpeg2.TS_STREAM_H265:
+			if info.VideoCodec == "" {
+				info.VideoCodec = getTsCodecName(cid, frame)
+			}
+		default:
+			if info.AudioCodec == "" {
+				info.AudioCodec = getTsCodecName(cid, frame)
+			}
+		}
 		if cid == mpeg2.TS_STREAM_H264 {
 			codec.SplitFrameWithStartCode(frame, func(nalu []byte) bool {
 				naluType := codec.H264NaluType(nalu)